@@ -0,0 +1,256 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// the C1G2 memory banks
+const (
+	memoryBankEPC  = 1
+	memoryBankUser = 3
+)
+
+// the C1G2ReadOpSpecResult results
+const (
+	readSuccess       = 0
+	readTagError      = 1
+	readMemoryOverrun = 4
+)
+
+const (
+	// protocolEPCGlobal is the ProtocolID of the C1G2 AccessSpecs
+	protocolEPCGlobal = 1
+	// stopOperationCount is the AccessSpecStopTrigger on an operation count
+	stopOperationCount = 1
+)
+
+// accessSpecs holds the AccessSpecs added by the LLRP client of the server
+// mode
+var accessSpecs = &accessSpecStore{}
+
+// accessSpec is an AccessSpec and the number of tags it was run on
+type accessSpec struct {
+	*codec.Parameter
+	enabled    bool
+	operations uint64
+}
+
+// accessSpecStore is the AccessSpecs of the reader, in the order they
+// were added
+type accessSpecStore struct {
+	sync.Mutex
+	specs []*accessSpec
+}
+
+// Handle applies an ADD, DELETE, ENABLE or DISABLE_ACCESSSPEC or a
+// GET_ACCESSSPECS and returns its response
+func (s *accessSpecStore) Handle(m *codec.Message) *codec.Message {
+	s.Lock()
+	defer s.Unlock()
+	res := codec.NewMessage(m.Type+codec.AddAccessSpecResponse-codec.AddAccessSpec, m.ID)
+	var err error
+	v, _ := m.Field("AccessSpecID")
+	id, _ := v.(uint64)
+	switch m.Type {
+	case codec.AddAccessSpec:
+		err = s.add(m.First(codec.AccessSpec))
+	case codec.DeleteAccessSpec:
+		err = s.each(id, func(i int) { s.specs = append(s.specs[:i], s.specs[i+1:]...) })
+	case codec.EnableAccessSpec:
+		err = s.each(id, func(i int) { s.specs[i].enabled = true })
+	case codec.DisableAccessSpec:
+		err = s.each(id, func(i int) { s.specs[i].enabled = false })
+	case codec.GetAccessSpecs:
+		for _, spec := range s.specs {
+			p := *spec.Parameter
+			p.Fields = append([]codec.Field{}, p.Fields...)
+			res.Add(p.SetField("CurrentState", spec.enabled))
+		}
+	}
+	status := codec.NewParameter(codec.LLRPStatus).SetField("StatusCode", codec.StatusSuccess)
+	if err != nil {
+		status.SetField("StatusCode", codec.StatusMessageFieldError).SetField("ErrorDescription", err.Error())
+	}
+	res.Parameters = append([]*codec.Parameter{status}, res.Parameters...)
+	return res
+}
+
+// errorMessage is the ERROR_MESSAGE answering the message of the id when
+// the reader fails to respond
+func errorMessage(id uint32, err error) []byte {
+	status := codec.NewParameter(codec.LLRPStatus).
+		SetField("StatusCode", codec.StatusDeviceError).
+		SetField("ErrorDescription", err.Error())
+	res, _ := codec.NewMessage(codec.ErrorMessage, id).Add(status).Encode()
+	return res
+}
+
+// add checks and adds an AccessSpec, its OpSpecs only C1G2Reads
+func (s *accessSpecStore) add(p *codec.Parameter) error {
+	if p == nil {
+		return fmt.Errorf("no AccessSpec")
+	}
+	id := p.Uint("AccessSpecID")
+	if id == 0 {
+		return fmt.Errorf("AccessSpecID 0 is reserved")
+	}
+	if p.Bool("CurrentState") {
+		// an AccessSpec is added disabled and enabled by ENABLE_ACCESSSPEC
+		return fmt.Errorf("AccessSpec %v: CurrentState must be disabled", id)
+	}
+	for _, spec := range s.specs {
+		if spec.Uint("AccessSpecID") == id {
+			return fmt.Errorf("AccessSpec %v already exists", id)
+		}
+	}
+	if p.Uint("ProtocolID") != protocolEPCGlobal {
+		return fmt.Errorf("AccessSpec %v: only the EPCglobal C1G2 protocol is supported", id)
+	}
+	command := p.First(codec.AccessCommand)
+	if command == nil {
+		return fmt.Errorf("AccessSpec %v has no AccessCommand", id)
+	}
+	for _, op := range command.Parameters {
+		if op.Type != codec.C1G2TagSpec && op.Type != codec.C1G2Read {
+			return fmt.Errorf("AccessSpec %v: %v isn't supported, only C1G2Read", id, op.Name)
+		}
+	}
+	s.specs = append(s.specs, &accessSpec{Parameter: p})
+	log.Printf("AccessSpec %v added", id)
+	return nil
+}
+
+// each runs f on the AccessSpec of the id, or every one for 0, last first
+func (s *accessSpecStore) each(id uint64, f func(i int)) error {
+	found := false
+	for i := len(s.specs) - 1; i >= 0; i-- {
+		if id == 0 || s.specs[i].Uint("AccessSpecID") == id {
+			f(i)
+			found = true
+		}
+	}
+	if !found && id != 0 {
+		return fmt.Errorf("no AccessSpec %v", id)
+	}
+	return nil
+}
+
+// Apply runs the first enabled AccessSpec matching each tag of the
+// TagReportData and adds its AccessSpecID and OpSpec results
+func (s *accessSpecStore) Apply(data []byte) []byte {
+	s.Lock()
+	defer s.Unlock()
+	enabled := false
+	for _, spec := range s.specs {
+		enabled = enabled || spec.enabled
+	}
+	if !enabled {
+		return data
+	}
+	m, err := decodeTagReportData(data)
+	if err != nil {
+		log.Printf("couldn't run the AccessSpecs on the report: %v", err)
+		return data
+	}
+	for _, trd := range m.Find(codec.TagReportData) {
+		epc := codec.EPC(trd)
+		var pc, antenna uint64
+		if p := trd.First(codec.C1G2PC); p != nil {
+			pc = p.Uint("PC_Bits")
+		}
+		if p := trd.First(codec.AntennaID); p != nil {
+			antenna = p.Uint("AntennaID")
+		}
+		banks := tagBanks(uint16(pc), epc)
+		for i, spec := range s.specs {
+			if !spec.enabled || !spec.matches(antenna, banks) {
+				continue
+			}
+			trd.Add(codec.NewParameter(codec.AccessSpecID).SetField("AccessSpecID", spec.Uint("AccessSpecID")))
+			for _, op := range spec.Find(codec.C1G2Read) {
+				trd.Add(readOpSpecResult(op, banks))
+			}
+			spec.operations++
+			if stop := spec.First(codec.AccessSpecStopTrigger); stop != nil && stop.Uint("AccessSpecStopTrigger") == stopOperationCount &&
+				spec.operations >= stop.Uint("OperationCountValue") {
+				log.Printf("AccessSpec %v deleted after %v operations", spec.Uint("AccessSpecID"), spec.operations)
+				s.specs = append(s.specs[:i], s.specs[i+1:]...)
+			}
+			break
+		}
+	}
+	b, err := encodeTagReportData(m)
+	if err != nil {
+		log.Printf("couldn't run the AccessSpecs on the report: %v", err)
+		return data
+	}
+	return b
+}
+
+// matches tells whether the AccessSpec targets the tag read by the antenna
+func (spec *accessSpec) matches(antenna uint64, banks map[uint64][]byte) bool {
+	if a := spec.Uint("AntennaID"); a != 0 && antenna != 0 && a != antenna {
+		return false
+	}
+	for _, target := range spec.Find(codec.C1G2TargetTag) {
+		mask, _ := target.Field("TagMask")
+		data, _ := target.Field("TagData")
+		m, _ := mask.([]byte)
+		d, _ := data.([]byte)
+		if matchTarget(banks[target.Uint("MB")], int(target.Uint("Pointer")), m, d) != target.Bool("Match") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTarget tells whether the bits of the bank under the mask from the
+// pointer equal the data
+func matchTarget(bank []byte, pointer int, mask, data []byte) bool {
+	for i := 0; i < len(mask)*8; i++ {
+		if mask[i/8]>>uint(7-i%8)&1 == 0 {
+			continue
+		}
+		bit := pointer + i
+		if bit >= len(bank)*8 || i >= len(data)*8 {
+			return false
+		}
+		if bank[bit/8]>>uint(7-bit%8)&1 != data[i/8]>>uint(7-i%8)&1 {
+			return false
+		}
+	}
+	return true
+}
+
+// readOpSpecResult reads the words of a C1G2Read from the banks, all of
+// them from the pointer for a WordCount of 0
+func readOpSpecResult(op *codec.Parameter, banks map[uint64][]byte) *codec.Parameter {
+	res := codec.NewParameter(codec.C1G2ReadOpSpecResult).SetField("OpSpecID", op.Uint("OpSpecID"))
+	bank, ok := banks[op.Uint("MB")]
+	if !ok {
+		return res.SetField("Result", uint64(readTagError)).SetField("ReadData", []uint16{})
+	}
+	pointer, count := int(op.Uint("WordPointer")), int(op.Uint("WordCount"))
+	words := len(bank) / 2
+	if count == 0 && pointer <= words {
+		count = words - pointer
+	}
+	if words == 0 || pointer+count > words {
+		return res.SetField("Result", uint64(readMemoryOverrun)).SetField("ReadData", []uint16{})
+	}
+	read := make([]uint16, count)
+	for i := range read {
+		read[i] = binary.BigEndian.Uint16(bank[(pointer+i)*2:])
+	}
+	return res.SetField("Result", uint64(readSuccess)).SetField("ReadData", read)
+}
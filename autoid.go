@@ -0,0 +1,595 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/iomz/go-llrp"
+	"github.com/iomz/golemu/llrpclient"
+)
+
+// the namespaces of the AutoID and DI companion specifications, after the
+// server's own
+const (
+	uaAutoIDNamespace = "http://opcfoundation.org/UA/AutoID/"
+	uaDINamespace     = "http://opcfoundation.org/UA/DI/"
+	uaNsApp           = 1
+	uaNsAutoID        = 2
+	uaNsDI            = 3
+)
+
+// DeviceStatusEnumeration
+const (
+	autoIDIdle     = 0
+	autoIDScanning = 2
+)
+
+// AutoIdOperationStatusEnumeration
+const (
+	autoIDSuccess           = 0
+	autoIDOpNotPossible     = 6
+	autoIDNoIdentifier      = 8
+	autoIDDeviceNotReady    = 17
+	autoIDMaxScanDuration   = time.Minute
+	autoIDScanEventSeverity = 100
+)
+
+// the AutoID types with the NodeIds of Opc.Ua.AutoID.NodeSet2.xml, which
+// --opcua-nodeset overrides
+var (
+	uaAutoIDDeviceType     = uaNumeric(uaNsAutoID, 1001)
+	uaRfidReaderDeviceType = uaNumeric(uaNsAutoID, 1003)
+	uaAutoIDScanEventType  = uaNumeric(uaNsAutoID, 1006)
+	uaRfidScanEventType    = uaNumeric(uaNsAutoID, 1008)
+	uaScanSettings         = uaNumeric(uaNsAutoID, 3010)
+	uaRfidScanResult       = uaNumeric(uaNsAutoID, 3007)
+	uaDeviceStatus         = uaNumeric(uaNsAutoID, 3009)
+	uaAutoIDOperation      = uaNumeric(uaNsAutoID, 3008)
+	uaRfidScanResultBinary = uaNumeric(uaNsAutoID, 5015)
+	uaScanEventDeviceName  = uaNumeric(uaNsAutoID, 6010)
+	uaScanEventScanResult  = uaNumeric(uaNsAutoID, 6011)
+	uaDeviceSet            = uaNumeric(uaNsDI, 5001)
+)
+
+// autoIDReader is an emulated reader as an RfidReaderDeviceType, scanning
+// the event cycles of its inventory
+type autoIDReader struct {
+	sync.Mutex
+	srv       *opcuaServer
+	name      string
+	port      int
+	object    uaNodeID
+	inventory func() llrp.TagReportDataStack
+	status    int32
+	last      string
+	stop      chan struct{}
+}
+
+// readerInventory holds the TagReportData of the event cycle a simulated
+// reader is reporting
+type readerInventory struct {
+	sync.Mutex
+	trds llrp.TagReportDataStack
+}
+
+// Set replaces the event cycle
+func (i *readerInventory) Set(trds llrp.TagReportDataStack) {
+	i.Lock()
+	i.trds = trds
+	i.Unlock()
+}
+
+// Cycle returns the event cycle
+func (i *readerInventory) Cycle() llrp.TagReportDataStack {
+	i.Lock()
+	defer i.Unlock()
+	return i.trds
+}
+
+// storeInventory returns the reports of the tags in the store, as the
+// server mode sends them
+func storeInventory() llrp.TagReportDataStack {
+	tags := llrp.Tags{}
+	for _, tr := range journal.Tags() {
+		t, err := llrp.NewTag(&tr)
+		if err != nil {
+			continue
+		}
+		tags = append(tags, t)
+	}
+	return buildReports(tags)
+}
+
+// scanSettings is the ScanSettings argument of the scan methods
+type scanSettings struct {
+	duration      time.Duration
+	cycles        int32
+	dataAvailable bool
+}
+
+var (
+	// the OPC UA servers of the readers when --opcua is given
+	opcuaServers     []*opcuaServer
+	opcuaServersLock sync.Mutex
+	opcuaNodeSetOnce sync.Once
+)
+
+// serveOPCUA serves the reader on the LLRP port over OPC UA when --opcua
+// is given, scanning the event cycles of inventory
+func serveOPCUA(readerPort int, inventory func() llrp.TagReportDataStack) error {
+	if *opcuaAddress == "" {
+		return nil
+	}
+	address, err := opcuaReaderAddress(readerPort)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	srv := newOPCUAServer(l, uaAutoIDNamespace, uaDINamespace)
+	opcuaNodeSetOnce.Do(func() {
+		if *opcuaNodeSet == "" {
+			return
+		}
+		if err := useAutoIDNodeSet(*opcuaNodeSet, srv.namespaces); err != nil {
+			log.Fatal(err)
+		}
+	})
+	srv.addAutoIDTypes()
+	newAutoIDReader(srv, portName(*opcuaName, readerPort), readerPort, inventory)
+	opcuaServersLock.Lock()
+	opcuaServers = append(opcuaServers, srv)
+	opcuaServersLock.Unlock()
+	log.Printf("serving the reader on port %v over OPC UA on %v", readerPort, address)
+	go srv.serve()
+	return nil
+}
+
+// opcuaReaderAddress returns the OPC UA address of the reader on the LLRP
+// port: --opcua for --port, and the ports that follow for the next ones
+func opcuaReaderAddress(readerPort int) (string, error) {
+	host, p, err := net.SplitHostPort(*opcuaAddress)
+	if err != nil {
+		return "", err
+	}
+	base, err := strconv.Atoi(p)
+	if err != nil {
+		return "", fmt.Errorf("invalid --opcua port %q", p)
+	}
+	n := base + readerPort - *port
+	if n <= 0 || n > 0xffff {
+		return "", fmt.Errorf("no OPC UA port for the reader on port %v after --opcua %v", readerPort, *opcuaAddress)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n)), nil
+}
+
+// closeOPCUA closes the OPC UA servers of the readers
+func closeOPCUA() {
+	opcuaServersLock.Lock()
+	defer opcuaServersLock.Unlock()
+	for _, srv := range opcuaServers {
+		srv.Close()
+	}
+	opcuaServers = nil
+}
+
+// useAutoIDNodeSet takes the NodeIds of the AutoID types, the encoding of
+// RfidScanResult and the properties of the scan events from the NodeSet of
+// the specification
+func useAutoIDNodeSet(path string, namespaces []string) error {
+	ids, err := loadNodeSet(path, namespaces)
+	if err != nil {
+		return err
+	}
+	for _, t := range []struct {
+		id   *uaNodeID
+		name string
+	}{
+		{&uaAutoIDDeviceType, "AutoIdDeviceType"},
+		{&uaRfidReaderDeviceType, "RfidReaderDeviceType"},
+		{&uaAutoIDScanEventType, "AutoIdScanEventType"},
+		{&uaRfidScanEventType, "RfidScanEventType"},
+		{&uaScanSettings, "ScanSettings"},
+		{&uaRfidScanResult, "RfidScanResult"},
+		{&uaDeviceStatus, "DeviceStatusEnumeration"},
+		{&uaAutoIDOperation, "AutoIdOperationStatusEnumeration"},
+	} {
+		if *t.id, err = ids.find(uaNsAutoID, uaNodeID{}, t.name); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	if uaRfidScanResultBinary, err = ids.encoding(uaRfidScanResult, "Default Binary"); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if uaScanEventDeviceName, err = ids.find(uaNsAutoID, uaAutoIDScanEventType, "DeviceName"); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if uaScanEventScanResult, err = ids.find(uaNsAutoID, uaAutoIDScanEventType, "ScanResult"); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	log.Printf("AutoID NodeIds from %v: RfidReaderDeviceType %v, RfidScanEventType %v", path, uaRfidReaderDeviceType, uaRfidScanEventType)
+	return nil
+}
+
+// addAutoIDTypes adds the AutoID types used by the reader
+func (srv *opcuaServer) addAutoIDTypes() {
+	srv.objectType(uaAutoIDDeviceType, uaBaseObjectType, uaQName{uaNsAutoID, "AutoIdDeviceType"}, true)
+	srv.objectType(uaRfidReaderDeviceType, uaAutoIDDeviceType, uaQName{uaNsAutoID, "RfidReaderDeviceType"}, false)
+	srv.objectType(uaAutoIDScanEventType, uaBaseEventType, uaQName{uaNsAutoID, "AutoIdScanEventType"}, true)
+	srv.variable(uaScanEventDeviceName, uaAutoIDScanEventType, uaHasProperty,
+		uaQName{uaNsAutoID, "DeviceName"}, uaNumeric(0, uaString), -1, nil)
+	srv.variable(uaScanEventScanResult, uaAutoIDScanEventType, uaHasProperty,
+		uaQName{uaNsAutoID, "ScanResult"}, uaRfidScanResult, 1, nil)
+	srv.objectType(uaRfidScanEventType, uaAutoIDScanEventType, uaQName{uaNsAutoID, "RfidScanEventType"}, false)
+	srv.dataType(uaScanSettings, uaStructure, uaQName{uaNsAutoID, "ScanSettings"})
+	srv.dataType(uaRfidScanResult, uaStructure, uaQName{uaNsAutoID, "RfidScanResult"})
+	srv.dataType(uaDeviceStatus, uaEnumeration, uaQName{uaNsAutoID, "DeviceStatusEnumeration"})
+	srv.dataType(uaAutoIDOperation, uaEnumeration, uaQName{uaNsAutoID, "AutoIdOperationStatusEnumeration"})
+}
+
+// newAutoIDReader adds the reader object to the DeviceSet
+func newAutoIDReader(srv *opcuaServer, name string, readerPort int, inventory func() llrp.TagReportDataStack) *autoIDReader {
+	a := &autoIDReader{srv: srv, name: name, port: readerPort, object: uaNamed(uaNsApp, name), inventory: inventory}
+	srv.folder(uaDeviceSet, uaObjectsFolder, uaQName{uaNsDI, "DeviceSet"})
+	srv.addNode(&uaNode{
+		id: a.object, class: uaObject, browseName: uaQName{uaNsApp, name},
+		typeDef: uaRfidReaderDeviceType, eventNotifier: 1,
+	}, uaDeviceSet, uaOrganizes)
+	srv.addRef(uaServerObject, uaHasNotifier, a.object)
+
+	str := func(s string) func() uaVariant {
+		return func() uaVariant { return uaVariant{uaString, s} }
+	}
+	srv.variable(a.child("DeviceName"), a.object, uaHasProperty, uaQName{uaNsAutoID, "DeviceName"}, uaNumeric(0, uaString), -1, str(name))
+	srv.variable(a.child("DeviceManual"), a.object, uaHasProperty, uaQName{uaNsAutoID, "DeviceManual"}, uaNumeric(0, uaString), -1, str(""))
+	srv.variable(a.child("Manufacturer"), a.object, uaHasProperty, uaQName{uaNsDI, "Manufacturer"}, uaNumeric(0, uaLocalizedText), -1, func() uaVariant {
+		return uaVariant{uaLocalizedText, "golemu"}
+	})
+	srv.variable(a.child("Model"), a.object, uaHasProperty, uaQName{uaNsDI, "Model"}, uaNumeric(0, uaLocalizedText), -1, func() uaVariant {
+		return uaVariant{uaLocalizedText, "LLRP reader emulator"}
+	})
+	srv.variable(a.child("SerialNumber"), a.object, uaHasProperty, uaQName{uaNsDI, "SerialNumber"}, uaNumeric(0, uaString), -1, str(localReader(readerPort)))
+	srv.variable(a.child("DeviceStatus"), a.object, uaHasComponent, uaQName{uaNsAutoID, "DeviceStatus"}, uaDeviceStatus, -1, func() uaVariant {
+		a.Lock()
+		defer a.Unlock()
+		return uaVariant{uaInt32, a.status}
+	})
+	srv.variable(a.child("LastScanData"), a.object, uaHasComponent, uaQName{uaNsAutoID, "LastScanData"}, uaNumeric(0, uaString), -1, func() uaVariant {
+		a.Lock()
+		defer a.Unlock()
+		return uaVariant{uaString, a.last}
+	})
+
+	settings := uaArgument{"Settings", uaScanSettings, -1}
+	results := uaArgument{"Results", uaRfidScanResult, 1}
+	status := uaArgument{"Status", uaAutoIDOperation, -1}
+	srv.method(a.child("Scan"), a.object, uaQName{uaNsAutoID, "Scan"}, []uaArgument{settings}, []uaArgument{results, status}, a.scan)
+	srv.method(a.child("ScanStart"), a.object, uaQName{uaNsAutoID, "ScanStart"}, []uaArgument{settings}, []uaArgument{status}, a.scanStart)
+	srv.method(a.child("ScanStop"), a.object, uaQName{uaNsAutoID, "ScanStop"}, nil, nil, a.scanStop)
+	return a
+}
+
+// child returns the NodeId of a component of the reader
+func (a *autoIDReader) child(name string) uaNodeID {
+	return uaNamed(uaNsApp, a.name+"."+name)
+}
+
+// parseScanSettings reads the ScanSettings argument, the missing ones
+// meaning a single scan
+func parseScanSettings(args []uaVariant) (scanSettings, uint32) {
+	s := scanSettings{}
+	if len(args) == 0 {
+		return s, uaBadArgumentsMissing
+	}
+	e, ok := args[0].value.(uaExtension)
+	if !ok {
+		return s, uaBadInvalidArgument
+	}
+	if e.body == nil {
+		return s, uaGood
+	}
+	r := &uaReader{b: e.body}
+	r.uint32() // encoding mask
+	s.duration = time.Duration(r.double() * float64(time.Millisecond))
+	s.cycles = r.int32()
+	s.dataAvailable = r.boolean()
+	if r.err != nil || s.duration < 0 || s.cycles < 0 {
+		return s, uaBadInvalidArgument
+	}
+	if s.duration > autoIDMaxScanDuration {
+		s.duration = autoIDMaxScanDuration
+	}
+	return s, uaGood
+}
+
+// scanSighting is a sighting of a scan result
+type scanSighting struct {
+	antenna  uint16
+	strength int8
+	seen     time.Time
+}
+
+// scanResult is the RfidScanResult of a tag, with a sighting per antenna
+type scanResult struct {
+	epc       []byte
+	pc        uint16
+	seen      time.Time
+	sightings []scanSighting
+}
+
+// scanResults gathers the tags read in the event cycles of a scan
+type scanResults struct {
+	order []string
+	byEPC map[string]*scanResult
+}
+
+func newScanResults() *scanResults {
+	return &scanResults{byEPC: map[string]*scanResult{}}
+}
+
+// add merges the tags of a report, keeping the strongest sighting on each
+// antenna and the time it was last seen
+func (sr *scanResults) add(t llrpclient.TagRead, at time.Time) {
+	seen := t.LastSeen
+	if seen.IsZero() {
+		seen = at
+	}
+	key := hex.EncodeToString(t.EPC)
+	r, ok := sr.byEPC[key]
+	if !ok {
+		r = &scanResult{epc: t.EPC, pc: t.PC, seen: seen}
+		sr.byEPC[key] = r
+		sr.order = append(sr.order, key)
+	}
+	for i, s := range r.sightings {
+		if s.antenna == t.AntennaID {
+			if t.PeakRSSI > s.strength {
+				r.sightings[i].strength = t.PeakRSSI
+			}
+			r.sightings[i].seen = seen
+			return
+		}
+	}
+	r.sightings = append(r.sightings, scanSighting{t.AntennaID, t.PeakRSSI, seen})
+}
+
+// merge adds the results of another event cycle
+func (sr *scanResults) merge(other *scanResults) {
+	for _, key := range other.order {
+		r := other.byEPC[key]
+		for _, s := range r.sightings {
+			sr.add(llrpclient.TagRead{EPC: r.epc, PC: r.pc, AntennaID: s.antenna, PeakRSSI: s.strength, LastSeen: s.seen}, s.seen)
+		}
+	}
+}
+
+// values returns the RfidScanResults in the order the tags were first read
+func (sr *scanResults) values() []interface{} {
+	results := []interface{}{}
+	for _, key := range sr.order {
+		results = append(results, sr.byEPC[key].encode())
+	}
+	return results
+}
+
+// read adds the tags of the event cycle the reader reports at the tick to
+// the results, and returns the operation status of the cycle
+func (a *autoIDReader) read(results *scanResults, tick time.Time) int32 {
+	if len(health.ConnectedAntennas()) == 0 {
+		return autoIDDeviceNotReady
+	}
+	n := 0
+	for _, trd := range a.inventory() {
+		m, err := decodeTagReportData(trd.Data)
+		if err != nil {
+			log.Printf("couldn't read the report for OPC UA: %v", err)
+			continue
+		}
+		for _, t := range llrpclient.NewReport(m).Tags {
+			results.add(t, tick)
+			a.Lock()
+			a.last = hex.EncodeToString(t.EPC)
+			a.Unlock()
+			n++
+		}
+	}
+	if n == 0 {
+		return autoIDNoIdentifier
+	}
+	return autoIDSuccess
+}
+
+// encode encodes the RfidScanResult, with the antennas and the peak RSSIs
+// of the reports; both are 0 when the reports don't have them
+func (r *scanResult) encode() uaExtension {
+	var w uaWriter
+	w.uint32(0) // no location
+	w.string("EPC")
+	w.uint32(3) // ScanData is an Epc
+	w.uint16(r.pc)
+	w.byteString(r.epc)
+	w.uint16(0)
+	w.uint16(0)
+	w.dateTime(r.seen)
+	w.int32(int32(len(r.sightings)))
+	for _, s := range r.sightings {
+		w.int32(int32(s.antenna))
+		w.int32(int32(s.strength)) // dBm
+		w.dateTime(s.seen)
+		w.int32(30)
+	}
+	return uaExtension{typeID: uaRfidScanResultBinary, body: w.Bytes()}
+}
+
+// scanCycles runs the event cycles of a scan, one at once and then one
+// every --reportInterval, and hands the results of each to cycle until it
+// returns false. A cycle due while the carrier is off under --region runs
+// when it is back on. The scan ends after Cycles, after Duration or when
+// stop is closed
+func (a *autoIDReader) scanCycles(settings scanSettings, stop <-chan struct{}, cycle func(results *scanResults, status int32) bool) {
+	ticker := clk.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if settings.duration > 0 {
+		timer := clk.NewTimer(clk.Now().Add(settings.duration))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	tx := newRegionTransmitter(clk.Now())
+	tick := clk.Now()
+	for n := int32(1); ; n++ {
+		if on := tx.Due(tick); on.After(tick) {
+			carrier := clk.NewTimer(on)
+		wait:
+			for {
+				select {
+				case <-stop:
+					carrier.Stop()
+					return
+				case <-deadline:
+					carrier.Stop()
+					return
+				case <-ticker.C:
+					// within the same gap
+				case tick = <-carrier.C:
+					break wait
+				}
+			}
+			carrier.Stop()
+		}
+		results := newScanResults()
+		if !cycle(results, a.read(results, tick)) || (settings.cycles > 0 && n >= settings.cycles) {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-deadline:
+			return
+		case tick = <-ticker.C:
+		}
+	}
+}
+
+// scan runs a synchronous scan and returns the tags of its event cycles:
+// a single cycle unless Cycles or Duration is given, and only up to the
+// first cycle with tags when DataAvailable is set
+func (a *autoIDReader) scan(args []uaVariant) ([]uaVariant, uint32) {
+	settings, status := parseScanSettings(args)
+	if status != uaGood {
+		return nil, status
+	}
+	a.Lock()
+	busy := a.status != autoIDIdle
+	if !busy {
+		a.status = autoIDScanning
+	}
+	a.Unlock()
+	if busy {
+		return []uaVariant{uaArray(uaExtensionObject), {uaInt32, int32(autoIDOpNotPossible)}}, uaGood
+	}
+	defer a.setStatus(autoIDIdle)
+	switch {
+	case settings.cycles == 0 && settings.duration == 0 && settings.dataAvailable:
+		settings.duration = autoIDMaxScanDuration
+	case settings.cycles == 0 && settings.duration == 0:
+		settings.cycles = 1
+	}
+	all := newScanResults()
+	result := int32(autoIDNoIdentifier)
+	a.scanCycles(settings, nil, func(results *scanResults, status int32) bool {
+		all.merge(results)
+		result = status
+		if len(all.order) != 0 {
+			result = autoIDSuccess
+		}
+		return !settings.dataAvailable || len(all.order) == 0
+	})
+	return []uaVariant{uaArray(uaExtensionObject, all.values()...), {uaInt32, result}}, uaGood
+}
+
+// scanStart fires an RfidScanEvent for every event cycle until ScanStop,
+// or until Cycles or Duration runs out; with DataAvailable, only the
+// cycles with tags fire
+func (a *autoIDReader) scanStart(args []uaVariant) ([]uaVariant, uint32) {
+	settings, status := parseScanSettings(args)
+	if status != uaGood {
+		return nil, status
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.stop != nil || a.status != autoIDIdle {
+		return []uaVariant{{uaInt32, int32(autoIDOpNotPossible)}}, uaGood
+	}
+	a.status = autoIDScanning
+	a.stop = make(chan struct{})
+	go a.scanning(settings, a.stop)
+	return []uaVariant{{uaInt32, int32(autoIDSuccess)}}, uaGood
+}
+
+func (a *autoIDReader) scanning(settings scanSettings, stop chan struct{}) {
+	defer func() {
+		a.Lock()
+		if a.stop == stop {
+			a.stop = nil
+			a.status = autoIDIdle
+		}
+		a.Unlock()
+	}()
+	a.scanCycles(settings, stop, func(results *scanResults, status int32) bool {
+		if len(results.order) != 0 || !settings.dataAvailable {
+			a.fire(results.values())
+		}
+		return true
+	})
+}
+
+// scanStop stops the scan started by ScanStart
+func (a *autoIDReader) scanStop(args []uaVariant) ([]uaVariant, uint32) {
+	a.Lock()
+	defer a.Unlock()
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+		a.status = autoIDIdle
+	}
+	return nil, uaGood
+}
+
+func (a *autoIDReader) setStatus(status int32) {
+	a.Lock()
+	a.status = status
+	a.Unlock()
+}
+
+// fire sends an RfidScanEvent with the results
+func (a *autoIDReader) fire(results []interface{}) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	now := clk.Now()
+	a.srv.fire(a.object, map[string]uaVariant{
+		"EventId":     {uaByteString, id},
+		"EventType":   {uaNodeIDType, uaRfidScanEventType},
+		"SourceNode":  {uaNodeIDType, a.object},
+		"SourceName":  {uaString, a.name},
+		"Time":        {uaDateTime, now},
+		"ReceiveTime": {uaDateTime, now},
+		"Message":     {uaLocalizedText, "RFID scan"},
+		"Severity":    {uaUInt16, uint16(autoIDScanEventSeverity)},
+		"DeviceName":  {uaString, a.name},
+		"ScanResult":  uaArray(uaExtensionObject, results...),
+	})
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iomz/golemu/codec"
+)
+
+// autostart runs the default ROSpec of the server mode
+var autostart = &autostartInventory{}
+
+// autostartInventory is a default ROSpec the reader runs from launch,
+// producing reads to the outputs and the history while no LLRP client is
+// connected
+type autostartInventory struct {
+	sync.Mutex
+	rospec   *codec.Parameter
+	period   time.Duration
+	antennas []uint16
+	stop     chan struct{}
+}
+
+// AutostartState is the JSON body of the autostart API
+type AutostartState struct {
+	ROSpec *codec.Parameter
+	// Period is the time between the inventory cycles in ms
+	Period int64
+	// Antennas are the antennas of the AISpecs, empty for all
+	Antennas []uint16
+	// Paused is true while an LLRP client is connected
+	Paused bool
+}
+
+// parseAutostart returns the inventory period of a ROSpec with an
+// Immediate or Periodic start trigger and the antennas of its AISpecs,
+// none for all: the period of a periodic start trigger, or else the
+// duration of the AISpec or ROSpec stop trigger, or else --reportInterval
+func parseAutostart(rospec *codec.Parameter) (time.Duration, []uint16, error) {
+	if rospec.Type != codec.ROSpec {
+		return 0, nil, fmt.Errorf("expected a ROSpec, got %v", rospec.Name)
+	}
+	if rospec.Uint("ROSpecID") == 0 {
+		return 0, nil, fmt.Errorf("ROSpecID 0 is reserved")
+	}
+	aispecs := rospec.Find(codec.AISpec)
+	if len(aispecs) == 0 {
+		return 0, nil, fmt.Errorf("ROSpec %v has no AISpec", rospec.Uint("ROSpecID"))
+	}
+	period := time.Duration(*reportInterval) * time.Millisecond
+	if stop := rospec.First(codec.ROSpecStopTrigger); stop != nil && stop.Uint("ROSpecStopTriggerType") == 1 && stop.Uint("DurationTriggerValue") > 0 {
+		period = time.Duration(stop.Uint("DurationTriggerValue")) * time.Millisecond
+	}
+	ids := []uint16{}
+	all := false
+	for _, aispec := range aispecs {
+		if stop := aispec.First(codec.AISpecStopTrigger); stop != nil && stop.Uint("AISpecStopTriggerType") == 1 && stop.Uint("DurationTrigger") > 0 {
+			period = time.Duration(stop.Uint("DurationTrigger")) * time.Millisecond
+		}
+		v, _ := aispec.Field("AntennaIDs")
+		aispecIDs, _ := v.([]uint16)
+		if len(aispecIDs) == 0 {
+			return 0, nil, fmt.Errorf("AISpec without AntennaIDs, use 0 for all")
+		}
+		for _, id := range aispecIDs {
+			if id == 0 {
+				all = true
+			} else if int(id) > *antennas {
+				return 0, nil, fmt.Errorf("no antenna %v, the reader has %v", id, *antennas)
+			}
+			ids = append(ids, id)
+		}
+	}
+	start := rospec.First(codec.ROSpecStartTrigger)
+	if start == nil {
+		return 0, nil, fmt.Errorf("ROSpec %v has no ROSpecStartTrigger", rospec.Uint("ROSpecID"))
+	}
+	switch start.Uint("ROSpecStartTriggerType") {
+	case 0:
+		return 0, nil, fmt.Errorf("ROSpec %v has a Null start trigger, it would wait for a START_ROSPEC", rospec.Uint("ROSpecID"))
+	case 1:
+	case 2:
+		if p := start.First(codec.PeriodicTriggerValue); p != nil && p.Uint("Period") > 0 {
+			period = time.Duration(p.Uint("Period")) * time.Millisecond
+		}
+	default:
+		return 0, nil, fmt.Errorf("ROSpec %v: only the Immediate and Periodic start triggers are supported", rospec.Uint("ROSpecID"))
+	}
+	if all {
+		ids = []uint16{}
+	}
+	return period, ids, nil
+}
+
+// Set replaces the default ROSpec and starts it
+func (a *autostartInventory) Set(rospec *codec.Parameter) error {
+	period, antennas, err := parseAutostart(rospec)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.clear()
+	a.rospec, a.period, a.antennas = rospec, period, antennas
+	a.stop = make(chan struct{})
+	go a.run(a.stop, period, antennas)
+	log.Printf("autostart ROSpec %v: an inventory every %v on antennas %v", rospec.Uint("ROSpecID"), period, antennas)
+	return nil
+}
+
+// Clear stops the default ROSpec and forgets it
+func (a *autostartInventory) Clear() {
+	a.Lock()
+	defer a.Unlock()
+	a.clear()
+}
+
+// clear stops the default ROSpec with the lock held
+func (a *autostartInventory) clear() {
+	if a.stop != nil {
+		close(a.stop)
+		log.Printf("autostart ROSpec %v stopped", a.rospec.Uint("ROSpecID"))
+	}
+	a.rospec, a.stop = nil, nil
+}
+
+// State returns the default ROSpec, nil without one
+func (a *autostartInventory) State() *AutostartState {
+	a.Lock()
+	defer a.Unlock()
+	if a.rospec == nil {
+		return nil
+	}
+	return &AutostartState{
+		ROSpec:   a.rospec,
+		Period:   int64(a.period / time.Millisecond),
+		Antennas: a.antennas,
+		Paused:   health.Connected(),
+	}
+}
+
+// run reads the tag population every period while no client is
+// connected, the connected antennas of the ROSpec taking turns like the
+// antennas of an AISpec
+func (a *autostartInventory) run(stop chan struct{}, period time.Duration, antennas []uint16) {
+	ticker := clk.NewTicker(period)
+	defer ticker.Stop()
+	reader := localReader(*port)
+	for cycle := 0; ; {
+		var tick time.Time
+		select {
+		case <-stop:
+			return
+		case tick = <-ticker.C:
+		}
+		if health.Connected() {
+			continue
+		}
+		active := []uint16{}
+		for _, id := range health.ConnectedAntennas() {
+			if len(antennas) == 0 {
+				active = append(active, uint16(id))
+				continue
+			}
+			for _, want := range antennas {
+				if int(want) == id {
+					active = append(active, want)
+					break
+				}
+			}
+		}
+		if len(active) == 0 {
+			continue
+		}
+		antenna := active[cycle%len(active)]
+		cycle++
+		tags := journal.Tags()
+		reads := make([]TagRead, 0, len(tags))
+		for _, t := range tags {
+			pc, _ := strconv.ParseUint(t.PCBits, 16, 16)
+			reads = append(reads, TagRead{Reader: reader, EPC: t.EPC, PC: uint16(pc), Antenna: antenna, Timestamp: tick})
+		}
+		if len(reads) != 0 {
+			publishReads(reads)
+		}
+	}
+}
+
+// loadAutostart starts the ROSpec of the --autostart file, if it exists
+func loadAutostart() {
+	if *autostartFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*autostartFile)
+	if os.IsNotExist(err) {
+		log.Printf("%v doesn't exist, no ROSpec to autostart until one is PUT", *autostartFile)
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	var rospec codec.Parameter
+	if err := json.Unmarshal(data, &rospec); err != nil {
+		log.Fatalf("%v: %v", *autostartFile, err)
+	}
+	if err := autostart.Set(&rospec); err != nil {
+		log.Fatalf("%v: %v", *autostartFile, err)
+	}
+}
+
+// APIGetAutostart returns the default ROSpec
+func APIGetAutostart(c *gin.Context) {
+	state := autostart.State()
+	if state == nil {
+		c.String(http.StatusNotFound, "No ROSpec to autostart!\n")
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+// APIPutAutostart replaces the default ROSpec, saved to the --autostart
+// file for the next launch
+func APIPutAutostart(c *gin.Context) {
+	var rospec codec.Parameter
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &rospec)
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	if err := autostart.Set(&rospec); err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	if *autostartFile != "" {
+		if err := ioutil.WriteFile(*autostartFile, data, 0644); err != nil {
+			c.String(http.StatusInternalServerError, err.Error()+"\n")
+			return
+		}
+	}
+	c.String(http.StatusAccepted, "ROSpec started!\n")
+}
+
+// APIDeleteAutostart stops the default ROSpec and removes the --autostart
+// file
+func APIDeleteAutostart(c *gin.Context) {
+	autostart.Clear()
+	if *autostartFile != "" {
+		if err := os.Remove(*autostartFile); err != nil && !os.IsNotExist(err) {
+			c.String(http.StatusInternalServerError, err.Error()+"\n")
+			return
+		}
+	}
+	c.String(http.StatusAccepted, "ROSpec stopped!\n")
+}
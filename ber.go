@@ -0,0 +1,209 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BER tags of the SNMP types
+const (
+	berInteger     byte = 0x02
+	berOctetString byte = 0x04
+	berNull        byte = 0x05
+	berOID         byte = 0x06
+	berSequence    byte = 0x30
+	berCounter32   byte = 0x41
+	berGauge32     byte = 0x42
+	berTimeTicks   byte = 0x43
+	berNoSuchObj   byte = 0x80
+	berEndOfMib    byte = 0x82
+)
+
+var errBER = errors.New("malformed BER")
+
+// oid is an ASN.1 object identifier
+type oid []uint32
+
+// parseOID parses a dotted object identifier
+func parseOID(s string) (oid, error) {
+	var o oid
+	for _, part := range strings.Split(strings.Trim(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		o = append(o, uint32(n))
+	}
+	if len(o) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return o, nil
+}
+
+func mustOID(s string) oid {
+	o, err := parseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compare orders the OIDs lexicographically
+func (o oid) compare(other oid) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+// append returns a copy of o with the sub-identifiers appended
+func (o oid) append(ids ...uint32) oid {
+	return append(append(oid{}, o...), ids...)
+}
+
+// berTLV encodes a value with its tag and length
+func berTLV(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+// berSeq encodes the concatenated values as a constructed value
+func berSeq(tag byte, values ...[]byte) []byte {
+	var content []byte
+	for _, v := range values {
+		content = append(content, v...)
+	}
+	return berTLV(tag, content)
+}
+
+// berInt encodes an integer in the fewest bytes, also used for the
+// unsigned application types
+func berInt(tag byte, n int64) []byte {
+	b := []byte{byte(n)}
+	for n < -128 || n > 127 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berString(s string) []byte {
+	return berTLV(berOctetString, []byte(s))
+}
+
+func berObjectID(o oid) []byte {
+	b := berBase128(nil, o[0]*40+o[1])
+	for _, n := range o[2:] {
+		b = berBase128(b, n)
+	}
+	return berTLV(berOID, b)
+}
+
+func berBase128(b []byte, n uint32) []byte {
+	var tmp []byte
+	tmp = append(tmp, byte(n&0x7f))
+	for n >>= 7; n != 0; n >>= 7 {
+		tmp = append([]byte{byte(n&0x7f) | 0x80}, tmp...)
+	}
+	return append(b, tmp...)
+}
+
+// berRead splits the first value off b
+func berRead(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errBER
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < size {
+			return 0, nil, nil, errBER
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, errBER
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// berReadInt reads an INTEGER off b
+func berReadInt(b []byte) (int64, []byte, error) {
+	tag, content, rest, err := berRead(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != berInteger || len(content) == 0 || len(content) > 8 {
+		return 0, nil, errBER
+	}
+	n := int64(int8(content[0]))
+	for _, c := range content[1:] {
+		n = n<<8 | int64(c)
+	}
+	return n, rest, nil
+}
+
+// berReadOID reads an OBJECT IDENTIFIER off b
+func berReadOID(b []byte) (oid, []byte, error) {
+	tag, content, rest, err := berRead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tag != berOID || len(content) == 0 {
+		return nil, nil, errBER
+	}
+	var o oid
+	var n uint32
+	for i, c := range content {
+		n = n<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(content)-1 {
+				return nil, nil, errBER
+			}
+			continue
+		}
+		if o == nil {
+			first := n / 40
+			if first > 2 {
+				first = 2
+			}
+			o = oid{first, n - first*40}
+		} else {
+			o = append(o, n)
+		}
+		n = 0
+	}
+	return o, rest, nil
+}
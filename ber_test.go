@@ -0,0 +1,88 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestBERInt(t *testing.T) {
+	// X.690 8.3, the unsigned application types in the fewest bytes too
+	for _, c := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "020100"},
+		{127, "02017f"},
+		{128, "02020080"},
+		{256, "02020100"},
+		{-128, "020180"},
+		{-129, "0202ff7f"},
+		{4294967295, "020500ffffffff"},
+	} {
+		b := berInt(berInteger, c.n)
+		if got := hex.EncodeToString(b); got != c.want {
+			t.Errorf("berInt(%v) = %v, want %v", c.n, got, c.want)
+		}
+		n, rest, err := berReadInt(b)
+		if err != nil || n != c.n || len(rest) != 0 {
+			t.Errorf("berReadInt(%v) = %v, %x, %v", c.want, n, rest, err)
+		}
+	}
+}
+
+func TestBERLength(t *testing.T) {
+	// X.690 8.1.3, the short and the long forms
+	for _, c := range []struct {
+		n    int
+		want string
+	}{
+		{0, "0400"},
+		{127, "047f"},
+		{128, "048180"},
+		{255, "0481ff"},
+		{256, "04820100"},
+	} {
+		content := bytes.Repeat([]byte{0xaa}, c.n)
+		b := berTLV(berOctetString, content)
+		if got := hex.EncodeToString(b[:len(b)-c.n]); got != c.want {
+			t.Errorf("header of %v bytes = %v, want %v", c.n, got, c.want)
+		}
+		tag, got, rest, err := berRead(b)
+		if err != nil || tag != berOctetString || !bytes.Equal(got, content) || len(rest) != 0 {
+			t.Errorf("berRead of %v bytes = %x, %v bytes, %x, %v", c.n, tag, len(got), rest, err)
+		}
+	}
+	for _, b := range []string{"04", "0402aa", "0480", "0484ffffffff"} {
+		if _, _, _, err := berRead(unhex(t, b)); err == nil {
+			t.Errorf("berRead(%v) accepted", b)
+		}
+	}
+}
+
+func TestBERObjectID(t *testing.T) {
+	// X.690 8.19, with the subidentifiers above 127 in base 128
+	for _, c := range []struct {
+		oid  string
+		want string
+	}{
+		{"1.3.6.1.2.1.1.3.0", "06082b06010201010300"},
+		{"1.3.6.1.4.1.8072", "06072b06010401bf08"},
+		{"2.999.3", "0603883703"},
+		{"1.3.6.1.4.1.4294967295", "060a2b060104018fffffff7f"},
+	} {
+		b := berObjectID(mustOID(c.oid))
+		if got := hex.EncodeToString(b); got != c.want {
+			t.Errorf("berObjectID(%v) = %v, want %v", c.oid, got, c.want)
+		}
+		o, rest, err := berReadOID(b)
+		if err != nil || o.String() != c.oid || len(rest) != 0 {
+			t.Errorf("berReadOID(%v) = %v, %x, %v", c.want, o, rest, err)
+		}
+	}
+}
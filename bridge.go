@@ -0,0 +1,183 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/iomz/golemu/codec"
+	"golang.org/x/net/websocket"
+)
+
+// bridgeError is sent to a JSON bridge client for a message that couldn't
+// be encoded or decoded
+type bridgeError struct {
+	Error string
+	// Raw is the frame that couldn't be decoded, in hex
+	Raw string `json:",omitempty"`
+}
+
+// BridgeServer tunnels the binary LLRP frames of a websocket to an LLRP
+// connection of the emulated reader, or of the ?reader=host:port allowed by
+// --bridge-reader
+func BridgeServer(ws *websocket.Conn) {
+	bridgeLLRP(ws, false)
+}
+
+// BridgeJSONServer is BridgeServer with the messages decoded by the codec,
+// one JSON message per text frame
+func BridgeJSONServer(ws *websocket.Conn) {
+	bridgeLLRP(ws, true)
+}
+
+// bridgeHandshake refuses the websockets a page of another site opens
+// from a browser, whose Origin isn't the host of the web UI
+func bridgeHandshake(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if config.Origin != nil && config.Origin.Host != req.Host {
+		return fmt.Errorf("websocket bridge: origin %v refused", config.Origin)
+	}
+	return nil
+}
+
+// bridgeLLRP connects the websocket to the reader until either closes
+func bridgeLLRP(ws *websocket.Conn, decoded bool) {
+	defer ws.Close()
+	target := ws.Request().URL.Query().Get("reader")
+	local := target == ""
+	if local {
+		// the reader listening on every address is dialed on the loopback
+		host := ip.String()
+		if ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		target = net.JoinHostPort(host, strconv.Itoa(*port))
+	} else if !bridgeAllowed(target) {
+		log.Printf("websocket bridge: %v isn't a --bridge-reader", target)
+		websocket.JSON.Send(ws, bridgeError{Error: target + " isn't a --bridge-reader"})
+		return
+	}
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Printf("websocket bridge: %v", err)
+		websocket.JSON.Send(ws, bridgeError{Error: err.Error()})
+		return
+	}
+	if !local {
+		// the sessions of the emulated reader are recorded on its side
+		conn = recordConn(conn, "client")
+	}
+	defer conn.Close()
+	client := ws.Request().RemoteAddr
+	log.Printf("websocket bridge: %v connected to the reader %v", client, target)
+
+	var once sync.Once
+	done := make(chan struct{})
+	stop := func() { once.Do(func() { close(done) }) }
+	go func() {
+		defer stop()
+		for {
+			frame, err := codec.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			if !decoded {
+				err = websocket.Message.Send(ws, frame)
+			} else if m, derr := codec.Decode(frame); derr != nil {
+				err = websocket.JSON.Send(ws, bridgeError{Error: derr.Error(), Raw: hex.EncodeToString(frame)})
+			} else {
+				err = websocket.JSON.Send(ws, m)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer stop()
+		for {
+			frames, err := receiveFrames(ws, decoded)
+			if err != nil {
+				if _, ok := err.(bridgeFrameError); !ok {
+					return
+				}
+				log.Printf("websocket bridge: %v: %v", client, err)
+				if decoded {
+					websocket.JSON.Send(ws, bridgeError{Error: err.Error()})
+					continue
+				}
+				// the stream to the reader would lose its framing
+				return
+			}
+			if _, err := conn.Write(frames); err != nil {
+				return
+			}
+		}
+	}()
+	<-done
+	log.Printf("websocket bridge: %v disconnected from the reader %v", client, target)
+}
+
+// bridgeFrameError is a websocket message that isn't a valid LLRP message
+type bridgeFrameError string
+
+func (e bridgeFrameError) Error() string { return string(e) }
+
+// receiveFrames receives the next websocket message, one or more whole
+// LLRP frames or a JSON message, and returns its LLRP frames
+func receiveFrames(ws *websocket.Conn, decoded bool) ([]byte, error) {
+	if decoded {
+		var text []byte
+		if err := websocket.Message.Receive(ws, &text); err != nil {
+			return nil, err
+		}
+		var m codec.Message
+		if err := json.Unmarshal(text, &m); err != nil {
+			return nil, bridgeFrameError(err.Error())
+		}
+		frame, err := m.Encode()
+		if err != nil {
+			return nil, bridgeFrameError(err.Error())
+		}
+		return frame, nil
+	}
+	var frames []byte
+	if err := websocket.Message.Receive(ws, &frames); err != nil {
+		return nil, err
+	}
+	for b := frames; len(b) != 0; {
+		if len(b) < codec.HeaderSize {
+			return nil, bridgeFrameError(fmt.Sprintf("%v bytes left after the last LLRP frame", len(b)))
+		}
+		length := binary.BigEndian.Uint32(b[2:6])
+		if length < codec.HeaderSize || int(length) > len(b) {
+			return nil, bridgeFrameError(fmt.Sprintf("invalid LLRP message length %v", length))
+		}
+		b = b[length:]
+	}
+	return frames, nil
+}
+
+// bridgeAllowed tells whether the bridge may connect to the reader
+func bridgeAllowed(target string) bool {
+	for _, r := range *bridgeReaders {
+		if r == target {
+			return true
+		}
+	}
+	return false
+}
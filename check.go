@@ -0,0 +1,507 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iomz/go-llrp"
+	"github.com/iomz/go-llrp/binutil"
+	"github.com/iomz/golemu/codec"
+)
+
+// minPDU is the smallest --pdu that fits an RO_ACCESS_REPORT with a tag
+const minPDU = 64
+
+// checker collects the problems found by `golemu check`
+type checker struct {
+	problems int
+	rospecs  map[uint64]string
+}
+
+// errorf prints a problem at a line of a file, or in the whole file when
+// line is 0
+func (c *checker) errorf(path string, line int, format string, args ...interface{}) {
+	c.problems++
+	if line > 0 {
+		fmt.Printf("%v:%v: %v\n", path, line, fmt.Sprintf(format, args...))
+	} else {
+		fmt.Printf("%v: %v\n", path, fmt.Sprintf(format, args...))
+	}
+}
+
+// checkFlags dry-runs the timings and sizes of the global flags
+func (c *checker) checkFlags() {
+	const where = "flags"
+	if *reportInterval <= 0 {
+		c.errorf(where, 0, "--reportInterval must be positive, got %v", *reportInterval)
+	}
+	if *keepaliveInterval < 0 {
+		c.errorf(where, 0, "--keepalive can't be negative, got %v", *keepaliveInterval)
+	}
+	if *pdu < minPDU {
+		c.errorf(where, 0, "--pdu %v can't fit a single tag report, use at least %v", *pdu, minPDU)
+	}
+	if *maxTagsPerReport < 0 {
+		c.errorf(where, 0, "--max-tags-per-report can't be negative, got %v", *maxTagsPerReport)
+	}
+	if *antennas < 1 || *antennas > 0xffff {
+		c.errorf(where, 0, "--antennas must be between 1 and 65535, got %v", *antennas)
+	}
+	if _, err := time.Parse(time.RFC3339, *epoch); err != nil {
+		c.errorf(where, 0, "--epoch: %v", err)
+	}
+	if *speed < 0 {
+		c.errorf(where, 0, "--speed can't be negative, got %v", *speed)
+	}
+	if *dutyCycle < 0 || *dutyCycle > 100 || *dutyPeriod <= 0 {
+		c.errorf(where, 0, "--duty-cycle must be a percentage of a positive --duty-period")
+	} else if *dutyCycle > 0 && time.Duration(*dutyCycle/100*float64(*dutyPeriod)) < time.Duration(*reportInterval)*time.Millisecond {
+		c.errorf(where, 0, "--duty-cycle leaves %v on air per --duty-period, less than a --reportInterval",
+			time.Duration(*dutyCycle/100*float64(*dutyPeriod)))
+	}
+	if *lbtBusy < 0 || *lbtBusy >= 1 {
+		c.errorf(where, 0, "--lbt-busy must be a probability below 1, got %v", *lbtBusy)
+	}
+}
+
+// checkPath checks a file by its kind, or every file in a directory
+func (c *checker) checkPath(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		c.errorf(path, 0, "%v", err)
+		return
+	}
+	if info.IsDir() {
+		c.checkSimulationDir(path)
+		return
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gob":
+		c.checkTagFile(path)
+	case ".json":
+		c.checkJSON(path)
+	case ".jsonl":
+		c.checkRecording(path)
+	case ".llrp", ".bin":
+		c.checkFrames(path)
+	default:
+		// --file defaults to tags.csv but holds gob encoded tags
+		c.checkTagFile(path)
+	}
+}
+
+// checkSimulationDir checks the event cycles of a simulation directory
+func (c *checker) checkSimulationDir(dir string) {
+	files, err := listSimulationFiles(dir)
+	if err != nil {
+		c.errorf(dir, 0, "%v", err)
+		return
+	}
+	if len(files) == 0 {
+		c.errorf(dir, 0, "no event cycle file found")
+	}
+	for _, f := range files {
+		c.checkTagFile(f)
+	}
+}
+
+// checkTagFile checks gob encoded tags, by their index in the file
+func (c *checker) checkTagFile(path string) {
+	var tags llrp.Tags
+	if err := binutil.Load(path, &tags); err != nil {
+		c.errorf(path, 0, "not a tag file: %v", err)
+		return
+	}
+	seen := map[string]string{}
+	for i, t := range tags {
+		if t == nil {
+			c.errorf(path, 0, "tag %v is empty", i+1)
+			continue
+		}
+		where := fmt.Sprintf("tag %v", i+1)
+		c.checkTag(path, 0, where, t.PCBits, t.EPC, seen, where)
+		if t.EPCLengthBits != 0 && int(t.EPCLengthBits) != len(t.EPC)*8 {
+			c.errorf(path, 0, "%v: EPCLengthBits is %v but the EPC has %v bits", where, t.EPCLengthBits, len(t.EPC)*8)
+		}
+	}
+}
+
+// checkTag checks the EPC length against the PC bits and for duplicates;
+// seen maps the EPCs to where they were first seen
+func (c *checker) checkTag(path string, line int, where string, pc uint16, epc []byte, seen map[string]string, at string) {
+	prefix := ""
+	if where != "" {
+		prefix = where + ": "
+	}
+	if len(epc) == 0 {
+		c.errorf(path, line, "%vempty EPC", prefix)
+		return
+	}
+	// the L field of the PC counts the 16-bit words of the EPC
+	if words := int(pc >> 11); words*2 != len(epc) {
+		c.errorf(path, line, "%vPC %04x says %v bits but the EPC %x has %v", prefix, pc, words*16, epc, len(epc)*8)
+	}
+	key := hex.EncodeToString(epc)
+	if first, ok := seen[key]; ok {
+		c.errorf(path, line, "%vduplicate EPC %v, first at %v", prefix, key, first)
+		return
+	}
+	seen[key] = at
+}
+
+// checkJSON checks a JSON file by its kind: a floor plan by its
+// extension, and the others by their keys
+func (c *checker) checkJSON(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.errorf(path, 0, "%v", err)
+		return
+	}
+	if strings.HasSuffix(strings.ToLower(path), floorPlanExt) {
+		c.checkFloorPlan(path, data)
+		return
+	}
+	var keys map[string]json.RawMessage
+	if line, err := decodeJSON(data, &keys, false); err != nil {
+		c.errorf(path, line, "%v", err)
+		return
+	}
+	var name string
+	json.Unmarshal(keys["Name"], &name)
+	switch {
+	case keys["Steps"] != nil:
+		c.checkScenario(path, data)
+	case name == "ROSpec":
+		c.checkAutostart(path, data)
+	case keys["Readers"] != nil:
+		c.checkFloorPlan(path, data)
+	default:
+		// the --chips and --usermemory files are objects by EPC
+		var first map[string]json.RawMessage
+		for _, v := range keys {
+			json.Unmarshal(v, &first)
+			break
+		}
+		switch {
+		case first["Model"] != nil:
+			c.checkChips(path, data)
+		case first["Format"] != nil:
+			c.checkUserMemory(path, data)
+		case len(keys) == 0:
+			c.errorf(path, 0, "empty JSON object")
+		default:
+			c.errorf(path, 0, "unknown JSON file, expected a scenario, an --autostart ROSpec, a --chips or --usermemory file or a floor plan")
+		}
+	}
+}
+
+// decodeJSON decodes data into v, refusing the unknown fields when
+// strict, and returns the line of the error: the offset of a syntax or
+// type error, the first use of an unknown field, or else where the
+// decoder stopped
+func decodeJSON(data []byte, v interface{}, strict bool) (int, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		d.DisallowUnknownFields()
+	}
+	err := d.Decode(v)
+	if err == nil {
+		if _, err := d.Token(); err != io.EOF {
+			return lineAt(data, d.InputOffset()), fmt.Errorf("data after the JSON value")
+		}
+		return 0, nil
+	}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return lineAt(data, e.Offset), err
+	case *json.UnmarshalTypeError:
+		return lineAt(data, e.Offset), err
+	}
+	if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+		if m := regexp.MustCompile(regexp.QuoteMeta(field) + `\s*:`).FindIndex(data); m != nil {
+			return lineAt(data, int64(m[0])), err
+		}
+	}
+	return lineAt(data, d.InputOffset()), err
+}
+
+// keyLine returns the line of the first use of a key in data, 0 if it
+// isn't found
+func keyLine(data []byte, key string) int {
+	m := regexp.MustCompile(regexp.QuoteMeta(strconv.Quote(key)) + `\s*:`).FindIndex(data)
+	if m == nil {
+		return 0
+	}
+	return lineAt(data, int64(m[0]))
+}
+
+// checkAutostart checks an --autostart ROSpec
+func (c *checker) checkAutostart(path string, data []byte) {
+	var rospec codec.Parameter
+	if line, err := decodeJSON(data, &rospec, true); err != nil {
+		c.errorf(path, line, "%v", err)
+		return
+	}
+	problems := c.problems
+	c.checkROSpec(path, 0, "", &rospec)
+	if c.problems != problems {
+		return
+	}
+	if _, _, err := parseAutostart(&rospec); err != nil {
+		c.errorf(path, 0, "%v", err)
+	}
+}
+
+// checkChips checks a --chips file against the chip models
+func (c *checker) checkChips(path string, data []byte) {
+	var tags map[string]TagChip
+	if line, err := decodeJSON(data, &tags, true); err != nil {
+		c.errorf(path, line, "%v", err)
+		return
+	}
+	epcs := []string{}
+	for epc := range tags {
+		epcs = append(epcs, epc)
+	}
+	sort.Strings(epcs)
+	store := &chipStore{tags: map[string]TagChip{}}
+	for _, epc := range epcs {
+		if _, err := store.Set(epc, tags[epc]); err != nil {
+			c.errorf(path, keyLine(data, epc), "%v: %v", epc, err)
+		}
+	}
+}
+
+// checkUserMemory checks that the user memory of a --usermemory file
+// encodes
+func (c *checker) checkUserMemory(path string, data []byte) {
+	var tags map[string]UserMemory
+	if line, err := decodeJSON(data, &tags, true); err != nil {
+		c.errorf(path, line, "%v", err)
+		return
+	}
+	epcs := []string{}
+	for epc := range tags {
+		epcs = append(epcs, epc)
+	}
+	sort.Strings(epcs)
+	for _, epc := range epcs {
+		if _, err := hex.DecodeString(epc); err != nil || epc == "" {
+			c.errorf(path, keyLine(data, epc), "invalid EPC %q", epc)
+			continue
+		}
+		m := tags[epc]
+		if _, err := m.Encode(); err != nil {
+			c.errorf(path, keyLine(data, epc), "%v: %v", epc, err)
+		}
+	}
+}
+
+// checkFloorPlan checks a floor plan of the web UI
+func (c *checker) checkFloorPlan(path string, data []byte) {
+	var fp FloorPlan
+	if line, err := decodeJSON(data, &fp, true); err != nil {
+		c.errorf(path, line, "%v", err)
+		return
+	}
+	if err := fp.validate(); err != nil {
+		c.errorf(path, 0, "%v", err)
+	}
+}
+
+// checkScenario checks a scenario saved from the timeline API
+func (c *checker) checkScenario(path string, data []byte) {
+	var sc Scenario
+	if line, err := decodeJSON(data, &sc, true); err != nil {
+		c.errorf(path, line, "%v", err)
+		return
+	}
+	// locate the tags by their EPC strings in the file
+	offset := 0
+	for i, step := range sc.Steps {
+		seen := map[string]string{}
+		for _, tr := range step.Tags {
+			quoted := []byte(strconv.Quote(tr.EPC))
+			line := 0
+			if j := bytes.Index(data[offset:], quoted); j >= 0 {
+				line = lineAt(data, int64(offset+j))
+				offset += j + len(quoted)
+			}
+			where := fmt.Sprintf("step %v", i+1)
+			pc, err := strconv.ParseUint(tr.PCBits, 16, 16)
+			if err != nil {
+				c.errorf(path, line, "%v: invalid PCBits %q", where, tr.PCBits)
+				continue
+			}
+			epc, err := hex.DecodeString(tr.EPC)
+			if err != nil {
+				c.errorf(path, line, "%v: invalid EPC %q", where, tr.EPC)
+				continue
+			}
+			c.checkTag(path, line, where, uint16(pc), epc, seen, fmt.Sprintf("line %v", line))
+		}
+	}
+	if sc.Interval < 0 {
+		c.errorf(path, 0, "negative Interval %v", sc.Interval)
+	}
+}
+
+// checkRecording checks the frames of a session recording line by line
+func (c *checker) checkRecording(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		c.errorf(path, 0, "%v", err)
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec SessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			c.errorf(path, line, "%v", err)
+			continue
+		}
+		m, err := rec.Message()
+		if err != nil {
+			c.errorf(path, line, "%v: %v", rec.Type, err)
+			continue
+		}
+		c.checkMessage(path, line, "", m)
+	}
+	if err := scanner.Err(); err != nil {
+		c.errorf(path, 0, "%v", err)
+	}
+}
+
+// checkFrames checks a file of binary LLRP messages, by their index
+func (c *checker) checkFrames(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		c.errorf(path, 0, "%v", err)
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for i := 1; ; i++ {
+		frame, err := codec.ReadFrame(r)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			c.errorf(path, 0, "message %v: %v", i, err)
+			return
+		}
+		m, err := codec.Decode(frame)
+		if err != nil {
+			c.errorf(path, 0, "message %v: %v", i, err)
+			continue
+		}
+		c.checkMessage(path, 0, fmt.Sprintf("message %v: ", i), m)
+	}
+}
+
+// checkMessage checks the ROSpecs and the keepalive timing of a message
+func (c *checker) checkMessage(path string, line int, prefix string, m *codec.Message) {
+	for _, rospec := range m.Find(codec.ROSpec) {
+		c.checkROSpec(path, line, prefix, rospec)
+	}
+	for _, ks := range m.Find(codec.KeepaliveSpec) {
+		if ks.Uint("KeepaliveTriggerType") == 1 && ks.Uint("PeriodicTriggerValue") == 0 {
+			c.errorf(path, line, "%vKeepaliveSpec: periodic keepalive every 0 ms", prefix)
+		}
+	}
+}
+
+// checkROSpec checks the IDs, antennas and triggers of a ROSpec
+func (c *checker) checkROSpec(path string, line int, prefix string, rospec *codec.Parameter) {
+	id := rospec.Uint("ROSpecID")
+	prefix += fmt.Sprintf("ROSpec %v: ", id)
+	if id == 0 {
+		c.errorf(path, line, "%vROSpecID 0 is reserved", prefix)
+	}
+	at := fmt.Sprintf("%v:%v", path, line)
+	if line == 0 {
+		at = path
+	}
+	if first, ok := c.rospecs[id]; ok {
+		c.errorf(path, line, "%vduplicate ROSpecID, first at %v", prefix, first)
+	} else {
+		c.rospecs[id] = at
+	}
+
+	if start := rospec.First(codec.ROSpecStartTrigger); start != nil && start.Uint("ROSpecStartTriggerType") == 2 {
+		if p := start.First(codec.PeriodicTriggerValue); p == nil {
+			c.errorf(path, line, "%vperiodic start without a PeriodicTriggerValue", prefix)
+		} else if p.Uint("Period") == 0 {
+			c.errorf(path, line, "%vperiodic start every 0 ms", prefix)
+		}
+	}
+	stop := rospec.First(codec.ROSpecStopTrigger)
+	if stop != nil && stop.Uint("ROSpecStopTriggerType") == 1 && stop.Uint("DurationTriggerValue") == 0 {
+		c.errorf(path, line, "%vstops after a duration of 0 ms", prefix)
+	}
+	for _, aispec := range rospec.Find(codec.AISpec) {
+		v, _ := aispec.Field("AntennaIDs")
+		ids, _ := v.([]uint16)
+		if len(ids) == 0 {
+			c.errorf(path, line, "%vAISpec without antennas", prefix)
+		}
+		for _, a := range ids {
+			if int(a) > *antennas {
+				c.errorf(path, line, "%vunknown antenna %v, the reader has %v", prefix, a, *antennas)
+			}
+		}
+		aistop := aispec.First(codec.AISpecStopTrigger)
+		if aistop != nil && aistop.Uint("AISpecStopTriggerType") == 1 {
+			d := aistop.Uint("DurationTrigger")
+			if d == 0 {
+				c.errorf(path, line, "%vAISpec stops after a duration of 0 ms", prefix)
+			} else if stop != nil && stop.Uint("ROSpecStopTriggerType") == 1 && d > stop.Uint("DurationTriggerValue") {
+				c.errorf(path, line, "%vAISpec runs for %v ms but the ROSpec stops after %v ms", prefix, d, stop.Uint("DurationTriggerValue"))
+			}
+		}
+	}
+}
+
+// lineAt returns the line number of a byte offset
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// runCheck validates the flags and the files, and exits with 1 on any
+// problem
+func runCheck() int {
+	c := &checker{rospecs: map[uint64]string{}}
+	c.checkFlags()
+	for _, path := range *checkFiles {
+		c.checkPath(path)
+	}
+	if c.problems > 0 {
+		fmt.Printf("%v problems found\n", c.problems)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/iomz/go-llrp"
+	"github.com/iomz/go-llrp/binutil"
+)
+
+// Checkpoint is the state of a simulation saved to resume it later
+type Checkpoint struct {
+	// SimulationDir is the absolute path of the simulated event cycles
+	SimulationDir string
+	// EventCycle is the index of the next event cycle file, whose Tags
+	// are sent in the next cycle
+	EventCycle int
+	Tags       llrp.Tags
+	// CyclesSent counts the event cycles sent since the start
+	CyclesSent int
+	// Clock is the time of the virtual clock and Draws the number of
+	// random values drawn, in the deterministic mode
+	Deterministic bool
+	Clock         time.Time
+	Draws         uint64
+	// the reader state that outlives the LLRP sessions
+	MessageID   uint32
+	KeepaliveID int
+	Booted      time.Time
+	Antennas    []bool
+	// Saved is the wall time of the checkpoint
+	Saved time.Time
+}
+
+// countingSource counts the values drawn from a random source so that a
+// resumed simulation can skip them; it serializes the draws of the sessions
+type countingSource struct {
+	sync.Mutex
+	rand.Source64
+	draws uint64
+}
+
+func newCountingSource(seed int64) *countingSource {
+	return &countingSource{Source64: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (s *countingSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	s.draws++
+	return s.Source64.Int63()
+}
+
+func (s *countingSource) Uint64() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	s.draws++
+	return s.Source64.Uint64()
+}
+
+// skip draws n values
+func (s *countingSource) skip(n uint64) {
+	s.Lock()
+	defer s.Unlock()
+	for s.draws < n {
+		s.draws++
+		s.Source64.Uint64()
+	}
+}
+
+// Draws returns the number of values drawn
+func (s *countingSource) Draws() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.draws
+}
+
+// loadCheckpoint reads a checkpoint file
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	var cp Checkpoint
+	if err := binutil.Load(path, &cp); err != nil {
+		return nil, fmt.Errorf("couldn't load the checkpoint %v: %v", path, err)
+	}
+	return &cp, nil
+}
+
+// saveCheckpoint writes the simulation state to the --checkpoint file,
+// through a temporary file so that a crash never leaves it half written
+func saveCheckpoint(dir string, eventCycle int, tags llrp.Tags, sent int) {
+	cp := Checkpoint{
+		SimulationDir: dir,
+		EventCycle:    eventCycle,
+		Tags:          tags,
+		CyclesSent:    sent,
+		Deterministic: *deterministic,
+		Clock:         clk.Now(),
+		Draws:         rngSource.Draws(),
+		MessageID:     messageID,
+		KeepaliveID:   keepaliveID,
+		Saved:         time.Now(),
+	}
+	health.Lock()
+	cp.Booted = health.booted
+	cp.Antennas = append([]bool{}, health.antennas...)
+	health.Unlock()
+
+	tmp := filepath.Join(filepath.Dir(*checkpoint), "."+filepath.Base(*checkpoint)+".tmp")
+	if err := binutil.Save(tmp, &cp); err != nil {
+		log.Printf("couldn't save the checkpoint: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, *checkpoint); err != nil {
+		log.Printf("couldn't save the checkpoint: %v", err)
+		return
+	}
+	log.Printf("checkpoint after %v event cycles saved to %v", sent, *checkpoint)
+}
+
+// restore applies the reader state of the checkpoint; the virtual clock
+// and the random source are restored when they are created
+func (cp *Checkpoint) restore() {
+	messageID = cp.MessageID
+	keepaliveID = cp.KeepaliveID
+	health.Lock()
+	if cp.Deterministic {
+		health.booted = cp.Booted
+	}
+	copy(health.antennas, cp.Antennas)
+	health.Unlock()
+	log.Printf("resuming from the checkpoint of %v after %v event cycles", cp.Saved.Format(time.RFC3339), cp.CyclesSent)
+}
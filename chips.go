@@ -0,0 +1,388 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/iomz/golemu/codec"
+)
+
+const (
+	// memoryBankTID is the C1G2 TID memory bank
+	memoryBankTID = 2
+	// impinjVendorID and impinjSerializedTID are the custom parameter of
+	// the TID reported by FastID, enabled by an ImpinjEnableSerializedTID
+	// in the ImpinjTagReportContentSelector of the client's ROReportSpec
+	impinjVendorID                 = 25882
+	impinjTagReportContentSelector = 50
+	impinjEnableSerializedTID      = 51
+	impinjSerializedTID            = 55
+	// configWord is the word of the EPC bank holding the configuration of
+	// the chips with a tamper alarm, and tamperAlarm its alarm bit
+	configWord  = 0x20
+	tamperAlarm = 0x0100
+)
+
+// ChipModel is the memory and the special behaviors of a tag chip
+type ChipModel struct {
+	Name   string
+	Vendor string
+	// TID is the class, mask designer and model number the TID bank starts
+	// with, in hex
+	TID      string
+	TIDBits  int
+	EPCBits  int
+	UserBits int
+	// FastID reports the TID with the EPC in every read
+	FastID bool `json:",omitempty"`
+	// BrandID is the brand identifier read after the TID, in hex
+	BrandID string `json:",omitempty"`
+	// Tamper is a tamper alarm in the configuration word of the EPC bank
+	Tamper bool `json:",omitempty"`
+}
+
+// chipCatalog is the built-in chip models
+var chipCatalog = []ChipModel{
+	{Name: "impinj-monza-r6", Vendor: "Impinj", TID: "e2801160", TIDBits: 96, EPCBits: 96, FastID: true},
+	{Name: "impinj-monza-4qt", Vendor: "Impinj", TID: "e2801105", TIDBits: 96, EPCBits: 128, UserBits: 512, FastID: true},
+	{Name: "impinj-m730", Vendor: "Impinj", TID: "e2801191", TIDBits: 96, EPCBits: 128, FastID: true},
+	{Name: "impinj-m750", Vendor: "Impinj", TID: "e2801190", TIDBits: 96, EPCBits: 96, UserBits: 32, FastID: true},
+	{Name: "nxp-ucode-8", Vendor: "NXP", TID: "e2806894", TIDBits: 96, EPCBits: 128, BrandID: "0000"},
+	{Name: "nxp-ucode-g2il-plus", Vendor: "NXP", TID: "e2806811", TIDBits: 96, EPCBits: 128, Tamper: true},
+	{Name: "nxp-ucode-7xm-plus", Vendor: "NXP", TID: "e2806d12", TIDBits: 96, EPCBits: 448, UserBits: 2048},
+	{Name: "alien-higgs-3", Vendor: "Alien", TID: "e2003412", TIDBits: 64, EPCBits: 480, UserBits: 512},
+	{Name: "alien-higgs-4", Vendor: "Alien", TID: "e2003414", TIDBits: 64, EPCBits: 128, UserBits: 128},
+}
+
+// chips holds the chip models of the tags of the server mode
+var chips = &chipStore{tags: map[string]TagChip{}}
+
+// TagChip is the chip of a tag
+type TagChip struct {
+	Model string
+	// Serial is the serial number after the model number in the TID, in
+	// hex, derived from the EPC without
+	Serial string `json:",omitempty"`
+	// BrandID replaces the brand identifier of the model
+	BrandID string `json:",omitempty"`
+	// Tamper is the state of the tamper alarm
+	Tamper bool `json:",omitempty"`
+	// TID is the TID bank, set in the responses
+	TID string `json:",omitempty"`
+}
+
+// chipStore is the chip models of the tags by EPC, --chip for the others
+type chipStore struct {
+	sync.Mutex
+	tags map[string]TagChip
+	// serializedTID is whether the LLRP client enabled the FastID TIDs
+	serializedTID bool
+}
+
+// chipModel returns the model of the catalog, nil if it doesn't exist
+func chipModel(name string) *ChipModel {
+	for i := range chipCatalog {
+		if chipCatalog[i].Name == name {
+			return &chipCatalog[i]
+		}
+	}
+	return nil
+}
+
+// Get returns the chip of a tag and its model, nil without one
+func (s *chipStore) Get(epc string) (TagChip, *ChipModel) {
+	s.Lock()
+	c, ok := s.tags[strings.ToLower(epc)]
+	s.Unlock()
+	if !ok {
+		c = TagChip{Model: *defaultChip}
+	}
+	return c, chipModel(c.Model)
+}
+
+// Set checks the chip of a tag against its EPC and user memory and keeps it
+func (s *chipStore) Set(epc string, c TagChip) (TagChip, error) {
+	model := chipModel(c.Model)
+	if model == nil {
+		return c, fmt.Errorf("unknown chip model %q", c.Model)
+	}
+	b, err := hex.DecodeString(epc)
+	if err != nil {
+		return c, fmt.Errorf("invalid EPC %q", epc)
+	}
+	if len(b)*8 > model.EPCBits {
+		return c, fmt.Errorf("the %v-bit EPC doesn't fit the %v bits of the %v", len(b)*8, model.EPCBits, model.Name)
+	}
+	if n := len(userMemory.Bank(epc)) * 8; n > model.UserBits {
+		return c, fmt.Errorf("the %v bits of user memory don't fit the %v bits of the %v", n, model.UserBits, model.Name)
+	}
+	serial, err := hex.DecodeString(c.Serial)
+	if err != nil || len(serial) > model.TIDBits/8-len(model.TID)/2 {
+		return c, fmt.Errorf("invalid serial %q, expected up to %v hex digits", c.Serial, model.TIDBits/4-len(model.TID))
+	}
+	if c.BrandID != "" {
+		if model.BrandID == "" {
+			return c, fmt.Errorf("the %v has no brand identifier", model.Name)
+		}
+		if id, err := hex.DecodeString(c.BrandID); err != nil || len(id) != 2 {
+			return c, fmt.Errorf("invalid brand identifier %q, expected 4 hex digits", c.BrandID)
+		}
+	}
+	if c.Tamper && !model.Tamper {
+		return c, fmt.Errorf("the %v has no tamper alarm", model.Name)
+	}
+	c.TID = ""
+	s.Lock()
+	s.tags[strings.ToLower(epc)] = c
+	s.Unlock()
+	c.TID = hex.EncodeToString(c.tid(model, b))
+	return c, nil
+}
+
+// Delete forgets the chip of a tag
+func (s *chipStore) Delete(epc string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.tags[strings.ToLower(epc)]
+	delete(s.tags, strings.ToLower(epc))
+	return ok
+}
+
+// fastID tells whether a tag may have a FastID chip
+func (s *chipStore) fastID() bool {
+	if m := chipModel(*defaultChip); m != nil && m.FastID {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.tags {
+		if m := chipModel(c.Model); m != nil && m.FastID {
+			return true
+		}
+	}
+	return false
+}
+
+// tid returns the TID bank of the chip: the model, the serial and the
+// brand identifier
+func (c TagChip) tid(model *ChipModel, epc []byte) []byte {
+	tid := make([]byte, model.TIDBits/8)
+	prefix, _ := hex.DecodeString(model.TID)
+	n := copy(tid, prefix)
+	serial, _ := hex.DecodeString(c.Serial)
+	if len(serial) == 0 {
+		h := fnv.New64a()
+		h.Write(epc)
+		serial = h.Sum(nil)
+	}
+	copy(tid[n:], serial)
+	brand := model.BrandID
+	if c.BrandID != "" {
+		brand = c.BrandID
+	}
+	id, _ := hex.DecodeString(brand)
+	return append(tid, id...)
+}
+
+// tagBanks returns the memory banks of a tag, sized by its chip model
+func tagBanks(pc uint16, epc []byte) map[uint64][]byte {
+	key := hex.EncodeToString(epc)
+	pc = userMemory.PC(pc, key)
+	banks := map[uint64][]byte{
+		memoryBankEPC:  append([]byte{0, 0, byte(pc >> 8), byte(pc)}, epc...),
+		memoryBankUser: userMemory.Bank(key),
+	}
+	c, model := chips.Get(key)
+	if model == nil {
+		return banks
+	}
+	size := 4 + model.EPCBits/8
+	if model.Tamper && size < (configWord+1)*2 {
+		size = (configWord + 1) * 2
+	}
+	if len(banks[memoryBankEPC]) < size {
+		banks[memoryBankEPC] = append(banks[memoryBankEPC], make([]byte, size-len(banks[memoryBankEPC]))...)
+	}
+	if c.Tamper {
+		binary.BigEndian.PutUint16(banks[memoryBankEPC][configWord*2:], tamperAlarm)
+	}
+	banks[memoryBankTID] = c.tid(model, epc)
+	user := make([]byte, model.UserBits/8)
+	copy(user, banks[memoryBankUser])
+	banks[memoryBankUser] = user
+	return banks
+}
+
+// Configure takes the ImpinjEnableSerializedTID of the ROReportSpec of a
+// client message, an ROReportSpec without it disables the FastID TIDs and
+// the messages without an ROReportSpec leave them as they are
+func (s *chipStore) Configure(m *codec.Message) {
+	if m.First(codec.ROReportSpec) == nil {
+		return
+	}
+	enabled := false
+	for _, p := range m.Find(codec.Custom) {
+		if p.Uint("VendorIdentifier") != impinjVendorID || p.Uint("ParameterSubtype") != impinjTagReportContentSelector {
+			continue
+		}
+		v, _ := p.Field("Data")
+		data, _ := v.([]byte)
+		selector, err := decodeTagReportData(data)
+		if err != nil {
+			log.Printf("invalid ImpinjTagReportContentSelector: %v", err)
+			continue
+		}
+		for _, e := range selector.Find(codec.Custom) {
+			v, _ := e.Field("Data")
+			mode, _ := v.([]byte)
+			if e.Uint("VendorIdentifier") == impinjVendorID && e.Uint("ParameterSubtype") == impinjEnableSerializedTID &&
+				len(mode) >= 2 && binary.BigEndian.Uint16(mode) == 1 {
+				enabled = true
+			}
+		}
+	}
+	s.Lock()
+	s.serializedTID = enabled
+	s.Unlock()
+}
+
+// Apply adds the TID of the tags with a FastID chip to the TagReportData,
+// as an ImpinjSerializedTID, once the LLRP client enabled it
+func (s *chipStore) Apply(data []byte) []byte {
+	s.Lock()
+	enabled := s.serializedTID
+	s.Unlock()
+	if !enabled || !s.fastID() {
+		return data
+	}
+	m, err := decodeTagReportData(data)
+	if err != nil {
+		log.Printf("couldn't add the FastID TIDs to the report: %v", err)
+		return data
+	}
+	for _, trd := range m.Find(codec.TagReportData) {
+		epc := codec.EPC(trd)
+		c, model := s.Get(hex.EncodeToString(epc))
+		if model == nil || !model.FastID {
+			continue
+		}
+		tid := c.tid(model, epc)
+		body := append([]byte{byte(len(tid) / 2 >> 8), byte(len(tid) / 2)}, tid...)
+		trd.Add(codec.NewParameter(codec.Custom).
+			SetField("VendorIdentifier", uint64(impinjVendorID)).
+			SetField("ParameterSubtype", uint64(impinjSerializedTID)).
+			SetField("Data", body))
+	}
+	b, err := encodeTagReportData(m)
+	if err != nil {
+		log.Printf("couldn't add the FastID TIDs to the report: %v", err)
+		return data
+	}
+	return b
+}
+
+// save writes the chips of the tags to the --chips file
+func (s *chipStore) save() error {
+	if *chipFile == "" {
+		return nil
+	}
+	s.Lock()
+	data, err := json.MarshalIndent(s.tags, "", "  ")
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*chipFile, data, 0644)
+}
+
+// loadChips checks --chip and sets the chips of the --chips file, if it
+// exists
+func loadChips() {
+	if *defaultChip != "" && chipModel(*defaultChip) == nil {
+		log.Fatalf("unknown chip model %q", *defaultChip)
+	}
+	if *chipFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*chipFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	var tags map[string]TagChip
+	if err := json.Unmarshal(data, &tags); err != nil {
+		log.Fatalf("%v: %v", *chipFile, err)
+	}
+	for epc, c := range tags {
+		if _, err := chips.Set(epc, c); err != nil {
+			log.Fatalf("%v: %v: %v", *chipFile, epc, err)
+		}
+	}
+	log.Printf("loaded the chips of %v tags from %v", len(tags), *chipFile)
+}
+
+// APIGetChips returns the chip model catalog
+func APIGetChips(c *gin.Context) {
+	c.JSON(http.StatusOK, chipCatalog)
+}
+
+// APIGetTagChip returns the chip of a tag with its TID
+func APIGetTagChip(c *gin.Context) {
+	epc := strings.ToLower(c.Param("epc"))
+	chip, model := chips.Get(epc)
+	b, err := hex.DecodeString(epc)
+	if model == nil || err != nil {
+		c.String(http.StatusNotFound, "No chip model!\n")
+		return
+	}
+	chip.TID = hex.EncodeToString(chip.tid(model, b))
+	c.JSON(http.StatusOK, chip)
+}
+
+// APIPutTagChip sets the chip of a tag
+func APIPutTagChip(c *gin.Context) {
+	var chip TagChip
+	if err := c.BindWith(&chip, binding.JSON); err != nil {
+		return
+	}
+	chip, err := chips.Set(strings.ToLower(c.Param("epc")), chip)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	if err := chips.save(); err != nil {
+		c.String(http.StatusInternalServerError, err.Error()+"\n")
+		return
+	}
+	c.JSON(http.StatusOK, chip)
+}
+
+// APIDeleteTagChip sets the chip of a tag back to --chip
+func APIDeleteTagChip(c *gin.Context) {
+	if !chips.Delete(c.Param("epc")) {
+		c.String(http.StatusNotFound, "No chip model!\n")
+		return
+	}
+	if err := chips.save(); err != nil {
+		c.String(http.StatusInternalServerError, err.Error()+"\n")
+		return
+	}
+	c.String(http.StatusAccepted, "Chip model cleared!\n")
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the emulated reader
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) *ClockTicker
+	// NewTimer delivers a single tick at at, right away once it's past
+	NewTimer(at time.Time) *ClockTicker
+}
+
+// ClockTicker delivers ticks on C like time.Ticker; each tick carries the
+// time it stands for
+type ClockTicker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns off the ticker
+func (t *ClockTicker) Stop() {
+	if t.stop != nil {
+		t.stop()
+	}
+}
+
+// clockSleep blocks for d on the clock
+func clockSleep(c Clock, d time.Duration) {
+	t := c.NewTimer(c.Now().Add(d))
+	<-t.C
+	t.Stop()
+}
+
+// wallClock follows the system time
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (wallClock) NewTicker(d time.Duration) *ClockTicker {
+	t := time.NewTicker(d)
+	return &ClockTicker{C: t.C, stop: t.Stop}
+}
+
+func (wallClock) NewTimer(at time.Time) *ClockTicker {
+	t := time.NewTimer(time.Until(at))
+	return &ClockTicker{C: t.C, stop: func() { t.Stop() }}
+}
+
+// followerClock follows the time of another process, set at every tick it
+// receives and running in real time in between
+type followerClock struct {
+	sync.Mutex
+	at  time.Time
+	set time.Time
+}
+
+// Set moves the clock to t
+func (fc *followerClock) Set(t time.Time) {
+	fc.Lock()
+	fc.at, fc.set = t, time.Now()
+	fc.Unlock()
+}
+
+func (fc *followerClock) Now() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	if fc.set.IsZero() {
+		return time.Now().UTC()
+	}
+	return fc.at.Add(time.Since(fc.set))
+}
+
+func (fc *followerClock) NewTicker(d time.Duration) *ClockTicker {
+	return wallClock{}.NewTicker(d)
+}
+
+func (fc *followerClock) NewTimer(at time.Time) *ClockTicker {
+	return wallClock{}.NewTimer(time.Now().Add(at.Sub(fc.Now())))
+}
+
+// virtualClock only moves forward by firing its tickers, one at a time in
+// deadline order with ties broken by creation order, so the time and the
+// order of the ticks depend on the schedule alone; speed scales the real
+// time waited between ticks, and 0 doesn't wait at all
+type virtualClock struct {
+	sync.Mutex
+	now     time.Time
+	speed   float64
+	seq     int
+	tickers []*virtualTicker
+	wake    chan struct{}
+}
+
+type virtualTicker struct {
+	next time.Time
+	// period is 0 for a timer
+	period time.Duration
+	seq    int
+	c      chan time.Time
+	done   chan struct{}
+}
+
+// NewVirtualClock starts a virtual clock at epoch
+func NewVirtualClock(epoch time.Time, speed float64) Clock {
+	vc := &virtualClock{now: epoch.UTC(), speed: speed, wake: make(chan struct{}, 1)}
+	go vc.run()
+	return vc
+}
+
+func (vc *virtualClock) Now() time.Time {
+	vc.Lock()
+	defer vc.Unlock()
+	return vc.now
+}
+
+func (vc *virtualClock) NewTicker(d time.Duration) *ClockTicker {
+	return vc.start(vc.Now().Add(d), d)
+}
+
+// NewTimer fires once at at; a timer added while the clock is already
+// handing a later tick out fires first, the clock going back to it
+func (vc *virtualClock) NewTimer(at time.Time) *ClockTicker {
+	return vc.start(at, 0)
+}
+
+// start schedules a ticker firing at at and then every period
+func (vc *virtualClock) start(at time.Time, period time.Duration) *ClockTicker {
+	vc.Lock()
+	vc.seq++
+	t := &virtualTicker{
+		next:   at,
+		period: period,
+		seq:    vc.seq,
+		c:      make(chan time.Time),
+		done:   make(chan struct{}),
+	}
+	vc.tickers = append(vc.tickers, t)
+	vc.Unlock()
+	vc.notify()
+
+	var once sync.Once
+	return &ClockTicker{C: t.c, stop: func() {
+		once.Do(func() {
+			vc.Lock()
+			vc.remove(t)
+			vc.Unlock()
+			close(t.done)
+			vc.notify()
+		})
+	}}
+}
+
+// remove takes a ticker off the schedule
+func (vc *virtualClock) remove(t *virtualTicker) {
+	for i, other := range vc.tickers {
+		if other == t {
+			vc.tickers = append(vc.tickers[:i], vc.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (vc *virtualClock) notify() {
+	select {
+	case vc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the ticker due first
+func (vc *virtualClock) next() *virtualTicker {
+	var first *virtualTicker
+	for _, t := range vc.tickers {
+		if first == nil || t.next.Before(first.next) || (t.next.Equal(first.next) && t.seq < first.seq) {
+			first = t
+		}
+	}
+	return first
+}
+
+// run fires the tickers forever
+func (vc *virtualClock) run() {
+	for {
+		vc.Lock()
+		t := vc.next()
+		if t == nil {
+			vc.Unlock()
+			<-vc.wake
+			continue
+		}
+		wait := time.Duration(0)
+		if vc.speed > 0 {
+			wait = time.Duration(float64(t.next.Sub(vc.now)) / vc.speed)
+		}
+		vc.Unlock()
+
+		if wait > 0 && !vc.sleep(t, wait) {
+			// an earlier ticker was added or t was stopped, look again
+			continue
+		}
+
+		vc.deliver(t)
+	}
+}
+
+// deliver moves the clock to the tick of t and hands it out, unless an
+// earlier timer is added meanwhile: the clock then goes back and t stays
+// due
+func (vc *virtualClock) deliver(t *virtualTicker) {
+	vc.Lock()
+	prev, tick := vc.now, t.next
+	if tick.After(vc.now) {
+		vc.now = tick
+	}
+	t.next = tick.Add(t.period)
+	if t.period == 0 {
+		vc.remove(t)
+	}
+	vc.Unlock()
+
+	for {
+		select {
+		case t.c <- tick:
+			return
+		case <-t.done:
+			return
+		case <-vc.wake:
+			vc.Lock()
+			if first := vc.next(); first != nil && first.next.Before(tick) {
+				vc.now, t.next = prev, tick
+				if t.period == 0 {
+					vc.tickers = append(vc.tickers, t)
+				}
+				vc.Unlock()
+				return
+			}
+			vc.Unlock()
+		}
+	}
+}
+
+// sleep waits for d in real time unless t stops being the next ticker
+func (vc *virtualClock) sleep(t *virtualTicker, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-vc.wake:
+			vc.Lock()
+			next := vc.next()
+			vc.Unlock()
+			if next != t {
+				return false
+			}
+		}
+	}
+}
@@ -0,0 +1,901 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/contrib/static"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/iomz/go-llrp"
+)
+
+// ClusterAntenna is an antenna of a reader of the cluster with the
+// simulation it plays and the tags added by the API
+type ClusterAntenna struct {
+	ID        uint16
+	Connected bool
+	Track     string           `json:",omitempty"`
+	Tags      []llrp.TagRecord `json:",omitempty"`
+}
+
+// ClusterReader is a reader of the cluster with its antennas, and its
+// state on the worker
+type ClusterReader struct {
+	Port      int
+	Antennas  []ClusterAntenna `json:",omitempty"`
+	Connected bool
+	Client    string `json:",omitempty"`
+	Reads     uint
+}
+
+// ClusterWorker is a worker process and the readers assigned to it
+type ClusterWorker struct {
+	Address string
+	Local   bool
+	Readers []ClusterReader
+	Error   string `json:",omitempty"`
+}
+
+// ClusterStatus is the state of the cluster served by the controller
+type ClusterStatus struct {
+	Cycle   int
+	Time    time.Time
+	Workers []*ClusterWorker
+}
+
+// ClusterTrack is the JSON body to play a scenario on an antenna
+type ClusterTrack struct {
+	Scenario string
+}
+
+// clusterAssignment is a reader assigned to a worker with its tracks,
+// sent when the reader is assigned and when its tracks change
+type clusterAssignment struct {
+	Port   int
+	Tracks []clusterTrack
+}
+
+// clusterTrack is a simulation directory played on an antenna from the
+// event cycle Start of the controller; the directory is read by the worker
+type clusterTrack struct {
+	Antenna uint16
+	Dir     string
+	Start   int
+}
+
+// clusterTick tells a worker to play an event cycle of its readers at a
+// time of the controller's clock: the workers advance the tracks to the
+// cycle, and the tick only carries the changes made by the API
+type clusterTick struct {
+	Cycle int
+	Time  time.Time
+	// Tracks are the readers whose tracks changed since the last tick
+	Tracks []clusterAssignment `json:",omitempty"`
+	// Overrides are the readers with antennas disconnected or tags added
+	Overrides []clusterOverride `json:",omitempty"`
+}
+
+// clusterOverride is the state of the antennas of a reader set by the API
+type clusterOverride struct {
+	Port         int
+	Disconnected []uint16             `json:",omitempty"`
+	Tags         []clusterAntennaTags `json:",omitempty"`
+}
+
+type clusterAntennaTags struct {
+	Antenna uint16
+	Tags    []llrp.TagRecord
+}
+
+// clusterReader is the scenario of a reader, owned by the controller
+type clusterReader struct {
+	port         int
+	worker       *ClusterWorker
+	tracks       map[uint16]*simTrack
+	tags         map[uint16]llrp.Tags
+	disconnected map[uint16]bool
+	// version counts the changes of the tracks, sent is the last one the
+	// worker has
+	version int
+	sent    int
+}
+
+var (
+	// cluster is the state of the cluster in the controller mode
+	cluster = &ClusterStatus{}
+	// clusterReaders are the readers of the cluster by port
+	clusterReaders = map[int]*clusterReader{}
+	// clusterNext is the event cycle of the next tick
+	clusterNext int
+	clusterLock sync.Mutex
+)
+
+// the flags of the controller that aren't for the workers, and the
+// global ones the local workers can't share
+var (
+	controllerFlags = []string{"--worker", "--local-workers", "--local-worker-port", "--track", "--cycles", "--scenarios", "--webPort", "-w"}
+	unsharedFlags   = []string{"--lines", "--record"}
+)
+
+// runController assigns the readers of the --track specs to the workers
+// and plays their event cycles in lockstep on its clock, ticking the
+// workers at every cycle
+func runController() int {
+	readers, err := groupTracks(*controllerTracks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(readers) == 0 {
+		log.Fatal("no --track to play")
+	}
+	*scenarioDir = *clusterScenarios
+	for _, address := range *workerAddresses {
+		cluster.Workers = append(cluster.Workers, &ClusterWorker{Address: address})
+	}
+	processes := startLocalWorkers()
+	stop := func() {
+		for _, p := range processes {
+			p.Process.Kill()
+		}
+	}
+	defer stop()
+	if len(cluster.Workers) == 0 {
+		log.Fatal("the controller needs a --worker or --local-workers")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case signal := <-signals:
+				stop()
+				closeSinks()
+				log.Fatal(signal)
+			}
+		}
+	}()
+
+	// spread the readers over the workers
+	for i, r := range readers {
+		w := cluster.Workers[i%len(cluster.Workers)]
+		cr := &clusterReader{
+			port:         r.port,
+			worker:       w,
+			tracks:       map[uint16]*simTrack{},
+			tags:         map[uint16]llrp.Tags{},
+			disconnected: map[uint16]bool{},
+		}
+		for _, t := range r.tracks {
+			if cr.tracks[t.Antenna] != nil {
+				log.Fatalf("two tracks on antenna %v of the reader on port %v", t.Antenna, r.port)
+			}
+			cr.tracks[t.Antenna] = t
+		}
+		clusterReaders[r.port] = cr
+		w.Readers = append(w.Readers, ClusterReader{Port: r.port})
+	}
+	for _, w := range cluster.Workers {
+		assigned := []clusterAssignment{}
+		for _, cr := range w.Readers {
+			assigned = append(assigned, clusterReaders[cr.Port].assignment())
+		}
+		if err := w.assign(assigned); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%v readers assigned to the worker %v", len(w.Readers), w.Address)
+	}
+	defer func() {
+		for _, w := range cluster.Workers {
+			w.call("DELETE", "/readers", nil, nil)
+		}
+	}()
+
+	go func() {
+		r := gin.Default()
+		r.Use(static.Serve("/", static.LocalFile(os.Getenv("GOPATH")+"/src/github.com/iomz/golemu/web", true)))
+		v1 := r.Group("api/v1")
+		v1.GET("/cluster", APIGetCluster)
+		v1.PUT("/readers/:port/antennas/:id", APIPutClusterAntenna)
+		v1.POST("/readers/:port/antennas/:id/tags", APIPostClusterTags)
+		v1.DELETE("/readers/:port/antennas/:id/tags", APIDeleteClusterTags)
+		v1.PUT("/readers/:port/antennas/:id/track", APIPutClusterTrack)
+		v1.DELETE("/readers/:port/antennas/:id/track", APIDeleteClusterTrack)
+		v1.GET("/scenarios", APIGetScenarios)
+		v1.GET("/scenarios/:name", APIGetScenario)
+		v1.PUT("/scenarios/:name", APIPutScenario)
+		r.Run(":" + strconv.Itoa(*controllerWebPort))
+	}()
+
+	// wait for the LLRP clients of all the readers
+	log.Printf("waiting for the LLRP clients of %v readers...", len(readers))
+	for !clusterConnected() {
+		time.Sleep(time.Second)
+	}
+
+	ticker := clk.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+	tx := newRegionTransmitter(clk.Now())
+	for n := 0; *controllerCycles == 0 || n < *controllerCycles; n++ {
+		t, _ := tx.Next(ticker.C)
+		ticks := map[*ClusterWorker]*clusterTick{}
+		for _, w := range cluster.Workers {
+			ticks[w] = &clusterTick{Cycle: n, Time: t}
+		}
+		versions := map[*clusterReader]int{}
+		clusterLock.Lock()
+		for _, r := range readers {
+			cr := clusterReaders[r.port]
+			tick := ticks[cr.worker]
+			if cr.version != cr.sent {
+				tick.Tracks = append(tick.Tracks, cr.assignment())
+				versions[cr] = cr.version
+			}
+			if o := cr.override(); o != nil {
+				tick.Overrides = append(tick.Overrides, *o)
+			}
+		}
+		clusterNext = n + 1
+		clusterLock.Unlock()
+		var wg sync.WaitGroup
+		for _, w := range cluster.Workers {
+			wg.Add(1)
+			go func(w *ClusterWorker) {
+				defer wg.Done()
+				var state []ClusterReader
+				err := w.call("POST", "/tick", ticks[w], &state)
+				clusterLock.Lock()
+				defer clusterLock.Unlock()
+				if err != nil {
+					log.Printf("worker %v: %v", w.Address, err)
+					w.Error = err.Error()
+					return
+				}
+				w.Readers, w.Error = state, ""
+				for cr, v := range versions {
+					if cr.worker == w {
+						cr.sent = v
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		clusterLock.Lock()
+		cluster.Cycle, cluster.Time = n, t
+		clusterLock.Unlock()
+	}
+	ticker.Stop()
+	log.Printf("simulated %v event cycles on %v workers", *controllerCycles, len(cluster.Workers))
+	return 0
+}
+
+// startLocalWorkers starts the --local-workers processes on localhost,
+// with the global flags of the controller
+func startLocalWorkers() []*exec.Cmd {
+	args := withoutFlags(os.Args[1:], append(controllerFlags, unsharedFlags...)...)
+	processes := []*exec.Cmd{}
+	for i := 0; i < *localWorkers; i++ {
+		address := fmt.Sprintf("127.0.0.1:%v", *localWorkerPort+i)
+		cmd := exec.Command(os.Args[0], append(args, "worker", "--listen", address)...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			log.Fatal(err)
+		}
+		processes = append(processes, cmd)
+		cluster.Workers = append(cluster.Workers, &ClusterWorker{Address: address, Local: true})
+	}
+	return processes
+}
+
+// withoutFlags removes the flags and their values from the arguments,
+// along with the controller command
+func withoutFlags(args []string, names ...string) []string {
+	kept := []string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] == controller.FullCommand() {
+			continue
+		}
+		skip := false
+		for _, name := range names {
+			if args[i] == name {
+				// the value follows
+				skip = true
+				i++
+				break
+			}
+			if strings.HasPrefix(args[i], name+"=") {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
+
+// clusterConnected tells whether every reader has an LLRP client
+func clusterConnected() bool {
+	connected := true
+	for _, w := range cluster.Workers {
+		var state []ClusterReader
+		err := w.call("GET", "/readers", nil, &state)
+		clusterLock.Lock()
+		if err != nil {
+			w.Error = err.Error()
+			connected = false
+		} else {
+			w.Readers, w.Error = state, ""
+			for _, r := range state {
+				connected = connected && r.Connected
+			}
+		}
+		clusterLock.Unlock()
+	}
+	return connected
+}
+
+// assign hands the readers to the worker, waiting ten seconds at most for
+// it to start
+func (w *ClusterWorker) assign(readers []clusterAssignment) error {
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = w.call("GET", "/readers", nil, nil); err == nil {
+			return w.call("PUT", "/readers", readers, nil)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("worker %v: %v", w.Address, err)
+}
+
+// call sends a request to the worker API and decodes the response into
+// out
+func (w *ClusterWorker) call(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://"+w.Address+"/cluster/v1"+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// a tick may take the whole interval with --pacing spread
+	client := &http.Client{Timeout: time.Duration(*reportInterval)*time.Millisecond + 10*time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var msg bytes.Buffer
+		msg.ReadFrom(res.Body)
+		return fmt.Errorf("%v %v: %v", method, path, strings.TrimSpace(msg.String()))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// assignment returns the reader with its tracks for the worker
+func (r *clusterReader) assignment() clusterAssignment {
+	a := clusterAssignment{Port: r.port, Tracks: []clusterTrack{}}
+	for id := uint16(1); int(id) <= *antennas; id++ {
+		if t := r.tracks[id]; t != nil {
+			a.Tracks = append(a.Tracks, clusterTrack{Antenna: id, Dir: t.Dir, Start: t.start})
+		}
+	}
+	return a
+}
+
+// override returns the antennas of the reader disconnected and the tags
+// added to them by the API, nil without any
+func (r *clusterReader) override() *clusterOverride {
+	o := &clusterOverride{Port: r.port}
+	for id := uint16(1); int(id) <= *antennas; id++ {
+		if r.disconnected[id] {
+			o.Disconnected = append(o.Disconnected, id)
+			continue
+		}
+		if len(r.tags[id]) == 0 {
+			continue
+		}
+		at := clusterAntennaTags{Antenna: id, Tags: []llrp.TagRecord{}}
+		for _, t := range r.tags[id] {
+			at.Tags = append(at.Tags, *llrp.NewTagRecord(*t))
+		}
+		o.Tags = append(o.Tags, at)
+	}
+	if len(o.Disconnected) == 0 && len(o.Tags) == 0 {
+		return nil
+	}
+	return o
+}
+
+// antennas describes the antennas of the reader
+func (r *clusterReader) antennas() []ClusterAntenna {
+	if r == nil {
+		return nil
+	}
+	list := []ClusterAntenna{}
+	for id := uint16(1); int(id) <= *antennas; id++ {
+		a := ClusterAntenna{ID: id, Connected: !r.disconnected[id]}
+		if t := r.tracks[id]; t != nil {
+			a.Track = t.Dir
+		}
+		for _, t := range r.tags[id] {
+			a.Tags = append(a.Tags, *llrp.NewTagRecord(*t))
+		}
+		list = append(list, a)
+	}
+	return list
+}
+
+// tags decodes the tags added to the antennas
+func (o clusterOverride) tags() (map[uint16]llrp.Tags, error) {
+	tags := map[uint16]llrp.Tags{}
+	for _, at := range o.Tags {
+		for _, tr := range at.Tags {
+			t, err := llrp.NewTag(&llrp.TagRecord{PCBits: tr.PCBits, EPC: tr.EPC})
+			if err != nil {
+				return nil, fmt.Errorf("reader on port %v: %v: %v", o.Port, tr.EPC, err)
+			}
+			tags[at.Antenna] = append(tags[at.Antenna], t)
+		}
+	}
+	return tags, nil
+}
+
+// APIGetCluster returns the workers and the state of their readers
+func APIGetCluster(c *gin.Context) {
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	status := *cluster
+	status.Workers = []*ClusterWorker{}
+	for _, w := range cluster.Workers {
+		view := *w
+		view.Readers = []ClusterReader{}
+		for _, cr := range w.Readers {
+			cr.Antennas = clusterReaders[cr.Port].antennas()
+			view.Readers = append(view.Readers, cr)
+		}
+		status.Workers = append(status.Workers, &view)
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// clusterAntenna returns the reader and the antenna of the request, or
+// answers that they don't exist; the caller holds clusterLock
+func clusterAntenna(c *gin.Context) (*clusterReader, uint16, bool) {
+	p, err := strconv.Atoi(c.Param("port"))
+	r := clusterReaders[p]
+	if err != nil || r == nil {
+		c.String(http.StatusNotFound, "The reader doesn't exist!\n")
+		return nil, 0, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 || id > *antennas {
+		c.String(http.StatusNotFound, "The antenna doesn't exist!\n")
+		return nil, 0, false
+	}
+	return r, uint16(id), true
+}
+
+// clusterTags decodes the tags of the request body
+func clusterTags(c *gin.Context) (llrp.Tags, bool) {
+	var records []llrp.TagRecord
+	if err := c.BindWith(&records, binding.JSON); err != nil {
+		return nil, false
+	}
+	tags := llrp.Tags{}
+	for _, tr := range records {
+		t, err := llrp.NewTag(&llrp.TagRecord{PCBits: tr.PCBits, EPC: tr.EPC})
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("%v: %v\n", tr.EPC, err))
+			return nil, false
+		}
+		tags = append(tags, t)
+	}
+	return tags, true
+}
+
+// APIPutClusterAntenna connects or disconnects an antenna of a reader of
+// the cluster
+func APIPutClusterAntenna(c *gin.Context) {
+	var state AntennaState
+	if err := c.BindWith(&state, binding.JSON); err != nil {
+		return
+	}
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	r, id, ok := clusterAntenna(c)
+	if !ok {
+		return
+	}
+	r.disconnected[id] = !state.Connected
+	c.String(http.StatusAccepted, "Antenna updated!\n")
+}
+
+// APIPostClusterTags adds tags read on an antenna of a reader of the
+// cluster at every event cycle
+func APIPostClusterTags(c *gin.Context) {
+	tags, ok := clusterTags(c)
+	if !ok {
+		return
+	}
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	r, id, ok := clusterAntenna(c)
+	if !ok {
+		return
+	}
+	exists := false
+	for _, t := range tags {
+		if r.tags[id].GetIndexOf(t) >= 0 {
+			exists = true
+			continue
+		}
+		r.tags[id] = append(r.tags[id], t)
+	}
+	if exists {
+		c.String(http.StatusAlreadyReported, "The tag already exists!\n")
+	} else {
+		c.String(http.StatusAccepted, "Post requested!\n")
+	}
+}
+
+// APIDeleteClusterTags removes tags added to an antenna of a reader of the
+// cluster
+func APIDeleteClusterTags(c *gin.Context) {
+	tags, ok := clusterTags(c)
+	if !ok {
+		return
+	}
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	r, id, ok := clusterAntenna(c)
+	if !ok {
+		return
+	}
+	missing := false
+	for _, t := range tags {
+		i := r.tags[id].GetIndexOf(t)
+		if i < 0 {
+			missing = true
+			continue
+		}
+		r.tags[id] = append(r.tags[id][:i], r.tags[id][i+1:]...)
+	}
+	if missing {
+		c.String(http.StatusNoContent, "The tag doesn't exist!\n")
+	} else {
+		c.String(http.StatusAccepted, "Delete requested!\n")
+	}
+}
+
+// APIPutClusterTrack plays a scenario of --scenarios on an antenna of a
+// reader of the cluster, from its first event cycle
+func APIPutClusterTrack(c *gin.Context) {
+	var track ClusterTrack
+	if err := c.BindWith(&track, binding.JSON); err != nil {
+		return
+	}
+	dir, err := scenarioPath(track.Scenario)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	files, err := listSimulationFiles(dir)
+	if os.IsNotExist(err) || (err == nil && len(files) == 0) {
+		c.String(http.StatusNotFound, "The scenario doesn't exist!\n")
+		return
+	} else if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	r, id, ok := clusterAntenna(c)
+	if !ok {
+		return
+	}
+	r.tracks[id] = &simTrack{Dir: dir, Port: r.port, Antenna: id, files: files, start: clusterNext}
+	r.version++
+	log.Printf("playing %v on antenna %v of the reader on port %v", dir, id, r.port)
+	c.String(http.StatusAccepted, "Track updated!\n")
+}
+
+// APIDeleteClusterTrack stops the simulation played on an antenna of a
+// reader of the cluster
+func APIDeleteClusterTrack(c *gin.Context) {
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	r, id, ok := clusterAntenna(c)
+	if !ok {
+		return
+	}
+	delete(r.tracks, id)
+	r.version++
+	c.String(http.StatusAccepted, "Track removed!\n")
+}
+
+// workerNode is the worker process, playing the event cycles of its
+// readers at the ticks of the controller
+type workerNode struct {
+	sync.Mutex
+	// tick serializes the ticks, which own the tracks of the readers
+	tick      sync.Mutex
+	clock     *followerClock
+	readers   []*simReader
+	listeners []net.Listener
+	connected map[*simReader]bool
+	reads     map[*simReader]uint
+	notify    sync.Mutex
+}
+
+// runWorker serves the worker API on --listen
+func runWorker() int {
+	node := &workerNode{clock: &followerClock{}}
+	clk = node.clock
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case signal := <-signals:
+				node.release()
+				closeSinks()
+				log.Fatal(signal)
+			}
+		}
+	}()
+
+	r := gin.Default()
+	v1 := r.Group("cluster/v1")
+	v1.GET("/readers", node.getReaders)
+	v1.PUT("/readers", node.putReaders)
+	v1.DELETE("/readers", node.deleteReaders)
+	v1.POST("/tick", node.postTick)
+	log.Printf("worker listening on %v", *workerListen)
+	if err := r.Run(*workerListen); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+// state returns the state of the readers
+func (node *workerNode) state() []ClusterReader {
+	state := []ClusterReader{}
+	for _, r := range node.readers {
+		cr := ClusterReader{Port: r.port, Connected: node.connected[r], Reads: node.reads[r]}
+		if cr.Connected {
+			cr.Client = r.conn.RemoteAddr().String()
+		}
+		state = append(state, cr)
+	}
+	return state
+}
+
+func (node *workerNode) getReaders(c *gin.Context) {
+	node.Lock()
+	defer node.Unlock()
+	c.JSON(http.StatusOK, node.state())
+}
+
+// putReaders starts the LLRP readers assigned by the controller
+func (node *workerNode) putReaders(c *gin.Context) {
+	var assigned []clusterAssignment
+	if err := c.BindWith(&assigned, binding.JSON); err != nil {
+		return
+	}
+	node.Lock()
+	defer node.Unlock()
+	if len(node.readers) != 0 {
+		c.String(http.StatusConflict, "The worker already has readers!\n")
+		return
+	}
+	readers := []*simReader{}
+	for _, a := range assigned {
+		tracks, err := a.tracks()
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error()+"\n")
+			return
+		}
+		readers = append(readers, &simReader{port: a.Port, tracks: tracks})
+	}
+	node.connected = map[*simReader]bool{}
+	node.reads = map[*simReader]uint{}
+	for _, r := range readers {
+		l, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(r.port))
+		if err != nil {
+			node.release()
+			c.String(http.StatusBadRequest, err.Error()+"\n")
+			return
+		}
+		node.listeners = append(node.listeners, l)
+		node.readers = append(node.readers, r)
+		if err := serveOPCUA(r.port, r.inventory.Cycle); err != nil {
+			node.release()
+			c.String(http.StatusBadRequest, err.Error()+"\n")
+			return
+		}
+		log.Printf("listening on %v:%v", ip, r.port)
+		advertise(r.port)
+		go node.accept(r, l)
+	}
+	c.JSON(http.StatusOK, node.state())
+}
+
+// accept waits for the client of a reader to send SET_READER_CONFIG
+func (node *workerNode) accept(r *simReader, l net.Listener) {
+	r.serve(l, nil, func() {
+		node.Lock()
+		node.connected[r] = true
+		node.Unlock()
+	}, &node.notify)
+}
+
+// deleteReaders closes the readers so that the worker can be assigned
+// again
+func (node *workerNode) deleteReaders(c *gin.Context) {
+	node.Lock()
+	defer node.Unlock()
+	node.release()
+	c.String(http.StatusOK, "Readers closed!\n")
+}
+
+// release closes the connections and the listeners of the readers
+func (node *workerNode) release() {
+	for _, r := range node.readers {
+		if node.connected[r] {
+			r.conn.Close()
+			publishEvent(localReader(r.port), "ConnectionClose", 0)
+		}
+	}
+	for _, l := range node.listeners {
+		l.Close()
+	}
+	closeOPCUA()
+	node.readers, node.listeners = nil, nil
+}
+
+// tracks lists the event cycles of the tracks of the reader
+func (a clusterAssignment) tracks() ([]*simTrack, error) {
+	tracks := []*simTrack{}
+	for _, ct := range a.Tracks {
+		files, err := listSimulationFiles(ct.Dir)
+		if err == nil && len(files) == 0 {
+			err = fmt.Errorf("no event cycle file found in %s", ct.Dir)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reader on port %v: %v", a.Port, err)
+		}
+		tracks = append(tracks, &simTrack{Dir: ct.Dir, Port: a.Port, Antenna: ct.Antenna, files: files, start: ct.Start})
+	}
+	return tracks, nil
+}
+
+// postTick advances the tracks of the connected readers to the event cycle
+// of the controller and sends it to their clients, along with the tags
+// added by the API. The clients are written to without the lock, and a
+// client that can't take the cycle within --reportInterval is dropped
+// rather than holding up the cluster
+func (node *workerNode) postTick(c *gin.Context) {
+	var tick clusterTick
+	if err := c.BindWith(&tick, binding.JSON); err != nil {
+		return
+	}
+	overrides := map[int]clusterOverride{}
+	added := map[int]map[uint16]llrp.Tags{}
+	for _, o := range tick.Overrides {
+		tags, err := o.tags()
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error()+"\n")
+			return
+		}
+		overrides[o.Port], added[o.Port] = o, tags
+	}
+	node.tick.Lock()
+	defer node.tick.Unlock()
+	node.Lock()
+	node.clock.Set(tick.Time)
+	for _, a := range tick.Tracks {
+		tracks, err := a.tracks()
+		if err != nil {
+			node.Unlock()
+			c.String(http.StatusBadRequest, err.Error()+"\n")
+			return
+		}
+		for _, r := range node.readers {
+			if r.port == a.Port {
+				r.tracks = tracks
+			}
+		}
+	}
+	playing := []*simReader{}
+	for _, r := range node.readers {
+		if node.connected[r] {
+			playing = append(playing, r)
+		}
+	}
+	node.Unlock()
+
+	deadline := time.Now().Add(time.Duration(*reportInterval) * time.Millisecond)
+	for _, r := range playing {
+		r.conn.SetWriteDeadline(deadline)
+	}
+	sent, failed := playCycle(playing, func(r *simReader) []antennaTags {
+		return r.clusterCycle(tick.Cycle, overrides[r.port], added[r.port])
+	})
+	for _, r := range playing {
+		r.conn.SetWriteDeadline(time.Time{})
+	}
+
+	node.Lock()
+	defer node.Unlock()
+	for r, n := range sent {
+		node.reads[r] += n
+	}
+	for r, err := range failed {
+		// wait for a new client
+		log.Print(err)
+		r.conn.Close()
+		publishEvent(localReader(r.port), "ConnectionClose", 0)
+		node.connected[r] = false
+		for i, other := range node.readers {
+			if other == r {
+				go node.accept(r, node.listeners[i])
+			}
+		}
+	}
+	c.JSON(http.StatusOK, node.state())
+}
+
+// clusterCycle returns the tags read on the connected antennas of the
+// reader at an event cycle of the cluster, those of its tracks and those
+// added by the API
+func (r *simReader) clusterCycle(cycle int, o clusterOverride, added map[uint16]llrp.Tags) []antennaTags {
+	disconnected := map[uint16]bool{}
+	for _, id := range o.Disconnected {
+		disconnected[id] = true
+	}
+	tags := map[uint16]llrp.Tags{}
+	rssi := map[uint16]map[string]int8{}
+	for _, t := range r.tracks {
+		tags[t.Antenna] = t.at(cycle)
+		rssi[t.Antenna] = t.rssi
+		log.Printf("<<< Event Cycle %v of %v, %v tags on antenna %v of port %v", cycle, t.Dir, len(tags[t.Antenna]), t.Antenna, r.port)
+	}
+	read := []antennaTags{}
+	for id := uint16(1); int(id) <= *antennas; id++ {
+		if disconnected[id] {
+			continue
+		}
+		if all := append(tags[id], added[id]...); len(all) != 0 {
+			read = append(read, antennaTags{id, all, rssi[id]})
+		}
+	}
+	return read
+}
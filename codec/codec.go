@@ -0,0 +1,482 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+// Package codec decodes and encodes LLRP 1.0.1 messages into a generic
+// tree of named fields and parameters, driven by the schema tables in
+// schema.go.
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// HeaderSize is the size of the fixed LLRP message header
+const HeaderSize = 10
+
+// Version is the LLRP protocol version written by Encode
+const Version = 1
+
+// Field is a single named value in a message or parameter body
+//
+// Value is a bool for 1-bit fields, uint64 for other unsigned integers,
+// int64 for signed integers, string for UTF-8 strings, []uint16 and
+// []uint32 for vectors, and []byte for everything else.
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Parameter is a decoded TLV or TV parameter
+type Parameter struct {
+	Type       uint16
+	Name       string
+	Fields     []Field
+	Parameters []*Parameter
+	// Raw holds the undecoded body of a parameter missing from the schema
+	Raw []byte
+}
+
+// Message is a decoded LLRP message
+type Message struct {
+	Version    uint8
+	Type       uint16
+	Name       string
+	ID         uint32
+	Fields     []Field
+	Parameters []*Parameter
+	// Raw holds the undecoded body of a message missing from the schema
+	Raw []byte
+}
+
+// NewMessage returns an empty message of the given type
+func NewMessage(t uint16, id uint32) *Message {
+	return &Message{Version: Version, Type: t, Name: MessageName(t), ID: id}
+}
+
+// NewParameter returns an empty parameter of the given type
+func NewParameter(t uint16) *Parameter {
+	return &Parameter{Type: t, Name: ParameterName(t)}
+}
+
+// MessageName returns the LLRP name of the message type
+func MessageName(t uint16) string {
+	if s, ok := messageSchemas[t]; ok {
+		return s.name
+	}
+	return fmt.Sprintf("MESSAGE_%d", t)
+}
+
+// ParameterName returns the LLRP name of the parameter type
+func ParameterName(t uint16) string {
+	if s, ok := parameterSchemas[t]; ok {
+		return s.name
+	}
+	return fmt.Sprintf("Parameter%d", t)
+}
+
+// ReadFrame reads a single LLRP frame from r
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[2:6])
+	if length < HeaderSize {
+		return nil, fmt.Errorf("invalid LLRP message length: %v", length)
+	}
+	frame := make([]byte, length)
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[HeaderSize:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// FrameType returns the message type of a raw LLRP frame
+func FrameType(frame []byte) uint16 {
+	if len(frame) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(frame[:2]) & 0x3ff
+}
+
+// Decode parses a complete LLRP frame
+func Decode(frame []byte) (*Message, error) {
+	if len(frame) < HeaderSize {
+		return nil, fmt.Errorf("short LLRP frame: %v bytes", len(frame))
+	}
+	h := binary.BigEndian.Uint16(frame[:2])
+	length := binary.BigEndian.Uint32(frame[2:6])
+	if int(length) != len(frame) {
+		return nil, fmt.Errorf("LLRP length %v doesn't match frame size %v", length, len(frame))
+	}
+	m := &Message{
+		Version: uint8(h>>10) & 0x7,
+		Type:    h & 0x3ff,
+		ID:      binary.BigEndian.Uint32(frame[6:10]),
+	}
+	m.Name = MessageName(m.Type)
+	body := frame[HeaderSize:]
+	s, ok := messageSchemas[m.Type]
+	if !ok {
+		m.Raw = body
+		return m, nil
+	}
+	fields, n, err := decodeFields(s.fields, body)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", m.Name, err)
+	}
+	m.Fields = fields
+	if m.Parameters, err = decodeParameters(body[n:]); err != nil {
+		return nil, fmt.Errorf("%v: %v", m.Name, err)
+	}
+	return m, nil
+}
+
+// decodeParameters parses a sequence of TV and TLV parameters
+func decodeParameters(b []byte) ([]*Parameter, error) {
+	var ps []*Parameter
+	for len(b) > 0 {
+		p, n, err := decodeParameter(b)
+		if err != nil {
+			return ps, err
+		}
+		ps = append(ps, p)
+		b = b[n:]
+	}
+	return ps, nil
+}
+
+// decodeParameter parses the first parameter in b and returns its size
+func decodeParameter(b []byte) (*Parameter, int, error) {
+	if b[0]&0x80 != 0 {
+		// TV-encoded parameter
+		t := uint16(b[0] & 0x7f)
+		s, ok := parameterSchemas[t]
+		if !ok || s.tvLength == 0 {
+			return nil, 0, fmt.Errorf("unknown TV parameter type %v", t)
+		}
+		if len(b) < 1+s.tvLength {
+			return nil, 0, fmt.Errorf("truncated %v", s.name)
+		}
+		fields, _, err := decodeFields(s.fields, b[1:1+s.tvLength])
+		if err != nil {
+			return nil, 0, fmt.Errorf("%v: %v", s.name, err)
+		}
+		return &Parameter{Type: t, Name: s.name, Fields: fields}, 1 + s.tvLength, nil
+	}
+
+	// TLV-encoded parameter
+	if len(b) < 4 {
+		return nil, 0, fmt.Errorf("truncated parameter header")
+	}
+	t := binary.BigEndian.Uint16(b[:2]) & 0x3ff
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 4 || length > len(b) {
+		return nil, 0, fmt.Errorf("invalid length %v for %v", length, ParameterName(t))
+	}
+	p := &Parameter{Type: t, Name: ParameterName(t)}
+	body := b[4:length]
+	s, ok := parameterSchemas[t]
+	if !ok {
+		p.Raw = body
+		return p, length, nil
+	}
+	fields, n, err := decodeFields(s.fields, body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v: %v", p.Name, err)
+	}
+	p.Fields = fields
+	if p.Parameters, err = decodeParameters(body[n:]); err != nil {
+		return nil, 0, fmt.Errorf("%v: %v", p.Name, err)
+	}
+	return p, length, nil
+}
+
+// decodeFields parses the fixed fields of a body and returns the number of
+// bytes consumed
+func decodeFields(specs []fieldSpec, b []byte) ([]Field, int, error) {
+	var fields []Field
+	bit := 0
+	for _, f := range specs {
+		var v interface{}
+		switch f.kind {
+		case kindUint, kindInt:
+			if bit+f.bits > len(b)*8 {
+				return nil, 0, fmt.Errorf("truncated field %v", f.name)
+			}
+			u := readBits(b, bit, f.bits)
+			bit += f.bits
+			switch {
+			case f.kind == kindInt:
+				v = int64(u<<(64-uint(f.bits))) >> (64 - uint(f.bits))
+			case f.bits == 1:
+				v = u == 1
+			default:
+				v = u
+			}
+		default:
+			if bit%8 != 0 {
+				return nil, 0, fmt.Errorf("unaligned field %v", f.name)
+			}
+			var n int
+			var err error
+			v, n, err = decodeVariable(f, b[bit/8:])
+			if err != nil {
+				return nil, 0, err
+			}
+			bit += n * 8
+		}
+		if f.name != "" {
+			fields = append(fields, Field{Name: f.name, Value: v})
+		}
+	}
+	if bit%8 != 0 {
+		return nil, 0, fmt.Errorf("fields end on a partial byte")
+	}
+	return fields, bit / 8, nil
+}
+
+// decodeVariable parses a byte-aligned variable-length field
+func decodeVariable(f fieldSpec, b []byte) (interface{}, int, error) {
+	if f.kind == kindBytes {
+		if len(b) < f.bits/8 {
+			return nil, 0, fmt.Errorf("truncated field %v", f.name)
+		}
+		return append([]byte{}, b[:f.bits/8]...), f.bits / 8, nil
+	}
+	if f.kind == kindRest {
+		return append([]byte{}, b...), len(b), nil
+	}
+	if len(b) < 2 {
+		return nil, 0, fmt.Errorf("truncated field %v", f.name)
+	}
+	count := int(binary.BigEndian.Uint16(b[:2]))
+	b = b[2:]
+	switch f.kind {
+	case kindU8v, kindUTF8:
+		if len(b) < count {
+			return nil, 0, fmt.Errorf("truncated field %v", f.name)
+		}
+		if f.kind == kindUTF8 {
+			return string(b[:count]), 2 + count, nil
+		}
+		return append([]byte{}, b[:count]...), 2 + count, nil
+	case kindBitArray:
+		n := (count + 7) / 8
+		if len(b) < n {
+			return nil, 0, fmt.Errorf("truncated field %v", f.name)
+		}
+		return append([]byte{}, b[:n]...), 2 + n, nil
+	case kindU16v:
+		if len(b) < count*2 {
+			return nil, 0, fmt.Errorf("truncated field %v", f.name)
+		}
+		v := make([]uint16, count)
+		for i := range v {
+			v[i] = binary.BigEndian.Uint16(b[i*2:])
+		}
+		return v, 2 + count*2, nil
+	case kindU32v:
+		if len(b) < count*4 {
+			return nil, 0, fmt.Errorf("truncated field %v", f.name)
+		}
+		v := make([]uint32, count)
+		for i := range v {
+			v[i] = binary.BigEndian.Uint32(b[i*4:])
+		}
+		return v, 2 + count*4, nil
+	}
+	return nil, 0, fmt.Errorf("unknown kind for field %v", f.name)
+}
+
+// readBits reads n bits MSB-first starting at bit offset off
+func readBits(b []byte, off, n int) uint64 {
+	var u uint64
+	for i := 0; i < n; i++ {
+		bit := (b[(off+i)/8] >> uint(7-(off+i)%8)) & 1
+		u = u<<1 | uint64(bit)
+	}
+	return u
+}
+
+// Encode serializes the message into an LLRP frame
+func (m *Message) Encode() ([]byte, error) {
+	body := m.Raw
+	if s, ok := messageSchemas[m.Type]; ok {
+		var err error
+		if body, err = encodeFields(s.fields, m.Fields); err != nil {
+			return nil, fmt.Errorf("%v: %v", m.Name, err)
+		}
+		for _, p := range m.Parameters {
+			b, err := p.Encode()
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", m.Name, err)
+			}
+			body = append(body, b...)
+		}
+	}
+	version := m.Version
+	if version == 0 {
+		version = Version
+	}
+	frame := make([]byte, HeaderSize, HeaderSize+len(body))
+	binary.BigEndian.PutUint16(frame[0:2], uint16(version&0x7)<<10|m.Type&0x3ff)
+	binary.BigEndian.PutUint32(frame[2:6], uint32(HeaderSize+len(body)))
+	binary.BigEndian.PutUint32(frame[6:10], m.ID)
+	return append(frame, body...), nil
+}
+
+// Encode serializes the parameter in TV or TLV form
+func (p *Parameter) Encode() ([]byte, error) {
+	s, ok := parameterSchemas[p.Type]
+	if !ok {
+		b := make([]byte, 4, 4+len(p.Raw))
+		binary.BigEndian.PutUint16(b[0:2], p.Type&0x3ff)
+		binary.BigEndian.PutUint16(b[2:4], uint16(4+len(p.Raw)))
+		return append(b, p.Raw...), nil
+	}
+	body, err := encodeFields(s.fields, p.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", s.name, err)
+	}
+	if s.tvLength != 0 {
+		return append([]byte{0x80 | byte(p.Type)}, body...), nil
+	}
+	for _, sub := range p.Parameters {
+		b, err := sub.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", s.name, err)
+		}
+		body = append(body, b...)
+	}
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(b[0:2], p.Type&0x3ff)
+	binary.BigEndian.PutUint16(b[2:4], uint16(4+len(body)))
+	return append(b, body...), nil
+}
+
+// encodeFields serializes the fixed fields of a body, looking the values
+// up by name and defaulting missing ones to zero
+func encodeFields(specs []fieldSpec, fields []Field) ([]byte, error) {
+	values := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		values[f.Name] = f.Value
+	}
+	var b []byte
+	var acc uint64
+	accBits := 0
+	for _, f := range specs {
+		v := values[f.name]
+		if f.kind == kindUint || f.kind == kindInt {
+			u, err := toUint64(v)
+			if err != nil {
+				return nil, fmt.Errorf("field %v: %v", f.name, err)
+			}
+			for i := f.bits - 1; i >= 0; i-- {
+				acc = acc<<1 | (u>>uint(i))&1
+				accBits++
+				if accBits == 8 {
+					b = append(b, byte(acc))
+					acc, accBits = 0, 0
+				}
+			}
+			continue
+		}
+		if accBits != 0 {
+			return nil, fmt.Errorf("unaligned field %v", f.name)
+		}
+		vb, err := encodeVariable(f, v)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, vb...)
+	}
+	if accBits != 0 {
+		return nil, fmt.Errorf("fields end on a partial byte")
+	}
+	return b, nil
+}
+
+// encodeVariable serializes a byte-aligned variable-length field
+func encodeVariable(f fieldSpec, v interface{}) ([]byte, error) {
+	count := func(n int) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		return b
+	}
+	switch f.kind {
+	case kindBytes:
+		b := make([]byte, f.bits/8)
+		vb, _ := v.([]byte)
+		copy(b, vb)
+		return b, nil
+	case kindRest:
+		vb, _ := v.([]byte)
+		return vb, nil
+	case kindU8v:
+		vb, _ := v.([]byte)
+		return append(count(len(vb)), vb...), nil
+	case kindBitArray:
+		vb, _ := v.([]byte)
+		return append(count(len(vb)*8), vb...), nil
+	case kindUTF8:
+		s, _ := v.(string)
+		return append(count(len(s)), s...), nil
+	case kindU16v:
+		vs, _ := v.([]uint16)
+		b := count(len(vs))
+		for _, u := range vs {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		return b, nil
+	case kindU32v:
+		vs, _ := v.([]uint32)
+		b := count(len(vs))
+		for _, u := range vs {
+			b = append(b, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown kind for field %v", f.name)
+}
+
+// toUint64 converts an integer or bool field value
+func toUint64(v interface{}) (uint64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	case uint8:
+		return uint64(n), nil
+	case uint16:
+		return uint64(n), nil
+	case uint32:
+		return uint64(n), nil
+	case uint64:
+		return n, nil
+	case uint:
+		return uint64(n), nil
+	case int8:
+		return uint64(n), nil
+	case int16:
+		return uint64(n), nil
+	case int32:
+		return uint64(n), nil
+	case int64:
+		return uint64(n), nil
+	case int:
+		return uint64(n), nil
+	case float64:
+		return uint64(int64(n)), nil
+	}
+	return 0, fmt.Errorf("%T is not an integer", v)
+}
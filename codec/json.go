@@ -0,0 +1,223 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// jsonMessage is the JSON form of a message: the fields by name, byte
+// fields and Raw in hex, and the type by number or name
+type jsonMessage struct {
+	Type       uint16
+	Name       string
+	ID         uint32
+	Fields     map[string]json.RawMessage `json:",omitempty"`
+	Parameters []*Parameter               `json:",omitempty"`
+	Raw        string                     `json:",omitempty"`
+}
+
+// jsonParameter is the JSON form of a parameter, like jsonMessage
+type jsonParameter struct {
+	Type       uint16
+	Name       string
+	Fields     map[string]json.RawMessage `json:",omitempty"`
+	Parameters []*Parameter               `json:",omitempty"`
+	Raw        string                     `json:",omitempty"`
+}
+
+var messageTypes, parameterTypes map[string]uint16
+
+func init() {
+	messageTypes = make(map[string]uint16, len(messageSchemas))
+	for t, s := range messageSchemas {
+		messageTypes[s.name] = t
+	}
+	parameterTypes = make(map[string]uint16, len(parameterSchemas))
+	for t, s := range parameterSchemas {
+		parameterTypes[s.name] = t
+	}
+}
+
+// MarshalJSON encodes the message with its fields by name
+func (m *Message) MarshalJSON() ([]byte, error) {
+	fields, err := marshalFields(m.Fields)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonMessage{m.Type, m.Name, m.ID, fields, m.Parameters, hex.EncodeToString(m.Raw)})
+}
+
+// UnmarshalJSON decodes a message, typed by Type or Name, checking its
+// fields against the schema
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var j jsonMessage
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Type == 0 {
+		t, ok := messageTypes[j.Name]
+		if !ok {
+			return fmt.Errorf("unknown message %q", j.Name)
+		}
+		j.Type = t
+	}
+	*m = Message{Version: Version, Type: j.Type, Name: MessageName(j.Type), ID: j.ID, Parameters: j.Parameters}
+	s, ok := messageSchemas[j.Type]
+	if !ok {
+		return unmarshalRaw(m.Name, j.Fields, j.Raw, &m.Raw)
+	}
+	var err error
+	if m.Fields, err = unmarshalFields(m.Name, s.fields, j.Fields); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MarshalJSON encodes the parameter with its fields by name
+func (p *Parameter) MarshalJSON() ([]byte, error) {
+	fields, err := marshalFields(p.Fields)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonParameter{p.Type, p.Name, fields, p.Parameters, hex.EncodeToString(p.Raw)})
+}
+
+// UnmarshalJSON decodes a parameter, typed by Type or Name, checking its
+// fields against the schema
+func (p *Parameter) UnmarshalJSON(b []byte) error {
+	var j jsonParameter
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Type == 0 {
+		t, ok := parameterTypes[j.Name]
+		if !ok {
+			return fmt.Errorf("unknown parameter %q", j.Name)
+		}
+		j.Type = t
+	}
+	*p = Parameter{Type: j.Type, Name: ParameterName(j.Type), Parameters: j.Parameters}
+	s, ok := parameterSchemas[j.Type]
+	if !ok {
+		return unmarshalRaw(p.Name, j.Fields, j.Raw, &p.Raw)
+	}
+	var err error
+	if p.Fields, err = unmarshalFields(p.Name, s.fields, j.Fields); err != nil {
+		return err
+	}
+	return nil
+}
+
+// marshalFields returns the fields by name, with the byte fields in hex
+func marshalFields(fields []Field) (map[string]json.RawMessage, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		v := f.Value
+		if b, ok := v.([]byte); ok {
+			v = hex.EncodeToString(b)
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %v: %v", f.Name, err)
+		}
+		m[f.Name] = raw
+	}
+	return m, nil
+}
+
+// unmarshalFields converts the JSON fields to the values Decode returns
+// for the field specs, in their order
+func unmarshalFields(name string, specs []fieldSpec, values map[string]json.RawMessage) ([]Field, error) {
+	known := map[string]bool{}
+	var fields []Field
+	for _, f := range specs {
+		if f.name == "" {
+			continue
+		}
+		known[f.name] = true
+		raw, ok := values[f.name]
+		if !ok {
+			continue
+		}
+		v, err := unmarshalValue(f, raw)
+		if err != nil {
+			return nil, fmt.Errorf("%v: field %v: %v", name, f.name, err)
+		}
+		fields = append(fields, Field{Name: f.name, Value: v})
+	}
+	for n := range values {
+		if !known[n] {
+			return nil, fmt.Errorf("%v: unknown field %v", name, n)
+		}
+	}
+	return fields, nil
+}
+
+// unmarshalValue converts a JSON value to the type of the field kind
+func unmarshalValue(f fieldSpec, raw json.RawMessage) (interface{}, error) {
+	switch f.kind {
+	case kindUint, kindInt:
+		if f.bits == 1 && f.kind == kindUint {
+			var v bool
+			if err := json.Unmarshal(raw, &v); err == nil {
+				return v, nil
+			}
+		}
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		var n json.Number
+		if err := d.Decode(&n); err != nil {
+			return nil, err
+		}
+		if f.kind == kindInt {
+			return strconv.ParseInt(n.String(), 10, f.bits)
+		}
+		u, err := strconv.ParseUint(n.String(), 10, f.bits)
+		if err == nil && f.bits == 1 {
+			return u == 1, nil
+		}
+		return u, err
+	case kindUTF8:
+		var v string
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case kindU16v:
+		var v []uint16
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case kindU32v:
+		var v []uint32
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	}
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(v)
+}
+
+// unmarshalRaw takes the hex body of a message or parameter missing from
+// the schema
+func unmarshalRaw(name string, fields map[string]json.RawMessage, s string, raw *[]byte) error {
+	if len(fields) != 0 {
+		return fmt.Errorf("%v isn't in the schema, only its Raw body can be set", name)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("%v: Raw: %v", name, err)
+	}
+	*raw = b
+	return nil
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package codec
+
+// fieldKind is the wire representation of a field
+type fieldKind int
+
+const (
+	kindUint fieldKind = iota
+	kindInt
+	kindBytes
+	kindU8v
+	kindU16v
+	kindU32v
+	kindUTF8
+	kindBitArray
+	kindRest
+)
+
+// fieldSpec describes a single field; bits is the width of integer fields
+// and eight times the size of fixed byte fields
+type fieldSpec struct {
+	name string
+	kind fieldKind
+	bits int
+}
+
+// schema describes the fixed fields of a message or parameter body;
+// tvLength is the value size of TV-encoded parameters
+type schema struct {
+	name     string
+	fields   []fieldSpec
+	tvLength int
+}
+
+func u(name string, bits int) fieldSpec { return fieldSpec{name, kindUint, bits} }
+func s(name string, bits int) fieldSpec { return fieldSpec{name, kindInt, bits} }
+func rsv(bits int) fieldSpec            { return fieldSpec{"", kindUint, bits} }
+func fixed(name string, n int) fieldSpec {
+	return fieldSpec{name, kindBytes, n * 8}
+}
+func u8v(name string) fieldSpec      { return fieldSpec{name, kindU8v, 0} }
+func u16v(name string) fieldSpec     { return fieldSpec{name, kindU16v, 0} }
+func u32v(name string) fieldSpec     { return fieldSpec{name, kindU32v, 0} }
+func utf8v(name string) fieldSpec    { return fieldSpec{name, kindUTF8, 0} }
+func bitArray(name string) fieldSpec { return fieldSpec{name, kindBitArray, 0} }
+func rest(name string) fieldSpec     { return fieldSpec{name, kindRest, 0} }
+
+func fields(fs ...fieldSpec) []fieldSpec { return fs }
+
+// LLRP message types
+const (
+	GetReaderCapabilities         uint16 = 1
+	GetReaderConfig               uint16 = 2
+	SetReaderConfig               uint16 = 3
+	CloseConnectionResponse       uint16 = 4
+	GetReaderCapabilitiesResponse uint16 = 11
+	GetReaderConfigResponse       uint16 = 12
+	SetReaderConfigResponse       uint16 = 13
+	CloseConnection               uint16 = 14
+	AddROSpec                     uint16 = 20
+	DeleteROSpec                  uint16 = 21
+	StartROSpec                   uint16 = 22
+	StopROSpec                    uint16 = 23
+	EnableROSpec                  uint16 = 24
+	DisableROSpec                 uint16 = 25
+	GetROSpecs                    uint16 = 26
+	AddROSpecResponse             uint16 = 30
+	DeleteROSpecResponse          uint16 = 31
+	StartROSpecResponse           uint16 = 32
+	StopROSpecResponse            uint16 = 33
+	EnableROSpecResponse          uint16 = 34
+	DisableROSpecResponse         uint16 = 35
+	GetROSpecsResponse            uint16 = 36
+	AddAccessSpec                 uint16 = 40
+	DeleteAccessSpec              uint16 = 41
+	EnableAccessSpec              uint16 = 42
+	DisableAccessSpec             uint16 = 43
+	GetAccessSpecs                uint16 = 44
+	ClientRequestOp               uint16 = 45
+	AddAccessSpecResponse         uint16 = 50
+	DeleteAccessSpecResponse      uint16 = 51
+	EnableAccessSpecResponse      uint16 = 52
+	DisableAccessSpecResponse     uint16 = 53
+	GetAccessSpecsResponse        uint16 = 54
+	ClientRequestOpResponse       uint16 = 55
+	GetReport                     uint16 = 60
+	ROAccessReport                uint16 = 61
+	Keepalive                     uint16 = 62
+	ReaderEventNotification       uint16 = 63
+	EnableEventsAndReports        uint16 = 64
+	KeepaliveAck                  uint16 = 72
+	ErrorMessage                  uint16 = 100
+	CustomMessage                 uint16 = 1023
+)
+
+// LLRP parameter types
+const (
+	AntennaID                   uint16 = 1
+	FirstSeenTimestampUTC       uint16 = 2
+	FirstSeenTimestampUptime    uint16 = 3
+	LastSeenTimestampUTC        uint16 = 4
+	LastSeenTimestampUptime     uint16 = 5
+	PeakRSSI                    uint16 = 6
+	ChannelIndex                uint16 = 7
+	TagSeenCount                uint16 = 8
+	ROSpecID                    uint16 = 9
+	InventoryParameterSpecID    uint16 = 10
+	C1G2CRC                     uint16 = 11
+	C1G2PC                      uint16 = 12
+	EPC96                       uint16 = 13
+	SpecIndex                   uint16 = 14
+	AccessSpecID                uint16 = 16
+	OpSpecID                    uint16 = 17
+	UTCTimestamp                uint16 = 128
+	Uptime                      uint16 = 129
+	GeneralDeviceCapabilities   uint16 = 137
+	ReceiveSensitivityEntry     uint16 = 139
+	GPIOCapabilities            uint16 = 141
+	LLRPCapabilities            uint16 = 142
+	RegulatoryCapabilities      uint16 = 143
+	TransmitPowerLevelEntry     uint16 = 145
+	ROSpec                      uint16 = 177
+	ROBoundarySpec              uint16 = 178
+	ROSpecStartTrigger          uint16 = 179
+	PeriodicTriggerValue        uint16 = 180
+	ROSpecStopTrigger           uint16 = 182
+	AISpec                      uint16 = 183
+	AISpecStopTrigger           uint16 = 184
+	InventoryParameterSpec      uint16 = 186
+	AccessSpec                  uint16 = 207
+	AccessSpecStopTrigger       uint16 = 208
+	AccessCommand               uint16 = 209
+	Identification              uint16 = 218
+	GPOWriteData                uint16 = 219
+	KeepaliveSpec               uint16 = 220
+	AntennaProperties           uint16 = 221
+	AntennaConfiguration        uint16 = 222
+	RFReceiver                  uint16 = 223
+	RFTransmitter               uint16 = 224
+	GPIPortCurrentState         uint16 = 225
+	EventsAndReports            uint16 = 226
+	ROReportSpec                uint16 = 237
+	TagReportContentSelector    uint16 = 238
+	AccessReportSpec            uint16 = 239
+	TagReportData               uint16 = 240
+	EPCData                     uint16 = 241
+	ReaderEventNotificationSpec uint16 = 244
+	EventNotificationState      uint16 = 245
+	ReaderEventNotificationData uint16 = 246
+	GPIEvent                    uint16 = 248
+	ROSpecEvent                 uint16 = 249
+	ReaderExceptionEvent        uint16 = 252
+	AISpecEvent                 uint16 = 254
+	AntennaEvent                uint16 = 255
+	ConnectionAttemptEvent      uint16 = 256
+	ConnectionCloseEvent        uint16 = 257
+	LLRPStatus                  uint16 = 287
+	FieldError                  uint16 = 288
+	ParameterError              uint16 = 289
+	C1G2LLRPCapabilities        uint16 = 327
+	C1G2InventoryCommand        uint16 = 330
+	C1G2TagSpec                 uint16 = 338
+	C1G2TargetTag               uint16 = 339
+	C1G2Read                    uint16 = 341
+	C1G2Write                   uint16 = 342
+	C1G2EPCMemorySelector       uint16 = 348
+	C1G2ReadOpSpecResult        uint16 = 349
+	C1G2WriteOpSpecResult       uint16 = 350
+	Custom                      uint16 = 1023
+)
+
+// LLRPStatus codes
+const (
+	StatusSuccess               uint64 = 0
+	StatusMessageParameterError uint64 = 100
+	StatusMessageFieldError     uint64 = 101
+	StatusMessageUnsupported    uint64 = 102
+	StatusParameterUnsupported  uint64 = 201
+	StatusDeviceError           uint64 = 401
+)
+
+// messageSchemas lists the fixed fields of each LLRP message body; any
+// bytes left after the fields are decoded as parameters
+var messageSchemas = map[uint16]schema{
+	GetReaderCapabilities:         {name: "GET_READER_CAPABILITIES", fields: fields(u("RequestedData", 8))},
+	GetReaderCapabilitiesResponse: {name: "GET_READER_CAPABILITIES_RESPONSE"},
+	GetReaderConfig: {name: "GET_READER_CONFIG", fields: fields(
+		u("AntennaID", 16), u("RequestedData", 8), u("GPIPortNum", 16), u("GPOPortNum", 16))},
+	GetReaderConfigResponse:   {name: "GET_READER_CONFIG_RESPONSE"},
+	SetReaderConfig:           {name: "SET_READER_CONFIG", fields: fields(u("ResetToFactoryDefault", 1), rsv(7))},
+	SetReaderConfigResponse:   {name: "SET_READER_CONFIG_RESPONSE"},
+	CloseConnection:           {name: "CLOSE_CONNECTION"},
+	CloseConnectionResponse:   {name: "CLOSE_CONNECTION_RESPONSE"},
+	AddROSpec:                 {name: "ADD_ROSPEC"},
+	AddROSpecResponse:         {name: "ADD_ROSPEC_RESPONSE"},
+	DeleteROSpec:              {name: "DELETE_ROSPEC", fields: fields(u("ROSpecID", 32))},
+	DeleteROSpecResponse:      {name: "DELETE_ROSPEC_RESPONSE"},
+	StartROSpec:               {name: "START_ROSPEC", fields: fields(u("ROSpecID", 32))},
+	StartROSpecResponse:       {name: "START_ROSPEC_RESPONSE"},
+	StopROSpec:                {name: "STOP_ROSPEC", fields: fields(u("ROSpecID", 32))},
+	StopROSpecResponse:        {name: "STOP_ROSPEC_RESPONSE"},
+	EnableROSpec:              {name: "ENABLE_ROSPEC", fields: fields(u("ROSpecID", 32))},
+	EnableROSpecResponse:      {name: "ENABLE_ROSPEC_RESPONSE"},
+	DisableROSpec:             {name: "DISABLE_ROSPEC", fields: fields(u("ROSpecID", 32))},
+	DisableROSpecResponse:     {name: "DISABLE_ROSPEC_RESPONSE"},
+	GetROSpecs:                {name: "GET_ROSPECS"},
+	GetROSpecsResponse:        {name: "GET_ROSPECS_RESPONSE"},
+	AddAccessSpec:             {name: "ADD_ACCESSSPEC"},
+	AddAccessSpecResponse:     {name: "ADD_ACCESSSPEC_RESPONSE"},
+	DeleteAccessSpec:          {name: "DELETE_ACCESSSPEC", fields: fields(u("AccessSpecID", 32))},
+	DeleteAccessSpecResponse:  {name: "DELETE_ACCESSSPEC_RESPONSE"},
+	EnableAccessSpec:          {name: "ENABLE_ACCESSSPEC", fields: fields(u("AccessSpecID", 32))},
+	EnableAccessSpecResponse:  {name: "ENABLE_ACCESSSPEC_RESPONSE"},
+	DisableAccessSpec:         {name: "DISABLE_ACCESSSPEC", fields: fields(u("AccessSpecID", 32))},
+	DisableAccessSpecResponse: {name: "DISABLE_ACCESSSPEC_RESPONSE"},
+	GetAccessSpecs:            {name: "GET_ACCESSSPECS"},
+	GetAccessSpecsResponse:    {name: "GET_ACCESSSPECS_RESPONSE"},
+	ClientRequestOp:           {name: "CLIENT_REQUEST_OP"},
+	ClientRequestOpResponse:   {name: "CLIENT_REQUEST_OP_RESPONSE"},
+	GetReport:                 {name: "GET_REPORT"},
+	ROAccessReport:            {name: "RO_ACCESS_REPORT"},
+	Keepalive:                 {name: "KEEPALIVE"},
+	KeepaliveAck:              {name: "KEEPALIVE_ACK"},
+	ReaderEventNotification:   {name: "READER_EVENT_NOTIFICATION"},
+	EnableEventsAndReports:    {name: "ENABLE_EVENTS_AND_REPORTS"},
+	ErrorMessage:              {name: "ERROR_MESSAGE"},
+	CustomMessage: {name: "CUSTOM_MESSAGE", fields: fields(
+		u("VendorIdentifier", 32), u("MessageSubtype", 8), rest("Data"))},
+}
+
+// parameterSchemas lists the fixed fields of each LLRP parameter; any bytes
+// left after the fields of a TLV parameter are decoded as sub-parameters
+var parameterSchemas = map[uint16]schema{
+	// TV-encoded parameters
+	AntennaID:                {name: "AntennaID", fields: fields(u("AntennaID", 16)), tvLength: 2},
+	FirstSeenTimestampUTC:    {name: "FirstSeenTimestampUTC", fields: fields(u("Microseconds", 64)), tvLength: 8},
+	FirstSeenTimestampUptime: {name: "FirstSeenTimestampUptime", fields: fields(u("Microseconds", 64)), tvLength: 8},
+	LastSeenTimestampUTC:     {name: "LastSeenTimestampUTC", fields: fields(u("Microseconds", 64)), tvLength: 8},
+	LastSeenTimestampUptime:  {name: "LastSeenTimestampUptime", fields: fields(u("Microseconds", 64)), tvLength: 8},
+	PeakRSSI:                 {name: "PeakRSSI", fields: fields(s("PeakRSSI", 8)), tvLength: 1},
+	ChannelIndex:             {name: "ChannelIndex", fields: fields(u("ChannelIndex", 16)), tvLength: 2},
+	TagSeenCount:             {name: "TagSeenCount", fields: fields(u("TagCount", 16)), tvLength: 2},
+	ROSpecID:                 {name: "ROSpecID", fields: fields(u("ROSpecID", 32)), tvLength: 4},
+	InventoryParameterSpecID: {name: "InventoryParameterSpecID", fields: fields(u("InventoryParameterSpecID", 16)), tvLength: 2},
+	C1G2CRC:                  {name: "C1G2_CRC", fields: fields(u("CRC", 16)), tvLength: 2},
+	C1G2PC:                   {name: "C1G2_PC", fields: fields(u("PC_Bits", 16)), tvLength: 2},
+	EPC96:                    {name: "EPC-96", fields: fields(fixed("EPC", 12)), tvLength: 12},
+	SpecIndex:                {name: "SpecIndex", fields: fields(u("SpecIndex", 16)), tvLength: 2},
+	15:                       {name: "ClientRequestOpSpecResult", fields: fields(u("OpSpecID", 16)), tvLength: 2},
+	AccessSpecID:             {name: "AccessSpecID", fields: fields(u("AccessSpecID", 32)), tvLength: 4},
+	OpSpecID:                 {name: "OpSpecID", fields: fields(u("OpSpecID", 16)), tvLength: 2},
+	18:                       {name: "C1G2SingulationDetails", fields: fields(u("NumCollisionSlots", 16), u("NumEmptySlots", 16)), tvLength: 4},
+	19:                       {name: "C1G2XPCW1", fields: fields(u("XPC_W1", 16)), tvLength: 2},
+	20:                       {name: "C1G2XPCW2", fields: fields(u("XPC_W2", 16)), tvLength: 2},
+
+	// TLV-encoded parameters
+	UTCTimestamp: {name: "UTCTimestamp", fields: fields(u("Microseconds", 64))},
+	Uptime:       {name: "Uptime", fields: fields(u("Microseconds", 64))},
+	GeneralDeviceCapabilities: {name: "GeneralDeviceCapabilities", fields: fields(
+		u("MaxNumberOfAntennaSupported", 16), u("CanSetAntennaProperties", 1), u("HasUTCClockCapability", 1), rsv(14),
+		u("DeviceManufacturerName", 32), u("ModelName", 32), utf8v("ReaderFirmwareVersion"))},
+	ReceiveSensitivityEntry: {name: "ReceiveSensitivityTableEntry", fields: fields(u("Index", 16), s("ReceiveSensitivityValue", 16))},
+	140:                     {name: "PerAntennaAirProtocol", fields: fields(u("AntennaID", 16), u8v("ProtocolID"))},
+	GPIOCapabilities:        {name: "GPIOCapabilities", fields: fields(u("NumGPIs", 16), u("NumGPOs", 16))},
+	LLRPCapabilities: {name: "LLRPCapabilities", fields: fields(
+		u("CanDoRFSurvey", 1), u("CanReportBufferFillWarning", 1), u("SupportsClientRequestOpSpec", 1),
+		u("CanDoTagInventoryStateAwareSingulation", 1), u("SupportsEventAndReportHolding", 1), rsv(3),
+		u("MaxNumPriorityLevelsSupported", 8), u("ClientRequestOpSpecTimeout", 16), u("MaxNumROSpecs", 32),
+		u("MaxNumSpecsPerROSpec", 32), u("MaxNumInventoryParameterSpecsPerAISpec", 32),
+		u("MaxNumAccessSpecs", 32), u("MaxNumOpSpecsPerAccessSpec", 32))},
+	RegulatoryCapabilities:  {name: "RegulatoryCapabilities", fields: fields(u("CountryCode", 16), u("CommunicationsStandard", 16))},
+	144:                     {name: "UHFBandCapabilities"},
+	TransmitPowerLevelEntry: {name: "TransmitPowerLevelTableEntry", fields: fields(u("Index", 16), s("TransmitPowerValue", 16))},
+	146:                     {name: "FrequencyInformation", fields: fields(u("Hopping", 1), rsv(7))},
+	147:                     {name: "FrequencyHopTable", fields: fields(u("HopTableID", 8), rsv(8), u32v("Frequency"))},
+	148:                     {name: "FixedFrequencyTable", fields: fields(u32v("Frequency"))},
+	149: {name: "PerAntennaReceiveSensitivityRange", fields: fields(
+		u("AntennaID", 16), u("ReceiveSensitivityIndexMin", 16), u("ReceiveSensitivityIndexMax", 16))},
+	ROSpec:               {name: "ROSpec", fields: fields(u("ROSpecID", 32), u("Priority", 8), u("CurrentState", 8))},
+	ROBoundarySpec:       {name: "ROBoundarySpec"},
+	ROSpecStartTrigger:   {name: "ROSpecStartTrigger", fields: fields(u("ROSpecStartTriggerType", 8))},
+	PeriodicTriggerValue: {name: "PeriodicTriggerValue", fields: fields(u("Offset", 32), u("Period", 32))},
+	181:                  {name: "GPITriggerValue", fields: fields(u("GPIPortNum", 16), u("GPIEvent", 1), rsv(7), u("Timeout", 32))},
+	ROSpecStopTrigger:    {name: "ROSpecStopTrigger", fields: fields(u("ROSpecStopTriggerType", 8), u("DurationTriggerValue", 32))},
+	AISpec:               {name: "AISpec", fields: fields(u16v("AntennaIDs"))},
+	AISpecStopTrigger:    {name: "AISpecStopTrigger", fields: fields(u("AISpecStopTriggerType", 8), u("DurationTrigger", 32))},
+	185: {name: "TagObservationTrigger", fields: fields(
+		u("TriggerType", 8), rsv(8), u("NumberOfTags", 16), u("NumberOfAttempts", 16), u("T", 16), u("Timeout", 32))},
+	InventoryParameterSpec: {name: "InventoryParameterSpec", fields: fields(u("InventoryParameterSpecID", 16), u("ProtocolID", 8))},
+	187:                    {name: "RFSurveySpec", fields: fields(u("AntennaID", 16), u("StartFrequency", 32), u("EndFrequency", 32))},
+	188:                    {name: "RFSurveySpecStopTrigger", fields: fields(u("StopTriggerType", 8), u("DurationPeriod", 32), u("N", 32))},
+	AccessSpec: {name: "AccessSpec", fields: fields(
+		u("AccessSpecID", 32), u("AntennaID", 16), u("ProtocolID", 8), u("CurrentState", 1), rsv(7), u("ROSpecID", 32))},
+	AccessSpecStopTrigger: {name: "AccessSpecStopTrigger", fields: fields(u("AccessSpecStopTrigger", 8), u("OperationCountValue", 16))},
+	AccessCommand:         {name: "AccessCommand"},
+	210:                   {name: "ClientRequestOpSpec", fields: fields(u("OpSpecID", 16))},
+	211:                   {name: "ClientRequestResponse", fields: fields(u("AccessSpecID", 32))},
+	217:                   {name: "LLRPConfigurationStateValue", fields: fields(u("LLRPConfigurationStateValue", 32))},
+	Identification:        {name: "Identification", fields: fields(u("IDType", 8), u8v("ReaderID"))},
+	GPOWriteData:          {name: "GPOWriteData", fields: fields(u("GPOPortNumber", 16), u("GPOData", 1), rsv(7))},
+	KeepaliveSpec:         {name: "KeepaliveSpec", fields: fields(u("KeepaliveTriggerType", 8), u("PeriodicTriggerValue", 32))},
+	AntennaProperties: {name: "AntennaProperties", fields: fields(
+		u("AntennaConnected", 1), rsv(7), u("AntennaID", 16), s("AntennaGain", 16))},
+	AntennaConfiguration: {name: "AntennaConfiguration", fields: fields(u("AntennaID", 16))},
+	RFReceiver:           {name: "RFReceiver", fields: fields(u("ReceiverSensitivity", 16))},
+	RFTransmitter:        {name: "RFTransmitter", fields: fields(u("HopTableID", 16), u("ChannelIndex", 16), u("TransmitPower", 16))},
+	GPIPortCurrentState:  {name: "GPIPortCurrentState", fields: fields(u("GPIPortNum", 16), u("Config", 1), rsv(7), u("State", 8))},
+	EventsAndReports:     {name: "EventsAndReports", fields: fields(u("HoldEventsAndReportsUponReconnect", 1), rsv(7))},
+	ROReportSpec:         {name: "ROReportSpec", fields: fields(u("ROReportTrigger", 8), u("N", 16))},
+	TagReportContentSelector: {name: "TagReportContentSelector", fields: fields(
+		u("EnableROSpecID", 1), u("EnableSpecIndex", 1), u("EnableInventoryParameterSpecID", 1),
+		u("EnableAntennaID", 1), u("EnableChannelIndex", 1), u("EnablePeakRSSI", 1),
+		u("EnableFirstSeenTimestamp", 1), u("EnableLastSeenTimestamp", 1), u("EnableTagSeenCount", 1),
+		u("EnableAccessSpecID", 1), rsv(6))},
+	AccessReportSpec:            {name: "AccessReportSpec", fields: fields(u("AccessReportTrigger", 8))},
+	TagReportData:               {name: "TagReportData"},
+	EPCData:                     {name: "EPCData", fields: fields(bitArray("EPC"))},
+	242:                         {name: "RFSurveyReportData"},
+	243:                         {name: "FrequencyRSSILevelEntry", fields: fields(u("Frequency", 32), u("Bandwidth", 32), s("AverageRSSI", 8), s("PeakRSSI", 8))},
+	ReaderEventNotificationSpec: {name: "ReaderEventNotificationSpec"},
+	EventNotificationState:      {name: "EventNotificationState", fields: fields(u("EventType", 16), u("NotificationState", 1), rsv(7))},
+	ReaderEventNotificationData: {name: "ReaderEventNotificationData"},
+	247:                         {name: "HoppingEvent", fields: fields(u("HopTableID", 16), u("NextChannelIndex", 16))},
+	GPIEvent:                    {name: "GPIEvent", fields: fields(u("GPIPortNumber", 16), u("GPIEvent", 1), rsv(7))},
+	ROSpecEvent:                 {name: "ROSpecEvent", fields: fields(u("EventType", 8), u("ROSpecID", 32), u("PreemptingROSpecID", 32))},
+	250:                         {name: "ReportBufferLevelWarningEvent", fields: fields(u("ReportBufferPercentageFull", 8))},
+	251:                         {name: "ReportBufferOverflowErrorEvent"},
+	ReaderExceptionEvent:        {name: "ReaderExceptionEvent", fields: fields(utf8v("Message"))},
+	253:                         {name: "RFSurveyEvent", fields: fields(u("EventType", 8), u("ROSpecID", 32), u("SpecIndex", 16))},
+	AISpecEvent:                 {name: "AISpecEvent", fields: fields(u("EventType", 8), u("ROSpecID", 32), u("SpecIndex", 16))},
+	AntennaEvent:                {name: "AntennaEvent", fields: fields(u("EventType", 8), u("AntennaID", 16))},
+	ConnectionAttemptEvent:      {name: "ConnectionAttemptEvent", fields: fields(u("Status", 16))},
+	ConnectionCloseEvent:        {name: "ConnectionCloseEvent"},
+	LLRPStatus:                  {name: "LLRPStatus", fields: fields(u("StatusCode", 16), utf8v("ErrorDescription"))},
+	FieldError:                  {name: "FieldError", fields: fields(u("FieldNum", 16), u("ErrorCode", 16))},
+	ParameterError:              {name: "ParameterError", fields: fields(u("ParameterType", 16), u("ErrorCode", 16))},
+	C1G2LLRPCapabilities: {name: "C1G2LLRPCapabilities", fields: fields(
+		u("CanSupportBlockErase", 1), u("CanSupportBlockWrite", 1), rsv(6), u("MaxNumSelectFiltersPerQuery", 16))},
+	328: {name: "UHFC1G2RFModeTable"},
+	329: {name: "UHFC1G2RFModeTableEntry", fields: fields(
+		u("ModeIdentifier", 32), u("DRValue", 1), u("EPCHAGTCConformance", 1), rsv(6), u("MValue", 8),
+		u("ForwardLinkModulation", 8), u("SpectralMaskIndicator", 8), u("BDRValue", 32), u("PIEValue", 32),
+		u("MinTariValue", 32), u("MaxTariValue", 32), u("StepTariValue", 32))},
+	C1G2InventoryCommand: {name: "C1G2InventoryCommand", fields: fields(u("TagInventoryStateAware", 1), rsv(7))},
+	331:                  {name: "C1G2Filter", fields: fields(u("T", 2), rsv(6))},
+	332:                  {name: "C1G2TagInventoryMask", fields: fields(u("MB", 2), rsv(6), u("Pointer", 16), bitArray("TagMask"))},
+	333:                  {name: "C1G2TagInventoryStateAwareFilterAction", fields: fields(u("Target", 8), u("Action", 8))},
+	334:                  {name: "C1G2TagInventoryStateUnawareFilterAction", fields: fields(u("Action", 8))},
+	335:                  {name: "C1G2RFControl", fields: fields(u("ModeIndex", 16), u("Tari", 16))},
+	336:                  {name: "C1G2SingulationControl", fields: fields(u("Session", 2), rsv(6), u("TagPopulation", 16), u("TagTransitTime", 32))},
+	337:                  {name: "C1G2TagInventoryStateAwareSingulationAction", fields: fields(u("I", 1), u("S", 1), rsv(6))},
+	C1G2TagSpec:          {name: "C1G2TagSpec"},
+	C1G2TargetTag: {name: "C1G2TargetTag", fields: fields(
+		u("MB", 2), u("Match", 1), rsv(5), u("Pointer", 16), bitArray("TagMask"), bitArray("TagData"))},
+	C1G2Read: {name: "C1G2Read", fields: fields(
+		u("OpSpecID", 16), u("AccessPassword", 32), u("MB", 2), rsv(6), u("WordPointer", 16), u("WordCount", 16))},
+	C1G2Write: {name: "C1G2Write", fields: fields(
+		u("OpSpecID", 16), u("AccessPassword", 32), u("MB", 2), rsv(6), u("WordPointer", 16), u16v("WriteData"))},
+	343: {name: "C1G2Kill", fields: fields(u("OpSpecID", 16), u("KillPassword", 32))},
+	344: {name: "C1G2Lock", fields: fields(u("OpSpecID", 16), u("AccessPassword", 32))},
+	345: {name: "C1G2LockPayload", fields: fields(u("Privilege", 8), u("DataField", 8))},
+	346: {name: "C1G2BlockErase", fields: fields(
+		u("OpSpecID", 16), u("AccessPassword", 32), u("MB", 2), rsv(6), u("WordPointer", 16), u("WordCount", 16))},
+	347: {name: "C1G2BlockWrite", fields: fields(
+		u("OpSpecID", 16), u("AccessPassword", 32), u("MB", 2), rsv(6), u("WordPointer", 16), u16v("WriteData"))},
+	C1G2EPCMemorySelector: {name: "C1G2EPCMemorySelector", fields: fields(u("EnableCRC", 1), u("EnablePCBits", 1), rsv(6))},
+	C1G2ReadOpSpecResult:  {name: "C1G2ReadOpSpecResult", fields: fields(u("Result", 8), u("OpSpecID", 16), u16v("ReadData"))},
+	C1G2WriteOpSpecResult: {name: "C1G2WriteOpSpecResult", fields: fields(u("Result", 8), u("OpSpecID", 16), u("NumWordsWritten", 16))},
+	351:                   {name: "C1G2KillOpSpecResult", fields: fields(u("Result", 8), u("OpSpecID", 16))},
+	352:                   {name: "C1G2LockOpSpecResult", fields: fields(u("Result", 8), u("OpSpecID", 16))},
+	353:                   {name: "C1G2BlockEraseOpSpecResult", fields: fields(u("Result", 8), u("OpSpecID", 16))},
+	354:                   {name: "C1G2BlockWriteOpSpecResult", fields: fields(u("Result", 8), u("OpSpecID", 16), u("NumWordsWritten", 16))},
+	Custom:                {name: "Custom", fields: fields(u("VendorIdentifier", 32), u("ParameterSubtype", 32), rest("Data"))},
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Entry is a field value flattened to its dotted parameter path
+type Entry struct {
+	Path  string
+	Value string
+}
+
+// Field returns the value of the named field
+func (m *Message) Field(name string) (interface{}, bool) {
+	return lookup(m.Fields, name)
+}
+
+// Field returns the value of the named field
+func (p *Parameter) Field(name string) (interface{}, bool) {
+	return lookup(p.Fields, name)
+}
+
+// Uint returns the named integer field, or 0 when it is missing
+func (p *Parameter) Uint(name string) uint64 {
+	v, _ := p.Field(name)
+	n, _ := toUint64(v)
+	return n
+}
+
+// Int returns the named signed field, or 0 when it is missing
+func (p *Parameter) Int(name string) int64 {
+	v, _ := p.Field(name)
+	return int64(asUint(v))
+}
+
+// Bool returns the named 1-bit field
+func (p *Parameter) Bool(name string) bool {
+	v, _ := p.Field(name)
+	b, _ := v.(bool)
+	return b
+}
+
+// SetField sets or replaces the named field
+func (p *Parameter) SetField(name string, v interface{}) *Parameter {
+	p.Fields = set(p.Fields, name, v)
+	return p
+}
+
+// SetField sets or replaces the named field
+func (m *Message) SetField(name string, v interface{}) *Message {
+	m.Fields = set(m.Fields, name, v)
+	return m
+}
+
+// Add appends sub-parameters
+func (p *Parameter) Add(ps ...*Parameter) *Parameter {
+	p.Parameters = append(p.Parameters, ps...)
+	return p
+}
+
+// Add appends parameters
+func (m *Message) Add(ps ...*Parameter) *Message {
+	m.Parameters = append(m.Parameters, ps...)
+	return m
+}
+
+// Find returns every parameter of type t in the message, depth-first
+func (m *Message) Find(t uint16) []*Parameter {
+	return Find(m.Parameters, t)
+}
+
+// Find returns every sub-parameter of type t, depth-first
+func (p *Parameter) Find(t uint16) []*Parameter {
+	return Find(p.Parameters, t)
+}
+
+// First returns the first parameter of type t in the message or nil
+func (m *Message) First(t uint16) *Parameter {
+	if ps := m.Find(t); len(ps) != 0 {
+		return ps[0]
+	}
+	return nil
+}
+
+// First returns the first sub-parameter of type t or nil
+func (p *Parameter) First(t uint16) *Parameter {
+	if ps := p.Find(t); len(ps) != 0 {
+		return ps[0]
+	}
+	return nil
+}
+
+// Find returns every parameter of type t in ps and their descendants
+func Find(ps []*Parameter, t uint16) []*Parameter {
+	var found []*Parameter
+	for _, p := range ps {
+		if p.Type == t {
+			found = append(found, p)
+		}
+		found = append(found, Find(p.Parameters, t)...)
+	}
+	return found
+}
+
+// EPC returns the EPC of a TagReportData parameter
+func EPC(trd *Parameter) []byte {
+	if p := trd.First(EPCData); p != nil {
+		v, _ := p.Field("EPC")
+		b, _ := v.([]byte)
+		return b
+	}
+	if p := trd.First(EPC96); p != nil {
+		v, _ := p.Field("EPC")
+		b, _ := v.([]byte)
+		return b
+	}
+	return nil
+}
+
+// Status returns the LLRPStatus code and description of a response
+func (m *Message) Status() (uint64, string) {
+	for _, p := range m.Parameters {
+		if p.Type == LLRPStatus {
+			v, _ := p.Field("ErrorDescription")
+			desc, _ := v.(string)
+			return p.Uint("StatusCode"), desc
+		}
+	}
+	return StatusSuccess, ""
+}
+
+// Flatten lists every field of the message as path and value pairs,
+// leaving out the parameters for which skip returns true
+func (m *Message) Flatten(skip func(p *Parameter) bool) []Entry {
+	entries := flattenFields("", m.Fields)
+	if m.Raw != nil {
+		entries = append(entries, Entry{"Raw", hex.EncodeToString(m.Raw)})
+	}
+	return append(entries, flattenParameters("", m.Parameters, skip)...)
+}
+
+// Flatten lists every field of the parameter and its sub-parameters
+func (p *Parameter) Flatten(skip func(p *Parameter) bool) []Entry {
+	return flattenParameters("", []*Parameter{p}, skip)
+}
+
+func flattenParameters(prefix string, ps []*Parameter, skip func(p *Parameter) bool) []Entry {
+	var entries []Entry
+	count := map[string]int{}
+	for _, p := range ps {
+		count[p.Name]++
+	}
+	index := map[string]int{}
+	for _, p := range ps {
+		index[p.Name]++
+		if skip != nil && skip(p) {
+			continue
+		}
+		path := prefix + p.Name
+		if count[p.Name] > 1 {
+			path += "[" + strconv.Itoa(index[p.Name]) + "]"
+		}
+		entries = append(entries, Entry{path, ""})
+		entries = append(entries, flattenFields(path+".", p.Fields)...)
+		if p.Raw != nil {
+			entries = append(entries, Entry{path + ".Raw", hex.EncodeToString(p.Raw)})
+		}
+		entries = append(entries, flattenParameters(path+".", p.Parameters, skip)...)
+	}
+	return entries
+}
+
+func flattenFields(prefix string, fields []Field) []Entry {
+	entries := make([]Entry, 0, len(fields))
+	for _, f := range fields {
+		entries = append(entries, Entry{prefix + f.Name, FormatValue(f.Value)})
+	}
+	return entries
+}
+
+// FormatValue renders a field value for display; byte slices are shown in
+// hex
+func FormatValue(v interface{}) string {
+	switch t := v.(type) {
+	case []byte:
+		return hex.EncodeToString(t)
+	case string:
+		return strconv.Quote(t)
+	}
+	return fmt.Sprint(v)
+}
+
+func lookup(fields []Field, name string) (interface{}, bool) {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+func set(fields []Field, name string, v interface{}) []Field {
+	for i, f := range fields {
+		if f.Name == name {
+			fields[i].Value = v
+			return fields
+		}
+	}
+	return append(fields, Field{name, v})
+}
+
+func asUint(v interface{}) uint64 {
+	n, _ := toUint64(v)
+	return n
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// sessionEvent is a recorded message normalized for comparison;
+// consecutive RO_ACCESS_REPORTs are merged into a single event
+type sessionEvent struct {
+	Index   int
+	From    string
+	Name    string
+	ID      uint32
+	Count   int
+	Entries []codec.Entry
+	Tags    map[string]bool
+}
+
+// timestampParameters are left out of a comparison unless --timestamps
+var timestampParameters = map[uint16]bool{
+	codec.UTCTimestamp:             true,
+	codec.Uptime:                   true,
+	codec.FirstSeenTimestampUTC:    true,
+	codec.FirstSeenTimestampUptime: true,
+	codec.LastSeenTimestampUTC:     true,
+	codec.LastSeenTimestampUptime:  true,
+}
+
+func (e *sessionEvent) key() string {
+	return e.From + " " + e.Name
+}
+
+func (e *sessionEvent) String() string {
+	s := fmt.Sprintf("#%v %v %v", e.Index, e.From, e.Name)
+	if *diffIDs {
+		s += fmt.Sprintf(" (id %v)", e.ID)
+	}
+	if e.Tags != nil {
+		s += fmt.Sprintf(" (%v messages, %v tags)", e.Count, len(e.Tags))
+	}
+	return s
+}
+
+// loadSessionEvents reads a recording and normalizes it into events
+func loadSessionEvents(path string) ([]*sessionEvent, error) {
+	records, err := loadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	ignored := map[string]bool{}
+	for _, name := range *diffIgnore {
+		ignored[name] = true
+	}
+	skip := func(p *codec.Parameter) bool {
+		if p.Type == codec.TagReportData || ignored[p.Name] {
+			return true
+		}
+		return !*diffTimestamps && timestampParameters[p.Type]
+	}
+
+	var events []*sessionEvent
+	for i, rec := range records {
+		m, err := rec.Message()
+		if err != nil {
+			log.Printf("%v:%v: %v", path, i+1, err)
+			m = &codec.Message{Name: rec.Type, ID: rec.ID}
+		}
+		if m.Type == codec.ROAccessReport && len(events) != 0 {
+			if last := events[len(events)-1]; last.Tags != nil && last.From == rec.From {
+				last.Count++
+				for _, trd := range m.Find(codec.TagReportData) {
+					last.Tags[hex.EncodeToString(codec.EPC(trd))] = true
+				}
+				continue
+			}
+		}
+		e := &sessionEvent{Index: i + 1, From: rec.From, Name: m.Name, ID: m.ID, Count: 1}
+		for _, entry := range m.Flatten(skip) {
+			if ignored[entry.Path[strings.LastIndex(entry.Path, ".")+1:]] {
+				continue
+			}
+			e.Entries = append(e.Entries, entry)
+		}
+		if m.Type == codec.ROAccessReport {
+			e.Tags = map[string]bool{}
+			for _, trd := range m.Find(codec.TagReportData) {
+				e.Tags[hex.EncodeToString(codec.EPC(trd))] = true
+			}
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// diffOp is a single step of an edit script between two event sequences
+type diffOp struct {
+	Kind byte // '=', '-' or '+'
+	A, B int
+}
+
+// diffMaxEdits bounds the edits searched on each side of a split of the
+// edit script; a part of the sessions that differs more is reported as
+// removed and added as a whole
+const diffMaxEdits = 1000
+
+// diffEvents aligns two event sequences by sender and message type with
+// the linear space Myers algorithm, so that long sessions that diverge
+// early don't need a frontier per edit
+func diffEvents(a, b []*sessionEvent) []diffOp {
+	s := &eventScript{}
+	for _, e := range a {
+		s.a = append(s.a, e.key())
+	}
+	for _, e := range b {
+		s.b = append(s.b, e.key())
+	}
+	s.diff(0, len(a), 0, len(b))
+	return s.ops
+}
+
+// eventScript is the edit script between the keys of two event sequences
+type eventScript struct {
+	a, b []string
+	ops  []diffOp
+}
+
+// diff appends the edit script of a[a0:a1] and b[b0:b1]
+func (s *eventScript) diff(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && s.a[a0] == s.b[b0] {
+		s.ops = append(s.ops, diffOp{'=', a0, b0})
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a0 < a1-suffix && b0 < b1-suffix && s.a[a1-suffix-1] == s.b[b1-suffix-1] {
+		suffix++
+	}
+	a1, b1 = a1-suffix, b1-suffix
+	switch {
+	case a0 == a1:
+		for y := b0; y < b1; y++ {
+			s.ops = append(s.ops, diffOp{'+', a0, y})
+		}
+	case b0 == b1:
+		for x := a0; x < a1; x++ {
+			s.ops = append(s.ops, diffOp{'-', x, b0})
+		}
+	default:
+		x, y := s.middle(a0, a1, b0, b1)
+		s.diff(a0, x, b0, y)
+		s.diff(x, a1, y, b1)
+	}
+	for i := 0; i < suffix; i++ {
+		s.ops = append(s.ops, diffOp{'=', a1 + i, b1 + i})
+	}
+}
+
+// middle returns where the forward and the reverse Myers paths of
+// a[a0:a1] and b[b0:b1] meet, which splits their edit script in two
+func (s *eventScript) middle(a0, a1, b0, b1 int) (int, int) {
+	n, m := a1-a0, b1-b0
+	max := (n + m + 1) / 2
+	// the furthest x of the diagonals k, offset by max, forward and in
+	// reverse from the ends
+	fwd, rev := make([]int, 2*max+2), make([]int, 2*max+2)
+	for i := range fwd {
+		fwd[i], rev[i] = -1, -1
+	}
+	fwd[max+1], rev[max+1] = 0, 0
+	delta := n - m
+	odd := delta%2 != 0
+	for d := 0; d < max && d < diffMaxEdits; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && fwd[max+k-1] < fwd[max+k+1]) {
+				x = fwd[max+k+1]
+			} else {
+				x = fwd[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && s.a[a0+x] == s.b[b0+y] {
+				x++
+				y++
+			}
+			fwd[max+k] = x
+			if x > n || y > m || !odd {
+				continue
+			}
+			// the reverse path on the same diagonal got past it
+			if r := max + delta - k; r >= 0 && r < len(rev) && rev[r] != -1 && x >= n-rev[r] {
+				return a0 + x, b0 + y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && rev[max+k-1] < rev[max+k+1]) {
+				x = rev[max+k+1]
+			} else {
+				x = rev[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && s.a[a1-x-1] == s.b[b1-y-1] {
+				x++
+				y++
+			}
+			rev[max+k] = x
+			if x > n || y > m || odd {
+				continue
+			}
+			if f := max + delta - k; f >= 0 && f < len(fwd) && fwd[f] != -1 && fwd[f] >= n-x {
+				return a0 + fwd[f], b0 + fwd[f] - (delta - k)
+			}
+		}
+	}
+	// nothing in common, or too different
+	return a1, b0
+}
+
+// diffEntries compares the flattened parameters of two aligned events
+func diffEntries(a, b []codec.Entry) []string {
+	av := map[string]string{}
+	for _, e := range a {
+		av[e.Path] = e.Value
+	}
+	bv := map[string]string{}
+	for _, e := range b {
+		bv[e.Path] = e.Value
+	}
+	var lines []string
+	for _, e := range a {
+		if v, ok := bv[e.Path]; !ok {
+			lines = append(lines, fmt.Sprintf("    - %v %v", e.Path, e.Value))
+		} else if v != e.Value {
+			lines = append(lines, fmt.Sprintf("    ~ %v: %v -> %v", e.Path, e.Value, v))
+		}
+	}
+	for _, e := range b {
+		if _, ok := av[e.Path]; !ok {
+			lines = append(lines, fmt.Sprintf("    + %v %v", e.Path, e.Value))
+		}
+	}
+	return lines
+}
+
+// diffTags compares two tag sets
+func diffTags(a, b map[string]bool) []string {
+	var lines []string
+	for _, epc := range sortedKeys(a) {
+		if !b[epc] {
+			lines = append(lines, "    - tag "+epc)
+		}
+	}
+	for _, epc := range sortedKeys(b) {
+		if !a[epc] {
+			lines = append(lines, "    + tag "+epc)
+		}
+	}
+	return lines
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diff mode
+func runDiff() int {
+	a, err := loadSessionEvents(*diffA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := loadSessionEvents(*diffB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("--- %v (%v events)\n+++ %v (%v events)\n", *diffA, len(a), *diffB, len(b))
+	onlyA, onlyB, changed, tagged := 0, 0, 0, 0
+	allA, allB := map[string]bool{}, map[string]bool{}
+	for _, op := range diffEvents(a, b) {
+		switch op.Kind {
+		case '-':
+			fmt.Printf("- %v\n", a[op.A])
+			onlyA++
+		case '+':
+			fmt.Printf("+ %v\n", b[op.B])
+			onlyB++
+		case '=':
+			ea, eb := a[op.A], b[op.B]
+			lines := diffEntries(ea.Entries, eb.Entries)
+			if *diffIDs && ea.ID != eb.ID {
+				lines = append(lines, fmt.Sprintf("    ~ MessageID: %v -> %v", ea.ID, eb.ID))
+			}
+			if len(lines) != 0 {
+				changed++
+			}
+			if tags := diffTags(ea.Tags, eb.Tags); len(tags) != 0 {
+				lines = append(lines, tags...)
+				tagged++
+			}
+			if len(lines) != 0 {
+				fmt.Printf("~ %v | #%v\n%v\n", ea, eb.Index, strings.Join(lines, "\n"))
+			}
+		}
+	}
+	for _, e := range a {
+		for epc := range e.Tags {
+			allA[epc] = true
+		}
+	}
+	for _, e := range b {
+		for epc := range e.Tags {
+			allB[epc] = true
+		}
+	}
+	tags := diffTags(allA, allB)
+	if len(tags) != 0 {
+		fmt.Printf("~ tags seen over the whole session\n%v\n", strings.Join(tags, "\n"))
+	}
+
+	fmt.Printf("%v only in a, %v only in b, %v with different parameters, %v with different tag sets\n",
+		onlyA, onlyB, changed, tagged)
+	if onlyA+onlyB+changed+tagged+len(tags) != 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// responseProfile summarizes how a reader answered one type of request
+type responseProfile struct {
+	Requests   int
+	Missing    int
+	Unechoed   int
+	Statuses   map[string]int
+	Parameters map[string]bool
+}
+
+// reportBurstGap is the longest gap between the RO_ACCESS_REPORTs of one
+// burst, e.g. the reports of the tags read in one cycle
+const reportBurstGap = 20 * time.Millisecond
+
+// sessionProfile summarizes the reader behavior in a recording
+type sessionProfile struct {
+	Responses map[string]*responseProfile
+	// ReportIntervals are between the first reports of successive bursts,
+	// BurstSpacings between the reports within a burst
+	ReportIntervals    []float64
+	BurstSpacings      []float64
+	KeepaliveIntervals []float64
+	SeenCounts         []float64
+	RSSI               []float64
+	TagReports         int
+	TagParameters      map[string]int
+}
+
+// unsolicited messages are never a response to a client request
+var unsolicited = map[uint16]bool{
+	codec.ROAccessReport:          true,
+	codec.Keepalive:               true,
+	codec.ReaderEventNotification: true,
+}
+
+var pathIndex = regexp.MustCompile(`\[\d+\]`)
+
+// loadSessionProfile reads a recording and profiles the reader side
+func loadSessionProfile(path string) (*sessionProfile, error) {
+	records, err := loadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	sp := &sessionProfile{
+		Responses:     map[string]*responseProfile{},
+		TagParameters: map[string]int{},
+	}
+	type request struct {
+		name string
+		id   uint32
+	}
+	// the state of each recorded connection
+	type session struct {
+		pending                          []request
+		burst, lastReport, lastKeepalive time.Time
+	}
+	sessions := map[string]*session{}
+	var conns []string
+	for i, rec := range records {
+		m, err := rec.Message()
+		if err != nil {
+			log.Printf("%v:%v: %v", path, i+1, err)
+			continue
+		}
+		ss, ok := sessions[rec.Conn]
+		if !ok {
+			ss = &session{}
+			sessions[rec.Conn] = ss
+			conns = append(conns, rec.Conn)
+		}
+		if rec.From == "client" {
+			if m.Type == codec.KeepaliveAck {
+				continue
+			}
+			rp, ok := sp.Responses[m.Name]
+			if !ok {
+				rp = &responseProfile{Statuses: map[string]int{}, Parameters: map[string]bool{}}
+				sp.Responses[m.Name] = rp
+			}
+			rp.Requests++
+			ss.pending = append(ss.pending, request{m.Name, m.ID})
+			continue
+		}
+
+		switch m.Type {
+		case codec.ROAccessReport:
+			switch {
+			case ss.lastReport.IsZero():
+				ss.burst = rec.Time
+			case rec.Time.Sub(ss.lastReport) <= reportBurstGap:
+				sp.BurstSpacings = append(sp.BurstSpacings, rec.Time.Sub(ss.lastReport).Seconds()*1000)
+			default:
+				sp.ReportIntervals = append(sp.ReportIntervals, rec.Time.Sub(ss.burst).Seconds()*1000)
+				ss.burst = rec.Time
+			}
+			ss.lastReport = rec.Time
+			for _, trd := range m.Find(codec.TagReportData) {
+				sp.TagReports++
+				for _, p := range trd.Parameters {
+					sp.TagParameters[p.Name]++
+				}
+				if p := trd.First(codec.TagSeenCount); p != nil {
+					sp.SeenCounts = append(sp.SeenCounts, float64(p.Uint("TagCount")))
+				}
+				if p := trd.First(codec.PeakRSSI); p != nil {
+					sp.RSSI = append(sp.RSSI, float64(p.Int("PeakRSSI")))
+				}
+			}
+			continue
+		case codec.Keepalive:
+			if !ss.lastKeepalive.IsZero() {
+				sp.KeepaliveIntervals = append(sp.KeepaliveIntervals, rec.Time.Sub(ss.lastKeepalive).Seconds()*1000)
+			}
+			ss.lastKeepalive = rec.Time
+			continue
+		}
+		pending := ss.pending
+		if unsolicited[m.Type] || len(pending) == 0 {
+			continue
+		}
+
+		// match the response by the echoed message ID, or else by its type
+		match := -1
+		echoed := false
+		for j, req := range pending {
+			if req.id == m.ID {
+				match, echoed = j, true
+				break
+			}
+		}
+		for j := 0; match < 0 && j < len(pending); j++ {
+			if pending[j].name+"_RESPONSE" == m.Name {
+				match = j
+			}
+		}
+		if match < 0 {
+			if m.Type != codec.ErrorMessage {
+				continue
+			}
+			match = 0
+		}
+		rp := sp.Responses[pending[match].name]
+		ss.pending = append(pending[:match], pending[match+1:]...)
+		if !echoed {
+			rp.Unechoed++
+		}
+		status := m.Name
+		if m.First(codec.LLRPStatus) != nil {
+			code, _ := m.Status()
+			status = fmt.Sprintf("%v status %v", m.Name, code)
+		}
+		rp.Statuses[status]++
+		for _, e := range m.Flatten(nil) {
+			rp.Parameters[pathIndex.ReplaceAllString(e.Path, "")] = true
+		}
+	}
+	for _, conn := range conns {
+		for _, req := range sessions[conn].pending {
+			sp.Responses[req.name].Missing++
+		}
+	}
+	return sp, nil
+}
+
+// supported reports whether the reader gave a successful answer to at
+// least one request
+func (rp *responseProfile) supported() bool {
+	if rp == nil {
+		return false
+	}
+	for status := range rp.Statuses {
+		if strings.HasSuffix(status, " status 0") {
+			return true
+		}
+	}
+	return false
+}
+
+func (rp *responseProfile) String() string {
+	if rp == nil {
+		return "never requested"
+	}
+	var parts []string
+	for _, status := range sortedKeys(toSet(rp.Statuses)) {
+		parts = append(parts, fmt.Sprintf("%v (%v)", status, rp.Statuses[status]))
+	}
+	if rp.Missing != 0 {
+		parts = append(parts, fmt.Sprintf("no response (%v)", rp.Missing))
+	}
+	if rp.Unechoed != 0 {
+		parts = append(parts, fmt.Sprintf("message ID not echoed (%v)", rp.Unechoed))
+	}
+	return fmt.Sprintf("%v requests: %v", rp.Requests, strings.Join(parts, ", "))
+}
+
+func toSet(m map[string]int) map[string]bool {
+	s := make(map[string]bool, len(m))
+	for k := range m {
+		s[k] = true
+	}
+	return s
+}
+
+// distribution summarizes a sample as count, min, median, p90, max and
+// mean
+func distribution(xs []float64) string {
+	if len(xs) == 0 {
+		return "n=0"
+	}
+	s := append([]float64{}, xs...)
+	sort.Float64s(s)
+	sum := 0.0
+	for _, x := range s {
+		sum += x
+	}
+	q := func(p float64) float64 { return s[int(p*float64(len(s)-1))] }
+	return fmt.Sprintf("n=%v min=%.1f p50=%.1f p90=%.1f max=%.1f mean=%.1f",
+		len(s), s[0], q(0.5), q(0.9), s[len(s)-1], sum/float64(len(s)))
+}
+
+// ksDistance is the two-sample Kolmogorov-Smirnov statistic, the largest
+// gap between the empirical distribution functions of a and b
+func ksDistance(a, b []float64) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return math.NaN()
+	}
+	sa := append([]float64{}, a...)
+	sb := append([]float64{}, b...)
+	sort.Float64s(sa)
+	sort.Float64s(sb)
+	d := 0.0
+	i, j := 0, 0
+	for i < len(sa) && j < len(sb) {
+		x := math.Min(sa[i], sb[j])
+		for i < len(sa) && sa[i] <= x {
+			i++
+		}
+		for j < len(sb) && sb[j] <= x {
+			j++
+		}
+		d = math.Max(d, math.Abs(float64(i)/float64(len(sa))-float64(j)/float64(len(sb))))
+	}
+	return d
+}
+
+func printDistribution(title string, actual, emulated []float64) {
+	fmt.Println(title)
+	fmt.Printf("  real:   %v\n", distribution(actual))
+	fmt.Printf("  golemu: %v\n", distribution(emulated))
+	if d := ksDistance(actual, emulated); !math.IsNaN(d) {
+		fmt.Printf("  KS distance: %.3f\n", d)
+	}
+}
+
+// fidelity mode
+func runFidelity() int {
+	actual, err := loadSessionProfile(*fidelityReal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	emulated, err := loadSessionProfile(*fidelityEmulated)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	requests := map[string]bool{}
+	for name := range actual.Responses {
+		requests[name] = true
+	}
+	for name := range emulated.Responses {
+		requests[name] = true
+	}
+
+	fmt.Println("Responses")
+	var unsupported []string
+	for _, name := range sortedKeys(requests) {
+		rr, er := actual.Responses[name], emulated.Responses[name]
+		fmt.Printf("  %v\n    real:   %v\n    golemu: %v\n", name, rr, er)
+		if rr != nil && er != nil && len(rr.Statuses) != 0 && len(er.Statuses) != 0 {
+			for _, path := range sortedKeys(rr.Parameters) {
+				if !er.Parameters[path] {
+					fmt.Printf("    - %v only in real\n", path)
+				}
+			}
+			for _, path := range sortedKeys(er.Parameters) {
+				if !rr.Parameters[path] {
+					fmt.Printf("    + %v only in golemu\n", path)
+				}
+			}
+		}
+		if rr.supported() && er != nil && !er.supported() {
+			unsupported = append(unsupported, name)
+		}
+	}
+
+	fmt.Println("Unsupported messages")
+	if len(unsupported) == 0 {
+		fmt.Println("  none")
+	}
+	for _, name := range unsupported {
+		fmt.Printf("  %v: real reader succeeded, golemu %v\n", name, emulated.Responses[name])
+	}
+
+	printDistribution("RO_ACCESS_REPORT interval between bursts (ms)", actual.ReportIntervals, emulated.ReportIntervals)
+	printDistribution("RO_ACCESS_REPORT spacing within a burst (ms)", actual.BurstSpacings, emulated.BurstSpacings)
+	printDistribution("KEEPALIVE interval (ms)", actual.KeepaliveIntervals, emulated.KeepaliveIntervals)
+	printDistribution("TagSeenCount", actual.SeenCounts, emulated.SeenCounts)
+	printDistribution("PeakRSSI (dBm)", actual.RSSI, emulated.RSSI)
+
+	fmt.Println("TagReportData contents")
+	names := map[string]bool{}
+	for name := range actual.TagParameters {
+		names[name] = true
+	}
+	for name := range emulated.TagParameters {
+		names[name] = true
+	}
+	ratio := func(sp *sessionProfile, name string) float64 {
+		if sp.TagReports == 0 {
+			return 0
+		}
+		return 100 * float64(sp.TagParameters[name]) / float64(sp.TagReports)
+	}
+	for _, name := range sortedKeys(names) {
+		fmt.Printf("  %-26v real %5.1f%%  golemu %5.1f%%\n", name, ratio(actual, name), ratio(emulated, name))
+	}
+	return 0
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// fixture is a recorded message and what a client test can expect of it
+type fixture struct {
+	Index int
+	// File is the message in the testdata directory
+	File   string `json:",omitempty"`
+	Conn   string
+	From   string
+	Type   uint16
+	Name   string
+	ID     uint32
+	Length int
+	// Status is the LLRPStatus code of a response
+	Status *uint64 `json:",omitempty"`
+	// EPCs are the tags of an RO_ACCESS_REPORT, in order
+	EPCs []string `json:",omitempty"`
+	// Fields are the fields of the message by path, but the TagReportData
+	Fields map[string]string `json:",omitempty"`
+	// Error is why the message couldn't be decoded
+	Error string `json:",omitempty"`
+	frame []byte
+	paths []string
+}
+
+// loadFixtures reads the messages of a recording, only those of --conn if
+// given
+func loadFixtures(path string) ([]*fixture, error) {
+	records, err := loadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	skip := func(p *codec.Parameter) bool { return p.Type == codec.TagReportData }
+	var table []*fixture
+	for _, rec := range records {
+		if *fixtureConn != "" && rec.Conn != *fixtureConn {
+			continue
+		}
+		frame, err := hex.DecodeString(rec.Frame)
+		if err != nil || len(frame) < codec.HeaderSize {
+			return nil, fmt.Errorf("%v: message %v isn't an LLRP frame", path, len(table)+1)
+		}
+		f := &fixture{
+			Index:  len(table) + 1,
+			Conn:   rec.Conn,
+			From:   rec.From,
+			Type:   codec.FrameType(frame),
+			Name:   codec.MessageName(codec.FrameType(frame)),
+			ID:     rec.ID,
+			Length: len(frame),
+			frame:  frame,
+		}
+		m, err := codec.Decode(frame)
+		if err != nil {
+			f.Error = err.Error()
+			table = append(table, f)
+			continue
+		}
+		if m.First(codec.LLRPStatus) != nil {
+			status, _ := m.Status()
+			f.Status = &status
+		}
+		for _, trd := range m.Find(codec.TagReportData) {
+			f.EPCs = append(f.EPCs, hex.EncodeToString(codec.EPC(trd)))
+		}
+		for _, e := range m.Flatten(skip) {
+			if e.Value == "" {
+				continue
+			}
+			if f.Fields == nil {
+				f.Fields = map[string]string{}
+			}
+			f.Fields[e.Path] = e.Value
+			f.paths = append(f.paths, e.Path)
+		}
+		table = append(table, f)
+	}
+	return table, nil
+}
+
+// writeTestdata writes every message as NNNN-FROM-TYPE.llrp to the
+// directory, and the table as expectations.json
+func writeTestdata(dir string, table []*fixture) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, f := range table {
+		f.File = fmt.Sprintf("%04d-%v-%v.llrp", f.Index, f.From, f.Name)
+		if err := ioutil.WriteFile(filepath.Join(dir, f.File), f.frame, 0644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(table, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "expectations.json"), append(data, '\n'), 0644)
+}
+
+// fixtureIdent returns a Go identifier for the table of a recording
+func fixtureIdent(path string) string {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var name []rune
+	upper := false
+	for _, r := range base {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) && len(name) != 0:
+			if upper {
+				r = unicode.ToUpper(r)
+			}
+			name = append(name, r)
+			upper = false
+		default:
+			upper = len(name) != 0
+		}
+	}
+	if len(name) == 0 {
+		return "recording"
+	}
+	name[0] = unicode.ToLower(name[0])
+	return string(name)
+}
+
+// writeGoFixtures writes the fixtures as a table of a Go test file, with a
+// function checking a decoder against them
+func writeGoFixtures(path, source string, table []*fixture) error {
+	name := *fixtureTable
+	if name == "" {
+		name = fixtureIdent(source)
+	}
+	exported := strings.ToUpper(name[:1]) + name[1:]
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by golemu fixtures from %v; DO NOT EDIT.\n\n", filepath.Base(source))
+	fmt.Fprintf(&b, "package %v\n\n", *fixturePackage)
+	fmt.Fprintf(&b, "import \"testing\"\n\n")
+	fmt.Fprintf(&b, "// %vFixture is a recorded LLRP message and what a client can expect of it\n", name)
+	fmt.Fprintf(&b, "type %vFixture struct {\n", name)
+	fmt.Fprintf(&b, "Conn string\nFrom string\nType uint16\nName string\nID uint32\n")
+	fmt.Fprintf(&b, "// Status is the LLRPStatus code of a response, -1 without one\nStatus int\n")
+	fmt.Fprintf(&b, "// EPCs are the tags of an RO_ACCESS_REPORT, in order\nEPCs []string\n")
+	fmt.Fprintf(&b, "// Fields are the fields of the message by path, but the TagReportData\nFields map[string]string\n")
+	fmt.Fprintf(&b, "// Error is why golemu couldn't decode the message, whose Status, EPCs\n// and Fields are unknown\nError string\n")
+	fmt.Fprintf(&b, "Frame []byte\n}\n\n")
+	fmt.Fprintf(&b, "// %vDecoded is what the decoder under test makes of a frame\n", name)
+	fmt.Fprintf(&b, "type %vDecoded struct {\nType uint16\nID uint32\n", name)
+	fmt.Fprintf(&b, "// Status is the LLRPStatus code of a response, -1 without one\nStatus int\n")
+	fmt.Fprintf(&b, "// EPCs are the tags of an RO_ACCESS_REPORT, in order\nEPCs []string\n")
+	fmt.Fprintf(&b, "// Fields are the fields the decoder reports, by the paths of the\n// fixtures; the others aren't checked\nFields map[string]string\n}\n\n")
+	fmt.Fprintf(&b, "// %vFixtures are the messages of %v, in order\n", name, filepath.Base(source))
+	fmt.Fprintf(&b, "var %vFixtures = []%vFixture{\n", name, name)
+	for _, f := range table {
+		status := -1
+		if f.Status != nil {
+			status = int(*f.Status)
+		}
+		fmt.Fprintf(&b, "{\nConn: %q,\nFrom: %q,\nType: %v,\nName: %q,\nID: %v,\nStatus: %v,\n", f.Conn, f.From, f.Type, f.Name, f.ID, status)
+		if f.Error != "" {
+			fmt.Fprintf(&b, "Error: %q,\n", f.Error)
+		}
+		if len(f.EPCs) != 0 {
+			fmt.Fprintf(&b, "EPCs: []string{\n")
+			for _, epc := range f.EPCs {
+				fmt.Fprintf(&b, "%q,\n", epc)
+			}
+			fmt.Fprintf(&b, "},\n")
+		}
+		if len(f.paths) != 0 {
+			fmt.Fprintf(&b, "Fields: map[string]string{\n")
+			for _, p := range f.paths {
+				fmt.Fprintf(&b, "%q: %q,\n", p, f.Fields[p])
+			}
+			fmt.Fprintf(&b, "},\n")
+		}
+		fmt.Fprintf(&b, "Frame: []byte{")
+		for i, c := range f.frame {
+			if i%12 == 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "0x%02x, ", c)
+		}
+		fmt.Fprintf(&b, "\n},\n},\n")
+	}
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "// check%vFixtures runs every recorded frame through the decoder under\n", exported)
+	fmt.Fprintf(&b, "// test and compares what it makes of it with the recording\n")
+	fmt.Fprintf(&b, "func check%vFixtures(t *testing.T, decode func(frame []byte) (*%vDecoded, error)) {\n", exported, name)
+	fmt.Fprintf(&b, `t.Helper()
+for i, f := range %vFixtures {
+d, err := decode(f.Frame)
+if f.Error != "" {
+if err == nil {
+t.Errorf("#%%v %%v: decoded, expected an error: %%v", i+1, f.Name, f.Error)
+}
+continue
+}
+if err != nil {
+t.Errorf("#%%v %%v: %%v", i+1, f.Name, err)
+continue
+}
+if d.Type != f.Type || d.ID != f.ID {
+t.Errorf("#%%v %%v: type %%v and message ID %%v, expected %%v and %%v", i+1, f.Name, d.Type, d.ID, f.Type, f.ID)
+}
+if d.Status != f.Status {
+t.Errorf("#%%v %%v: status %%v, expected %%v", i+1, f.Name, d.Status, f.Status)
+}
+if len(d.EPCs) != len(f.EPCs) {
+t.Errorf("#%%v %%v: %%v EPCs, expected %%v", i+1, f.Name, d.EPCs, f.EPCs)
+} else {
+for j := range f.EPCs {
+if d.EPCs[j] != f.EPCs[j] {
+t.Errorf("#%%v %%v: EPC %%v is %%v, expected %%v", i+1, f.Name, j+1, d.EPCs[j], f.EPCs[j])
+}
+}
+}
+for path, v := range d.Fields {
+if want, ok := f.Fields[path]; !ok {
+t.Errorf("#%%v %%v: unexpected field %%v", i+1, f.Name, path)
+} else if v != want {
+t.Errorf("#%%v %%v: %%v is %%v, expected %%v", i+1, f.Name, path, v, want)
+}
+}
+}
+}
+`, name)
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("invalid Go source: %v", err)
+	}
+	return ioutil.WriteFile(path, src, 0644)
+}
+
+// fixtures mode
+func runFixtures() int {
+	if *fixtureDir == "" && *fixtureGo == "" {
+		log.Fatal("fixtures needs --testdata, --go or both")
+	}
+	if *fixtureTable != "" && !isIdentifier(*fixtureTable) {
+		log.Fatalf("--name %q isn't a Go identifier", *fixtureTable)
+	}
+	table, err := loadFixtures(*fixtureRecording)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(table) == 0 {
+		log.Fatalf("no messages in %v", *fixtureRecording)
+	}
+	if *fixtureDir != "" {
+		if err := writeTestdata(*fixtureDir, table); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %v messages and expectations.json to %v", len(table), *fixtureDir)
+	}
+	if *fixtureGo != "" {
+		if err := writeGoFixtures(*fixtureGo, *fixtureRecording, table); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %v messages to %v", len(table), *fixtureGo)
+	}
+	return 0
+}
+
+// isIdentifier tells whether s is a Go identifier
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/iomz/go-llrp"
+)
+
+// floorPlanExt is the extension of the floor plan files
+const floorPlanExt = ".floor.json"
+
+// the read model: the RSSI at a meter on the boresight, the path loss
+// exponent, and the loss at the edge of the beam
+const (
+	floorRSSIAt1m    = -40.0
+	floorPathLossExp = 2.0
+	floorBeamEdgeDB  = 12.0
+)
+
+// FloorPlan is a site laid out in meters, x to the right and y down, with
+// the readers and their antennas and the tags placed on it
+type FloorPlan struct {
+	Name    string
+	Width   float64
+	Height  float64
+	Readers []FloorReader
+	Tags    []FloorTag
+}
+
+// FloorReader is a reader on the floor plan, identified by its LLRP port
+type FloorReader struct {
+	Name     string
+	Port     int
+	Antennas []FloorAntenna
+}
+
+// FloorAntenna is an antenna port of a reader, its position, the
+// direction it faces in degrees clockwise from the x axis, the width of
+// its beam in degrees and how far it reads in meters
+type FloorAntenna struct {
+	ID          uint16
+	X           float64
+	Y           float64
+	Orientation float64
+	BeamWidth   float64
+	Range       float64
+}
+
+// FloorTag is a tag, or a pallet of tags, at a spot of the floor plan
+type FloorTag struct {
+	Label string
+	X     float64
+	Y     float64
+	Tags  []llrp.TagRecord
+}
+
+// FloorRead is a tag seen by an antenna, with the RSSI of the read model
+type FloorRead struct {
+	Port    int
+	Antenna uint16
+	Label   string
+	PCBits  string
+	EPC     string
+	RSSI    int8
+}
+
+// floorPlanPath returns the file of a floor plan, refusing names that
+// would leave the --floorplans directory
+func floorPlanPath(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid floor plan name %q", name)
+	}
+	return filepath.Join(*floorPlanDir, name+floorPlanExt), nil
+}
+
+// listFloorPlans returns the names of the floor plans
+func listFloorPlans() ([]string, error) {
+	entries, err := ioutil.ReadDir(*floorPlanDir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), floorPlanExt) {
+			names = append(names, strings.TrimSuffix(e.Name(), floorPlanExt))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// loadFloorPlan reads a floor plan
+func loadFloorPlan(name string) (*FloorPlan, error) {
+	path, err := floorPlanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fp := &FloorPlan{}
+	if err := json.Unmarshal(data, fp); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	fp.Name = name
+	return fp, nil
+}
+
+// saveFloorPlan checks and writes a floor plan
+func saveFloorPlan(fp *FloorPlan) error {
+	path, err := floorPlanPath(fp.Name)
+	if err != nil {
+		return err
+	}
+	if err := fp.validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	log.Printf("saved floor plan %v with %v readers and %v tags", fp.Name, len(fp.Readers), len(fp.Tags))
+	return nil
+}
+
+// validate checks the readers, antennas and tags of a floor plan
+func (fp *FloorPlan) validate() error {
+	ports := map[int]bool{}
+	for _, r := range fp.Readers {
+		if r.Port <= 0 || r.Port > 0xffff || ports[r.Port] {
+			return fmt.Errorf("reader %q: invalid or duplicate port %v", r.Name, r.Port)
+		}
+		ports[r.Port] = true
+		ids := map[uint16]bool{}
+		for _, a := range r.Antennas {
+			if a.ID == 0 || int(a.ID) > *antennas || ids[a.ID] {
+				return fmt.Errorf("reader %q: invalid or duplicate antenna %v, the reader has %v", r.Name, a.ID, *antennas)
+			}
+			ids[a.ID] = true
+			if a.Range < 0 || a.BeamWidth < 0 || a.BeamWidth > 360 {
+				return fmt.Errorf("reader %q: antenna %v needs a positive range and a beam width up to 360", r.Name, a.ID)
+			}
+		}
+	}
+	for _, t := range fp.Tags {
+		for _, tr := range t.Tags {
+			if _, err := llrp.NewTag(&llrp.TagRecord{PCBits: tr.PCBits, EPC: tr.EPC}); err != nil {
+				return fmt.Errorf("%v: %v: %v", t.Label, tr.EPC, err)
+			}
+		}
+	}
+	return nil
+}
+
+// floorRSSI is the read model: a tag is read by an antenna within its
+// range and beam, with the RSSI falling with the log of the distance and
+// with the angle off the boresight; ok is false when it isn't read
+func floorRSSI(a FloorAntenna, x, y float64) (rssi int8, ok bool) {
+	dx, dy := x-a.X, y-a.Y
+	d := math.Hypot(dx, dy)
+	if d > a.Range {
+		return 0, false
+	}
+	off := 0.0
+	if d > 0 {
+		off = math.Abs(math.Remainder(math.Atan2(dy, dx)*180/math.Pi-a.Orientation, 360))
+	}
+	if off > a.BeamWidth/2 {
+		return 0, false
+	}
+	db := floorRSSIAt1m - 10*floorPathLossExp*math.Log10(math.Max(d, 0.1))
+	if a.BeamWidth > 0 {
+		db -= floorBeamEdgeDB * math.Pow(off/(a.BeamWidth/2), 2)
+	}
+	return int8(math.Max(-128, math.Min(-1, math.Round(db)))), true
+}
+
+// Visibility returns the tags read by every antenna of the floor plan
+func (fp *FloorPlan) Visibility() []FloorRead {
+	reads := []FloorRead{}
+	for _, r := range fp.Readers {
+		for _, a := range r.Antennas {
+			for _, t := range fp.Tags {
+				rssi, ok := floorRSSI(a, t.X, t.Y)
+				if !ok {
+					continue
+				}
+				for _, tr := range t.Tags {
+					reads = append(reads, FloorRead{
+						Port: r.Port, Antenna: a.ID, Label: t.Label,
+						PCBits: tr.PCBits, EPC: tr.EPC, RSSI: rssi,
+					})
+				}
+			}
+		}
+	}
+	return reads
+}
+
+// APIGetFloorPlans lists the floor plans
+func APIGetFloorPlans(c *gin.Context) {
+	names, err := listFloorPlans()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error()+"\n")
+		return
+	}
+	c.JSON(http.StatusOK, names)
+}
+
+// APIGetFloorPlan returns a floor plan
+func APIGetFloorPlan(c *gin.Context) {
+	fp, err := loadFloorPlan(c.Param("name"))
+	if os.IsNotExist(err) {
+		c.String(http.StatusNotFound, "The floor plan doesn't exist!\n")
+		return
+	} else if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	c.JSON(http.StatusOK, fp)
+}
+
+// APIPutFloorPlan saves a floor plan
+func APIPutFloorPlan(c *gin.Context) {
+	var fp FloorPlan
+	if err := c.BindWith(&fp, binding.JSON); err != nil {
+		return
+	}
+	fp.Name = c.Param("name")
+	if err := saveFloorPlan(&fp); err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	c.String(http.StatusAccepted, "Floor plan saved!\n")
+}
+
+// APIPostVisibility returns the tags read by the antennas of a floor
+// plan, saved or not
+func APIPostVisibility(c *gin.Context) {
+	var fp FloorPlan
+	if err := c.BindWith(&fp, binding.JSON); err != nil {
+		return
+	}
+	if err := fp.validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	c.JSON(http.StatusOK, fp.Visibility())
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// goldenConn keeps a copy of the byte stream sent to the client
+type goldenConn struct {
+	net.Conn
+	sync.Mutex
+	sent bytes.Buffer
+}
+
+func (c *goldenConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.Lock()
+	c.sent.Write(b[:n])
+	c.Unlock()
+	return n, err
+}
+
+// check compares the stream with the golden file, or overwrites the file
+// with the stream when update is set
+func (c *goldenConn) check(path string, update bool) int {
+	c.Lock()
+	got := c.sent.Bytes()
+	c.Unlock()
+	if !*deterministic {
+		log.Print("golden files are only reproducible with --deterministic")
+	}
+	if update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %v bytes to %v", len(got), path)
+		return 0
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if bytes.Equal(got, want) {
+		log.Printf("the byte stream matches %v", path)
+		return 0
+	}
+	offset := 0
+	for offset < len(got) && offset < len(want) && got[offset] == want[offset] {
+		offset++
+	}
+	index, name := frameAt(want, offset)
+	log.Printf("the byte stream differs from %v at byte %v, in message #%v (%v); got %v bytes, want %v",
+		path, offset, index, name, len(got), len(want))
+	return 1
+}
+
+// frameAt locates the LLRP frame containing the byte offset in a stream
+func frameAt(stream []byte, offset int) (int, string) {
+	index := 1
+	for start := 0; start+codec.HeaderSize <= len(stream); index++ {
+		end := start + int(binary.BigEndian.Uint32(stream[start+2:start+6]))
+		if offset < end || end <= start {
+			return index, codec.MessageName(codec.FrameType(stream[start:]))
+		}
+		start = end
+	}
+	return index, "end of stream"
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iomz/golemu/codec"
+)
+
+const (
+	// gpoLogSize is the number of actions kept in the log
+	gpoLogSize = 1000
+	// gpoActionTimeout bounds a webhook, command or MQTT publish
+	gpoActionTimeout = 10 * time.Second
+	// gpoOutputSize is the most of the output of a command kept in the log
+	gpoOutputSize = 1024
+)
+
+// gpo holds the GPO ports of the server mode and runs their bindings
+var gpo = newGPOBank()
+
+// GPOChange is a change of state of a GPO port, the body of the webhooks,
+// MQTT messages and websocket events
+type GPOChange struct {
+	Port      uint16
+	State     bool
+	Timestamp time.Time
+}
+
+// GPOState is the state of a GPO port
+type GPOState struct {
+	Port  uint16
+	State bool
+}
+
+// GPOAction is an action run for a change, as kept in the log
+type GPOAction struct {
+	Seq uint64
+	GPOChange
+	// Action is webhook, exec, mqtt or ws, and Target its URL or command
+	Action string
+	Target string
+	// Result is the HTTP status, the exit status or the output of a command
+	Result string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// gpoBinding is an action bound to a port, 0 for all of them
+type gpoBinding struct {
+	port   uint16
+	action string
+	target string
+}
+
+// gpoBank is the state of the GPO ports, the actions bound to them and
+// the log of the actions run
+type gpoBank struct {
+	sync.Mutex
+	states   map[uint16]bool
+	bindings []gpoBinding
+	changes  chan GPOChange
+	seq      uint64
+	log      []GPOAction
+}
+
+// newGPOBank returns GPO ports all off
+func newGPOBank() *gpoBank {
+	return &gpoBank{states: map[uint16]bool{}, changes: make(chan GPOChange, 256)}
+}
+
+// parseGPOBinding parses a --gpo of the form PORT=ACTION, the port * for
+// all of them
+func parseGPOBinding(spec string) (gpoBinding, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return gpoBinding{}, fmt.Errorf("invalid GPO binding %q, expected PORT=ACTION", spec)
+	}
+	b := gpoBinding{}
+	if spec[:i] != "*" {
+		p, err := strconv.ParseUint(spec[:i], 10, 16)
+		if err != nil || p == 0 {
+			return gpoBinding{}, fmt.Errorf("invalid GPO port in %q", spec)
+		}
+		b.port = uint16(p)
+	}
+	action := spec[i+1:]
+	switch {
+	case action == "ws":
+		b.action = "ws"
+	case strings.HasPrefix(action, "webhook:"):
+		b.action, b.target = "webhook", strings.TrimPrefix(action, "webhook:")
+		if u, err := url.Parse(b.target); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return gpoBinding{}, fmt.Errorf("invalid webhook URL in %q", spec)
+		}
+	case strings.HasPrefix(action, "exec:"):
+		b.action, b.target = "exec", strings.TrimPrefix(action, "exec:")
+	case strings.HasPrefix(action, "mqtt://"):
+		b.action, b.target = "mqtt", action
+		if u, err := url.Parse(action); err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return gpoBinding{}, fmt.Errorf("invalid MQTT URL in %q, expected mqtt://HOST:PORT/TOPIC", spec)
+		}
+	default:
+		return gpoBinding{}, fmt.Errorf("unknown GPO action in %q, expected webhook:URL, exec:COMMAND, mqtt://HOST:PORT/TOPIC or ws", spec)
+	}
+	return b, nil
+}
+
+// bindGPOs binds the actions of the --gpo flags and runs them in order
+func bindGPOs() {
+	if len(*gpoBindings) == 0 {
+		return
+	}
+	for _, spec := range *gpoBindings {
+		b, err := parseGPOBinding(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gpo.Lock()
+		gpo.bindings = append(gpo.bindings, b)
+		gpo.Unlock()
+	}
+	go gpo.run()
+}
+
+// Write sets a port and runs its actions when its state changes
+func (b *gpoBank) Write(port uint16, state bool) {
+	b.Lock()
+	changed := b.states[port] != state
+	b.states[port] = state
+	bound := len(b.bindings) != 0
+	b.Unlock()
+	log.Printf("GPO %v: %v", port, state)
+	if !changed || !bound {
+		return
+	}
+	select {
+	case b.changes <- GPOChange{Port: port, State: state, Timestamp: clk.Now()}:
+	default:
+		log.Printf("GPO %v: too many changes pending, dropping the actions", port)
+	}
+}
+
+// WriteMessage applies the GPOWriteData of a SET_READER_CONFIG
+func (b *gpoBank) WriteMessage(m *codec.Message) {
+	for _, p := range m.Find(codec.GPOWriteData) {
+		b.Write(uint16(p.Uint("GPOPortNumber")), p.Bool("GPOData"))
+	}
+}
+
+// States returns the ports written so far, in order
+func (b *gpoBank) States() []GPOState {
+	b.Lock()
+	defer b.Unlock()
+	states := []GPOState{}
+	for p, s := range b.states {
+		states = append(states, GPOState{Port: p, State: s})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Port < states[j].Port })
+	return states
+}
+
+// Log returns the actions after since
+func (b *gpoBank) Log(since uint64) []GPOAction {
+	b.Lock()
+	defer b.Unlock()
+	actions := []GPOAction{}
+	for _, a := range b.log {
+		if a.Seq > since {
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
+
+// run runs the actions of the changes one at a time
+func (b *gpoBank) run() {
+	for c := range b.changes {
+		b.Lock()
+		bindings := b.bindings
+		b.Unlock()
+		for _, binding := range bindings {
+			if binding.port != 0 && binding.port != c.Port {
+				continue
+			}
+			a := GPOAction{GPOChange: c, Action: binding.action, Target: binding.shown()}
+			a.Result, a.Error = binding.run(c)
+			if a.Error != "" {
+				log.Printf("GPO %v %v %v: %v", c.Port, a.Action, a.Target, a.Error)
+			}
+			b.Lock()
+			b.seq++
+			a.Seq = b.seq
+			b.log = append(b.log, a)
+			if len(b.log) > gpoLogSize {
+				b.log = b.log[len(b.log)-gpoLogSize:]
+			}
+			b.Unlock()
+		}
+	}
+}
+
+// shown is the target of the binding without the MQTT password
+func (g gpoBinding) shown() string {
+	if g.action != "mqtt" {
+		return g.target
+	}
+	u, _ := url.Parse(g.target)
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+	}
+	return u.String()
+}
+
+// run runs the action for a change and returns its result or error
+func (g gpoBinding) run(c GPOChange) (string, string) {
+	body, _ := json.Marshal(c)
+	ctx, cancel := context.WithTimeout(context.Background(), gpoActionTimeout)
+	defer cancel()
+	switch g.action {
+	case "webhook":
+		req, err := http.NewRequest("POST", g.target, bytes.NewReader(body))
+		if err != nil {
+			return "", err.Error()
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err.Error()
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			return res.Status, "unexpected status " + res.Status
+		}
+		return res.Status, ""
+	case "exec":
+		cmd := exec.CommandContext(ctx, "sh", "-c", g.target)
+		cmd.Env = append(os.Environ(),
+			"GPO_PORT="+strconv.Itoa(int(c.Port)),
+			"GPO_STATE="+map[bool]string{false: "0", true: "1"}[c.State])
+		out, err := cmd.CombinedOutput()
+		if len(out) > gpoOutputSize {
+			out = out[:gpoOutputSize]
+		}
+		if err != nil {
+			return string(out), err.Error()
+		}
+		return string(out), ""
+	case "mqtt":
+		u, _ := url.Parse(g.target)
+		if err := mqttPublish(ctx, u, body); err != nil {
+			return "", err.Error()
+		}
+		return "published", ""
+	case "ws":
+		m, _ := json.Marshal(struct {
+			UpdateType string
+			GPO        GPOChange
+		}{"gpo", c})
+		journal.Lock()
+		Broadcast(m)
+		journal.Unlock()
+		return "broadcast", ""
+	}
+	return "", "unknown action " + g.action
+}
+
+// APIGetGPOs returns the state of the GPO ports
+func APIGetGPOs(c *gin.Context) {
+	c.JSON(http.StatusOK, gpo.States())
+}
+
+// APIGetGPOLog returns the actions run after ?since=SEQ, all the kept ones
+// without
+func APIGetGPOLog(c *gin.Context) {
+	var since uint64
+	if s := c.Query("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			c.String(http.StatusBadRequest, "Invalid since!\n")
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gpo.Log(since))
+}
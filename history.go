@@ -0,0 +1,67 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readHistorySize is the number of reads and of events kept by the history
+const readHistorySize = 1000
+
+// history keeps the last reads and events of the server mode
+var history = &readHistory{}
+
+// readHistory is an output of the read stream keeping the last reads and
+// reader events, for GET /api/v1/reads
+type readHistory struct {
+	sync.Mutex
+	reads  []TagRead
+	events []ReaderEvent
+}
+
+// ReadHistory is the JSON body of GET /api/v1/reads, oldest first
+type ReadHistory struct {
+	Reads  []TagRead
+	Events []ReaderEvent
+}
+
+// Reads keeps the reads, forgetting the oldest ones
+func (h *readHistory) Reads(reads []TagRead) {
+	h.Lock()
+	defer h.Unlock()
+	h.reads = append(h.reads, reads...)
+	if n := len(h.reads) - readHistorySize; n > 0 {
+		h.reads = append([]TagRead{}, h.reads[n:]...)
+	}
+}
+
+// Event keeps the event, forgetting the oldest one
+func (h *readHistory) Event(e ReaderEvent) {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, e)
+	if n := len(h.events) - readHistorySize; n > 0 {
+		h.events = append([]ReaderEvent{}, h.events[n:]...)
+	}
+}
+
+// Close keeps the history for the API
+func (h *readHistory) Close() {}
+
+// APIGetReads returns the last reads and reader events, from the LLRP
+// sessions and the autostart ROSpec
+func APIGetReads(c *gin.Context) {
+	history.Lock()
+	defer history.Unlock()
+	c.JSON(http.StatusOK, ReadHistory{
+		Reads:  append([]TagRead{}, history.reads...),
+		Events: append([]ReaderEvent{}, history.events...),
+	})
+}
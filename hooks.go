@@ -0,0 +1,139 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// hookQueueSize is the number of batches queued for a hook, the reads
+	// of a slower hook are dropped
+	hookQueueSize = 256
+	// hookTimeout bounds a webhook or an MQTT publish
+	hookTimeout = 10 * time.Second
+)
+
+// HookMessage is the JSON body of a --read-hook: the reads of a report or
+// a reader event
+type HookMessage struct {
+	Reads []TagRead    `json:",omitempty"`
+	Event *ReaderEvent `json:",omitempty"`
+}
+
+// hookSink posts the read stream to a webhook or publishes it to an MQTT
+// topic, one message per report and per event
+type hookSink struct {
+	target *url.URL
+	// shown is the URL without the password
+	shown    string
+	queue    chan HookMessage
+	dropping bool
+	done     sync.WaitGroup
+}
+
+// newHookSink starts the hook of a --read-hook URL
+func newHookSink(target string) (*hookSink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "mqtt":
+		if u.Host == "" || u.Path == "" || u.Path == "/" {
+			return nil, fmt.Errorf("invalid MQTT URL %q, expected mqtt://HOST[:PORT]/TOPIC", target)
+		}
+	default:
+		return nil, fmt.Errorf("invalid hook URL %q, expected http(s):// or mqtt://", target)
+	}
+	h := &hookSink{target: u, shown: target, queue: make(chan HookMessage, hookQueueSize)}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			shown := *u
+			shown.User = url.UserPassword(u.User.Username(), "xxxxx")
+			h.shown = shown.String()
+		}
+	}
+	h.done.Add(1)
+	go h.run()
+	log.Printf("sending the reads to %v", h.shown)
+	return h, nil
+}
+
+// Reads queues the reads of a report
+func (h *hookSink) Reads(reads []TagRead) {
+	h.enqueue(HookMessage{Reads: reads})
+}
+
+// Event queues a reader event
+func (h *hookSink) Event(e ReaderEvent) {
+	h.enqueue(HookMessage{Event: &e})
+}
+
+// Close sends the queued messages
+func (h *hookSink) Close() {
+	close(h.queue)
+	h.done.Wait()
+}
+
+// enqueue is called with sinksLock held
+func (h *hookSink) enqueue(m HookMessage) {
+	select {
+	case h.queue <- m:
+		h.dropping = false
+	default:
+		if !h.dropping {
+			log.Printf("%v is too slow, dropping reads", h.shown)
+			h.dropping = true
+		}
+	}
+}
+
+// run sends the queued messages until the sink is closed
+func (h *hookSink) run() {
+	defer h.done.Done()
+	for m := range h.queue {
+		if err := h.send(m); err != nil {
+			log.Printf("%v: %v", h.shown, err)
+		}
+	}
+}
+
+// send posts or publishes a message
+func (h *hookSink) send(m HookMessage) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	if h.target.Scheme == "mqtt" {
+		return mqttPublish(ctx, h.target, body)
+	}
+	req, err := http.NewRequest("POST", h.target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/fatih/structs"
+	"github.com/iomz/go-llrp"
+	"golang.org/x/net/websocket"
+)
+
+// journalSize is the number of recent changes kept for resuming clients,
+// the ones further behind get a snapshot
+const journalSize = 1024
+
+// tagJournal numbers the changes of the tag store, keeps the recent ones
+// and a copy of the store so that the websocket clients can catch up; the
+// lock also orders the messages sent to the clients. The numbers only mean
+// something within the epoch of the process
+type tagJournal struct {
+	sync.Mutex
+	epoch   string
+	seq     uint64
+	tags    []llrp.TagRecord
+	changes []WebsocketMessage
+}
+
+// newTagJournal starts a journal with a random epoch
+func newTagJournal() *tagJournal {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &tagJournal{epoch: hex.EncodeToString(b)}
+}
+
+// Reset starts the journal over with the tags loaded at startup
+func (j *tagJournal) Reset(tags llrp.Tags) {
+	j.Lock()
+	defer j.Unlock()
+	j.tags = []llrp.TagRecord{}
+	for _, t := range tags {
+		j.tags = append(j.tags, *llrp.NewTagRecord(*t))
+	}
+	j.changes = nil
+}
+
+// Tags returns a copy of the tags in the store
+func (j *tagJournal) Tags() []llrp.TagRecord {
+	j.Lock()
+	defer j.Unlock()
+	return append([]llrp.TagRecord{}, j.tags...)
+}
+
+// Record numbers a change made by the tag manager and broadcasts it
+func (j *tagJournal) Record(updateType string, t *llrp.Tag) {
+	tr := *llrp.NewTagRecord(*t)
+	j.Lock()
+	defer j.Unlock()
+	j.seq++
+	m := WebsocketMessage{
+		UpdateType: updateType,
+		Tag:        tr,
+		Tags:       []map[string]interface{}{},
+		Seq:        j.seq,
+		Epoch:      j.epoch,
+	}
+	switch updateType {
+	case "add":
+		j.tags = append(j.tags, tr)
+	case "delete":
+		for i, other := range j.tags {
+			if other == tr {
+				j.tags = append(j.tags[:i], j.tags[i+1:]...)
+				break
+			}
+		}
+	}
+	j.changes = append(j.changes, m)
+	if len(j.changes) > journalSize {
+		j.changes = j.changes[len(j.changes)-journalSize:]
+	}
+
+	clientMessage, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	Broadcast(clientMessage)
+}
+
+// Resume sends a client the changes after since, or a snapshot of the
+// store when they are no longer kept, since is 0 or the client's numbers
+// come from another epoch
+func (j *tagJournal) Resume(cs WebsockConn, epoch string, since uint64) {
+	j.Lock()
+	defer j.Unlock()
+	var messages []WebsocketMessage
+	switch {
+	case epoch == j.epoch && since == j.seq && since != 0:
+		// up to date
+	case epoch == j.epoch && since != 0 && since < j.seq && len(j.changes) > 0 && j.changes[0].Seq <= since+1:
+		for _, m := range j.changes {
+			if m.Seq > since {
+				messages = append(messages, m)
+			}
+		}
+		log.Printf("resuming %v from %v with %v changes", cs.clientIP, since, len(messages))
+	default:
+		// too far behind, or numbered by another process like a server
+		// since restarted
+		messages = append(messages, j.snapshot())
+		log.Printf("sending %v a snapshot of %v tags at %v", cs.clientIP, len(j.tags), j.seq)
+	}
+	for _, m := range messages {
+		clientMessage, err := json.Marshal(m)
+		if err != nil {
+			panic(err)
+		}
+		if err := websocket.Message.Send(cs.websocket, string(clientMessage)); err != nil {
+			log.Printf("could not send message to %v", cs.clientIP)
+			log.Print(err)
+			return
+		}
+	}
+}
+
+// snapshot is a retrieval of the whole store
+func (j *tagJournal) snapshot() WebsocketMessage {
+	m := WebsocketMessage{
+		UpdateType: "retrieval",
+		Tags:       []map[string]interface{}{},
+		Seq:        j.seq,
+		Epoch:      j.epoch,
+	}
+	for i := range j.tags {
+		m.Tags = append(m.Tags, structs.Map(&j.tags[i]))
+	}
+	return m
+}
@@ -0,0 +1,690 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Kafka protocol API keys and error codes
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+
+	kafkaUnknownTopicOrPartition = 3
+	kafkaLeaderNotAvailable      = 5
+	kafkaNotLeaderForPartition   = 6
+)
+
+const (
+	// kafkaRetries is the number of attempts to produce a batch
+	kafkaRetries = 3
+	// kafkaBackoff is the time waited between two attempts, long enough
+	// for a broker to create a topic
+	kafkaBackoff = 500 * time.Millisecond
+	// kafkaTimeout bounds a request and its response
+	kafkaTimeout = 10 * time.Second
+	// kafkaQueueSize is the number of messages queued while a batch is
+	// produced; the reads are dropped rather than slowing down the LLRP
+	// sessions once it is full
+	kafkaQueueSize = 65536
+)
+
+// the Avro schemas of the messages with --kafka-format avro
+const (
+	avroTagReadSchema = `{"type":"record","name":"TagRead","namespace":"golemu","fields":[` +
+		`{"name":"reader","type":"string"},{"name":"epc","type":"string"},{"name":"pc","type":"int"},` +
+		`{"name":"antenna","type":"int"},{"name":"rssi","type":"int"},` +
+		`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+		`{"name":"location","type":"string","default":""},{"name":"product","type":"string","default":""}]}`
+	avroReaderEventSchema = `{"type":"record","name":"ReaderEvent","namespace":"golemu","fields":[` +
+		`{"name":"reader","type":"string"},{"name":"type","type":"string"},{"name":"antenna","type":"int"},` +
+		`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}}]}`
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaMessage is a record to produce
+type kafkaMessage struct {
+	topic     string
+	key       []byte
+	value     []byte
+	timestamp time.Time
+}
+
+// kafkaSink produces the read stream to Kafka, the reads to --kafka-topic
+// and the reader events to --kafka-event-topic, in batches of up to
+// --kafka-batch messages sent at least every --kafka-linger
+type kafkaSink struct {
+	queue   chan kafkaMessage
+	done    chan struct{}
+	dropped uint64
+	// the schema registry IDs of the Avro schemas, framing the Avro
+	// messages with --kafka-schema-registry
+	readSchema, eventSchema int32
+
+	// owned by the producer goroutine
+	correlation int32
+	brokers     map[int32]string
+	conns       map[int32]net.Conn
+	leaders     map[string][]int32
+	roundRobin  map[string]int
+}
+
+// newKafkaSink starts producing to the --kafka brokers
+func newKafkaSink() *kafkaSink {
+	k := &kafkaSink{
+		queue:       make(chan kafkaMessage, kafkaQueueSize),
+		done:        make(chan struct{}),
+		conns:       map[int32]net.Conn{},
+		leaders:     map[string][]int32{},
+		roundRobin:  map[string]int{},
+		readSchema:  -1,
+		eventSchema: -1,
+	}
+	if *kafkaSchemaRegistry != "" {
+		if *kafkaFormat != "avro" {
+			log.Fatal("--kafka-schema-registry requires --kafka-format avro")
+		}
+		var err error
+		if k.readSchema, err = registerAvroSchema(*kafkaSchemaRegistry, *kafkaTopic+"-value", avroTagReadSchema); err != nil {
+			log.Fatal(err)
+		}
+		if k.eventSchema, err = registerAvroSchema(*kafkaSchemaRegistry, *kafkaEventTopic+"-value", avroReaderEventSchema); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go k.run()
+	log.Printf("producing the reads to %v and the events to %v on %v", *kafkaTopic, *kafkaEventTopic, *kafkaBrokers)
+	if *kafkaFormat == "avro" {
+		log.Printf("Avro schema of %v: %v", *kafkaTopic, avroTagReadSchema)
+		log.Printf("Avro schema of %v: %v", *kafkaEventTopic, avroReaderEventSchema)
+	}
+	return k
+}
+
+// registerAvroSchema registers the schema under the subject of a schema
+// registry and returns its ID
+func registerAvroSchema(registry, subject, schema string) (int32, error) {
+	body, _ := json.Marshal(struct {
+		Schema string `json:"schema"`
+	}{schema})
+	target := strings.TrimSuffix(registry, "/") + "/subjects/" + url.PathEscape(subject) + "/versions"
+	client := &http.Client{Timeout: kafkaTimeout}
+	res, err := client.Post(target, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("registering the schema of %v: %v", subject, err)
+	}
+	defer res.Body.Close()
+	var registered struct {
+		ID      int32  `json:"id"`
+		Message string `json:"message"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&registered)
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("registering the schema of %v: %v %v", subject, res.Status, registered.Message)
+	} else if err != nil {
+		return 0, fmt.Errorf("registering the schema of %v: %v", subject, err)
+	}
+	log.Printf("registered the Avro schema of %v with ID %v", subject, registered.ID)
+	return registered.ID, nil
+}
+
+// avroFrame prefixes an Avro datum with the magic byte and the schema ID
+// of the schema registry wire format, when the schema was registered
+func avroFrame(schema int32, datum []byte) []byte {
+	if schema < 0 {
+		return datum
+	}
+	framed := make([]byte, 5, 5+len(datum))
+	binary.BigEndian.PutUint32(framed[1:], uint32(schema))
+	return append(framed, datum...)
+}
+
+// Reads queues a message per read
+func (k *kafkaSink) Reads(reads []TagRead) {
+	for _, r := range reads {
+		var key []byte
+		switch *kafkaKey {
+		case "epc":
+			key = []byte(r.EPC)
+		case "reader":
+			key = []byte(r.Reader)
+		}
+		var value []byte
+		if *kafkaFormat == "avro" {
+			value = avroFrame(k.readSchema, avroTagRead(r))
+		} else {
+			value, _ = json.Marshal(r)
+		}
+		k.enqueue(kafkaMessage{topic: *kafkaTopic, key: key, value: value, timestamp: r.Timestamp})
+	}
+}
+
+// Event queues a message for the event, keyed by the reader
+func (k *kafkaSink) Event(e ReaderEvent) {
+	var key []byte
+	if *kafkaKey != "none" {
+		key = []byte(e.Reader)
+	}
+	var value []byte
+	if *kafkaFormat == "avro" {
+		value = avroFrame(k.eventSchema, avroReaderEvent(e))
+	} else {
+		value, _ = json.Marshal(e)
+	}
+	k.enqueue(kafkaMessage{topic: *kafkaEventTopic, key: key, value: value, timestamp: e.Timestamp})
+}
+
+// Close produces the queued messages and disconnects
+func (k *kafkaSink) Close() {
+	close(k.queue)
+	<-k.done
+}
+
+func (k *kafkaSink) enqueue(m kafkaMessage) {
+	select {
+	case k.queue <- m:
+	default:
+		atomic.AddUint64(&k.dropped, 1)
+	}
+}
+
+// run collects the queued messages into batches and produces them
+func (k *kafkaSink) run() {
+	var batch []kafkaMessage
+	var linger <-chan time.Time
+	flush := func() {
+		if n := atomic.SwapUint64(&k.dropped, 0); n != 0 {
+			log.Printf("kafka: the queue was full, dropped %v messages", n)
+		}
+		for attempt := 0; attempt < kafkaRetries && len(batch) != 0; attempt++ {
+			if attempt != 0 {
+				time.Sleep(kafkaBackoff)
+			}
+			batch = k.send(batch)
+		}
+		if len(batch) != 0 {
+			log.Printf("kafka: couldn't produce %v messages", len(batch))
+		}
+		batch, linger = nil, nil
+	}
+	for {
+		select {
+		case m, ok := <-k.queue:
+			if !ok {
+				flush()
+				for _, c := range k.conns {
+					c.Close()
+				}
+				close(k.done)
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) == 1 {
+				linger = time.After(*kafkaLinger)
+			}
+			if len(batch) >= *kafkaBatch {
+				flush()
+			}
+		case <-linger:
+			flush()
+		}
+	}
+}
+
+// send produces a batch to the partition leaders and returns the messages
+// that failed
+func (k *kafkaSink) send(batch []kafkaMessage) []kafkaMessage {
+	topics := []string{}
+	for _, m := range batch {
+		if _, ok := k.leaders[m.topic]; !ok {
+			k.leaders[m.topic] = nil
+			topics = append(topics, m.topic)
+		}
+	}
+	if len(topics) != 0 {
+		if err := k.metadata(topics); err != nil {
+			log.Printf("kafka: %v", err)
+		}
+	}
+
+	// leader -> topic -> partition -> messages
+	requests := map[int32]map[string]map[int32][]kafkaMessage{}
+	failed := []kafkaMessage{}
+	for _, m := range batch {
+		leaders := k.leaders[m.topic]
+		if len(leaders) == 0 {
+			delete(k.leaders, m.topic)
+			failed = append(failed, m)
+			continue
+		}
+		p := k.partition(m, len(leaders))
+		leader := leaders[p]
+		if leader < 0 {
+			delete(k.leaders, m.topic)
+			failed = append(failed, m)
+			continue
+		}
+		if requests[leader] == nil {
+			requests[leader] = map[string]map[int32][]kafkaMessage{}
+		}
+		if requests[leader][m.topic] == nil {
+			requests[leader][m.topic] = map[int32][]kafkaMessage{}
+		}
+		requests[leader][m.topic][p] = append(requests[leader][m.topic][p], m)
+	}
+	for leader, sets := range requests {
+		failed = append(failed, k.produce(leader, sets)...)
+	}
+	return failed
+}
+
+// partition picks the partition of a message: the murmur2 hash of the key
+// like the Java client's default partitioner, or round robin
+func (k *kafkaSink) partition(m kafkaMessage, n int) int32 {
+	if *kafkaPartitioner == "hash" && m.key != nil {
+		return int32((murmur2(m.key) & 0x7fffffff) % uint32(n))
+	}
+	p := k.roundRobin[m.topic] % n
+	k.roundRobin[m.topic] = p + 1
+	return int32(p)
+}
+
+// produce sends the record batches of a leader with a Produce v3 request
+// and returns the messages of the partitions that failed
+func (k *kafkaSink) produce(leader int32, sets map[string]map[int32][]kafkaMessage) []kafkaMessage {
+	all := func() []kafkaMessage {
+		var ms []kafkaMessage
+		for _, partitions := range sets {
+			for _, set := range partitions {
+				ms = append(ms, set...)
+			}
+		}
+		return ms
+	}
+	var w kafkaWriter
+	w.int16(-1) // no transactional ID
+	w.int16(int16(*kafkaAcks))
+	w.int32(int32(kafkaTimeout / time.Millisecond))
+	w.int32(int32(len(sets)))
+	for topic, partitions := range sets {
+		w.string(topic)
+		w.int32(int32(len(partitions)))
+		for p, set := range partitions {
+			w.int32(p)
+			w.bytes(kafkaRecordBatch(set))
+		}
+	}
+	resp, err := k.request(leader, kafkaProduce, 3, w.Bytes(), *kafkaAcks != 0)
+	if err != nil {
+		log.Printf("kafka: produce to broker %v: %v", leader, err)
+		k.leaders = map[string][]int32{}
+		return all()
+	}
+	if resp == nil {
+		return nil
+	}
+	failed := []kafkaMessage{}
+	r := &kafkaReader{b: resp}
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		topic := r.string()
+		for j := r.int32(); j > 0 && r.err == nil; j-- {
+			p := r.int32()
+			code := r.int16()
+			r.int64() // base offset
+			r.int64() // log append time
+			if code != 0 && r.err == nil {
+				log.Printf("kafka: produce to %v/%v: error %v", topic, p, code)
+				failed = append(failed, sets[topic][p]...)
+				if code == kafkaNotLeaderForPartition || code == kafkaUnknownTopicOrPartition || code == kafkaLeaderNotAvailable {
+					delete(k.leaders, topic)
+				}
+			}
+		}
+	}
+	if r.err != nil {
+		log.Printf("kafka: invalid produce response: %v", r.err)
+		return all()
+	}
+	return failed
+}
+
+// metadata looks up the partition leaders of the topics with a Metadata
+// v1 request, which also creates them on brokers that allow it
+func (k *kafkaSink) metadata(topics []string) error {
+	var w kafkaWriter
+	w.int32(int32(len(topics)))
+	for _, t := range topics {
+		w.string(t)
+	}
+	var resp []byte
+	var err error
+	for _, node := range k.bootstrap() {
+		if resp, err = k.request(node, kafkaMetadata, 1, w.Bytes(), true); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("metadata: %v", err)
+	}
+	r := &kafkaReader{b: resp}
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		node := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.nullableString() // rack
+		if r.err == nil {
+			k.brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+	}
+	r.int32() // controller
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		code := r.int16()
+		topic := r.string()
+		r.int8() // internal
+		leaders := []int32{}
+		for j := r.int32(); j > 0 && r.err == nil; j-- {
+			r.int16() // partition error
+			p := r.int32()
+			leader := r.int32()
+			r.int32s() // replicas
+			r.int32s() // in-sync replicas
+			for int(p) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[p] = leader
+		}
+		if code != 0 {
+			log.Printf("kafka: metadata of %v: error %v", topic, code)
+			continue
+		}
+		k.leaders[topic] = leaders
+	}
+	return r.err
+}
+
+// bootstrap returns the nodes to ask for metadata: the known brokers, or
+// the --kafka addresses as negative pseudo node IDs
+func (k *kafkaSink) bootstrap() []int32 {
+	if k.brokers == nil {
+		k.brokers = map[int32]string{}
+	}
+	nodes := []int32{}
+	for node := range k.brokers {
+		if node >= 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	for i, addr := range *kafkaBrokers {
+		node := int32(-1 - i)
+		k.brokers[node] = addr
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// request sends a request to a broker and reads its response, without
+// the correlation ID, unless no response is expected
+func (k *kafkaSink) request(node int32, apiKey, version int16, body []byte, response bool) ([]byte, error) {
+	c, ok := k.conns[node]
+	if !ok {
+		addr, ok := k.brokers[node]
+		if !ok {
+			return nil, fmt.Errorf("unknown broker %v", node)
+		}
+		var err error
+		if c, err = net.DialTimeout("tcp", addr, kafkaTimeout); err != nil {
+			return nil, err
+		}
+		k.conns[node] = c
+	}
+	resp, err := k.roundTrip(c, apiKey, version, body, response)
+	if err != nil {
+		c.Close()
+		delete(k.conns, node)
+	}
+	return resp, err
+}
+
+func (k *kafkaSink) roundTrip(c net.Conn, apiKey, version int16, body []byte, response bool) ([]byte, error) {
+	k.correlation++
+	var w kafkaWriter
+	w.int32(0) // size
+	w.int16(apiKey)
+	w.int16(version)
+	w.int32(k.correlation)
+	w.string("golemu")
+	w.Write(body)
+	frame := w.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	c.SetDeadline(time.Now().Add(kafkaTimeout))
+	if _, err := c.Write(frame); err != nil {
+		return nil, err
+	}
+	if !response {
+		return nil, nil
+	}
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(c, size); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != k.correlation {
+		return nil, fmt.Errorf("unexpected response")
+	}
+	return resp[4:], nil
+}
+
+// kafkaRecordBatch encodes messages in a v2 record batch
+func kafkaRecordBatch(ms []kafkaMessage) []byte {
+	first := ms[0].timestamp.UnixNano() / 1e6
+	max := first
+	var records kafkaWriter
+	for i, m := range ms {
+		ts := m.timestamp.UnixNano() / 1e6
+		if ts > max {
+			max = ts
+		}
+		var r kafkaWriter
+		r.int8(0) // attributes
+		r.varint(ts - first)
+		r.varint(int64(i))
+		if m.key == nil {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(m.key)))
+			r.Write(m.key)
+		}
+		r.varint(int64(len(m.value)))
+		r.Write(m.value)
+		r.varint(0) // headers
+		records.varint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+
+	// the part covered by the CRC
+	var body kafkaWriter
+	body.int16(0) // attributes, no compression
+	body.int32(int32(len(ms) - 1))
+	body.int64(first)
+	body.int64(max)
+	body.int64(-1) // producer ID
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(ms)))
+	body.Write(records.Bytes())
+
+	var b kafkaWriter
+	b.int64(0) // base offset
+	b.int32(int32(4 + 1 + 4 + body.Len()))
+	b.int32(-1) // partition leader epoch
+	b.int8(2)   // magic
+	b.int32(int32(crc32.Checksum(body.Bytes(), castagnoli)))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// murmur2 is the hash of the Java client's default partitioner
+func murmur2(data []byte) uint32 {
+	const m, r = 0x5bd1e995, 24
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// avroTagRead encodes a read with avroTagReadSchema
+func avroTagRead(t TagRead) []byte {
+	var w kafkaWriter
+	w.avroString(t.Reader)
+	w.avroString(t.EPC)
+	w.varint(int64(t.PC))
+	w.varint(int64(t.Antenna))
+	w.varint(int64(t.RSSI))
+	w.varint(t.Timestamp.UnixNano() / 1e6)
+	w.avroString(t.Location)
+	w.avroString(t.Product)
+	return w.Bytes()
+}
+
+// avroReaderEvent encodes an event with avroReaderEventSchema
+func avroReaderEvent(e ReaderEvent) []byte {
+	var w kafkaWriter
+	w.avroString(e.Reader)
+	w.avroString(e.Type)
+	w.varint(int64(e.Antenna))
+	w.varint(e.Timestamp.UnixNano() / 1e6)
+	return w.Bytes()
+}
+
+// kafkaWriter encodes the big-endian primitives of the Kafka protocol and
+// the zig-zag varints shared by the record batches and Avro
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) { w.WriteByte(byte(v)) }
+
+func (w *kafkaWriter) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.Write(b)
+}
+
+func (w *kafkaWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (w *kafkaWriter) avroString(s string) {
+	w.varint(int64(len(s)))
+	w.WriteString(s)
+}
+
+// kafkaReader decodes a response, keeping the first error
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err == nil && (n < 0 || len(r.b) < n) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return make([]byte, 8)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+func (r *kafkaReader) nullableString() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *kafkaReader) int32s() []int32 {
+	vs := []int32{}
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		vs = append(vs, r.int32())
+	}
+	return vs
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unhex decodes a hex vector, ignoring the spaces
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMurmur2(t *testing.T) {
+	// the vectors of Utils.murmur2 in the Java client's UtilsTest
+	for _, c := range []struct {
+		data string
+		want int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	} {
+		if got := int32(murmur2([]byte(c.data))); got != c.want {
+			t.Errorf("murmur2(%q) = %v, want %v", c.data, got, c.want)
+		}
+	}
+}
+
+func TestKafkaVarint(t *testing.T) {
+	// zig-zag varints, as in the Kafka record and the Avro specifications
+	for _, c := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "00"},
+		{-1, "01"},
+		{1, "02"},
+		{-2, "03"},
+		{63, "7e"},
+		{-64, "7f"},
+		{64, "8001"},
+		{300, "d804"},
+		{-8193, "818001"},
+	} {
+		var w kafkaWriter
+		w.varint(c.n)
+		if got := hex.EncodeToString(w.Bytes()); got != c.want {
+			t.Errorf("varint(%v) = %v, want %v", c.n, got, c.want)
+		}
+	}
+}
+
+func TestCRC32C(t *testing.T) {
+	// the check value of CRC-32C and the vectors of RFC 3720 B.4
+	for _, c := range []struct {
+		data []byte
+		want uint32
+	}{
+		{[]byte("123456789"), 0xe3069283},
+		{make([]byte, 32), 0x8a9136aa},
+		{bytes.Repeat([]byte{0xff}, 32), 0x62a8ab43},
+	} {
+		if got := crc32.Checksum(c.data, castagnoli); got != c.want {
+			t.Errorf("CRC32C(%x) = %08x, want %08x", c.data, got, c.want)
+		}
+	}
+}
+
+// the Metadata v1 and Produce v3 exchange of a record keyed k with the
+// value v at 1s on the partition 0 of the topic reads
+const (
+	kafkaMetadataRequest = `
+		0000001b 0003 0001 00000001 0006 676f6c656d75
+		00000001 0005 7265616473`
+	// the broker 1 at 127.0.0.1:PORT, leading the partition 0 of reads
+	kafkaMetadataResponse = `
+		00000001
+		00000001 00000001 0009 3132372e302e302e31 %08x ffff
+		00000001
+		00000001 0000 0005 7265616473 00
+		00000001 0000 00000000 00000001 00000001 00000001 00000001 00000001`
+	kafkaProduceRequest = `
+		00000075 0000 0003 00000002 0006 676f6c656d75
+		ffff 0001 00002710
+		00000001 0005 7265616473
+		00000001 00000000 00000046
+		0000000000000000 0000003a ffffffff 02 %08x`
+	kafkaRecordBatchBody = `
+		0000 00000000 00000000000003e8 00000000000003e8
+		ffffffffffffffff ffff ffffffff 00000001
+		10 00 00 00 02 6b 02 76 00`
+	kafkaProduceResponse = `
+		00000002
+		00000001 0005 7265616473
+		00000001 00000000 0000 0000000000000000 ffffffffffffffff
+		00000000`
+)
+
+func TestKafkaProduce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	brokers, acks, partitioner := []string{l.Addr().String()}, 1, "hash"
+	kafkaBrokers, kafkaAcks, kafkaPartitioner = &brokers, &acks, &partitioner
+
+	body := unhex(t, kafkaRecordBatchBody)
+	exchanges := []struct{ request, response []byte }{
+		{unhex(t, kafkaMetadataRequest), unhex(t, strings.Replace(kafkaMetadataResponse, "%08x", hex.EncodeToString(be32(uint32(port))), 1))},
+		{append(unhex(t, strings.Replace(kafkaProduceRequest, "%08x", hex.EncodeToString(be32(crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)))), 1)), body...), unhex(t, kafkaProduceResponse)},
+	}
+	served := make(chan error, 1)
+	go func() {
+		// the bootstrap address and the broker 1 are two connections
+		for _, e := range exchanges {
+			c, err := l.Accept()
+			if err != nil {
+				served <- err
+				return
+			}
+			defer c.Close()
+			got := make([]byte, len(e.request))
+			if _, err := io.ReadFull(c, got); err != nil {
+				served <- err
+				return
+			}
+			if !bytes.Equal(got, e.request) {
+				served <- fmt.Errorf("request\n%x\nwant\n%x", got, e.request)
+				return
+			}
+			size := be32(uint32(len(e.response)))
+			c.Write(append(size, e.response...))
+		}
+		served <- nil
+	}()
+
+	k := &kafkaSink{conns: map[int32]net.Conn{}, leaders: map[string][]int32{}, roundRobin: map[string]int{}}
+	failed := k.send([]kafkaMessage{{topic: "reads", key: []byte("k"), value: []byte("v"), timestamp: time.Unix(1, 0)}})
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("%v messages failed", len(failed))
+	}
+	if got, want := k.brokers[1], "127.0.0.1:"+strconv.Itoa(port); got != want {
+		t.Errorf("broker 1 at %v, want %v", got, want)
+	}
+	for _, c := range k.conns {
+		c.Close()
+	}
+}
+
+func TestRegisterAvroSchema(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Schema string }
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &req)
+		if r.Method != "POST" || r.URL.Path != "/subjects/golemu-reads-value/versions" || req.Schema != avroTagReadSchema {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error_code":42201,"message":"Invalid schema"}`))
+			return
+		}
+		w.Write([]byte(`{"id":258}`))
+	}))
+	defer s.Close()
+
+	id, err := registerAvroSchema(s.URL+"/", "golemu-reads-value", avroTagReadSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(avroFrame(id, []byte{0x02})), "000000010202"; got != want {
+		t.Errorf("framed %v, want %v", got, want)
+	}
+	if _, err := registerAvroSchema(s.URL, "golemu-events-value", avroTagReadSchema); err == nil {
+		t.Error("a refused schema was registered")
+	}
+	if got := avroFrame(-1, []byte{0x02}); !bytes.Equal(got, []byte{0x02}) {
+		t.Errorf("unregistered datum framed as %x", got)
+	}
+}
+
+func be32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// lineQueueSize is the number of writes queued for a line client, the
+// reads of a slower client are dropped
+const lineQueueSize = 1024
+
+// lineFuncs are the functions of the --line-format and --line-heartbeat
+// templates
+var lineFuncs = template.FuncMap{
+	"rfc3339": func(t time.Time) string { return t.UTC().Format(time.RFC3339Nano) },
+	"unix":    func(t time.Time) int64 { return t.Unix() },
+	"unixms":  func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) },
+}
+
+// lineHeartbeat is the data of the --line-heartbeat template
+type lineHeartbeat struct {
+	Timestamp time.Time
+}
+
+// lineSink serves the reads as one --line-format line per read to the
+// clients connected to --lines, with a --line-heartbeat line every
+// --line-heartbeat-interval when set
+type lineSink struct {
+	sync.Mutex
+	listener  net.Listener
+	format    *template.Template
+	heartbeat *template.Template
+	delimiter []byte
+	clients   map[*lineClient]bool
+	writers   sync.WaitGroup
+	done      chan struct{}
+}
+
+// lineClient is a connected client with its queue of writes
+type lineClient struct {
+	conn     net.Conn
+	queue    chan []byte
+	dropping bool
+}
+
+// newLineSink listens on --lines
+func newLineSink() *lineSink {
+	delimiter, err := strconv.Unquote(`"` + *lineDelimiter + `"`)
+	if err != nil {
+		log.Fatalf("invalid --line-delimiter %q: %v", *lineDelimiter, err)
+	}
+	s := &lineSink{
+		format:    template.Must(template.New("line-format").Funcs(lineFuncs).Parse(*lineFormat)),
+		heartbeat: template.Must(template.New("line-heartbeat").Funcs(lineFuncs).Parse(*lineHeartbeatFormat)),
+		delimiter: []byte(delimiter),
+		clients:   map[*lineClient]bool{},
+		done:      make(chan struct{}),
+	}
+	if err := s.format.Execute(&bytes.Buffer{}, TagRead{}); err != nil {
+		log.Fatalf("invalid --line-format: %v", err)
+	}
+	if err := s.heartbeat.Execute(&bytes.Buffer{}, lineHeartbeat{}); err != nil {
+		log.Fatalf("invalid --line-heartbeat: %v", err)
+	}
+	if s.listener, err = net.Listen("tcp", *lineAddress); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving the reads as lines on %v", s.listener.Addr())
+	go s.accept()
+	if *lineHeartbeatInterval > 0 {
+		go s.beat()
+	}
+	return s
+}
+
+// accept adds the clients until the sink is closed
+func (s *lineSink) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &lineClient{conn: conn, queue: make(chan []byte, lineQueueSize)}
+		s.Lock()
+		s.clients[c] = true
+		s.writers.Add(1)
+		s.Unlock()
+		log.Printf("line client %v connected", conn.RemoteAddr())
+		go s.write(c)
+	}
+}
+
+// write sends the queued lines to a client until it disconnects
+func (s *lineSink) write(c *lineClient) {
+	defer func() {
+		defer s.writers.Done()
+		s.Lock()
+		delete(s.clients, c)
+		s.Unlock()
+		c.conn.Close()
+		log.Printf("line client %v disconnected", c.conn.RemoteAddr())
+	}()
+	// the clients only listen, whatever they send is discarded
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, c.conn)
+		close(gone)
+	}()
+	for {
+		select {
+		case b, ok := <-c.queue:
+			if !ok {
+				return
+			}
+			if _, err := c.conn.Write(b); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// broadcast queues the lines for every client
+func (s *lineSink) broadcast(b []byte) {
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.clients {
+		select {
+		case c.queue <- b:
+			c.dropping = false
+		default:
+			if !c.dropping {
+				log.Printf("line client %v is too slow, dropping reads", c.conn.RemoteAddr())
+				c.dropping = true
+			}
+		}
+	}
+}
+
+// beat sends the heartbeat lines
+func (s *lineSink) beat() {
+	ticker := time.NewTicker(*lineHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		var b bytes.Buffer
+		if err := s.heartbeat.Execute(&b, lineHeartbeat{Timestamp: clk.Now()}); err != nil {
+			log.Print(err)
+			continue
+		}
+		b.Write(s.delimiter)
+		s.broadcast(b.Bytes())
+	}
+}
+
+// Reads sends a line per read
+func (s *lineSink) Reads(reads []TagRead) {
+	var b bytes.Buffer
+	for _, r := range reads {
+		if err := s.format.Execute(&b, r); err != nil {
+			log.Print(err)
+			return
+		}
+		b.Write(s.delimiter)
+	}
+	s.broadcast(b.Bytes())
+}
+
+// Event ignores the reader events, the lines are only reads
+func (s *lineSink) Event(e ReaderEvent) {}
+
+// Close sends the queued lines, waiting a second at most, and disconnects
+// the clients
+func (s *lineSink) Close() {
+	s.listener.Close()
+	close(s.done)
+	s.Lock()
+	for c := range s.clients {
+		close(c.queue)
+	}
+	s.clients = map[*lineClient]bool{}
+	s.Unlock()
+	flushed := make(chan struct{})
+	go func() {
+		s.writers.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+	}
+}
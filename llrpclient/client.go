@@ -0,0 +1,415 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+// Package llrpclient is an LLRP client for RFID readers and golemu.
+//
+// A Client sends typed requests and waits for their responses, answers the
+// reader keepalives, and hands the reports and reader events to the
+// callbacks in its Config:
+//
+//	c, err := llrpclient.Dial("localhost:5084", &llrpclient.Config{
+//		OnReport: func(r *llrpclient.Report) {
+//			for _, t := range r.Tags {
+//				fmt.Printf("%x on antenna %v\n", t.EPC, t.AntennaID)
+//			}
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	if err := c.AddROSpec(llrpclient.BasicROSpec(1, 0)); err != nil {
+//		return err
+//	}
+//	if err := c.EnableROSpec(1); err != nil {
+//		return err
+//	}
+//	err = c.StartROSpec(1)
+package llrpclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// DefaultTimeout is the time to wait for a response when Config.Timeout
+// is zero
+const DefaultTimeout = 10 * time.Second
+
+// maxForgotten is the number of IDs of timed out requests kept
+const maxForgotten = 256
+
+// ErrClosed is returned for requests on a closed client
+var ErrClosed = errors.New("llrpclient: connection closed")
+
+// Config holds the client options; the callbacks are called one at a time
+// from a single goroutine and may issue requests, the messages received
+// meanwhile being queued
+type Config struct {
+	// InitialMessageID is the ID of the first request
+	InitialMessageID uint32
+	// Timeout limits the wait for the connection event and each response
+	Timeout time.Duration
+	// OnReport is called for every RO_ACCESS_REPORT
+	OnReport func(*Report)
+	// OnEvent is called for every READER_EVENT_NOTIFICATION after the
+	// connection attempt event
+	OnEvent func(*Event)
+	// OnKeepalive is called for every KEEPALIVE, after it is acknowledged
+	OnKeepalive func()
+	// OnMessage is called for any other message that isn't a response,
+	// including the late responses to requests that timed out
+	OnMessage func(*codec.Message)
+}
+
+// StatusError is a response with an LLRPStatus other than success
+type StatusError struct {
+	Response    string
+	Code        uint64
+	Description string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("llrpclient: %v failed with status %v: %v", e.Response, e.Code, e.Description)
+}
+
+// Client is a connection to an LLRP reader
+type Client struct {
+	conn      net.Conn
+	config    Config
+	wmu       sync.Mutex
+	mu        sync.Mutex
+	nextID    uint32
+	pending   []*pendingRequest
+	forgotten []uint32
+	callbacks []func()
+	queued    chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+type pendingRequest struct {
+	id       uint32
+	response uint16
+	c        chan *codec.Message
+}
+
+// Dial connects to the reader at address
+func Dial(address string, config *Config) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// New starts a client on an established connection and waits for the
+// reader to accept it with a ConnectionAttemptEvent
+func New(conn net.Conn, config *Config) (*Client, error) {
+	c := &Client{
+		conn:   conn,
+		queued: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.Timeout == 0 {
+		c.config.Timeout = DefaultTimeout
+	}
+	c.nextID = c.config.InitialMessageID
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+
+	// the first message must be the connection attempt event
+	conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+	frame, err := codec.ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	m, err := codec.Decode(frame)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != codec.ReaderEventNotification {
+		return nil, fmt.Errorf("llrpclient: expected READER_EVENT_NOTIFICATION, got %v", m.Name)
+	}
+	if p := m.First(codec.ConnectionAttemptEvent); p != nil && p.Uint("Status") != 0 {
+		return nil, fmt.Errorf("llrpclient: connection refused with status %v", p.Uint("Status"))
+	}
+
+	go c.run()
+	go c.readLoop()
+	return c, nil
+}
+
+// Done is closed when the connection ends
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that ended the connection
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close sends CLOSE_CONNECTION and closes the connection
+func (c *Client) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	_, err := c.Transact(codec.NewMessage(codec.CloseConnection, 0))
+	c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Send writes a message without waiting for a response; a zero ID is
+// replaced with the next message ID
+func (c *Client) Send(m *codec.Message) error {
+	if m.ID == 0 {
+		m.ID = c.messageID()
+	}
+	frame, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+// Transact sends a request and waits for its response; responses with an
+// LLRPStatus other than success are returned with a *StatusError
+func (c *Client) Transact(m *codec.Message) (*codec.Message, error) {
+	if m.ID == 0 {
+		m.ID = c.messageID()
+	}
+	req := &pendingRequest{
+		id:       m.ID,
+		response: responseType(m.Type),
+		c:        make(chan *codec.Message, 1),
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.pending = append(c.pending, req)
+	c.mu.Unlock()
+
+	if err := c.Send(m); err != nil {
+		c.forget(req)
+		return nil, err
+	}
+	timer := time.NewTimer(c.config.Timeout)
+	defer timer.Stop()
+	select {
+	case res := <-req.c:
+		if res.Type == codec.ErrorMessage {
+			code, desc := res.Status()
+			return res, &StatusError{res.Name, code, desc}
+		}
+		if code, desc := res.Status(); code != codec.StatusSuccess {
+			return res, &StatusError{res.Name, code, desc}
+		}
+		return res, nil
+	case <-timer.C:
+		c.forget(req)
+		return nil, fmt.Errorf("llrpclient: no response to %v within %v", m.Name, c.config.Timeout)
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+func (c *Client) messageID() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.nextID
+	c.nextID++
+	return id
+}
+
+// forget drops a request that won't wait for its response, keeping its ID
+// so that a late response isn't taken for the one of another request
+func (c *Client) forget(req *pendingRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pending {
+		if p == req {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			break
+		}
+	}
+	c.forgotten = append(c.forgotten, req.id)
+	if len(c.forgotten) > maxForgotten {
+		c.forgotten = c.forgotten[len(c.forgotten)-maxForgotten:]
+	}
+}
+
+// issued tells whether the ID is the one of a pending or forgotten
+// request; the caller holds mu
+func (c *Client) issued(id uint32) bool {
+	for _, p := range c.pending {
+		if p.id == id {
+			return true
+		}
+	}
+	for _, f := range c.forgotten {
+		if f == id {
+			return true
+		}
+	}
+	return false
+}
+
+// match finds the request answered by m, by message ID or else by the
+// response type for readers that don't echo the ID; a response with the
+// ID of a forgotten request matches none
+func (c *Client) match(m *codec.Message) *pendingRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := -1
+	for i, p := range c.pending {
+		if p.id == m.ID && (p.response == m.Type || m.Type == codec.ErrorMessage) {
+			found = i
+			break
+		}
+	}
+	for i := 0; found < 0 && !c.issued(m.ID) && i < len(c.pending); i++ {
+		if c.pending[i].response == m.Type {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil
+	}
+	req := c.pending[found]
+	c.pending = append(c.pending[:found], c.pending[found+1:]...)
+	return req
+}
+
+// readLoop reads messages until the connection ends
+func (c *Client) readLoop() {
+	var err error
+	for {
+		var frame []byte
+		if frame, err = codec.ReadFrame(c.conn); err != nil {
+			break
+		}
+		m, derr := codec.Decode(frame)
+		if derr != nil {
+			// keep the frame undecoded rather than dropping the connection
+			m = codec.NewMessage(codec.FrameType(frame), binary.BigEndian.Uint32(frame[6:10]))
+			m.Raw = frame[codec.HeaderSize:]
+		}
+		if req := c.match(m); req != nil {
+			req.c <- m
+			continue
+		}
+		c.handle(m)
+	}
+
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+	close(c.done)
+	c.conn.Close()
+}
+
+// handle answers and dispatches the unsolicited messages
+func (c *Client) handle(m *codec.Message) {
+	switch m.Type {
+	case codec.Keepalive:
+		c.Send(codec.NewMessage(codec.KeepaliveAck, m.ID))
+		if c.config.OnKeepalive != nil {
+			c.enqueue(c.config.OnKeepalive)
+		}
+	case codec.ROAccessReport:
+		if c.config.OnReport != nil {
+			r := NewReport(m)
+			c.enqueue(func() { c.config.OnReport(r) })
+		}
+	case codec.ReaderEventNotification:
+		if c.config.OnEvent != nil {
+			e := NewEvent(m)
+			c.enqueue(func() { c.config.OnEvent(e) })
+		}
+	default:
+		if c.config.OnMessage != nil {
+			c.enqueue(func() { c.config.OnMessage(m) })
+		}
+	}
+}
+
+// enqueue queues a callback without blocking the read loop, so that the
+// responses to the requests of a callback still get through
+func (c *Client) enqueue(f func()) {
+	c.mu.Lock()
+	c.callbacks = append(c.callbacks, f)
+	c.mu.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// run calls the callbacks in order, until the read loop is over
+func (c *Client) run() {
+	for {
+		c.mu.Lock()
+		callbacks := c.callbacks
+		c.callbacks = nil
+		c.mu.Unlock()
+		for _, f := range callbacks {
+			f()
+		}
+		if len(callbacks) != 0 {
+			continue
+		}
+		select {
+		case <-c.queued:
+		case <-c.done:
+			// the read loop queues nothing more once done
+			c.mu.Lock()
+			callbacks = c.callbacks
+			c.callbacks = nil
+			c.mu.Unlock()
+			for _, f := range callbacks {
+				f()
+			}
+			return
+		}
+	}
+}
+
+// responseType returns the type of the response to a request
+func responseType(t uint16) uint16 {
+	switch t {
+	case codec.CloseConnection:
+		return codec.CloseConnectionResponse
+	case codec.CustomMessage:
+		return codec.CustomMessage
+	}
+	return t + 10
+}
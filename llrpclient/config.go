@@ -0,0 +1,186 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package llrpclient
+
+import (
+	"time"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// Capabilities is a decoded GET_READER_CAPABILITIES_RESPONSE; the
+// capabilities the reader didn't send are left zero
+type Capabilities struct {
+	MaxAntennas             uint16
+	CanSetAntennaProperties bool
+	HasUTCClock             bool
+	Manufacturer            uint32
+	Model                   uint32
+	FirmwareVersion         string
+	// ReceiveSensitivities maps the RFReceiver indexes to dBm
+	ReceiveSensitivities map[uint16]int16
+	// TransmitPowerLevels maps the RFTransmitter indexes to dBm*100
+	TransmitPowerLevels map[uint16]int16
+	NumGPIs             uint16
+	NumGPOs             uint16
+	// LLRP capabilities
+	CanReportBufferFillWarning    bool
+	SupportsEventAndReportHolding bool
+	MaxPriorityLevels             uint8
+	MaxROSpecs                    uint32
+	MaxSpecsPerROSpec             uint32
+	MaxAccessSpecs                uint32
+	MaxOpSpecsPerAccessSpec       uint32
+	// Regulatory capabilities
+	CountryCode            uint16
+	CommunicationsStandard uint16
+	// C1G2 capabilities
+	CanSupportBlockErase     bool
+	CanSupportBlockWrite     bool
+	MaxSelectFiltersPerQuery uint16
+
+	Message *codec.Message
+}
+
+// ReaderConfig is a decoded GET_READER_CONFIG_RESPONSE
+type ReaderConfig struct {
+	ReaderID []byte
+	Antennas []AntennaConfig
+	GPIs     []GPIState
+	GPOs     []GPOState
+	// KeepalivePeriod is zero when the keepalives are disabled
+	KeepalivePeriod time.Duration
+	Message         *codec.Message
+}
+
+// AntennaConfig merges the AntennaProperties and the AntennaConfiguration
+// of an antenna
+type AntennaConfig struct {
+	AntennaID uint16
+	Connected bool
+	// Gain is in dBi*100
+	Gain int16
+	// ReceiverSensitivity and TransmitPower are indexes in the tables of
+	// the Capabilities
+	ReceiverSensitivity uint16
+	TransmitPower       uint16
+	HopTableID          uint16
+	ChannelIndex        uint16
+}
+
+// GPIState is a GPIPortCurrentState
+type GPIState struct {
+	Port    uint16
+	Enabled bool
+	// State is 0 low, 1 high and 2 unknown
+	State uint8
+}
+
+// GPOState is a GPOWriteData
+type GPOState struct {
+	Port uint16
+	Data bool
+}
+
+// NewCapabilities reads a GET_READER_CAPABILITIES_RESPONSE
+func NewCapabilities(m *codec.Message) *Capabilities {
+	c := &Capabilities{Message: m}
+	for _, p := range m.Find(codec.GeneralDeviceCapabilities) {
+		c.MaxAntennas = uint16(p.Uint("MaxNumberOfAntennaSupported"))
+		c.CanSetAntennaProperties = p.Bool("CanSetAntennaProperties")
+		c.HasUTCClock = p.Bool("HasUTCClockCapability")
+		c.Manufacturer = uint32(p.Uint("DeviceManufacturerName"))
+		c.Model = uint32(p.Uint("ModelName"))
+		v, _ := p.Field("ReaderFirmwareVersion")
+		c.FirmwareVersion, _ = v.(string)
+	}
+	for _, p := range m.Find(codec.ReceiveSensitivityEntry) {
+		if c.ReceiveSensitivities == nil {
+			c.ReceiveSensitivities = make(map[uint16]int16)
+		}
+		c.ReceiveSensitivities[uint16(p.Uint("Index"))] = int16(p.Int("ReceiveSensitivityValue"))
+	}
+	for _, p := range m.Find(codec.TransmitPowerLevelEntry) {
+		if c.TransmitPowerLevels == nil {
+			c.TransmitPowerLevels = make(map[uint16]int16)
+		}
+		c.TransmitPowerLevels[uint16(p.Uint("Index"))] = int16(p.Int("TransmitPowerValue"))
+	}
+	if p := m.First(codec.GPIOCapabilities); p != nil {
+		c.NumGPIs = uint16(p.Uint("NumGPIs"))
+		c.NumGPOs = uint16(p.Uint("NumGPOs"))
+	}
+	if p := m.First(codec.LLRPCapabilities); p != nil {
+		c.CanReportBufferFillWarning = p.Bool("CanReportBufferFillWarning")
+		c.SupportsEventAndReportHolding = p.Bool("SupportsEventAndReportHolding")
+		c.MaxPriorityLevels = uint8(p.Uint("MaxNumPriorityLevelsSupported"))
+		c.MaxROSpecs = uint32(p.Uint("MaxNumROSpecs"))
+		c.MaxSpecsPerROSpec = uint32(p.Uint("MaxNumSpecsPerROSpec"))
+		c.MaxAccessSpecs = uint32(p.Uint("MaxNumAccessSpecs"))
+		c.MaxOpSpecsPerAccessSpec = uint32(p.Uint("MaxNumOpSpecsPerAccessSpec"))
+	}
+	if p := m.First(codec.RegulatoryCapabilities); p != nil {
+		c.CountryCode = uint16(p.Uint("CountryCode"))
+		c.CommunicationsStandard = uint16(p.Uint("CommunicationsStandard"))
+	}
+	if p := m.First(codec.C1G2LLRPCapabilities); p != nil {
+		c.CanSupportBlockErase = p.Bool("CanSupportBlockErase")
+		c.CanSupportBlockWrite = p.Bool("CanSupportBlockWrite")
+		c.MaxSelectFiltersPerQuery = uint16(p.Uint("MaxNumSelectFiltersPerQuery"))
+	}
+	return c
+}
+
+// NewReaderConfig reads a GET_READER_CONFIG_RESPONSE
+func NewReaderConfig(m *codec.Message) *ReaderConfig {
+	rc := &ReaderConfig{Message: m}
+	antenna := func(id uint16) *AntennaConfig {
+		for i := range rc.Antennas {
+			if rc.Antennas[i].AntennaID == id {
+				return &rc.Antennas[i]
+			}
+		}
+		rc.Antennas = append(rc.Antennas, AntennaConfig{AntennaID: id})
+		return &rc.Antennas[len(rc.Antennas)-1]
+	}
+	for _, p := range m.Parameters {
+		switch p.Type {
+		case codec.Identification:
+			v, _ := p.Field("ReaderID")
+			rc.ReaderID, _ = v.([]byte)
+		case codec.AntennaProperties:
+			a := antenna(uint16(p.Uint("AntennaID")))
+			a.Connected = p.Bool("AntennaConnected")
+			a.Gain = int16(p.Int("AntennaGain"))
+		case codec.AntennaConfiguration:
+			a := antenna(uint16(p.Uint("AntennaID")))
+			if r := p.First(codec.RFReceiver); r != nil {
+				a.ReceiverSensitivity = uint16(r.Uint("ReceiverSensitivity"))
+			}
+			if t := p.First(codec.RFTransmitter); t != nil {
+				a.TransmitPower = uint16(t.Uint("TransmitPower"))
+				a.HopTableID = uint16(t.Uint("HopTableID"))
+				a.ChannelIndex = uint16(t.Uint("ChannelIndex"))
+			}
+		case codec.GPIPortCurrentState:
+			rc.GPIs = append(rc.GPIs, GPIState{
+				Port:    uint16(p.Uint("GPIPortNum")),
+				Enabled: p.Bool("Config"),
+				State:   uint8(p.Uint("State")),
+			})
+		case codec.GPOWriteData:
+			rc.GPOs = append(rc.GPOs, GPOState{
+				Port: uint16(p.Uint("GPOPortNumber")),
+				Data: p.Bool("GPOData"),
+			})
+		case codec.KeepaliveSpec:
+			if p.Uint("KeepaliveTriggerType") == 1 {
+				rc.KeepalivePeriod = time.Duration(p.Uint("PeriodicTriggerValue")) * time.Millisecond
+			}
+		}
+	}
+	return rc
+}
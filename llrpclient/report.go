@@ -0,0 +1,89 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package llrpclient
+
+import (
+	"time"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// Report is a decoded RO_ACCESS_REPORT
+type Report struct {
+	MessageID uint32
+	Tags      []TagRead
+	Message   *codec.Message
+}
+
+// TagRead is a TagReportData; the optional values the reader didn't send
+// are left zero
+type TagRead struct {
+	EPC          []byte
+	PC           uint16
+	AntennaID    uint16
+	PeakRSSI     int8
+	ChannelIndex uint16
+	SeenCount    uint16
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	ROSpecID     uint32
+	Parameter    *codec.Parameter
+}
+
+// Event is a decoded READER_EVENT_NOTIFICATION
+type Event struct {
+	MessageID uint32
+	Timestamp time.Time
+	// Data is the ReaderEventNotificationData, with the event parameters
+	// below its timestamp
+	Data    *codec.Parameter
+	Message *codec.Message
+}
+
+// NewReport reads the tags in an RO_ACCESS_REPORT
+func NewReport(m *codec.Message) *Report {
+	r := &Report{MessageID: m.ID, Message: m}
+	for _, trd := range m.Find(codec.TagReportData) {
+		t := TagRead{EPC: codec.EPC(trd), Parameter: trd}
+		for _, p := range trd.Parameters {
+			switch p.Type {
+			case codec.C1G2PC:
+				t.PC = uint16(p.Uint("PC_Bits"))
+			case codec.AntennaID:
+				t.AntennaID = uint16(p.Uint("AntennaID"))
+			case codec.PeakRSSI:
+				t.PeakRSSI = int8(p.Int("PeakRSSI"))
+			case codec.ChannelIndex:
+				t.ChannelIndex = uint16(p.Uint("ChannelIndex"))
+			case codec.TagSeenCount:
+				t.SeenCount = uint16(p.Uint("TagCount"))
+			case codec.FirstSeenTimestampUTC:
+				t.FirstSeen = microseconds(p.Uint("Microseconds"))
+			case codec.LastSeenTimestampUTC:
+				t.LastSeen = microseconds(p.Uint("Microseconds"))
+			case codec.ROSpecID:
+				t.ROSpecID = uint32(p.Uint("ROSpecID"))
+			}
+		}
+		r.Tags = append(r.Tags, t)
+	}
+	return r
+}
+
+// NewEvent reads the timestamp of a READER_EVENT_NOTIFICATION
+func NewEvent(m *codec.Message) *Event {
+	e := &Event{MessageID: m.ID, Message: m, Data: m.First(codec.ReaderEventNotificationData)}
+	if e.Data != nil {
+		if ts := e.Data.First(codec.UTCTimestamp); ts != nil {
+			e.Timestamp = microseconds(ts.Uint("Microseconds"))
+		}
+	}
+	return e
+}
+
+func microseconds(us uint64) time.Time {
+	return time.Unix(int64(us/1e6), int64(us%1e6)*1000).UTC()
+}
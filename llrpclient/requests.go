@@ -0,0 +1,175 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package llrpclient
+
+import (
+	"github.com/iomz/golemu/codec"
+)
+
+// RequestedData values for GET_READER_CAPABILITIES and GET_READER_CONFIG
+const (
+	RequestAll uint8 = 0
+)
+
+// GetReaderCapabilities requests the reader capabilities
+func (c *Client) GetReaderCapabilities(requestedData uint8) (*Capabilities, error) {
+	m := codec.NewMessage(codec.GetReaderCapabilities, 0).
+		SetField("RequestedData", requestedData)
+	res, err := c.Transact(m)
+	if err != nil {
+		return nil, err
+	}
+	return NewCapabilities(res), nil
+}
+
+// GetReaderConfig requests the reader configuration; zero selects all the
+// antennas and ports
+func (c *Client) GetReaderConfig(antennaID uint16, requestedData uint8, gpiPort, gpoPort uint16) (*ReaderConfig, error) {
+	m := codec.NewMessage(codec.GetReaderConfig, 0).
+		SetField("AntennaID", antennaID).
+		SetField("RequestedData", requestedData).
+		SetField("GPIPortNum", gpiPort).
+		SetField("GPOPortNum", gpoPort)
+	res, err := c.Transact(m)
+	if err != nil {
+		return nil, err
+	}
+	return NewReaderConfig(res), nil
+}
+
+// SetReaderConfig changes the reader configuration with the given
+// parameters, after a factory reset if reset is set
+func (c *Client) SetReaderConfig(reset bool, params ...*codec.Parameter) error {
+	m := codec.NewMessage(codec.SetReaderConfig, 0).
+		SetField("ResetToFactoryDefault", reset).
+		Add(params...)
+	_, err := c.Transact(m)
+	return err
+}
+
+// AddROSpec installs a ROSpec parameter
+func (c *Client) AddROSpec(rospec *codec.Parameter) error {
+	_, err := c.Transact(codec.NewMessage(codec.AddROSpec, 0).Add(rospec))
+	return err
+}
+
+// DeleteROSpec deletes a ROSpec, or all of them with 0
+func (c *Client) DeleteROSpec(id uint32) error {
+	return c.rospecRequest(codec.DeleteROSpec, id)
+}
+
+// StartROSpec starts a ROSpec
+func (c *Client) StartROSpec(id uint32) error {
+	return c.rospecRequest(codec.StartROSpec, id)
+}
+
+// StopROSpec stops a ROSpec
+func (c *Client) StopROSpec(id uint32) error {
+	return c.rospecRequest(codec.StopROSpec, id)
+}
+
+// EnableROSpec enables a ROSpec, or all of them with 0
+func (c *Client) EnableROSpec(id uint32) error {
+	return c.rospecRequest(codec.EnableROSpec, id)
+}
+
+// DisableROSpec disables a ROSpec, or all of them with 0
+func (c *Client) DisableROSpec(id uint32) error {
+	return c.rospecRequest(codec.DisableROSpec, id)
+}
+
+// GetROSpecs returns the ROSpecs installed on the reader
+func (c *Client) GetROSpecs() ([]*codec.Parameter, error) {
+	res, err := c.Transact(codec.NewMessage(codec.GetROSpecs, 0))
+	if err != nil {
+		return nil, err
+	}
+	return res.Find(codec.ROSpec), nil
+}
+
+// AddAccessSpec installs an AccessSpec parameter
+func (c *Client) AddAccessSpec(accessSpec *codec.Parameter) error {
+	_, err := c.Transact(codec.NewMessage(codec.AddAccessSpec, 0).Add(accessSpec))
+	return err
+}
+
+// DeleteAccessSpec deletes an AccessSpec, or all of them with 0
+func (c *Client) DeleteAccessSpec(id uint32) error {
+	return c.accessSpecRequest(codec.DeleteAccessSpec, id)
+}
+
+// EnableAccessSpec enables an AccessSpec, or all of them with 0
+func (c *Client) EnableAccessSpec(id uint32) error {
+	return c.accessSpecRequest(codec.EnableAccessSpec, id)
+}
+
+// DisableAccessSpec disables an AccessSpec, or all of them with 0
+func (c *Client) DisableAccessSpec(id uint32) error {
+	return c.accessSpecRequest(codec.DisableAccessSpec, id)
+}
+
+// GetAccessSpecs returns the AccessSpecs installed on the reader
+func (c *Client) GetAccessSpecs() ([]*codec.Parameter, error) {
+	res, err := c.Transact(codec.NewMessage(codec.GetAccessSpecs, 0))
+	if err != nil {
+		return nil, err
+	}
+	return res.Find(codec.AccessSpec), nil
+}
+
+// GetReport asks the reader to send the buffered reports
+func (c *Client) GetReport() error {
+	return c.Send(codec.NewMessage(codec.GetReport, 0))
+}
+
+// EnableEventsAndReports releases the events and reports held since the
+// connection
+func (c *Client) EnableEventsAndReports() error {
+	return c.Send(codec.NewMessage(codec.EnableEventsAndReports, 0))
+}
+
+func (c *Client) rospecRequest(t uint16, id uint32) error {
+	_, err := c.Transact(codec.NewMessage(t, 0).SetField("ROSpecID", id))
+	return err
+}
+
+func (c *Client) accessSpecRequest(t uint16, id uint32) error {
+	_, err := c.Transact(codec.NewMessage(t, 0).SetField("AccessSpecID", id))
+	return err
+}
+
+// BasicROSpec builds a ROSpec that inventories the antennas (0 for all)
+// with Class1 Gen2 until it is stopped, reporting every tag as it is read
+// with its antenna, RSSI, seen count and timestamps
+func BasicROSpec(id uint32, antennas ...uint16) *codec.Parameter {
+	if len(antennas) == 0 {
+		antennas = []uint16{0}
+	}
+	boundary := codec.NewParameter(codec.ROBoundarySpec).Add(
+		codec.NewParameter(codec.ROSpecStartTrigger).SetField("ROSpecStartTriggerType", 0),
+		codec.NewParameter(codec.ROSpecStopTrigger).SetField("ROSpecStopTriggerType", 0),
+	)
+	aispec := codec.NewParameter(codec.AISpec).SetField("AntennaIDs", antennas).Add(
+		codec.NewParameter(codec.AISpecStopTrigger).SetField("AISpecStopTriggerType", 0),
+		codec.NewParameter(codec.InventoryParameterSpec).
+			SetField("InventoryParameterSpecID", 1).
+			SetField("ProtocolID", 1),
+	)
+	report := codec.NewParameter(codec.ROReportSpec).
+		SetField("ROReportTrigger", 2).
+		SetField("N", 1).
+		Add(codec.NewParameter(codec.TagReportContentSelector).
+			SetField("EnableAntennaID", true).
+			SetField("EnablePeakRSSI", true).
+			SetField("EnableFirstSeenTimestamp", true).
+			SetField("EnableLastSeenTimestamp", true).
+			SetField("EnableTagSeenCount", true))
+	return codec.NewParameter(codec.ROSpec).
+		SetField("ROSpecID", id).
+		SetField("Priority", 0).
+		SetField("CurrentState", 0).
+		Add(boundary, aispec, report)
+}
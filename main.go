@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -24,12 +25,13 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/fatih/structs"
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/iomz/go-llrp"
 	"github.com/iomz/go-llrp/binutil"
+	"github.com/iomz/golemu/codec"
+	"github.com/iomz/golemu/llrpclient"
 	"golang.org/x/net/websocket"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -39,27 +41,129 @@ var (
 	version = "0.1.0"
 
 	// app
-	app                = kingpin.New("golemu", "A mock LLRP-based logical reader emulator for RFID Tags.")
-	debug              = app.Flag("debug", "Enable debug mode.").Short('v').Default("false").Bool()
-	initialMessageID   = app.Flag("initialMessageID", "The initial messageID to start from.").Default("1000").Int()
-	initialKeepaliveID = app.Flag("initialKeepaliveID", "The initial keepaliveID to start from.").Default("80000").Int()
-	ip                 = app.Flag("ip", "LLRP listening address.").Short('a').Default("0.0.0.0").IP()
-	keepaliveInterval  = app.Flag("keepalive", "LLRP Keepalive interval.").Short('k').Default("0").Int()
-	port               = app.Flag("port", "LLRP listening port.").Short('p').Default("5084").Int()
-	pdu                = app.Flag("pdu", "The maximum size of LLRP PDU.").Short('m').Default("1500").Int()
-	reportInterval     = app.Flag("reportInterval", "The interval of ROAccessReport in ms. Pseudo ROReport spec option.").Short('i').Default("10000").Int()
+	app                   = kingpin.New("golemu", "A mock LLRP-based logical reader emulator for RFID Tags.")
+	debug                 = app.Flag("debug", "Enable debug mode.").Short('v').Default("false").Bool()
+	initialMessageID      = app.Flag("initialMessageID", "The initial messageID to start from.").Default("1000").Int()
+	initialKeepaliveID    = app.Flag("initialKeepaliveID", "The initial keepaliveID to start from.").Default("80000").Int()
+	ip                    = app.Flag("ip", "LLRP listening address.").Short('a').Default("0.0.0.0").IP()
+	keepaliveInterval     = app.Flag("keepalive", "LLRP Keepalive interval.").Short('k').Default("0").Int()
+	port                  = app.Flag("port", "LLRP listening port.").Short('p').Default("5084").Int()
+	pdu                   = app.Flag("pdu", "The maximum size of LLRP PDU.").Short('m').Default("1500").Int()
+	reportInterval        = app.Flag("reportInterval", "The interval of ROAccessReport in ms. Pseudo ROReport spec option.").Short('i').Default("10000").Int()
+	record                = app.Flag("record", "Record the LLRP sessions to a JSON lines file.").String()
+	deterministic         = app.Flag("deterministic", "Drive message IDs, timestamps and reports by a virtual clock and a seed.").Bool()
+	epoch                 = app.Flag("epoch", "The start of the virtual clock in the deterministic mode (RFC 3339).").Default("2018-01-01T00:00:00Z").String()
+	speed                 = app.Flag("speed", "The pace of the virtual clock relative to real time, 0 runs it as fast as possible.").Default("1").Float64()
+	seed                  = app.Flag("seed", "The random seed in the deterministic mode.").Default("1").Int64()
+	mdns                  = app.Flag("mdns", "Advertise the reader as _llrp._tcp with mDNS/DNS-SD.").Bool()
+	mdnsName              = app.Flag("mdns-name", "The DNS-SD instance name of the reader.").Default("golemu").String()
+	mdnsModel             = app.Flag("mdns-model", "The reader model advertised in the TXT record.").Default("golemu").String()
+	mdnsImpinj            = app.Flag("mdns-impinj", "Advertise an Impinj-style SpeedwayR-XX-XX-XX hostname.").Bool()
+	mdnsInterface         = app.Flag("mdns-interface", "The network interface to advertise on, all by default.").String()
+	antennas              = app.Flag("antennas", "The number of antenna ports of the reader.").Default("4").Int()
+	snmpAddress           = app.Flag("snmp", "Serve the reader health with SNMP v2c and v3 on the UDP address, e.g. :1161.").String()
+	snmpCommunity         = app.Flag("snmp-community", "The SNMP v2c community.").Default("public").String()
+	snmpUsers             = app.Flag("snmp-user", "An SNMP v3 user NAME, or NAME:md5:PASSWORD or NAME:sha:PASSWORD to authenticate, can be repeated.").Strings()
+	snmpEngineIDHex       = app.Flag("snmp-engine-id", "The SNMP v3 engine ID in hex, from the hostname by default.").String()
+	snmpTraps             = app.Flag("snmp-trap", "Send SNMP traps to the host:port, can be repeated.").Strings()
+	region                = app.Flag("region", "The regulatory profile of the RF timing: fcc, etsi or etsi-lbt.").Default("fcc").Enum("fcc", "etsi", "etsi-lbt")
+	lbtBusy               = app.Flag("lbt-busy", "The probability that listen-before-talk finds the channel busy.").Default("0.1").Float64()
+	dutyCycle             = app.Flag("duty-cycle", "Limit the time on air to a percentage of every duty cycle period, 0 for no limit.").Default("0").Float64()
+	dutyPeriod            = app.Flag("duty-period", "The duty cycle observation period.").Default("1h").Duration()
+	pacing                = app.Flag("pacing", "How the reports of an interval are sent: burst, spread evenly or stream one per read.").Default("burst").Enum("burst", "spread", "stream")
+	maxTagsPerReport      = app.Flag("max-tags-per-report", "The maximum number of tags in an RO_ACCESS_REPORT, 0 for as many as --pdu fits.").Default("0").Int()
+	kafkaBrokers          = app.Flag("kafka", "Produce the reads and reader events to the Kafka broker host:port, can be repeated.").Strings()
+	kafkaTopic            = app.Flag("kafka-topic", "The Kafka topic of the reads.").Default("golemu-reads").String()
+	kafkaEventTopic       = app.Flag("kafka-event-topic", "The Kafka topic of the reader events.").Default("golemu-events").String()
+	kafkaFormat           = app.Flag("kafka-format", "The encoding of the Kafka messages: json or avro.").Default("json").Enum("json", "avro")
+	kafkaSchemaRegistry   = app.Flag("kafka-schema-registry", "Register the Avro schemas with the schema registry at the URL and frame the Avro messages with their schema IDs.").String()
+	kafkaKey              = app.Flag("kafka-key", "The key of the read messages: epc, reader or none.").Default("epc").Enum("epc", "reader", "none")
+	kafkaPartitioner      = app.Flag("kafka-partitioner", "Partition by the hash of the key or round-robin.").Default("hash").Enum("hash", "round-robin")
+	kafkaBatch            = app.Flag("kafka-batch", "The maximum number of messages in a produce request.").Default("100").Int()
+	kafkaLinger           = app.Flag("kafka-linger", "The longest time a message waits for its batch.").Default("100ms").Duration()
+	kafkaAcks             = app.Flag("kafka-acks", "The acknowledgements required from the brokers: 0, 1 or -1 for all.").Default("1").Int()
+	lineAddress           = app.Flag("lines", "Serve the reads as text lines to the clients of the TCP address, e.g. :2112.").String()
+	lineFormat            = app.Flag("line-format", "The Go template of a read line.").Default("{{.EPC}},{{.Antenna}},{{.RSSI}},{{rfc3339 .Timestamp}}").String()
+	lineDelimiter         = app.Flag("line-delimiter", "The end of a line, with Go escapes.").Default(`\r\n`).String()
+	lineHeartbeatFormat   = app.Flag("line-heartbeat", "The Go template of a heartbeat line.").Default("HEARTBEAT,{{rfc3339 .Timestamp}}").String()
+	lineHeartbeatInterval = app.Flag("line-heartbeat-interval", "Send a heartbeat line at this interval, 0 for none.").Default("0s").Duration()
+	readHooks             = app.Flag("read-hook", "POST the reads and reader events as JSON to the webhook URL, or publish them to mqtt://[USER:PASSWORD@]HOST[:PORT]/TOPIC, can be repeated.").Strings()
+	opcuaAddress          = app.Flag("opcua", "Serve every reader as an OPC UA AutoID RfidReaderDeviceType, the one on --port on the TCP address, e.g. :4840, and the others on the ports that follow.").String()
+	opcuaName             = app.Flag("opcua-name", "The name of the reader object in the OPC UA DeviceSet, followed by -PORT for the readers not on --port.").Default("golemu").String()
+	opcuaNodeSet          = app.Flag("opcua-nodeset", "The Opc.Ua.AutoID.NodeSet2.xml of the AutoID specification, overriding the NodeIds of its types.").ExistingFile()
 
 	// server mode
-	server  = app.Command("server", "Run as an LLRP tag stream server.")
-	webPort = server.Flag("webPort", "Port listening for web access.").Short('w').Default("3000").Int()
-	file    = server.Flag("file", "The file containing Tag data.").Short('f').Default("tags.csv").String()
+	server        = app.Command("server", "Run as an LLRP tag stream server.")
+	webPort       = server.Flag("webPort", "Port listening for web access.").Short('w').Default("3000").Int()
+	file          = server.Flag("file", "The file containing Tag data.").Short('f').Default("tags.csv").String()
+	scenarioDir   = server.Flag("scenarios", "The directory of the scenarios for the web UI, each a simulation directory.").Default(".").String()
+	floorPlanDir  = server.Flag("floorplans", "The directory of the floor plans for the web UI, saved as NAME.floor.json.").Default(".").String()
+	autostartFile = server.Flag("autostart", "The JSON ROSpec the reader runs from launch while no LLRP client is connected, replaced by PUT /api/v1/autostart.").String()
+	gpoBindings   = server.Flag("gpo", "Bind a GPO port, or * for all, to an action on its changes as PORT=webhook:URL, PORT=exec:COMMAND, PORT=mqtt://HOST:PORT/TOPIC or PORT=ws, can be repeated.").Strings()
+	defaultChip   = server.Flag("chip", "The chip model of the tags without one, from GET /api/v1/chips.").String()
+	chipFile      = server.Flag("chips", "The JSON file of the chip models of the tags by EPC, updated by PUT /api/v1/tags/EPC/chip.").String()
+	memoryFile    = server.Flag("usermemory", "The JSON file of the user memory of the tags by EPC, updated by PUT /api/v1/usermemory/EPC.").String()
+	bridgeReaders = server.Flag("bridge-reader", "Allow the websocket LLRP bridge to connect to the real reader host:port, can be repeated.").Strings()
 
 	// client mode
-	client = app.Command("client", "Run as an LLRP client.")
+	client      = app.Command("client", "Run as an LLRP client.")
+	includes    = client.Flag("include", "Only keep the reads whose EPC matches the hex glob or EPC URI pattern, can be repeated.").Strings()
+	excludes    = client.Flag("exclude", "Drop the reads whose EPC matches the hex glob or EPC URI pattern, can be repeated.").Strings()
+	minRSSI     = client.Flag("min-rssi", "Drop the reads below the RSSI in dBm.").Default("-128").Int()
+	locations   = client.Flag("location", "Name the location of an antenna as ANTENNA=NAME, can be repeated.").Strings()
+	dedupe      = client.Flag("dedupe", "Drop the reads of a tag already reported at the same location within the window, 0 for none.").Default("0s").Duration()
+	productFile = client.Flag("products", "Name the products of the reads from a CSV file of PREFIX,NAME rows.").String()
 
 	// simulator mode
-	simulate      = app.Command("simulate", "Run in the simulator mode.")
-	simulationDir = simulate.Arg("simulationDir", "The directory contains tags for each event cycle.").Required().String()
+	simulate        = app.Command("simulate", "Run in the simulator mode.")
+	simulationDir   = simulate.Arg("simulationDir", "The directory contains tags for each event cycle.").String()
+	tracks          = simulate.Flag("track", "Play a simulation directory on an antenna of a reader as [PORT:]ANTENNA=DIR, can be repeated.").Strings()
+	cycles          = simulate.Flag("cycles", "Stop after the number of event cycles, 0 runs forever.").Default("0").Int()
+	golden          = simulate.Flag("golden", "Compare the byte stream sent to the client with the golden file.").String()
+	updateGolden    = simulate.Flag("update-golden", "Write the byte stream sent to the client to the golden file.").Bool()
+	checkpoint      = simulate.Flag("checkpoint", "Save the simulation state to the file to resume it later.").String()
+	checkpointEvery = simulate.Flag("checkpoint-every", "Save a checkpoint every number of event cycles.").Default("10").Int()
+	resume          = simulate.Flag("resume", "Resume the simulation from the --checkpoint file.").Bool()
+
+	// controller mode
+	controller        = app.Command("controller", "Assign the readers of a simulation to worker processes and play it in lockstep.")
+	controllerTracks  = controller.Flag("track", "Play a simulation directory on an antenna of a reader as PORT:ANTENNA=DIR, can be repeated.").Strings()
+	controllerCycles  = controller.Flag("cycles", "Stop after the number of event cycles, 0 runs forever.").Default("0").Int()
+	controllerWebPort = controller.Flag("webPort", "Port listening for the cluster API and UI.").Short('w').Default("3000").Int()
+	clusterScenarios  = controller.Flag("scenarios", "The directory of the scenarios played on the antennas by the API.").Default(".").String()
+	workerAddresses   = controller.Flag("worker", "The host:port of a worker, can be repeated.").Strings()
+	localWorkers      = controller.Flag("local-workers", "The number of worker processes to start on this host.").Default("0").Int()
+	localWorkerPort   = controller.Flag("local-worker-port", "The port of the first local worker, the next ones follow.").Default("5090").Int()
+
+	// worker mode
+	worker       = app.Command("worker", "Host the readers assigned by a controller.")
+	workerListen = worker.Flag("listen", "The address of the worker API for the controller.").Default(":5090").String()
+
+	// diff mode
+	diff           = app.Command("diff", "Compare two recorded LLRP sessions.")
+	diffA          = diff.Arg("a", "The baseline recording.").Required().ExistingFile()
+	diffB          = diff.Arg("b", "The recording to compare with the baseline.").Required().ExistingFile()
+	diffIDs        = diff.Flag("ids", "Compare message IDs.").Bool()
+	diffTimestamps = diff.Flag("timestamps", "Compare timestamps.").Bool()
+	diffIgnore     = diff.Flag("ignore", "A parameter or field name to ignore, can be repeated.").Strings()
+
+	// fidelity mode
+	fidelity         = app.Command("fidelity", "Compare a golemu recording with a real reader recording of the same client.")
+	fidelityReal     = fidelity.Arg("real", "The recording of the real reader.").Required().ExistingFile()
+	fidelityEmulated = fidelity.Arg("golemu", "The recording of golemu.").Required().ExistingFile()
+
+	// check mode
+	check      = app.Command("check", "Validate tag files, simulation directories, scenarios, recordings and ROSpecs.")
+	checkFiles = check.Arg("files", "The files or simulation directories to check.").Strings()
+
+	// fixtures mode
+	fixtures         = app.Command("fixtures", "Convert a recorded LLRP session into Go test fixtures.")
+	fixtureRecording = fixtures.Arg("recording", "The recorded session.").Required().ExistingFile()
+	fixtureDir       = fixtures.Flag("testdata", "Write every message as a .llrp file and expectations.json to the directory.").String()
+	fixtureGo        = fixtures.Flag("go", "Write the messages as a Go test file.").String()
+	fixturePackage   = fixtures.Flag("package", "The package of the Go test file.").Default("llrp").String()
+	fixtureTable     = fixtures.Flag("name", "The name of the table in the Go test file, from the recording by default.").String()
+	fixtureConn      = fixtures.Flag("conn", "Only the messages of the connection.").String()
 
 	// LLRPConn flag
 	isLLRPConnAlive = false
@@ -69,12 +173,27 @@ var (
 	keepaliveID = *initialKeepaliveID
 	// Current activeClients
 	activeClients = make(map[WebsockConn]int) // map containing clients
+	// numbered changes of the tag store for the websocket clients
+	journal = newTagJournal()
 	// Tag management channel
 	tagManagerChannel = make(chan TagManager)
 	// notify tag update channel
 	notify = make(chan bool)
 	// update TagReportDataStack when tag is updated
 	tagUpdated = make(chan llrp.Tags)
+	// LLRP session recorder when --record is given
+	recorder *SessionRecorder
+	// time source of the reader, virtual in the deterministic mode
+	clk Clock = wallClock{}
+	// source of randomness for the read and report models
+	rng       *rand.Rand
+	rngSource *countingSource
+	// mDNS responder when --mdns is given
+	responder *mdnsResponder
+	// state of the emulated reader hardware
+	health *readerHealth
+	// SNMP agent when --snmp is given
+	agent *snmpAgent
 )
 
 // TagManager is a struct for tag management channel
@@ -100,6 +219,10 @@ type WebsocketMessage struct {
 	UpdateType string
 	Tag        llrp.TagRecord
 	Tags       []map[string]interface{}
+	// Seq numbers the tag store changes within the Epoch of the server
+	// process; a client sends the last ones it has seen with "resume"
+	Seq   uint64
+	Epoch string
 }
 
 // WebsockConn holds connection consists of the websocket and the client ip
@@ -130,6 +253,29 @@ func APIDeleteTag(c *gin.Context) {
 	}
 }
 
+// AntennaState is the JSON body to connect or disconnect an antenna
+type AntennaState struct {
+	Connected bool `json:"connected"`
+}
+
+// APIPutAntenna connects or disconnects an antenna of the reader
+func APIPutAntenna(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid antenna ID!\n")
+		return
+	}
+	var state AntennaState
+	if err := c.BindWith(&state, binding.JSON); err != nil {
+		return
+	}
+	if err := health.SetAntenna(id, state.Connected); err != nil {
+		c.String(http.StatusNotFound, err.Error()+"\n")
+		return
+	}
+	c.String(http.StatusAccepted, "Antenna updated!\n")
+}
+
 // Broadcast a message vi websocket
 func Broadcast(clientMessage []byte) {
 	for cs := range activeClients {
@@ -160,17 +306,8 @@ func ReqAddTag(ut string, req []llrp.TagRecord) string {
 		}
 		tagManagerChannel <- add
 
-		if add = <-tagManagerChannel; len(add.Tags) != 0 {
-			m := WebsocketMessage{
-				UpdateType: "add",
-				Tag:        t,
-				Tags:       []map[string]interface{}{}}
-			clientMessage, err := json.Marshal(m)
-			if err != nil {
-				panic(err)
-			}
-			Broadcast(clientMessage)
-		} else {
+		// the tag manager broadcasts the change to the websocket clients
+		if add = <-tagManagerChannel; len(add.Tags) == 0 {
 			failed = true
 		}
 	}
@@ -202,17 +339,7 @@ func ReqDeleteTag(ut string, req []llrp.TagRecord) string {
 		}
 		tagManagerChannel <- delete
 
-		if delete = <-tagManagerChannel; len(delete.Tags) != 0 {
-			m := WebsocketMessage{
-				UpdateType: "delete",
-				Tag:        t,
-				Tags:       []map[string]interface{}{}}
-			clientMessage, err := json.Marshal(m)
-			if err != nil {
-				panic(err)
-			}
-			Broadcast(clientMessage)
-		} else {
+		if delete = <-tagManagerChannel; len(delete.Tags) == 0 {
 			failed = true
 		}
 	}
@@ -224,23 +351,6 @@ func ReqDeleteTag(ut string, req []llrp.TagRecord) string {
 	return ut
 }
 
-// ReqRetrieveTag handles a tag retrieval request
-func ReqRetrieveTag() []map[string]interface{} {
-	retrieve := TagManager{
-		Action: RetrieveTags,
-		Tags:   []*llrp.Tag{},
-	}
-	tagManagerChannel <- retrieve
-	retrieve = <-tagManagerChannel
-	var tagList []map[string]interface{}
-	for _, tag := range retrieve.Tags {
-		t := structs.Map(llrp.NewTagRecord(*tag))
-		tagList = append(tagList, t)
-	}
-	log.Printf("retrieve: %v", tagList)
-	return tagList
-}
-
 // SockServer to handle messaging between clients
 func SockServer(ws *websocket.Conn) {
 	var err error
@@ -258,8 +368,10 @@ func SockServer(ws *websocket.Conn) {
 	client := ws.Request().RemoteAddr
 	log.Printf("client connected: %v", client)
 	clientSock := WebsockConn{ws, client}
+	journal.Lock()
 	activeClients[clientSock] = 0
 	log.Printf("number of clients connected: %v", len(activeClients))
+	journal.Unlock()
 
 	// for loop so the websocket stays open otherwise
 	// it'll close after one Receieve and Send
@@ -268,8 +380,10 @@ func SockServer(ws *websocket.Conn) {
 			// If we cannot Read then the connection is closed
 			log.Printf("websocket Disconnected waiting %v", err.Error())
 			// remove the ws client conn from our active clients
+			journal.Lock()
 			delete(activeClients, clientSock)
 			log.Printf("number of clients still connected ... %v", len(activeClients))
+			journal.Unlock()
 			return
 		}
 
@@ -290,16 +404,9 @@ func SockServer(ws *websocket.Conn) {
 		case "delete":
 			m.UpdateType = ReqDeleteTag(m.UpdateType, []llrp.TagRecord{m.Tag})
 		case "retrieve":
-			tagList := ReqRetrieveTag()
-			m = WebsocketMessage{
-				UpdateType: "retrieval",
-				Tag:        llrp.TagRecord{},
-				Tags:       tagList}
-			clientMessage, err = json.Marshal(m)
-			if err != nil {
-				panic(err)
-			}
-			Broadcast(clientMessage)
+			journal.Resume(clientSock, "", 0)
+		case "resume":
+			journal.Resume(clientSock, m.Epoch, m.Seq)
 		default:
 			log.Printf("unknown UpdateType: %v", m.UpdateType)
 		}
@@ -310,7 +417,12 @@ func SockServer(ws *websocket.Conn) {
 func handleRequest(conn net.Conn, tags llrp.Tags) {
 	// Make a buffer to hold incoming data.
 	buf := make([]byte, *pdu)
-	trds := tags.BuildTagReportDataStack(*pdu)
+	trds := buildReports(tags)
+	reader := localReader(*port)
+	// the FastID TIDs wait for the client to enable them
+	chips.Lock()
+	chips.serializedTID = false
+	chips.Unlock()
 
 	for {
 		// Read the incoming connection into the buffer.
@@ -319,11 +431,15 @@ func handleRequest(conn net.Conn, tags llrp.Tags) {
 			// Close the connection when you're done with it.
 			log.Println("the client is disconnected, closing LLRP connection")
 			conn.Close()
+			health.SetConnected(false)
+			publishEvent(reader, "ConnectionClose", 0)
 			return
 		} else if err != nil {
 			log.Println("closing LLRP connection")
 			log.Print(err)
 			conn.Close()
+			health.SetConnected(false)
+			publishEvent(reader, "ConnectionClose", 0)
 			return
 		}
 
@@ -333,48 +449,98 @@ func handleRequest(conn net.Conn, tags llrp.Tags) {
 			if header == llrp.SetReaderConfigHeader {
 				// SRC received, start ROAR
 				log.Println(">>> SET_READER_CONFIG")
+				gpos := false
+				if n := int(binary.BigEndian.Uint32(buf[2:6])); n <= reqLen {
+					if m, err := codec.Decode(buf[:n]); err == nil {
+						chips.Configure(m)
+						if m.First(codec.GPOWriteData) != nil {
+							gpo.WriteMessage(m)
+							gpos = true
+						}
+					}
+				}
 				conn.Write(llrp.SetReaderConfigResponse())
 				log.Println("<<< SET_READER_CONFIG_RESPONSE")
+				if gpos && isLLRPConnAlive {
+					// only the GPOs changed, the reports go on
+					continue
+				}
 			} else if header == llrp.KeepaliveAckHeader {
 				// KA receieved, continue ROAR
 				log.Println(">>> KEEP_ALIVE_ACK")
 			}
 
 			// Tick ROAR and Keepalive interval
-			roarTicker := time.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
-			keepaliveTicker := &time.Ticker{}
+			roarTicker := clk.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+			tx := newRegionTransmitter(clk.Now())
+			keepaliveTicker := &ClockTicker{}
 			if *keepaliveInterval != 0 {
-				keepaliveTicker = time.NewTicker(time.Duration(*keepaliveInterval) * time.Second)
+				keepaliveTicker = clk.NewTicker(time.Duration(*keepaliveInterval) * time.Second)
 			}
+			// the cycle of a tick while the carrier is off, due when it is
+			// back on
+			carrier := &ClockTicker{}
+			pacer := newReportPacer(func(trd *llrp.TagReportData) error {
+				data := accessSpecs.Apply(chips.Apply(userMemory.Apply(trd.Data)))
+				roar := llrp.NewROAccessReport(data, messageID)
+				messageID++
+				if err := roar.Send(conn); err != nil {
+					return err
+				}
+				publishTagReportData(reader, data)
+				return nil
+			})
 			go func() {
 				for { // Infinite loop
 					isLLRPConnAlive = true
 					select {
 					// ROAccessReport interval tick
-					case <-roarTicker.C:
+					case tick := <-roarTicker.C:
+						if carrier.C != nil {
+							// joins the deferred cycle
+							continue
+						}
+						if due := tx.Due(tick); due.After(tick) {
+							carrier = clk.NewTimer(due)
+							continue
+						}
 						log.Printf("<<< RO_ACCESS_REPORT (# reports: %v, # total tags: %v)", len(trds), trds.TotalTagCounts())
-						for _, trd := range trds {
-							roar := llrp.NewROAccessReport(trd.Data, messageID)
-							err := roar.Send(conn)
-							messageID++
-							if err != nil {
-								log.Print(err)
-								isLLRPConnAlive = false
-								break
-							}
+						if err := pacer.Start(tick, trds); err != nil {
+							log.Print(err)
+							isLLRPConnAlive = false
+						}
+					// the carrier is back on for the deferred cycle
+					case on := <-carrier.C:
+						carrier.Stop()
+						carrier = &ClockTicker{}
+						log.Printf("<<< RO_ACCESS_REPORT (# reports: %v, # total tags: %v)", len(trds), trds.TotalTagCounts())
+						if err := pacer.Start(on, trds); err != nil {
+							log.Print(err)
+							isLLRPConnAlive = false
+						}
+					// the next report paced within the interval
+					case now := <-pacer.C():
+						if err := pacer.Send(now); err != nil {
+							log.Print(err)
+							isLLRPConnAlive = false
 						}
 					// Keepalive interval tick
 					case <-keepaliveTicker.C:
+						if err := pacer.Flush(); err != nil {
+							log.Print(err)
+						}
 						log.Println("<<< KEEP_ALIVE")
 						conn.Write(llrp.Keepalive())
 						isLLRPConnAlive = false
 					// When the tag queue is updated
 					case tags := <-tagUpdated:
 						log.Println("### TagUpdated")
-						trds = tags.BuildTagReportDataStack(*pdu)
+						trds = buildReports(tags)
 					}
 					if !isLLRPConnAlive {
 						roarTicker.Stop()
+						carrier.Stop()
+						pacer.Stop()
 						if *keepaliveInterval != 0 {
 							keepaliveTicker.Stop()
 						}
@@ -382,6 +548,25 @@ func handleRequest(conn net.Conn, tags llrp.Tags) {
 					}
 				}
 			}()
+		} else if t := codec.FrameType(buf[:reqLen]); t >= codec.AddAccessSpec && t <= codec.GetAccessSpecs {
+			n := int(binary.BigEndian.Uint32(buf[2:6]))
+			if n > reqLen {
+				log.Printf("truncated message: %v, reqlen: %v", n, reqLen)
+				return
+			}
+			m, err := codec.Decode(buf[:n])
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			log.Printf(">>> %v", m.Name)
+			res, err := accessSpecs.Handle(m).Encode()
+			if err != nil {
+				log.Print(err)
+				res = errorMessage(m.ID, err)
+			}
+			conn.Write(res)
+			log.Printf("<<< %v", codec.MessageName(codec.FrameType(res)))
 		} else {
 			// Unknown LLRP packet received, reset the connection
 			log.Printf("unknown header: %v, reqlen: %v", header, reqLen)
@@ -407,6 +592,10 @@ func runServer() int {
 		log.Printf("%v tags loaded from %v", len(tags), *file)
 	}
 
+	journal.Reset(tags)
+	publishAntennaEvents(*port)
+	addSink(history)
+
 	// Listen for incoming connections.
 	l, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(*port))
 	if err != nil {
@@ -416,6 +605,15 @@ func runServer() int {
 	// Close the listener when the application closes.
 	defer l.Close()
 	log.Printf("listening on %v:%v", ip, *port)
+	advertise(*port)
+	serveSNMP()
+	if err := serveOPCUA(*port, storeInventory); err != nil {
+		log.Fatal(err)
+	}
+	loadAutostart()
+	loadChips()
+	loadUserMemory()
+	bindGPOs()
 
 	// Channel for communicating virtual tag updates and signals
 	signals := make(chan os.Signal)
@@ -429,9 +627,38 @@ func runServer() int {
 			handler := websocket.Handler(SockServer)
 			handler.ServeHTTP(c.Writer, c.Request)
 		})
+		r.GET("/llrp", func(c *gin.Context) {
+			websocket.Server{Handler: BridgeServer, Handshake: bridgeHandshake}.ServeHTTP(c.Writer, c.Request)
+		})
+		r.GET("/llrp/json", func(c *gin.Context) {
+			websocket.Server{Handler: BridgeJSONServer, Handshake: bridgeHandshake}.ServeHTTP(c.Writer, c.Request)
+		})
 		v1 := r.Group("api/v1")
 		v1.POST("/tags", APIPostTag)
 		v1.DELETE("/tags", APIDeleteTag)
+		v1.GET("/tags/:epc/chip", APIGetTagChip)
+		v1.PUT("/tags/:epc/chip", APIPutTagChip)
+		v1.DELETE("/tags/:epc/chip", APIDeleteTagChip)
+		v1.GET("/chips", APIGetChips)
+		v1.PUT("/antennas/:id", APIPutAntenna)
+		v1.GET("/reads", APIGetReads)
+		v1.GET("/gpo", APIGetGPOs)
+		v1.GET("/gpo/log", APIGetGPOLog)
+		v1.GET("/autostart", APIGetAutostart)
+		v1.PUT("/autostart", APIPutAutostart)
+		v1.DELETE("/autostart", APIDeleteAutostart)
+		v1.GET("/usermemory", APIGetUserMemories)
+		v1.POST("/usermemory/decode", APIPostDecodeUserMemory)
+		v1.GET("/usermemory/:epc", APIGetUserMemory)
+		v1.PUT("/usermemory/:epc", APIPutUserMemory)
+		v1.DELETE("/usermemory/:epc", APIDeleteUserMemory)
+		v1.GET("/scenarios", APIGetScenarios)
+		v1.GET("/scenarios/:name", APIGetScenario)
+		v1.PUT("/scenarios/:name", APIPutScenario)
+		v1.GET("/floorplans", APIGetFloorPlans)
+		v1.GET("/floorplans/:name", APIGetFloorPlan)
+		v1.PUT("/floorplans/:name", APIPutFloorPlan)
+		v1.POST("/floorplans/visibility", APIPostVisibility)
 		r.Run(":" + strconv.Itoa(*webPort))
 	}()
 
@@ -447,6 +674,7 @@ func runServer() int {
 						if i := tags.GetIndexOf(t); i < 0 {
 							tags = append(tags, t)
 							res = append(res, t)
+							journal.Record("add", t)
 							// Write to file
 							//writeTagsToCSV(*tags, *file)
 							if isLLRPConnAlive {
@@ -459,6 +687,7 @@ func runServer() int {
 						if i := tags.GetIndexOf(t); i >= 0 {
 							tags = append(tags[:i], tags[i+1:]...)
 							res = append(res, t)
+							journal.Record("delete", t)
 							// Write to file
 							//writeTagsToCSV(tags, *file)
 							if isLLRPConnAlive {
@@ -473,6 +702,10 @@ func runServer() int {
 				tagManagerChannel <- cmd
 			case signal := <-signals:
 				// Handle SIGINT and SIGTERM.
+				responder.Close()
+				agent.Close()
+				closeOPCUA()
+				closeSinks()
 				log.Fatalf("%v", signal)
 			}
 		}
@@ -486,10 +719,16 @@ func runServer() int {
 		if err != nil {
 			log.Fatal(err)
 		}
+		conn = recordConn(conn, "reader")
 		log.Println("LLRP connection initiated")
+		health.SetConnected(true)
+		publishEvent(localReader(*port), "ConnectionAttempt", 0)
+		if *deterministic {
+			atomic.StoreUint32(&messageID, uint32(*initialMessageID))
+		}
 
 		// Send back READER_EVENT_NOTIFICATION
-		currentTime := uint64(time.Now().UTC().Nanosecond() / 1000)
+		currentTime := uint64(clk.Now().UnixNano() / 1000)
 		conn.Write(llrp.ReaderEventNotification(messageID, currentTime))
 		log.Println("<<< READER_EVENT_NOTIFICATION")
 		atomic.AddUint32(&messageID, 1)
@@ -508,46 +747,41 @@ func runClient() int {
 	if err != nil {
 		panic(err)
 	}
+	conn = recordConn(conn, "client")
+	reader := conn.RemoteAddr().String()
+	pipeline = newReadPipeline()
 
-	header := make([]byte, 2)
-	length := make([]byte, 4)
-	for {
-		_, err = io.ReadFull(conn, header)
-		if err != nil {
-			log.Fatal(err)
-		}
-		//length := binary.BigEndian.Uint32(prefix)
-
-		h := binary.BigEndian.Uint16(header)
-		if h == llrp.ReaderEventNotificationHeader {
-			_, err = io.ReadFull(conn, length)
-			message := make([]byte, binary.BigEndian.Uint32(length)-6)
-			_, err = io.ReadFull(conn, message)
-			log.Println(">>> READER_EVENT_NOTIFICATION")
-			conn.Write(llrp.SetReaderConfig(messageID))
-		} else if h == llrp.KeepaliveHeader {
-			_, err = io.ReadFull(conn, length)
-			message := make([]byte, binary.BigEndian.Uint32(length)-6)
-			_, err = io.ReadFull(conn, message)
-			log.Println(">>> KEEP_ALIVE")
-			conn.Write(llrp.KeepaliveAck())
-		} else if h == llrp.SetReaderConfigResponseHeader {
-			_, err = io.ReadFull(conn, length)
-			message := make([]byte, binary.BigEndian.Uint32(length)-6)
-			_, err = io.ReadFull(conn, message)
-			log.Println(">>> SET_READER_CONFIG_RESPONSE")
-		} else if h == llrp.ROAccessReportHeader {
-			_, err = io.ReadFull(conn, length)
-			l := binary.BigEndian.Uint32(length)
-			message := make([]byte, l-6)
-			_, err = io.ReadFull(conn, message)
+	c, err := llrpclient.New(conn, &llrpclient.Config{
+		InitialMessageID: messageID,
+		OnReport: func(r *llrpclient.Report) {
 			log.Println(">>> RO_ACCESS_REPORT")
-			res := llrp.UnmarshalROAccessReportBody(message)
-			log.Printf("%v events received", len(res))
-		} else {
-			log.Fatalf("Unknown header: %v", h)
-		}
+			log.Printf("%v events received", len(r.Tags))
+			publishReport(reader, r)
+		},
+		OnKeepalive: func() {
+			log.Println(">>> KEEP_ALIVE")
+		},
+		OnEvent: func(e *llrpclient.Event) {
+			log.Println(">>> READER_EVENT_NOTIFICATION")
+			publishReaderEvent(reader, e)
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(">>> READER_EVENT_NOTIFICATION")
+	if err = c.SetReaderConfig(false); err != nil {
+		log.Fatal(err)
 	}
+	log.Println(">>> SET_READER_CONFIG_RESPONSE")
+
+	<-c.Done()
+	if err = c.Err(); err != io.EOF {
+		log.Fatal(err)
+	}
+	log.Println("the reader closed the LLRP connection")
+	closeSinks()
+	return 0
 }
 
 func loadTagsForNextEventCycle(simulationFiles []string, eventCycle *int) (llrp.Tags, error) {
@@ -565,16 +799,12 @@ func loadTagsForNextEventCycle(simulationFiles []string, eventCycle *int) (llrp.
 	return tags, nil
 }
 
-// simulator mode
-func runSimulation() {
-	// read simulation dir and prepare the file list
-	dir, err := filepath.Abs(*simulationDir)
-	if err != nil {
-		log.Fatal(err)
-	}
+// listSimulationFiles returns the event cycle files in a simulation
+// directory in the order they are simulated
+func listSimulationFiles(dir string) ([]string, error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	simulationFiles := []string{}
 	for _, f := range files {
@@ -582,6 +812,26 @@ func runSimulation() {
 			simulationFiles = append(simulationFiles, path.Join(dir, f.Name()))
 		}
 	}
+	return simulationFiles, nil
+}
+
+// simulator mode, resumed from cp unless it is nil
+func runSimulation(cp *Checkpoint) int {
+	if len(*tracks) != 0 {
+		return runTracks()
+	}
+	if *simulationDir == "" {
+		log.Fatal("simulate needs a simulationDir or a --track")
+	}
+	// read simulation dir and prepare the file list
+	dir, err := filepath.Abs(*simulationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	simulationFiles, err := listSimulationFiles(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if len(simulationFiles) == 0 {
 		log.Fatalf("no event cycle file found in %s", *simulationDir)
 	}
@@ -593,6 +843,12 @@ func runSimulation() {
 	}
 	defer l.Close()
 	log.Printf("listening on %v:%v", ip, *port)
+	advertise(*port)
+	serveSNMP()
+	inventory := &readerInventory{}
+	if err := serveOPCUA(*port, inventory.Cycle); err != nil {
+		log.Fatal(err)
+	}
 
 	// channel for communicating virtual tag updates and signals
 	signals := make(chan os.Signal)
@@ -601,6 +857,10 @@ func runSimulation() {
 		for {
 			select {
 			case signal := <-signals:
+				responder.Close()
+				closeOPCUA()
+				agent.Close()
+				closeSinks()
 				log.Fatal(signal)
 			}
 		}
@@ -612,25 +872,44 @@ func runSimulation() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	conn = recordConn(conn, "reader")
 	log.Printf("initiated LLRP connection with %v", conn.RemoteAddr())
+	health.SetConnected(true)
+	reader := localReader(*port)
+	publishEvent(reader, "ConnectionAttempt", 0)
+	var stream *goldenConn
+	if *golden != "" {
+		stream = &goldenConn{Conn: conn}
+		conn = stream
+	}
 
 	// Send back READER_EVENT_NOTIFICATION
-	currentTime := uint64(time.Now().UTC().Nanosecond() / 1000)
+	currentTime := uint64(clk.Now().UnixNano() / 1000)
 	conn.Write(llrp.ReaderEventNotification(messageID, currentTime))
 	log.Println("<<< READER_EVENT_NOTIFICATION")
 	messageID++
 
-	// simulate event cycles from 0
+	// simulate event cycles from 0, or from the checkpoint
 	eventCycle := 0
-
-	// initialize the first event cycle and roarTicker
-	tags, err := loadTagsForNextEventCycle(simulationFiles, &eventCycle)
-	if err != nil {
-		log.Fatal(err)
+	sent := 0
+	var tags llrp.Tags
+	if cp != nil {
+		if cp.SimulationDir != dir {
+			log.Fatalf("the checkpoint is for the simulation in %v", cp.SimulationDir)
+		}
+		eventCycle, tags, sent = cp.EventCycle, cp.Tags, cp.CyclesSent
+	} else {
+		// initialize the first event cycle
+		tags, err = loadTagsForNextEventCycle(simulationFiles, &eventCycle)
+		if err != nil {
+			log.Fatal(err)
+		}
+		eventCycle++
 	}
-	eventCycle++
-	trds := tags.BuildTagReportDataStack(*pdu)
-	roarTicker := time.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+	trds := buildReports(tags)
+	inventory.Set(trds)
+	roarTicker := clk.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+	done := make(chan struct{})
 
 	// prepare LLRP header storage
 	header := make([]byte, 2)
@@ -638,6 +917,16 @@ func runSimulation() {
 	receivedMessageID := make([]byte, 4)
 	for {
 		_, err = io.ReadFull(conn, header)
+		select {
+		case <-done:
+			// all the requested event cycles have been sent
+			closeSinks()
+			if stream != nil {
+				return stream.check(*golden, *updateGolden)
+			}
+			return 0
+		default:
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -662,20 +951,24 @@ func runSimulation() {
 		switch h {
 		case llrp.SetReaderConfigHeader:
 			conn.Write(llrp.SetReaderConfigResponse())
+			tx := newRegionTransmitter(clk.Now())
 			go func() {
-				for {
-					_, ok := <-roarTicker.C
-					if !ok {
+				for n := sent; *cycles == 0 || n < *cycles; n++ {
+					if _, ok := tx.Next(roarTicker.C); !ok {
 						log.Fatalln("roarTicker died")
 					}
 					log.Printf("<<< Simulated Event Cycle %v, %v tags, %v roars", eventCycle, len(tags), len(trds))
-					for _, trd := range trds {
+					err := paceReports(trds, func(trd *llrp.TagReportData) error {
 						roar := llrp.NewROAccessReport(trd.Data, messageID)
-						err := roar.Send(conn)
-						if err != nil {
-							log.Fatal(err)
+						if err := roar.Send(conn); err != nil {
+							return err
 						}
 						messageID++
+						publishTagReportData(reader, trd.Data)
+						return nil
+					})
+					if err != nil {
+						log.Fatal(err)
 					}
 					// prepare for the next event cycle
 					tags, err = loadTagsForNextEventCycle(simulationFiles, &eventCycle)
@@ -684,8 +977,18 @@ func runSimulation() {
 						log.Print(err)
 						continue
 					}
-					trds = tags.BuildTagReportDataStack(*pdu)
+					trds = buildReports(tags)
+					inventory.Set(trds)
+					if *checkpoint != "" && *checkpointEvery > 0 && (n+1)%*checkpointEvery == 0 {
+						saveCheckpoint(dir, eventCycle, tags, n+1)
+					}
 				}
+				roarTicker.Stop()
+				log.Printf("simulated %v event cycles, closing LLRP connection", *cycles)
+				publishEvent(reader, "ConnectionClose", 0)
+				close(done)
+				conn.Close()
+				health.SetConnected(false)
 			}()
 		default:
 			// unknown LLRP packet received, reset the connection
@@ -706,12 +1009,85 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	var cp *Checkpoint
+	if parse == simulate.FullCommand() && *resume {
+		if *checkpoint == "" {
+			log.Fatal("--resume needs the --checkpoint file")
+		}
+		var err error
+		if cp, err = loadCheckpoint(*checkpoint); err != nil {
+			log.Fatal(err)
+		}
+		if cp.Deterministic != *deterministic {
+			log.Printf("the checkpoint was saved with --deterministic=%v", cp.Deterministic)
+		}
+	}
+
+	messageID = uint32(*initialMessageID)
+	if *deterministic {
+		start, err := time.Parse(time.RFC3339, *epoch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rngSource = newCountingSource(*seed)
+		if cp != nil && cp.Deterministic {
+			start = cp.Clock
+			rngSource.skip(cp.Draws)
+		}
+		clk = NewVirtualClock(start, *speed)
+		log.Printf("deterministic mode from %v with seed %v", start, *seed)
+	} else {
+		rngSource = newCountingSource(time.Now().UnixNano())
+	}
+	rng = rand.New(rngSource)
+
+	health = newReaderHealth(*antennas)
+	if cp != nil {
+		cp.restore()
+	}
+	if *dutyCycle < 0 || *dutyCycle > 100 || *dutyPeriod <= 0 {
+		log.Fatal("--duty-cycle must be a percentage of a positive --duty-period")
+	}
+
+	if *record != "" {
+		var err error
+		if recorder, err = NewSessionRecorder(*record); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("recording LLRP sessions to %v", *record)
+	}
+	if len(*kafkaBrokers) != 0 {
+		addSink(newKafkaSink())
+	}
+	if *lineAddress != "" {
+		addSink(newLineSink())
+	}
+	for _, target := range *readHooks {
+		h, err := newHookSink(target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addSink(h)
+	}
+
 	switch parse {
 	case server.FullCommand():
 		os.Exit(runServer())
 	case client.FullCommand():
 		os.Exit(runClient())
 	case simulate.FullCommand():
-		runSimulation()
+		os.Exit(runSimulation(cp))
+	case controller.FullCommand():
+		os.Exit(runController())
+	case worker.FullCommand():
+		os.Exit(runWorker())
+	case diff.FullCommand():
+		os.Exit(runDiff())
+	case fidelity.FullCommand():
+		os.Exit(runFidelity())
+	case check.FullCommand():
+		os.Exit(runCheck())
+	case fixtures.FullCommand():
+		os.Exit(runFixtures())
 	}
 }
@@ -0,0 +1,319 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// llrpServiceType is the DNS-SD service type of LLRP readers
+	llrpServiceType = "_llrp._tcp.local."
+	// dnssdServices lists the service types for DNS-SD browsers
+	dnssdServices = "_services._dns-sd._udp.local."
+	// ttl of the host and SRV records, and of the others (RFC 6762 10)
+	mdnsHostTTL    = 120
+	mdnsServiceTTL = 4500
+	// cacheFlush marks the records only this responder answers for
+	cacheFlush = 0x8000
+)
+
+// mdnsGroup is the IPv4 mDNS multicast group
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsService is an emulated reader advertised with DNS-SD
+type mdnsService struct {
+	Instance string
+	Host     string
+	Port     int
+	IPs      []net.IP
+	TXT      []string
+}
+
+// mdnsResponder answers the mDNS queries for the advertised readers
+type mdnsResponder struct {
+	sync.Mutex
+	conn     *net.UDPConn
+	services []*mdnsService
+}
+
+// newMDNSResponder joins the mDNS group on the interface, or on the
+// system default one when ifname is empty
+func newMDNSResponder(ifname string) (*mdnsResponder, error) {
+	var ifi *net.Interface
+	if ifname != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(ifname); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	r := &mdnsResponder{conn: conn}
+	go r.serve()
+	return r, nil
+}
+
+// Advertise adds a reader and announces it twice, a second apart
+func (r *mdnsResponder) Advertise(s *mdnsService) {
+	r.Lock()
+	r.services = append(r.services, s)
+	r.Unlock()
+	go func() {
+		for i := 0; i < 2; i++ {
+			r.announce(s, false)
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// Close withdraws the readers and leaves the group
+func (r *mdnsResponder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	services := r.services
+	r.services = nil
+	r.Unlock()
+	for _, s := range services {
+		r.announce(s, true)
+	}
+	return r.conn.Close()
+}
+
+// announce multicasts all the records of s, with a zero TTL for goodbye
+func (r *mdnsResponder) announce(s *mdnsService, goodbye bool) {
+	answers := append(s.pointers(), s.records()...)
+	if goodbye {
+		for i := range answers {
+			answers[i].Header.TTL = 0
+		}
+	}
+	r.send(dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: answers,
+	}, mdnsGroup)
+}
+
+// serve answers the queries until the connection is closed
+func (r *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+		// legacy resolvers querying from another port get a unicast
+		// DNS response (RFC 6762 6.7)
+		legacy := src.Port != mdnsGroup.Port
+		res := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+		unicast := legacy
+		for _, q := range query.Questions {
+			answers, additionals := r.answer(q)
+			if len(answers) > 0 && q.Class&cacheFlush != 0 {
+				// the QU bit asks for a unicast response
+				unicast = true
+			}
+			res.Answers = append(res.Answers, answers...)
+			res.Additionals = append(res.Additionals, additionals...)
+		}
+		if len(res.Answers) == 0 {
+			continue
+		}
+		dst := mdnsGroup
+		if unicast {
+			dst = src
+		}
+		if legacy {
+			res.ID = query.ID
+			res.Questions = query.Questions
+			for _, rrs := range [][]dnsmessage.Resource{res.Answers, res.Additionals} {
+				for i := range rrs {
+					rrs[i].Header.Class &^= cacheFlush
+					if rrs[i].Header.TTL > 10 {
+						rrs[i].Header.TTL = 10
+					}
+				}
+			}
+		}
+		r.send(res, dst)
+	}
+}
+
+// answer returns the records answering q and the additional records
+// a browser needs to connect
+func (r *mdnsResponder) answer(q dnsmessage.Question) ([]dnsmessage.Resource, []dnsmessage.Resource) {
+	r.Lock()
+	defer r.Unlock()
+	var answers, additionals []dnsmessage.Resource
+	name := strings.ToLower(q.Name.String())
+	for _, s := range r.services {
+		for _, rr := range append(s.pointers(), s.records()...) {
+			if strings.ToLower(rr.Header.Name.String()) != name {
+				continue
+			}
+			if q.Type != dnsmessage.TypeALL && q.Type != rr.Header.Type {
+				continue
+			}
+			answers = append(answers, rr)
+		}
+		if name == llrpServiceType || name == strings.ToLower(s.instanceName()) {
+			additionals = append(additionals, s.records()...)
+		}
+	}
+	// don't repeat the answers in the additional section
+	var extra []dnsmessage.Resource
+	for _, rr := range additionals {
+		dup := false
+		for _, a := range answers {
+			if a.Header.Name == rr.Header.Name && a.Header.Type == rr.Header.Type {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			extra = append(extra, rr)
+		}
+	}
+	return answers, extra
+}
+
+func (r *mdnsResponder) send(m dnsmessage.Message, dst *net.UDPAddr) {
+	b, err := m.Pack()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if _, err := r.conn.WriteToUDP(b, dst); err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *mdnsService) instanceName() string {
+	// dnsmessage can't escape dots inside a label
+	return strings.Replace(s.Instance, ".", "-", -1) + "." + llrpServiceType
+}
+
+// pointers returns the shared PTR records of the service
+func (s *mdnsService) pointers() []dnsmessage.Resource {
+	return []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(dnssdServices), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsServiceTTL},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(llrpServiceType)},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(llrpServiceType), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsServiceTTL},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(s.instanceName())},
+		},
+	}
+}
+
+// records returns the SRV, TXT and A records unique to the reader
+func (s *mdnsService) records() []dnsmessage.Resource {
+	instance := dnsmessage.MustNewName(s.instanceName())
+	host := dnsmessage.MustNewName(s.Host)
+	rrs := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | cacheFlush, TTL: mdnsHostTTL},
+			Body:   &dnsmessage.SRVResource{Target: host, Port: uint16(s.Port)},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | cacheFlush, TTL: mdnsServiceTTL},
+			Body:   &dnsmessage.TXTResource{TXT: s.TXT},
+		},
+	}
+	for _, ip := range s.IPs {
+		var a [4]byte
+		copy(a[:], ip.To4())
+		rrs = append(rrs, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | cacheFlush, TTL: mdnsHostTTL},
+			Body:   &dnsmessage.AResource{A: a},
+		})
+	}
+	return rrs
+}
+
+// impinjHostname returns a SpeedwayR-XX-XX-XX hostname like the ones
+// Impinj readers derive from their MAC address, made up from the instance
+// name and port to tell the emulated readers apart
+func impinjHostname(instance string, port int) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%v:%v", instance, port)
+	sum := h.Sum32()
+	return fmt.Sprintf("SpeedwayR-%02X-%02X-%02X.local.", byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+// hostAddresses returns the IPv4 addresses to advertise for the listening
+// address, all the interface addresses when it is unspecified
+func hostAddresses(listen net.IP, ifname string) []net.IP {
+	if !listen.IsUnspecified() {
+		return []net.IP{listen}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	var ips []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || (ifname != "" && ifi.Name != ifname) {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+				ips = append(ips, ipnet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// advertise announces the reader listening on port when --mdns is given,
+// named after --mdns-name and the port like portName
+func advertise(port int) {
+	if !*mdns {
+		return
+	}
+	if responder == nil {
+		var err error
+		if responder, err = newMDNSResponder(*mdnsInterface); err != nil {
+			log.Fatal(err)
+		}
+	}
+	name := portName(*mdnsName, port)
+	host := strings.Replace(name, " ", "-", -1) + ".local."
+	if *mdnsImpinj {
+		host = impinjHostname(*mdnsName, port)
+	}
+	s := &mdnsService{
+		Instance: name,
+		Host:     host,
+		Port:     port,
+		IPs:      hostAddresses(*ip, *mdnsInterface),
+		TXT:      []string{"model=" + *mdnsModel, "name=" + name, "version=" + version},
+	}
+	responder.Advertise(s)
+	log.Printf("advertising %v on %v port %v with mDNS", s.instanceName(), s.Host, port)
+}
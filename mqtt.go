@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the MQTT 3.1.1 control packets of a publisher
+const (
+	mqttPacketConnect    = 0x10
+	mqttPacketConnAck    = 0x20
+	mqttPacketPublish    = 0x30
+	mqttPacketDisconnect = 0xe0
+)
+
+// mqttPublish connects to the broker of a mqtt://[USER:PASSWORD@]HOST[:PORT]/TOPIC
+// URL, publishes the payload with QoS 0 and disconnects
+func mqttPublish(ctx context.Context, u *url.URL, payload []byte) error {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+
+	// CONNECT with a clean session and no keepalive
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	flags := byte(0x02)
+	if u.User != nil {
+		flags |= 0x80
+		if _, ok := u.User.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	body.Write([]byte{4, flags, 0, 0})
+	// an empty client identifier, the broker assigns a unique one to the
+	// clean session so that the publishes of the hooks, the GPOs and other
+	// golemu processes don't take over each other's connections
+	mqttString(&body, "")
+	if u.User != nil {
+		mqttString(&body, u.User.Username())
+		if p, ok := u.User.Password(); ok {
+			mqttString(&body, p)
+		}
+	}
+	if _, err := conn.Write(mqttPacket(mqttPacketConnect, body.Bytes())); err != nil {
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("no CONNACK: %v", err)
+	}
+	if ack[0] != mqttPacketConnAck || ack[1] != 2 {
+		return fmt.Errorf("unexpected packet %#x instead of CONNACK", ack[0])
+	}
+	if ack[3] != 0 {
+		return fmt.Errorf("connection refused by the broker with code %v", ack[3])
+	}
+
+	body.Reset()
+	mqttString(&body, strings.Trim(u.Path, "/"))
+	body.Write(payload)
+	if _, err := conn.Write(mqttPacket(mqttPacketPublish, body.Bytes())); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{mqttPacketDisconnect, 0})
+	return err
+}
+
+// mqttPacket prefixes a packet body with its fixed header
+func mqttPacket(kind byte, body []byte) []byte {
+	p := []byte{kind}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+// mqttString writes a length-prefixed UTF-8 string
+func mqttString(b *bytes.Buffer, s string) {
+	b.Write([]byte{byte(len(s) >> 8), byte(len(s))})
+	b.WriteString(s)
+}
@@ -0,0 +1,1529 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// the DefaultBinary encoding NodeIds of the service requests and responses
+const (
+	uaServiceFault                 = 397
+	uaFindServersRequest           = 422
+	uaFindServersResponse          = 425
+	uaGetEndpointsRequest          = 428
+	uaGetEndpointsResponse         = 431
+	uaOpenSecureChannelRequest     = 446
+	uaOpenSecureChannelResponse    = 449
+	uaCloseSecureChannelRequest    = 452
+	uaCreateSessionRequest         = 461
+	uaCreateSessionResponse        = 464
+	uaActivateSessionRequest       = 467
+	uaActivateSessionResponse      = 470
+	uaCloseSessionRequest          = 473
+	uaCloseSessionResponse         = 476
+	uaBrowseRequest                = 527
+	uaBrowseResponse               = 530
+	uaTranslateBrowsePathsRequest  = 554
+	uaTranslateBrowsePathsResponse = 557
+	uaReadRequest                  = 631
+	uaReadResponse                 = 634
+	uaCallRequest                  = 712
+	uaCallResponse                 = 715
+	uaCreateMonitoredItemsRequest  = 751
+	uaCreateMonitoredItemsResponse = 754
+	uaSetMonitoringModeRequest     = 769
+	uaSetMonitoringModeResponse    = 772
+	uaDeleteMonitoredItemsRequest  = 781
+	uaDeleteMonitoredItemsResponse = 784
+	uaCreateSubscriptionRequest    = 787
+	uaCreateSubscriptionResponse   = 790
+	uaModifySubscriptionRequest    = 793
+	uaModifySubscriptionResponse   = 796
+	uaSetPublishingModeRequest     = 799
+	uaSetPublishingModeResponse    = 802
+	uaPublishRequest               = 826
+	uaPublishResponse              = 829
+	uaRepublishRequest             = 832
+	uaDeleteSubscriptionsRequest   = 847
+	uaDeleteSubscriptionsResponse  = 850
+
+	uaEventFilter                = 727
+	uaDataChangeNotification     = 811
+	uaEventNotificationList      = 916
+	uaArgumentEncoding           = 298
+	uaAnonymousIdentityToken     = 321
+	uaSecurityPolicyNone         = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	uaTransportProfile           = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+	uaMaxChunk                   = 65536
+	uaDefaultSessionTimeout      = time.Minute
+	uaMinPublishingInterval      = 50 * time.Millisecond
+	uaMaxQueuedNotificationLists = 1000
+)
+
+// OPC UA status codes
+const (
+	uaGood                        = 0
+	uaBadUnexpectedError          = 0x80010000
+	uaBadDecodingError            = 0x80070000
+	uaBadServiceUnsupported       = 0x800B0000
+	uaBadNothingToDo              = 0x800F0000
+	uaBadSessionIDInvalid         = 0x80250000
+	uaBadSubscriptionIDInvalid    = 0x80280000
+	uaBadNodeIDUnknown            = 0x80340000
+	uaBadAttributeIDInvalid       = 0x80350000
+	uaBadMonitoredItemIDInvalid   = 0x80420000
+	uaBadSecurityPolicyRejected   = 0x80550000
+	uaBadNoMatch                  = 0x806F0000
+	uaBadMethodInvalid            = 0x80750000
+	uaBadArgumentsMissing         = 0x80760000
+	uaBadMessageNotAvailable      = 0x807B0000
+	uaBadTCPMessageTypeInvalid    = 0x807E0000
+	uaBadInvalidArgument          = 0x80AB0000
+	uaBadMonitoredItemFilterInval = 0x80430000
+)
+
+// attribute IDs
+const (
+	uaAttrNodeID        = 1
+	uaAttrNodeClass     = 2
+	uaAttrBrowseName    = 3
+	uaAttrDisplayName   = 4
+	uaAttrDescription   = 5
+	uaAttrWriteMask     = 6
+	uaAttrUserWriteMask = 7
+	uaAttrIsAbstract    = 8
+	uaAttrEventNotifier = 12
+	uaAttrValue         = 13
+	uaAttrDataType      = 14
+	uaAttrValueRank     = 15
+	uaAttrArrayDims     = 16
+	uaAttrAccessLevel   = 17
+	uaAttrUserAccess    = 18
+	uaAttrMinSampling   = 19
+	uaAttrHistorizing   = 20
+	uaAttrExecutable    = 21
+	uaAttrUserExec      = 22
+)
+
+// node classes
+const (
+	uaObject     = 1
+	uaVariable   = 2
+	uaMethod     = 4
+	uaObjectType = 8
+	uaDataType   = 64
+)
+
+// namespace 0 nodes
+var (
+	uaReferences           = uaNumeric(0, 31)
+	uaNonHierarchical      = uaNumeric(0, 32)
+	uaHierarchical         = uaNumeric(0, 33)
+	uaHasChild             = uaNumeric(0, 34)
+	uaOrganizes            = uaNumeric(0, 35)
+	uaHasEventSource       = uaNumeric(0, 36)
+	uaHasEncoding          = uaNumeric(0, 38)
+	uaHasTypeDefinition    = uaNumeric(0, 40)
+	uaAggregates           = uaNumeric(0, 44)
+	uaHasSubtype           = uaNumeric(0, 45)
+	uaHasProperty          = uaNumeric(0, 46)
+	uaHasComponent         = uaNumeric(0, 47)
+	uaHasNotifier          = uaNumeric(0, 48)
+	uaBaseObjectType       = uaNumeric(0, 58)
+	uaFolderType           = uaNumeric(0, 61)
+	uaBaseDataVariableType = uaNumeric(0, 63)
+	uaPropertyType         = uaNumeric(0, 68)
+	uaRootFolder           = uaNumeric(0, 84)
+	uaObjectsFolder        = uaNumeric(0, 85)
+	uaTypesFolder          = uaNumeric(0, 86)
+	uaObjectTypesFolder    = uaNumeric(0, 88)
+	uaDataTypesFolder      = uaNumeric(0, 90)
+	uaServerObject         = uaNumeric(0, 2253)
+	uaServerType           = uaNumeric(0, 2004)
+	uaServerStatusType     = uaNumeric(0, 2138)
+	uaBaseEventType        = uaNumeric(0, 2041)
+	uaEventTypesFolder     = uaNumeric(0, 3048)
+	uaStructure            = uaNumeric(0, 22)
+	uaEnumeration          = uaNumeric(0, 29)
+	uaArgumentType         = uaNumeric(0, 296)
+)
+
+// the super types of the reference types, to match the subtypes
+var uaReferenceSupertypes = map[uaNodeID]uaNodeID{
+	uaHierarchical:      uaReferences,
+	uaNonHierarchical:   uaReferences,
+	uaHasChild:          uaHierarchical,
+	uaOrganizes:         uaHierarchical,
+	uaHasEventSource:    uaHierarchical,
+	uaHasNotifier:       uaHasEventSource,
+	uaAggregates:        uaHasChild,
+	uaHasSubtype:        uaHasChild,
+	uaHasComponent:      uaAggregates,
+	uaHasProperty:       uaAggregates,
+	uaHasTypeDefinition: uaNonHierarchical,
+}
+
+// uaIsReference tells whether a reference type is ref or one of its
+// subtypes
+func uaIsReference(refType, ref uaNodeID, subtypes bool) bool {
+	for {
+		if refType == ref {
+			return true
+		}
+		if !subtypes {
+			return false
+		}
+		super, ok := uaReferenceSupertypes[refType]
+		if !ok {
+			return false
+		}
+		refType = super
+	}
+}
+
+// uaNode is a node of the address space
+type uaNode struct {
+	id          uaNodeID
+	class       int32
+	browseName  uaQName
+	displayName string
+	typeDef     uaNodeID
+	refs        []uaRef
+	// variables
+	value     func() uaVariant
+	dataType  uaNodeID
+	valueRank int32
+	// objects
+	eventNotifier byte
+	// types
+	isAbstract bool
+	// methods
+	call func(args []uaVariant) ([]uaVariant, uint32)
+}
+
+// uaRef is a reference from a node
+type uaRef struct {
+	refType uaNodeID
+	target  uaNodeID
+	forward bool
+}
+
+// uaArgument describes an argument of a method
+type uaArgument struct {
+	name      string
+	dataType  uaNodeID
+	valueRank int32
+}
+
+// opcuaServer serves the address space of an emulated reader over the
+// OPC UA binary protocol, without security
+type opcuaServer struct {
+	sync.Mutex
+	listener   net.Listener
+	endpoint   string
+	appURI     string
+	namespaces []string
+	nodes      map[uaNodeID]*uaNode
+	sessions   map[uaNodeID]*uaSession
+	lastID     uint32
+}
+
+// uaChannel is a secure channel on a connection
+type uaChannel struct {
+	sync.Mutex
+	conn    net.Conn
+	id      uint32
+	token   uint32
+	seq     uint32
+	maxBody int
+}
+
+// uaSession is an activated session with its subscriptions
+type uaSession struct {
+	id            uaNodeID
+	token         uaNodeID
+	channel       *uaChannel
+	subscriptions map[uint32]*uaSubscription
+	publish       []uaPendingPublish
+}
+
+// uaPendingPublish is a PublishRequest waiting for notifications
+type uaPendingPublish struct {
+	channel   *uaChannel
+	requestID uint32
+	handle    uint32
+}
+
+// uaSubscription sends the notifications of its items every publishing
+// interval, or a keep-alive after maxKeepAlive empty intervals
+type uaSubscription struct {
+	id           uint32
+	session      *uaSession
+	interval     time.Duration
+	maxKeepAlive uint32
+	lifetime     uint32
+	enabled      bool
+	items        map[uint32]*uaMonitoredItem
+	seq          uint32
+	idle         uint32
+	queue        [][]byte
+	stop         chan struct{}
+}
+
+// uaMonitoredItem samples an attribute, or collects the events of a
+// notifier when its attribute is EventNotifier
+type uaMonitoredItem struct {
+	id           uint32
+	clientHandle uint32
+	node         uaNodeID
+	attribute    uint32
+	enabled      bool
+	selects      [][]uaQName
+	last         []byte
+	events       [][]uaVariant
+}
+
+// newOPCUAServer prepares a server for the endpoint with the namespaces
+// after the standard one and the server's own
+func newOPCUAServer(listener net.Listener, namespaces ...string) *opcuaServer {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	srv := &opcuaServer{
+		listener: listener,
+		endpoint: fmt.Sprintf("opc.tcp://%v:%v", host, port),
+		appURI:   fmt.Sprintf("urn:%v:golemu", host),
+		nodes:    map[uaNodeID]*uaNode{},
+		sessions: map[uaNodeID]*uaSession{},
+	}
+	srv.namespaces = append([]string{"http://opcfoundation.org/UA/", srv.appURI}, namespaces...)
+	srv.addStandardNodes()
+	return srv
+}
+
+// nextID returns a new ID for a channel, session, subscription or item
+func (srv *opcuaServer) nextID() uint32 {
+	srv.lastID++
+	return srv.lastID
+}
+
+// addNode adds a node below its parent
+func (srv *opcuaServer) addNode(n *uaNode, parent uaNodeID, refType uaNodeID) *uaNode {
+	if n.displayName == "" {
+		n.displayName = n.browseName.name
+	}
+	srv.nodes[n.id] = n
+	if !parent.isNull() {
+		srv.addRef(parent, refType, n.id)
+	}
+	if !n.typeDef.isNull() {
+		n.refs = append(n.refs, uaRef{refType: uaHasTypeDefinition, target: n.typeDef, forward: true})
+	}
+	return n
+}
+
+// addRef adds a reference and its inverse
+func (srv *opcuaServer) addRef(source, refType, target uaNodeID) {
+	if n, ok := srv.nodes[source]; ok {
+		n.refs = append(n.refs, uaRef{refType: refType, target: target, forward: true})
+	}
+	if n, ok := srv.nodes[target]; ok {
+		n.refs = append(n.refs, uaRef{refType: refType, target: source, forward: false})
+	}
+}
+
+// folder adds an object of FolderType
+func (srv *opcuaServer) folder(id, parent uaNodeID, name uaQName) *uaNode {
+	return srv.addNode(&uaNode{id: id, class: uaObject, browseName: name, typeDef: uaFolderType}, parent, uaOrganizes)
+}
+
+// objectType adds a subtype of an object or event type
+func (srv *opcuaServer) objectType(id, super uaNodeID, name uaQName, abstract bool) *uaNode {
+	return srv.addNode(&uaNode{id: id, class: uaObjectType, browseName: name, isAbstract: abstract}, super, uaHasSubtype)
+}
+
+// dataType adds a subtype of a data type
+func (srv *opcuaServer) dataType(id, super uaNodeID, name uaQName) *uaNode {
+	return srv.addNode(&uaNode{id: id, class: uaDataType, browseName: name}, super, uaHasSubtype)
+}
+
+// variable adds a variable whose value is read from value
+func (srv *opcuaServer) variable(id, parent, refType uaNodeID, name uaQName, dataType uaNodeID, valueRank int32, value func() uaVariant) *uaNode {
+	typeDef := uaBaseDataVariableType
+	if refType == uaHasProperty {
+		typeDef = uaPropertyType
+	}
+	return srv.addNode(&uaNode{
+		id: id, class: uaVariable, browseName: name, typeDef: typeDef,
+		dataType: dataType, valueRank: valueRank, value: value,
+	}, parent, refType)
+}
+
+// method adds a method with its argument properties
+func (srv *opcuaServer) method(id, parent uaNodeID, name uaQName, in, out []uaArgument, call func(args []uaVariant) ([]uaVariant, uint32)) *uaNode {
+	m := srv.addNode(&uaNode{id: id, class: uaMethod, browseName: name, call: call}, parent, uaHasComponent)
+	for _, args := range []struct {
+		name string
+		args []uaArgument
+	}{{"InputArguments", in}, {"OutputArguments", out}} {
+		if len(args.args) == 0 {
+			continue
+		}
+		value := uaArray(uaExtensionObject)
+		for _, a := range args.args {
+			value.value = append(value.value.([]interface{}), a.encode())
+		}
+		argID := uaNamed(id.ns, id.name+"."+args.name)
+		srv.variable(argID, id, uaHasProperty, uaQName{0, args.name}, uaArgumentType, 1, func() uaVariant { return value })
+	}
+	return m
+}
+
+// encode returns the Argument structure
+func (a uaArgument) encode() uaExtension {
+	var w uaWriter
+	w.string(a.name)
+	w.nodeID(a.dataType)
+	w.int32(a.valueRank)
+	if a.valueRank == 1 {
+		w.int32(1)
+		w.uint32(0)
+	} else {
+		w.int32(-1)
+	}
+	w.localizedText("")
+	return uaExtension{typeID: uaNumeric(0, uaArgumentEncoding), body: w.Bytes()}
+}
+
+// addStandardNodes adds the part of namespace 0 the clients look for
+func (srv *opcuaServer) addStandardNodes() {
+	srv.addNode(&uaNode{id: uaRootFolder, class: uaObject, browseName: uaQName{0, "Root"}, typeDef: uaFolderType}, uaNodeID{}, uaNodeID{})
+	srv.folder(uaObjectsFolder, uaRootFolder, uaQName{0, "Objects"})
+	srv.folder(uaTypesFolder, uaRootFolder, uaQName{0, "Types"})
+	srv.folder(uaObjectTypesFolder, uaTypesFolder, uaQName{0, "ObjectTypes"})
+	srv.folder(uaEventTypesFolder, uaTypesFolder, uaQName{0, "EventTypes"})
+	srv.folder(uaDataTypesFolder, uaTypesFolder, uaQName{0, "DataTypes"})
+
+	srv.addNode(&uaNode{id: uaBaseObjectType, class: uaObjectType, browseName: uaQName{0, "BaseObjectType"}}, uaObjectTypesFolder, uaOrganizes)
+	srv.objectType(uaFolderType, uaBaseObjectType, uaQName{0, "FolderType"}, false)
+	srv.objectType(uaServerType, uaBaseObjectType, uaQName{0, "ServerType"}, false)
+	srv.addNode(&uaNode{id: uaBaseEventType, class: uaObjectType, browseName: uaQName{0, "BaseEventType"}, isAbstract: true}, uaEventTypesFolder, uaOrganizes)
+	srv.addRef(uaBaseObjectType, uaHasSubtype, uaBaseEventType)
+	for _, f := range []struct {
+		id       uint32
+		name     string
+		dataType uint32
+	}{{2042, "EventId", 15}, {2043, "EventType", 17}, {2044, "SourceNode", 17}, {2045, "SourceName", 12},
+		{2046, "Time", 294}, {2047, "ReceiveTime", 294}, {2050, "Message", 21}, {2051, "Severity", 5}} {
+		srv.variable(uaNumeric(0, f.id), uaBaseEventType, uaHasProperty, uaQName{0, f.name}, uaNumeric(0, f.dataType), -1, nil)
+	}
+	baseDataType := srv.addNode(&uaNode{id: uaNumeric(0, 24), class: uaDataType, browseName: uaQName{0, "BaseDataType"}, isAbstract: true}, uaDataTypesFolder, uaOrganizes)
+	srv.dataType(uaStructure, baseDataType.id, uaQName{0, "Structure"})
+	srv.dataType(uaEnumeration, baseDataType.id, uaQName{0, "Enumeration"})
+	srv.dataType(uaArgumentType, uaStructure, uaQName{0, "Argument"})
+
+	srv.addNode(&uaNode{id: uaServerObject, class: uaObject, browseName: uaQName{0, "Server"}, typeDef: uaServerType, eventNotifier: 1}, uaObjectsFolder, uaOrganizes)
+	srv.variable(uaNumeric(0, 2254), uaServerObject, uaHasProperty, uaQName{0, "ServerArray"}, uaNumeric(0, 12), 1, func() uaVariant {
+		return uaArray(uaString, srv.appURI)
+	})
+	srv.variable(uaNumeric(0, 2255), uaServerObject, uaHasProperty, uaQName{0, "NamespaceArray"}, uaNumeric(0, 12), 1, func() uaVariant {
+		v := uaArray(uaString)
+		for _, ns := range srv.namespaces {
+			v.value = append(v.value.([]interface{}), ns)
+		}
+		return v
+	})
+	status := srv.variable(uaNumeric(0, 2256), uaServerObject, uaHasComponent, uaQName{0, "ServerStatus"}, uaNumeric(0, 862), -1, nil)
+	status.typeDef = uaServerStatusType
+	srv.variable(uaNumeric(0, 2257), status.id, uaHasComponent, uaQName{0, "StartTime"}, uaNumeric(0, 294), -1, func() uaVariant {
+		return uaVariant{uaDateTime, health.booted}
+	})
+	srv.variable(uaNumeric(0, 2258), status.id, uaHasComponent, uaQName{0, "CurrentTime"}, uaNumeric(0, 294), -1, func() uaVariant {
+		return uaVariant{uaDateTime, clk.Now()}
+	})
+	srv.variable(uaNumeric(0, 2259), status.id, uaHasComponent, uaQName{0, "State"}, uaNumeric(0, 852), -1, func() uaVariant {
+		return uaVariant{uaInt32, int32(0)} // Running
+	})
+}
+
+// serve accepts the clients until the listener is closed
+func (srv *opcuaServer) serve() {
+	log.Printf("serving OPC UA on %v", srv.endpoint)
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handle(conn)
+	}
+}
+
+// Close stops accepting clients
+func (srv *opcuaServer) Close() {
+	if srv != nil {
+		srv.listener.Close()
+	}
+}
+
+// handle runs a connection: the Hello, the secure channel and the
+// service requests
+func (srv *opcuaServer) handle(conn net.Conn) {
+	ch := &uaChannel{conn: conn, maxBody: uaMaxChunk - 24}
+	defer func() {
+		conn.Close()
+		srv.closeChannel(ch)
+	}()
+	var request []byte
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		size := binary.LittleEndian.Uint32(header[4:])
+		if size < 8 || size > uaMaxChunk {
+			ch.fail(uaBadTCPMessageTypeInvalid, "invalid message size")
+			return
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		r := &uaReader{b: body}
+		switch string(header[:3]) {
+		case "HEL":
+			r.uint32() // protocol version
+			receive := r.uint32()
+			if receive >= 8192 && receive < uaMaxChunk {
+				ch.maxBody = int(receive) - 24
+			}
+			var w uaWriter
+			w.uint32(0)
+			w.uint32(uaMaxChunk)
+			w.uint32(uaMaxChunk)
+			w.uint32(0)
+			w.uint32(0)
+			ch.write("ACKF", w.Bytes())
+		case "OPN":
+			if !srv.openChannel(ch, r) {
+				return
+			}
+		case "CLO":
+			return
+		case "MSG":
+			if r.uint32() != ch.id || ch.id == 0 {
+				ch.fail(uaBadSecurityPolicyRejected, "unknown secure channel")
+				return
+			}
+			r.uint32() // token
+			r.uint32() // sequence number
+			requestID := r.uint32()
+			if r.err != nil {
+				return
+			}
+			switch header[3] {
+			case 'C':
+				request = append(request, r.b...)
+				if len(request) > 16*uaMaxChunk {
+					ch.fail(uaBadDecodingError, "request too large")
+					return
+				}
+				continue
+			case 'A':
+				request = nil
+				continue
+			}
+			request = append(request, r.b...)
+			srv.dispatch(ch, requestID, request)
+			request = nil
+		default:
+			ch.fail(uaBadTCPMessageTypeInvalid, "unexpected message type")
+			return
+		}
+	}
+}
+
+// openChannel issues or renews the token of the secure channel
+func (srv *opcuaServer) openChannel(ch *uaChannel, r *uaReader) bool {
+	r.uint32() // secure channel ID
+	policy := r.string()
+	r.byteString() // sender certificate
+	r.byteString() // receiver thumbprint
+	r.uint32()     // sequence number
+	requestID := r.uint32()
+	r.nodeID()
+	_, handle := r.requestHeader()
+	if r.err != nil {
+		return false
+	}
+	if policy != uaSecurityPolicyNone {
+		ch.fail(uaBadSecurityPolicyRejected, "only "+uaSecurityPolicyNone+" is supported")
+		return false
+	}
+	r.uint32() // client protocol version
+	r.uint32() // issue or renew
+	r.uint32() // security mode
+	r.byteString()
+	lifetime := r.uint32()
+	if lifetime == 0 {
+		lifetime = 3600000
+	}
+	srv.Lock()
+	if ch.id == 0 {
+		ch.id = srv.nextID()
+	}
+	ch.token = srv.nextID()
+	srv.Unlock()
+
+	var w uaWriter
+	w.uint32(ch.id)
+	w.string(uaSecurityPolicyNone)
+	w.byteString(nil)
+	w.byteString(nil)
+	ch.Lock()
+	ch.seq++
+	w.uint32(ch.seq)
+	ch.Unlock()
+	w.uint32(requestID)
+	w.nodeID(uaNumeric(0, uaOpenSecureChannelResponse))
+	uaResponseHeader(&w, handle, uaGood)
+	w.uint32(0)
+	w.uint32(ch.id)
+	w.uint32(ch.token)
+	w.dateTime(clk.Now())
+	w.uint32(lifetime)
+	w.byteString([]byte{})
+	return ch.write("OPNF", w.Bytes()) == nil
+}
+
+// write sends a message with its header
+func (ch *uaChannel) write(typ string, body []byte) error {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.writeLocked(typ, body)
+}
+
+func (ch *uaChannel) writeLocked(typ string, body []byte) error {
+	msg := make([]byte, 8, 8+len(body))
+	copy(msg, typ)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(8+len(body)))
+	_, err := ch.conn.Write(append(msg, body...))
+	return err
+}
+
+// fail sends an Error message
+func (ch *uaChannel) fail(status uint32, reason string) {
+	var w uaWriter
+	w.uint32(status)
+	w.string(reason)
+	ch.write("ERRF", w.Bytes())
+}
+
+// send sends a service response in as many chunks as needed
+func (ch *uaChannel) send(requestID uint32, body []byte) error {
+	ch.Lock()
+	defer ch.Unlock()
+	for {
+		n, typ := len(body), "MSGF"
+		if n > ch.maxBody {
+			n, typ = ch.maxBody, "MSGC"
+		}
+		var w uaWriter
+		w.uint32(ch.id)
+		w.uint32(ch.token)
+		ch.seq++
+		w.uint32(ch.seq)
+		w.uint32(requestID)
+		w.Write(body[:n])
+		if err := ch.writeLocked(typ, w.Bytes()); err != nil {
+			return err
+		}
+		body = body[n:]
+		if typ == "MSGF" {
+			return nil
+		}
+	}
+}
+
+// uaResponseHeader writes a ResponseHeader
+func uaResponseHeader(w *uaWriter, handle, status uint32) {
+	w.dateTime(clk.Now())
+	w.uint32(handle)
+	w.uint32(status)
+	w.WriteByte(0) // no diagnostics
+	w.int32(-1)    // no string table
+	w.extension(uaExtension{})
+}
+
+// uaService handles a request, writes the response after its header and
+// returns the service result; a bad result sends a ServiceFault instead
+type uaService struct {
+	response uint32
+	session  bool
+	handle   func(srv *opcuaServer, s *uaSession, r *uaReader, w *uaWriter) uint32
+}
+
+var uaServices = map[uint32]uaService{
+	uaGetEndpointsRequest:         {uaGetEndpointsResponse, false, (*opcuaServer).getEndpoints},
+	uaFindServersRequest:          {uaFindServersResponse, false, (*opcuaServer).findServers},
+	uaCreateSessionRequest:        {uaCreateSessionResponse, false, nil},
+	uaActivateSessionRequest:      {uaActivateSessionResponse, false, nil},
+	uaCloseSessionRequest:         {uaCloseSessionResponse, true, (*opcuaServer).closeSession},
+	uaBrowseRequest:               {uaBrowseResponse, true, (*opcuaServer).browse},
+	uaTranslateBrowsePathsRequest: {uaTranslateBrowsePathsResponse, true, (*opcuaServer).translateBrowsePaths},
+	uaReadRequest:                 {uaReadResponse, true, (*opcuaServer).read},
+	uaCallRequest:                 {uaCallResponse, true, nil},
+	uaCreateSubscriptionRequest:   {uaCreateSubscriptionResponse, true, (*opcuaServer).createSubscription},
+	uaModifySubscriptionRequest:   {uaModifySubscriptionResponse, true, (*opcuaServer).modifySubscription},
+	uaSetPublishingModeRequest:    {uaSetPublishingModeResponse, true, (*opcuaServer).setPublishingMode},
+	uaDeleteSubscriptionsRequest:  {uaDeleteSubscriptionsResponse, true, (*opcuaServer).deleteSubscriptions},
+	uaCreateMonitoredItemsRequest: {uaCreateMonitoredItemsResponse, true, (*opcuaServer).createMonitoredItems},
+	uaSetMonitoringModeRequest:    {uaSetMonitoringModeResponse, true, (*opcuaServer).setMonitoringMode},
+	uaDeleteMonitoredItemsRequest: {uaDeleteMonitoredItemsResponse, true, (*opcuaServer).deleteMonitoredItems},
+	uaPublishRequest:              {uaPublishResponse, true, nil},
+	uaRepublishRequest:            {0, true, (*opcuaServer).republish},
+}
+
+// dispatch handles a service request
+func (srv *opcuaServer) dispatch(ch *uaChannel, requestID uint32, request []byte) {
+	r := &uaReader{b: request}
+	typ := r.nodeID()
+	if typ.ns != 0 || r.err != nil {
+		srv.fault(ch, requestID, 0, uaBadDecodingError)
+		return
+	}
+	if typ.id == uaCloseSecureChannelRequest {
+		ch.conn.Close()
+		return
+	}
+	token, handle := r.requestHeader()
+	if r.err != nil {
+		srv.fault(ch, requestID, handle, uaBadDecodingError)
+		return
+	}
+	service, ok := uaServices[typ.id]
+	if !ok {
+		srv.fault(ch, requestID, handle, uaBadServiceUnsupported)
+		return
+	}
+
+	var w uaWriter
+	w.nodeID(uaNumeric(0, service.response))
+	uaResponseHeader(&w, handle, uaGood)
+	var status uint32
+	switch typ.id {
+	case uaCallRequest:
+		// methods may take a while, without holding the server
+		srv.Lock()
+		s := srv.sessions[token]
+		srv.Unlock()
+		if s == nil || s.channel != ch {
+			status = uaBadSessionIDInvalid
+		} else {
+			status = srv.callMethods(r, &w)
+		}
+	default:
+		srv.Lock()
+		s := srv.sessions[token]
+		switch {
+		case service.session && (s == nil || s.channel != ch):
+			status = uaBadSessionIDInvalid
+		case typ.id == uaCreateSessionRequest:
+			status = srv.createSession(ch, r, &w)
+		case typ.id == uaActivateSessionRequest:
+			status = srv.activateSession(ch, token, r, &w)
+		case typ.id == uaPublishRequest:
+			status = srv.queuePublish(ch, s, requestID, handle, r)
+			srv.Unlock()
+			if status == uaGood {
+				// answered by the subscriptions
+				return
+			}
+			srv.fault(ch, requestID, handle, status)
+			return
+		default:
+			status = service.handle(srv, s, r, &w)
+		}
+		srv.Unlock()
+	}
+	if status != uaGood {
+		srv.fault(ch, requestID, handle, status)
+		return
+	}
+	if err := ch.send(requestID, w.Bytes()); err != nil {
+		ch.conn.Close()
+	}
+}
+
+// fault sends a ServiceFault
+func (srv *opcuaServer) fault(ch *uaChannel, requestID, handle, status uint32) {
+	var w uaWriter
+	w.nodeID(uaNumeric(0, uaServiceFault))
+	uaResponseHeader(&w, handle, status)
+	ch.send(requestID, w.Bytes())
+}
+
+// closeChannel drops the sessions of a closed channel
+func (srv *opcuaServer) closeChannel(ch *uaChannel) {
+	srv.Lock()
+	defer srv.Unlock()
+	for token, s := range srv.sessions {
+		if s.channel == ch {
+			srv.dropSession(token, s)
+		}
+	}
+}
+
+func (srv *opcuaServer) dropSession(token uaNodeID, s *uaSession) {
+	for _, sub := range s.subscriptions {
+		close(sub.stop)
+	}
+	delete(srv.sessions, token)
+}
+
+// endpoint writes the EndpointDescription of the server
+func (srv *opcuaServer) writeEndpoint(w *uaWriter) {
+	w.string(srv.endpoint)
+	srv.writeApplication(w)
+	w.byteString(nil)
+	w.uint32(1) // security mode None
+	w.string(uaSecurityPolicyNone)
+	w.int32(1)
+	w.string("anonymous")
+	w.uint32(0) // anonymous token
+	w.string("")
+	w.string("")
+	w.string("")
+	w.string(uaTransportProfile)
+	w.WriteByte(0)
+}
+
+// writeApplication writes the ApplicationDescription of the server
+func (srv *opcuaServer) writeApplication(w *uaWriter) {
+	w.string(srv.appURI)
+	w.string("https://github.com/iomz/golemu")
+	w.localizedText("golemu")
+	w.uint32(0) // server
+	w.string("")
+	w.string("")
+	w.int32(1)
+	w.string(srv.endpoint)
+}
+
+func (srv *opcuaServer) getEndpoints(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	w.int32(1)
+	srv.writeEndpoint(w)
+	return uaGood
+}
+
+func (srv *opcuaServer) findServers(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	w.int32(1)
+	srv.writeApplication(w)
+	return uaGood
+}
+
+// uaRandomID returns a random opaque string NodeId
+func uaRandomID(ns uint16) uaNodeID {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return uaNamed(ns, hex.EncodeToString(b))
+}
+
+func (srv *opcuaServer) createSession(ch *uaChannel, r *uaReader, w *uaWriter) uint32 {
+	// the client's ApplicationDescription
+	r.string()
+	r.string()
+	r.localizedText()
+	r.uint32()
+	r.string()
+	r.string()
+	for i := r.count(); i > 0; i-- {
+		r.string()
+	}
+	r.string() // server URI
+	r.string() // endpoint URL
+	name := r.string()
+	r.byteString() // client nonce
+	r.byteString() // client certificate
+	timeout := time.Duration(r.double() * float64(time.Millisecond))
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	if timeout < 10*time.Second || timeout > time.Hour {
+		timeout = uaDefaultSessionTimeout
+	}
+	s := &uaSession{
+		id:            uaNumeric(1, srv.nextID()),
+		token:         uaRandomID(0),
+		subscriptions: map[uint32]*uaSubscription{},
+	}
+	srv.sessions[s.token] = s
+	log.Printf("OPC UA session %q created from %v", name, ch.conn.RemoteAddr())
+
+	w.nodeID(s.id)
+	w.nodeID(s.token)
+	w.double(float64(timeout / time.Millisecond))
+	w.byteString(make([]byte, 32))
+	w.byteString(nil)
+	w.int32(1)
+	srv.writeEndpoint(w)
+	w.int32(0)   // software certificates
+	w.string("") // signature algorithm
+	w.byteString(nil)
+	w.uint32(0)
+	return uaGood
+}
+
+func (srv *opcuaServer) activateSession(ch *uaChannel, token uaNodeID, r *uaReader, w *uaWriter) uint32 {
+	s := srv.sessions[token]
+	if s == nil {
+		return uaBadSessionIDInvalid
+	}
+	// anonymous or not, the emulated reader trusts everyone
+	s.channel = ch
+	w.byteString(make([]byte, 32))
+	w.int32(0)
+	w.noDiagnostics()
+	return uaGood
+}
+
+func (srv *opcuaServer) closeSession(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	srv.dropSession(s.token, s)
+	return uaGood
+}
+
+// browse returns the references of the nodes
+func (srv *opcuaServer) browse(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	r.nodeID() // view
+	r.dateTime()
+	r.uint32()
+	r.uint32() // max references per node
+	n := r.count()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	if n == 0 {
+		return uaBadNothingToDo
+	}
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		id := r.nodeID()
+		direction := r.uint32()
+		refType := r.nodeID()
+		subtypes := r.boolean()
+		classMask := r.uint32()
+		r.uint32() // result mask
+		node, ok := srv.nodes[id]
+		if !ok {
+			w.uint32(uaBadNodeIDUnknown)
+			w.byteString(nil)
+			w.int32(0)
+			continue
+		}
+		var refs []uaRef
+		for _, ref := range node.refs {
+			if (direction == 0 && !ref.forward) || (direction == 1 && ref.forward) {
+				continue
+			}
+			if !refType.isNull() && !uaIsReference(ref.refType, refType, subtypes) {
+				continue
+			}
+			target, ok := srv.nodes[ref.target]
+			if !ok || (classMask != 0 && uint32(target.class)&classMask == 0) {
+				continue
+			}
+			refs = append(refs, ref)
+		}
+		w.uint32(uaGood)
+		w.byteString(nil)
+		w.int32(int32(len(refs)))
+		for _, ref := range refs {
+			target := srv.nodes[ref.target]
+			w.nodeID(ref.refType)
+			w.boolean(ref.forward)
+			w.expandedNodeID(target.id)
+			w.qualifiedName(target.browseName)
+			w.localizedText(target.displayName)
+			w.int32(target.class)
+			w.expandedNodeID(target.typeDef)
+		}
+	}
+	w.noDiagnostics()
+	return uaGood
+}
+
+// translateBrowsePaths follows the browse names of the paths
+func (srv *opcuaServer) translateBrowsePaths(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	n := r.count()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		current := r.nodeID()
+		found := srv.nodes[current] != nil
+		for j := r.count(); j > 0; j-- {
+			refType := r.nodeID()
+			inverse := r.boolean()
+			subtypes := r.boolean()
+			name := r.qualifiedName()
+			if !found {
+				continue
+			}
+			found = false
+			for _, ref := range srv.nodes[current].refs {
+				if ref.forward == inverse || (!refType.isNull() && !uaIsReference(ref.refType, refType, subtypes)) {
+					continue
+				}
+				if target, ok := srv.nodes[ref.target]; ok && target.browseName == name {
+					current, found = target.id, true
+					break
+				}
+			}
+		}
+		if !found {
+			w.uint32(uaBadNoMatch)
+			w.int32(0)
+			continue
+		}
+		w.uint32(uaGood)
+		w.int32(1)
+		w.expandedNodeID(current)
+		w.uint32(0xffffffff)
+	}
+	w.noDiagnostics()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	return uaGood
+}
+
+// attribute reads an attribute of a node
+func (srv *opcuaServer) attribute(id uaNodeID, attr uint32) (uaVariant, uint32) {
+	n, ok := srv.nodes[id]
+	if !ok {
+		return uaVariant{}, uaBadNodeIDUnknown
+	}
+	switch attr {
+	case uaAttrNodeID:
+		return uaVariant{uaNodeIDType, n.id}, uaGood
+	case uaAttrNodeClass:
+		return uaVariant{uaInt32, n.class}, uaGood
+	case uaAttrBrowseName:
+		return uaVariant{uaQualifiedName, n.browseName}, uaGood
+	case uaAttrDisplayName:
+		return uaVariant{uaLocalizedText, n.displayName}, uaGood
+	case uaAttrDescription:
+		return uaVariant{uaLocalizedText, ""}, uaGood
+	case uaAttrWriteMask, uaAttrUserWriteMask:
+		return uaVariant{uaUInt32, uint32(0)}, uaGood
+	}
+	switch {
+	case attr == uaAttrIsAbstract && (n.class == uaObjectType || n.class == uaDataType):
+		return uaVariant{uaBoolean, n.isAbstract}, uaGood
+	case attr == uaAttrEventNotifier && n.class == uaObject:
+		return uaVariant{uaByte, n.eventNotifier}, uaGood
+	case attr == uaAttrValue && n.class == uaVariable:
+		if n.value == nil {
+			return uaVariant{}, uaGood
+		}
+		return n.value(), uaGood
+	case attr == uaAttrDataType && n.class == uaVariable:
+		return uaVariant{uaNodeIDType, n.dataType}, uaGood
+	case attr == uaAttrValueRank && n.class == uaVariable:
+		return uaVariant{uaInt32, n.valueRank}, uaGood
+	case attr == uaAttrArrayDims && n.class == uaVariable:
+		if n.valueRank == 1 {
+			return uaArray(uaUInt32, uint32(0)), uaGood
+		}
+		return uaArray(uaUInt32), uaGood
+	case (attr == uaAttrAccessLevel || attr == uaAttrUserAccess) && n.class == uaVariable:
+		return uaVariant{uaByte, byte(1)}, uaGood // CurrentRead
+	case attr == uaAttrMinSampling && n.class == uaVariable:
+		return uaVariant{uaDouble, float64(0)}, uaGood
+	case attr == uaAttrHistorizing && n.class == uaVariable:
+		return uaVariant{uaBoolean, false}, uaGood
+	case (attr == uaAttrExecutable || attr == uaAttrUserExec) && n.class == uaMethod:
+		return uaVariant{uaBoolean, true}, uaGood
+	}
+	return uaVariant{}, uaBadAttributeIDInvalid
+}
+
+func (srv *opcuaServer) read(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	r.double() // max age
+	r.uint32() // timestamps to return
+	n := r.count()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	if n == 0 {
+		return uaBadNothingToDo
+	}
+	now := clk.Now()
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		id := r.nodeID()
+		attr := r.uint32()
+		r.string()
+		r.qualifiedName()
+		v, status := srv.attribute(id, attr)
+		w.dataValue(v, status, now)
+	}
+	w.noDiagnostics()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	return uaGood
+}
+
+// callMethods calls the methods, one after the other
+func (srv *opcuaServer) callMethods(r *uaReader, w *uaWriter) uint32 {
+	n := r.count()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	if n == 0 {
+		return uaBadNothingToDo
+	}
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		object := r.nodeID()
+		method := r.nodeID()
+		args := []uaVariant{}
+		for j := r.count(); j > 0 && r.err == nil; j-- {
+			args = append(args, r.variant())
+		}
+		if r.err != nil {
+			return uaBadDecodingError
+		}
+		srv.Lock()
+		m, ok := srv.nodes[method]
+		owned := false
+		for _, ref := range m.refsOrNil() {
+			if !ref.forward && ref.refType == uaHasComponent && ref.target == object {
+				owned = true
+			}
+		}
+		srv.Unlock()
+		status, out := uint32(uaGood), []uaVariant{}
+		switch {
+		case !ok || m.call == nil:
+			status = uaBadMethodInvalid
+		case !owned:
+			status = uaBadMethodInvalid
+		default:
+			out, status = m.call(args)
+		}
+		w.uint32(status)
+		w.int32(0) // input argument results
+		w.noDiagnostics()
+		w.int32(int32(len(out)))
+		for _, v := range out {
+			w.variant(v)
+		}
+	}
+	w.noDiagnostics()
+	return uaGood
+}
+
+// refsOrNil returns the references of a node that may be missing
+func (n *uaNode) refsOrNil() []uaRef {
+	if n == nil {
+		return nil
+	}
+	return n.refs
+}
+
+func (srv *opcuaServer) createSubscription(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	interval := time.Duration(r.double() * float64(time.Millisecond))
+	lifetime := r.uint32()
+	keepAlive := r.uint32()
+	r.uint32() // max notifications per publish
+	enabled := r.boolean()
+	r.byte() // priority
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	sub := &uaSubscription{
+		id:      srv.nextID(),
+		session: s,
+		enabled: enabled,
+		items:   map[uint32]*uaMonitoredItem{},
+		stop:    make(chan struct{}),
+	}
+	sub.revise(interval, lifetime, keepAlive)
+	s.subscriptions[sub.id] = sub
+	go srv.publishing(sub)
+
+	w.uint32(sub.id)
+	w.double(float64(sub.interval) / float64(time.Millisecond))
+	w.uint32(sub.lifetime)
+	w.uint32(sub.maxKeepAlive)
+	return uaGood
+}
+
+// revise bounds the requested publishing parameters
+func (sub *uaSubscription) revise(interval time.Duration, lifetime, keepAlive uint32) {
+	if interval < uaMinPublishingInterval {
+		interval = uaMinPublishingInterval
+	}
+	if keepAlive == 0 {
+		keepAlive = 10
+	}
+	if lifetime < 3*keepAlive {
+		lifetime = 3 * keepAlive
+	}
+	sub.interval, sub.lifetime, sub.maxKeepAlive = interval, lifetime, keepAlive
+}
+
+func (srv *opcuaServer) modifySubscription(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	sub, ok := s.subscriptions[r.uint32()]
+	interval := time.Duration(r.double() * float64(time.Millisecond))
+	lifetime := r.uint32()
+	keepAlive := r.uint32()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	if !ok {
+		return uaBadSubscriptionIDInvalid
+	}
+	sub.revise(interval, lifetime, keepAlive)
+	w.double(float64(sub.interval) / float64(time.Millisecond))
+	w.uint32(sub.lifetime)
+	w.uint32(sub.maxKeepAlive)
+	return uaGood
+}
+
+func (srv *opcuaServer) setPublishingMode(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	enabled := r.boolean()
+	n := r.count()
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		if sub, ok := s.subscriptions[r.uint32()]; ok {
+			sub.enabled = enabled
+			w.uint32(uaGood)
+		} else {
+			w.uint32(uaBadSubscriptionIDInvalid)
+		}
+	}
+	w.noDiagnostics()
+	return uaGood
+}
+
+func (srv *opcuaServer) deleteSubscriptions(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	n := r.count()
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		id := r.uint32()
+		if sub, ok := s.subscriptions[id]; ok {
+			close(sub.stop)
+			delete(s.subscriptions, id)
+			w.uint32(uaGood)
+		} else {
+			w.uint32(uaBadSubscriptionIDInvalid)
+		}
+	}
+	w.noDiagnostics()
+	return uaGood
+}
+
+func (srv *opcuaServer) createMonitoredItems(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	sub, ok := s.subscriptions[r.uint32()]
+	r.uint32() // timestamps to return
+	n := r.count()
+	if r.err != nil {
+		return uaBadDecodingError
+	}
+	if !ok {
+		return uaBadSubscriptionIDInvalid
+	}
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		item := &uaMonitoredItem{node: r.nodeID(), attribute: r.uint32()}
+		r.string()
+		r.qualifiedName()
+		item.enabled = r.uint32() != 0 // disabled, sampling or reporting
+		item.clientHandle = r.uint32()
+		sampling := r.double()
+		filter := r.extension()
+		queueSize := r.uint32()
+		r.boolean()
+		if r.err != nil {
+			return uaBadDecodingError
+		}
+		status := uint32(uaGood)
+		if node, ok := srv.nodes[item.node]; !ok {
+			status = uaBadNodeIDUnknown
+		} else if item.attribute == uaAttrEventNotifier {
+			if node.eventNotifier == 0 {
+				status = uaBadAttributeIDInvalid
+			} else if filter.typeID != uaNumeric(0, uaEventFilter) || filter.body == nil {
+				status = uaBadMonitoredItemFilterInval
+			} else {
+				item.selects = uaSelectClauses(filter.body)
+			}
+		} else if _, s := srv.attribute(item.node, item.attribute); s != uaGood {
+			status = s
+		}
+		if status != uaGood {
+			w.uint32(status)
+			w.uint32(0)
+			w.double(0)
+			w.uint32(0)
+			w.extension(uaExtension{})
+			continue
+		}
+		item.id = srv.nextID()
+		sub.items[item.id] = item
+		w.uint32(uaGood)
+		w.uint32(item.id)
+		w.double(sampling)
+		w.uint32(queueSize)
+		w.extension(uaExtension{})
+	}
+	w.noDiagnostics()
+	return uaGood
+}
+
+// uaSelectClauses reads the browse paths of the SelectClauses of an
+// EventFilter; the WhereClause is ignored
+func uaSelectClauses(filter []byte) [][]uaQName {
+	r := &uaReader{b: filter}
+	selects := [][]uaQName{}
+	for i := r.count(); i > 0 && r.err == nil; i-- {
+		r.nodeID() // type definition
+		path := []uaQName{}
+		for j := r.count(); j > 0; j-- {
+			path = append(path, r.qualifiedName())
+		}
+		r.uint32() // attribute
+		r.string() // index range
+		selects = append(selects, path)
+	}
+	return selects
+}
+
+func (srv *opcuaServer) setMonitoringMode(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	sub, ok := s.subscriptions[r.uint32()]
+	enabled := r.uint32() != 0
+	n := r.count()
+	if !ok {
+		return uaBadSubscriptionIDInvalid
+	}
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		if item, ok := sub.items[r.uint32()]; ok {
+			item.enabled = enabled
+			w.uint32(uaGood)
+		} else {
+			w.uint32(uaBadMonitoredItemIDInvalid)
+		}
+	}
+	w.noDiagnostics()
+	return uaGood
+}
+
+func (srv *opcuaServer) deleteMonitoredItems(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	sub, ok := s.subscriptions[r.uint32()]
+	n := r.count()
+	if !ok {
+		return uaBadSubscriptionIDInvalid
+	}
+	w.int32(int32(n))
+	for i := 0; i < n; i++ {
+		id := r.uint32()
+		if _, ok := sub.items[id]; ok {
+			delete(sub.items, id)
+			w.uint32(uaGood)
+		} else {
+			w.uint32(uaBadMonitoredItemIDInvalid)
+		}
+	}
+	w.noDiagnostics()
+	return uaGood
+}
+
+// republish has nothing to send again, the notifications aren't kept
+func (srv *opcuaServer) republish(s *uaSession, r *uaReader, w *uaWriter) uint32 {
+	return uaBadMessageNotAvailable
+}
+
+// queuePublish keeps a PublishRequest for the next notifications
+func (srv *opcuaServer) queuePublish(ch *uaChannel, s *uaSession, requestID, handle uint32, r *uaReader) uint32 {
+	if len(s.subscriptions) == 0 {
+		return 0x80790000 // BadNoSubscription
+	}
+	// the acknowledgements are not needed, nothing is kept to republish
+	s.publish = append(s.publish, uaPendingPublish{channel: ch, requestID: requestID, handle: handle})
+	return uaGood
+}
+
+// publishing samples the items of a subscription every interval and
+// answers the pending PublishRequests
+func (srv *opcuaServer) publishing(sub *uaSubscription) {
+	ticker := time.NewTicker(sub.interval)
+	defer ticker.Stop()
+	interval := sub.interval
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-ticker.C:
+		}
+		srv.Lock()
+		if sub.interval != interval {
+			interval = sub.interval
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+		}
+		srv.publish(sub)
+		srv.Unlock()
+	}
+}
+
+// publish queues the notifications of the items and sends the oldest
+// queued ones or a keep-alive to a pending PublishRequest
+func (srv *opcuaServer) publish(sub *uaSubscription) {
+	if sub.enabled {
+		if data := srv.notifications(sub); data != nil && len(sub.queue) < uaMaxQueuedNotificationLists {
+			sub.queue = append(sub.queue, data)
+		}
+	}
+	s := sub.session
+	if len(sub.queue) == 0 {
+		sub.idle++
+		if sub.idle < sub.maxKeepAlive {
+			return
+		}
+	}
+	if len(s.publish) == 0 {
+		return
+	}
+	p := s.publish[0]
+	s.publish = s.publish[1:]
+	sub.idle = 0
+
+	var w uaWriter
+	w.nodeID(uaNumeric(0, uaPublishResponse))
+	uaResponseHeader(&w, p.handle, uaGood)
+	w.uint32(sub.id)
+	w.int32(0) // available sequence numbers
+	w.boolean(len(sub.queue) > 1)
+	if len(sub.queue) == 0 {
+		// a keep-alive carries the next sequence number
+		w.uint32(sub.seq + 1)
+		w.dateTime(clk.Now())
+		w.int32(0)
+	} else {
+		sub.seq++
+		w.uint32(sub.seq)
+		w.dateTime(clk.Now())
+		w.Write(sub.queue[0])
+		sub.queue = sub.queue[1:]
+	}
+	w.int32(0) // acknowledgement results
+	w.noDiagnostics()
+	if err := p.channel.send(p.requestID, w.Bytes()); err != nil {
+		p.channel.conn.Close()
+	}
+}
+
+// notifications returns the NotificationData of the changed values and
+// the events of the items, nil if there are none
+func (srv *opcuaServer) notifications(sub *uaSubscription) []byte {
+	var changes, events uaWriter
+	nChanges, nEvents := 0, 0
+	for _, item := range sub.items {
+		if !item.enabled {
+			item.events = nil
+			continue
+		}
+		if item.attribute == uaAttrEventNotifier {
+			for _, fields := range item.events {
+				events.uint32(item.clientHandle)
+				events.int32(int32(len(fields)))
+				for _, f := range fields {
+					events.variant(f)
+				}
+				nEvents++
+			}
+			item.events = nil
+			continue
+		}
+		v, status := srv.attribute(item.node, item.attribute)
+		var value uaWriter
+		value.dataValue(v, status, time.Time{})
+		if item.last != nil && string(item.last) == string(value.Bytes()) {
+			continue
+		}
+		item.last = value.Bytes()
+		changes.uint32(item.clientHandle)
+		changes.dataValue(v, status, clk.Now())
+		nChanges++
+	}
+	if nChanges == 0 && nEvents == 0 {
+		return nil
+	}
+	var w uaWriter
+	count := 0
+	if nChanges != 0 {
+		count++
+	}
+	if nEvents != 0 {
+		count++
+	}
+	w.int32(int32(count))
+	if nChanges != 0 {
+		var body uaWriter
+		body.int32(int32(nChanges))
+		body.Write(changes.Bytes())
+		body.noDiagnostics()
+		w.extension(uaExtension{typeID: uaNumeric(0, uaDataChangeNotification), body: body.Bytes()})
+	}
+	if nEvents != 0 {
+		var body uaWriter
+		body.int32(int32(nEvents))
+		body.Write(events.Bytes())
+		w.extension(uaExtension{typeID: uaNumeric(0, uaEventNotificationList), body: body.Bytes()})
+	}
+	return w.Bytes()
+}
+
+// fire delivers an event of the source to the items monitoring it or the
+// Server object, with the fields picked by their select clauses
+func (srv *opcuaServer) fire(source uaNodeID, fields map[string]uaVariant) {
+	srv.Lock()
+	defer srv.Unlock()
+	for _, s := range srv.sessions {
+		for _, sub := range s.subscriptions {
+			for _, item := range sub.items {
+				if item.attribute != uaAttrEventNotifier || !item.enabled || (item.node != source && item.node != uaServerObject) {
+					continue
+				}
+				values := make([]uaVariant, len(item.selects))
+				for i, path := range item.selects {
+					if len(path) != 0 {
+						values[i] = fields[path[len(path)-1].name]
+					}
+				}
+				if len(item.events) < uaMaxQueuedNotificationLists {
+					item.events = append(item.events, values)
+				}
+			}
+		}
+	}
+}
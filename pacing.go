@@ -0,0 +1,144 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/iomz/go-llrp"
+)
+
+// reportLimit returns the maximum number of tags in a report, 0 for as
+// many as --pdu fits
+func reportLimit() int {
+	if *pacing == "stream" {
+		return 1
+	}
+	return *maxTagsPerReport
+}
+
+// buildReports splits the tags into the TagReportData of the reports, at
+// most reportLimit tags each and within --pdu bytes
+func buildReports(tags llrp.Tags) llrp.TagReportDataStack {
+	max := reportLimit()
+	if max <= 0 || len(tags) <= max {
+		return tags.BuildTagReportDataStack(*pdu)
+	}
+	trds := llrp.TagReportDataStack{}
+	for i := 0; i < len(tags); i += max {
+		end := i + max
+		if end > len(tags) {
+			end = len(tags)
+		}
+		trds = append(trds, tags[i:end].BuildTagReportDataStack(*pdu)...)
+	}
+	return trds
+}
+
+// reportOffsets returns when to send each of n reports after the tick:
+// all at once in the burst mode, evenly across the interval when spread,
+// and at random read times within the interval when streaming
+func reportOffsets(n int, interval time.Duration) []time.Duration {
+	offsets := make([]time.Duration, n)
+	if interval <= 0 {
+		return offsets
+	}
+	switch *pacing {
+	case "spread":
+		for i := range offsets {
+			offsets[i] = interval * time.Duration(i) / time.Duration(n)
+		}
+	case "stream":
+		for i := range offsets {
+			offsets[i] = time.Duration(rng.Int63n(int64(interval)))
+		}
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	}
+	return offsets
+}
+
+// reportPacer sends the reports of a tick following --pacing from the
+// select loop of a session: C delivers when the next report is due, so the
+// loop keeps serving the keepalives and the tag updates in between
+type reportPacer struct {
+	send    func(trd *llrp.TagReportData) error
+	trds    llrp.TagReportDataStack
+	start   time.Time
+	offsets []time.Duration
+	timer   *ClockTicker
+}
+
+// newReportPacer returns a pacer sending the reports with send
+func newReportPacer(send func(trd *llrp.TagReportData) error) *reportPacer {
+	return &reportPacer{send: send}
+}
+
+// C delivers when the next report is due, never while none is pending
+func (p *reportPacer) C() <-chan time.Time {
+	if p.timer == nil {
+		return nil
+	}
+	return p.timer.C
+}
+
+// Start paces the reports of the tick, after sending the ones left of the
+// last tick
+func (p *reportPacer) Start(tick time.Time, trds llrp.TagReportDataStack) error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	p.trds, p.start = trds, tick
+	p.offsets = reportOffsets(len(trds), time.Duration(*reportInterval)*time.Millisecond)
+	return p.Send(tick)
+}
+
+// Flush sends the pending reports right away
+func (p *reportPacer) Flush() error {
+	if len(p.offsets) == 0 {
+		return nil
+	}
+	return p.Send(p.start.Add(p.offsets[len(p.offsets)-1]))
+}
+
+// Send sends the reports due by now, the tick of C, and sets the timer of
+// the next one; it stops at the first error
+func (p *reportPacer) Send(now time.Time) error {
+	p.Stop()
+	for len(p.trds) != 0 {
+		if due := p.start.Add(p.offsets[0]); due.After(now) {
+			p.timer = clk.NewTimer(due)
+			return nil
+		}
+		trd := p.trds[0]
+		p.trds, p.offsets = p.trds[1:], p.offsets[1:]
+		if err := p.send(trd); err != nil {
+			p.trds, p.offsets = nil, nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop turns off the timer, the pending reports stay pending
+func (p *reportPacer) Stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// paceReports sends the reports of a tick with send following --pacing,
+// and stops at the first error; it blocks until the last one is sent
+func paceReports(trds llrp.TagReportDataStack, send func(trd *llrp.TagReportData) error) error {
+	p := newReportPacer(send)
+	defer p.Stop()
+	err := p.Start(clk.Now(), trds)
+	for err == nil && len(p.trds) != 0 {
+		err = p.Send(<-p.C())
+	}
+	return err
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pipeline processes the reads of the client mode before the outputs, nil
+// without any rule
+var pipeline *readPipeline
+
+// readPipeline filters, dedupes and enriches the reads: the --include and
+// --exclude patterns and the --min-rssi threshold drop reads, --location
+// names their antennas, --dedupe drops the reads of a tag already reported
+// at the same location within the window and --products names the
+// products of the EPCs
+type readPipeline struct {
+	include   []epcPattern
+	exclude   []epcPattern
+	minRSSI   int8
+	locations map[uint16]string
+	window    time.Duration
+	last      map[string]time.Time
+	pruned    time.Time
+	products  []product
+}
+
+// product is a row of the --products lookup
+type product struct {
+	prefix string
+	name   string
+}
+
+// newReadPipeline builds the pipeline of the client flags, nil when there
+// are no rules
+func newReadPipeline() *readPipeline {
+	if len(*includes) == 0 && len(*excludes) == 0 && *minRSSI == -128 &&
+		len(*locations) == 0 && *dedupe == 0 && *productFile == "" {
+		return nil
+	}
+	if *minRSSI < -128 || *minRSSI > 127 {
+		log.Fatalf("invalid --min-rssi %v", *minRSSI)
+	}
+	p := &readPipeline{
+		minRSSI:   int8(*minRSSI),
+		locations: map[uint16]string{},
+		window:    *dedupe,
+		last:      map[string]time.Time{},
+	}
+	var err error
+	if p.include, err = epcPatterns(*includes); err != nil {
+		log.Fatalf("invalid --include: %v", err)
+	}
+	if p.exclude, err = epcPatterns(*excludes); err != nil {
+		log.Fatalf("invalid --exclude: %v", err)
+	}
+	for _, l := range *locations {
+		i := strings.Index(l, "=")
+		if i < 0 {
+			log.Fatalf("invalid location %q, expected ANTENNA=NAME", l)
+		}
+		a, err := strconv.ParseUint(l[:i], 10, 16)
+		if err != nil || a == 0 {
+			log.Fatalf("invalid antenna in location %q", l)
+		}
+		p.locations[uint16(a)] = l[i+1:]
+	}
+	if *productFile != "" {
+		if p.products, err = loadProducts(*productFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("enriching the reads with %v products of %v", len(p.products), *productFile)
+	}
+	return p
+}
+
+// epcPattern is an --include or --exclude pattern: a glob of the EPC in
+// hex, or an EPC URI whose fields are matched one by one
+type epcPattern struct {
+	glob string
+	// scheme is the URI up to its last colon, e.g. urn:epc:tag:sgtin-96:
+	scheme string
+	fields []uriField
+}
+
+// uriField is a field of an EPC URI pattern: * matches any value,
+// [LO-HI] the decimal values within the range and the others only
+// themselves
+type uriField struct {
+	any    bool
+	ranged bool
+	lo, hi uint64
+	value  string
+}
+
+// epcPatterns parses the patterns, either EPC URI patterns or globs of
+// the EPC in hex, the latter in lower case like the reads
+func epcPatterns(patterns []string) ([]epcPattern, error) {
+	parsed := []epcPattern{}
+	for _, pat := range patterns {
+		if !strings.HasPrefix(pat, "urn:") {
+			pat = strings.ToLower(pat)
+			if _, err := path.Match(pat, ""); err != nil {
+				return nil, fmt.Errorf("%q: %v", pat, err)
+			}
+			parsed = append(parsed, epcPattern{glob: pat})
+			continue
+		}
+		p, err := parseURIPattern(pat)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", pat, err)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// parseURIPattern splits an EPC URI pattern into its fields; the
+// urn:epc:pat: patterns match the urn:epc:tag: URIs of the reads
+func parseURIPattern(pat string) (epcPattern, error) {
+	if strings.HasPrefix(pat, "urn:epc:pat:") {
+		pat = "urn:epc:tag:" + strings.TrimPrefix(pat, "urn:epc:pat:")
+	}
+	i := strings.LastIndex(pat, ":")
+	p := epcPattern{scheme: pat[:i+1]}
+	if strings.Count(p.scheme, ":") < 3 || i == len(pat)-1 {
+		return p, fmt.Errorf("expected urn:epc:SCHEME:FIELD.FIELD...")
+	}
+	for _, f := range strings.Split(pat[i+1:], ".") {
+		switch {
+		case f == "*":
+			p.fields = append(p.fields, uriField{any: true})
+		case strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]"):
+			bounds := strings.SplitN(f[1:len(f)-1], "-", 2)
+			if len(bounds) != 2 {
+				return p, fmt.Errorf("invalid range %v, expected [LO-HI]", f)
+			}
+			lo, err := strconv.ParseUint(bounds[0], 10, 64)
+			if err != nil {
+				return p, fmt.Errorf("invalid range %v, expected [LO-HI]", f)
+			}
+			hi, err := strconv.ParseUint(bounds[1], 10, 64)
+			if err != nil || hi < lo {
+				return p, fmt.Errorf("invalid range %v, expected [LO-HI]", f)
+			}
+			p.fields = append(p.fields, uriField{ranged: true, lo: lo, hi: hi})
+		case f == "" || strings.ContainsAny(f, "*[]"):
+			return p, fmt.Errorf("invalid field %q, expected a value, * or [LO-HI]", f)
+		default:
+			p.fields = append(p.fields, uriField{value: f})
+		}
+	}
+	return p, nil
+}
+
+// matchURI tells whether an EPC URI matches the pattern, field by field
+func (p epcPattern) matchURI(uri string) bool {
+	if !strings.HasPrefix(uri, p.scheme) {
+		return false
+	}
+	fields := strings.Split(uri[len(p.scheme):], ".")
+	if strings.Contains(uri[len(p.scheme):], ":") || len(fields) != len(p.fields) {
+		return false
+	}
+	for i, f := range p.fields {
+		switch {
+		case f.any:
+		case f.ranged:
+			// the ranges apply to the decimal values without leading zeros
+			if len(fields[i]) > 1 && fields[i][0] == '0' {
+				return false
+			}
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil || v < f.lo || v > f.hi {
+				return false
+			}
+		case f.value != fields[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// loadProducts reads the PREFIX,NAME rows of a CSV file, the prefix being
+// the start of the EPC in hex or of its EPC URI; a first row starting with
+// "prefix" is a header
+func loadProducts(name string) ([]product, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	products := []product{}
+	for n := 1; ; n++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			return products, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		if n == 1 && strings.EqualFold(strings.TrimSpace(row[0]), "prefix") {
+			continue
+		}
+		if len(row) < 2 {
+			return nil, fmt.Errorf("%v: row %v: expected PREFIX,NAME", name, n)
+		}
+		prefix := strings.TrimSpace(row[0])
+		if !strings.HasPrefix(prefix, "urn:") {
+			prefix = strings.ToLower(prefix)
+		}
+		products = append(products, product{prefix: prefix, name: strings.TrimSpace(row[1])})
+	}
+}
+
+// Process returns the reads kept by the pipeline
+func (p *readPipeline) Process(reads []TagRead) []TagRead {
+	kept := reads[:0]
+	for _, r := range reads {
+		uris := epcURIs(r.EPC)
+		if len(p.include) != 0 && !matchEPC(p.include, r.EPC, uris) {
+			continue
+		}
+		if matchEPC(p.exclude, r.EPC, uris) {
+			continue
+		}
+		// reads without a RSSI are kept
+		if r.RSSI != 0 && r.RSSI < p.minRSSI {
+			continue
+		}
+		r.Location = p.locations[r.Antenna]
+		if p.deduped(r) {
+			continue
+		}
+		r.Product = p.product(r.EPC, uris)
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// deduped tells whether the tag was reported at the same location, or
+// antenna without --location, within the --dedupe window
+func (p *readPipeline) deduped(r TagRead) bool {
+	if p.window == 0 {
+		return false
+	}
+	where := r.Location
+	if where == "" {
+		where = strconv.Itoa(int(r.Antenna))
+	}
+	key := r.Reader + "/" + where + "/" + r.EPC
+	if last, ok := p.last[key]; ok && r.Timestamp.Sub(last) < p.window {
+		return true
+	}
+	p.last[key] = r.Timestamp
+	// forget the tags of the past windows once per window
+	if r.Timestamp.Sub(p.pruned) >= p.window {
+		for k, t := range p.last {
+			if r.Timestamp.Sub(t) >= p.window {
+				delete(p.last, k)
+			}
+		}
+		p.pruned = r.Timestamp
+	}
+	return false
+}
+
+// product returns the name of the longest --products prefix of the EPC
+func (p *readPipeline) product(epc string, uris []string) string {
+	name, longest := "", -1
+	for _, pr := range p.products {
+		if len(pr.prefix) <= longest {
+			continue
+		}
+		if strings.HasPrefix(epc, pr.prefix) {
+			name, longest = pr.name, len(pr.prefix)
+			continue
+		}
+		for _, u := range uris {
+			if strings.HasPrefix(u, pr.prefix) {
+				name, longest = pr.name, len(pr.prefix)
+				break
+			}
+		}
+	}
+	return name
+}
+
+// matchEPC tells whether the EPC, or one of its URIs, matches one of the
+// patterns
+func matchEPC(patterns []epcPattern, epc string, uris []string) bool {
+	for _, pat := range patterns {
+		if pat.glob != "" {
+			if ok, _ := path.Match(pat.glob, epc); ok {
+				return true
+			}
+			continue
+		}
+		for _, u := range uris {
+			if pat.matchURI(u) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the partitions of the company prefix and the item or serial reference
+// of the SGTIN-96 and SSCC-96 EPCs: the bits and digits of each
+var (
+	sgtinPartitions = [7][4]uint{
+		{40, 12, 4, 1}, {37, 11, 7, 2}, {34, 10, 10, 3}, {30, 9, 14, 4},
+		{27, 8, 17, 5}, {24, 7, 20, 6}, {20, 6, 24, 7},
+	}
+	ssccPartitions = [7][4]uint{
+		{40, 12, 18, 5}, {37, 11, 21, 6}, {34, 10, 24, 7}, {30, 9, 28, 8},
+		{27, 8, 31, 9}, {24, 7, 34, 10}, {20, 6, 38, 11},
+	}
+)
+
+// epcURIs returns the pure identity and tag URIs of an SGTIN-96 or
+// SSCC-96 EPC in hex, and the raw URI of the others
+func epcURIs(epc string) []string {
+	b, err := hex.DecodeString(epc)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	raw := fmt.Sprintf("urn:epc:raw:%v.x%X", len(b)*8, b)
+	if len(b) != 12 {
+		return []string{raw}
+	}
+	field := func(off, n uint) uint64 {
+		var v uint64
+		for i := off; i < off+n; i++ {
+			v = v<<1 | uint64(b[i/8]>>(7-i%8)&1)
+		}
+		return v
+	}
+	filter, partition := field(8, 3), field(11, 3)
+	if partition > 6 {
+		return []string{raw}
+	}
+	switch b[0] {
+	case 0x30:
+		pt := sgtinPartitions[partition]
+		cp := fmt.Sprintf("%0*d", int(pt[1]), field(14, pt[0]))
+		item := fmt.Sprintf("%0*d", int(pt[3]), field(14+pt[0], pt[2]))
+		serial := field(58, 38)
+		return []string{
+			fmt.Sprintf("urn:epc:id:sgtin:%v.%v.%v", cp, item, serial),
+			fmt.Sprintf("urn:epc:tag:sgtin-96:%v.%v.%v.%v", filter, cp, item, serial),
+			raw,
+		}
+	case 0x31:
+		pt := ssccPartitions[partition]
+		cp := fmt.Sprintf("%0*d", int(pt[1]), field(14, pt[0]))
+		serial := fmt.Sprintf("%0*d", int(pt[3]), field(14+pt[0], pt[2]))
+		return []string{
+			fmt.Sprintf("urn:epc:id:sscc:%v.%v", cp, serial),
+			fmt.Sprintf("urn:epc:tag:sscc-96:%v.%v.%v", filter, cp, serial),
+			raw,
+		}
+	}
+	return []string{raw}
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iomz/golemu/codec"
+	"github.com/iomz/golemu/llrpclient"
+)
+
+// TagRead is a read of the read stream, taken from the RO_ACCESS_REPORTs
+// sent or received in the LLRP sessions
+type TagRead struct {
+	// Reader is the host:port of the reader
+	Reader string
+	EPC    string
+	PC     uint16
+	// Antenna and RSSI are 0 when the report doesn't have them
+	Antenna   uint16
+	RSSI      int8
+	Timestamp time.Time
+	// Location and Product are set by the client mode pipeline
+	Location string `json:",omitempty"`
+	Product  string `json:",omitempty"`
+}
+
+// ReaderEvent is a reader event of the read stream: ConnectionAttempt,
+// ConnectionClose, AntennaConnected, AntennaDisconnected or the name of
+// another LLRP event
+type ReaderEvent struct {
+	Reader    string
+	Type      string
+	Antenna   uint16
+	Timestamp time.Time
+}
+
+// readSink is an output of the read stream
+type readSink interface {
+	Reads(reads []TagRead)
+	Event(e ReaderEvent)
+	Close()
+}
+
+var (
+	sinks     []readSink
+	sinksLock sync.Mutex
+)
+
+// addSink starts feeding the read stream to an output
+func addSink(s readSink) {
+	sinksLock.Lock()
+	sinks = append(sinks, s)
+	sinksLock.Unlock()
+}
+
+// closeSinks flushes and closes the outputs
+func closeSinks() {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	for _, s := range sinks {
+		s.Close()
+	}
+	sinks = nil
+}
+
+// localReader names the emulated reader listening on the port
+func localReader(port int) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%v:%v", host, port)
+}
+
+// portName names the reader on the port after name: name itself for the
+// reader on --port, name-PORT for the others
+func portName(name string, readerPort int) string {
+	if readerPort == *port {
+		return name
+	}
+	return fmt.Sprintf("%v-%v", name, readerPort)
+}
+
+// publishReport feeds the tags of a received report to the outputs
+func publishReport(reader string, r *llrpclient.Report) {
+	sinksLock.Lock()
+	n := len(sinks)
+	sinksLock.Unlock()
+	if n == 0 || len(r.Tags) == 0 {
+		return
+	}
+	now := clk.Now()
+	reads := make([]TagRead, 0, len(r.Tags))
+	for _, t := range r.Tags {
+		read := TagRead{
+			Reader:    reader,
+			EPC:       hex.EncodeToString(t.EPC),
+			PC:        t.PC,
+			Antenna:   t.AntennaID,
+			RSSI:      t.PeakRSSI,
+			Timestamp: t.LastSeen,
+		}
+		if read.Timestamp.IsZero() {
+			read.Timestamp = now
+		}
+		reads = append(reads, read)
+	}
+	publishReads(reads)
+}
+
+// publishReads feeds the reads to the outputs, through the pipeline of
+// the client mode
+func publishReads(reads []TagRead) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	if pipeline != nil {
+		if reads = pipeline.Process(reads); len(reads) == 0 {
+			return
+		}
+	}
+	for _, s := range sinks {
+		s.Reads(reads)
+	}
+}
+
+// publishTagReportData feeds the tags of the TagReportData sent in an
+// RO_ACCESS_REPORT to the outputs
+func publishTagReportData(reader string, data []byte) {
+	sinksLock.Lock()
+	n := len(sinks)
+	sinksLock.Unlock()
+	if n == 0 {
+		return
+	}
+	m, err := decodeTagReportData(data)
+	if err != nil {
+		log.Printf("couldn't read the report for the outputs: %v", err)
+		return
+	}
+	publishReport(reader, llrpclient.NewReport(m))
+}
+
+// decodeTagReportData decodes the TagReportData of an RO_ACCESS_REPORT
+func decodeTagReportData(data []byte) (*codec.Message, error) {
+	frame, _ := codec.NewMessage(codec.ROAccessReport, 0).Encode()
+	frame = append(frame, data...)
+	binary.BigEndian.PutUint32(frame[2:6], uint32(len(frame)))
+	return codec.Decode(frame)
+}
+
+// encodeTagReportData encodes the parameters of an RO_ACCESS_REPORT
+func encodeTagReportData(m *codec.Message) ([]byte, error) {
+	var data []byte
+	for _, p := range m.Parameters {
+		b, err := p.Encode()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// publishEvent feeds a reader event to the outputs
+func publishEvent(reader, eventType string, antenna uint16) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	e := ReaderEvent{Reader: reader, Type: eventType, Antenna: antenna, Timestamp: clk.Now()}
+	for _, s := range sinks {
+		s.Event(e)
+	}
+}
+
+// publishReaderEvent feeds the events of a received
+// READER_EVENT_NOTIFICATION to the outputs
+func publishReaderEvent(reader string, e *llrpclient.Event) {
+	if e.Data == nil {
+		return
+	}
+	for _, p := range e.Data.Parameters {
+		switch p.Type {
+		case codec.UTCTimestamp, codec.Uptime:
+			continue
+		case codec.AntennaEvent:
+			if p.Uint("EventType") == 0 {
+				publishEvent(reader, "AntennaDisconnected", uint16(p.Uint("AntennaID")))
+			} else {
+				publishEvent(reader, "AntennaConnected", uint16(p.Uint("AntennaID")))
+			}
+		default:
+			publishEvent(reader, strings.TrimSuffix(codec.ParameterName(p.Type), "Event"), 0)
+		}
+	}
+}
+
+// publishAntennaEvents feeds the antenna changes of the emulated reader to
+// the outputs
+func publishAntennaEvents(port int) {
+	health.OnAntenna(func(antenna int, connected bool) {
+		if connected {
+			publishEvent(localReader(port), "AntennaConnected", uint16(antenna))
+		} else {
+			publishEvent(localReader(port), "AntennaDisconnected", uint16(antenna))
+		}
+	})
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iomz/golemu/codec"
+)
+
+// SessionRecord is a single LLRP message captured on a connection
+type SessionRecord struct {
+	Time  time.Time `json:"time"`
+	Conn  string    `json:"conn"`
+	From  string    `json:"from"`
+	Type  string    `json:"type"`
+	ID    uint32    `json:"id"`
+	Frame string    `json:"frame"`
+}
+
+// SessionRecorder writes the captured LLRP messages as JSON lines
+type SessionRecorder struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// recordingConn copies the LLRP frames passing through a connection to the
+// recorder
+type recordingConn struct {
+	net.Conn
+	recorder *SessionRecorder
+	local    string
+	peer     string
+	rmu, wmu sync.Mutex
+	rbuf     []byte
+	wbuf     []byte
+}
+
+// NewSessionRecorder creates or appends to the recording file
+func NewSessionRecorder(path string) (*SessionRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionRecorder{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes a single frame sent by from on conn
+func (r *SessionRecorder) Record(conn, from string, frame []byte) {
+	rec := SessionRecord{
+		Time:  clk.Now(),
+		Conn:  conn,
+		From:  from,
+		Type:  codec.MessageName(codec.FrameType(frame)),
+		ID:    binary.BigEndian.Uint32(frame[6:10]),
+		Frame: hex.EncodeToString(frame),
+	}
+	r.Lock()
+	defer r.Unlock()
+	if err := r.enc.Encode(&rec); err != nil {
+		log.Print(err)
+	}
+}
+
+// Close closes the recording file
+func (r *SessionRecorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.file.Close()
+}
+
+// recordConn wraps conn so that its traffic is recorded when --record is
+// given; local is the role golemu plays on the connection
+func recordConn(conn net.Conn, local string) net.Conn {
+	if recorder == nil {
+		return conn
+	}
+	peer := "client"
+	if local == "client" {
+		peer = "reader"
+	}
+	return &recordingConn{Conn: conn, recorder: recorder, local: local, peer: peer}
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rmu.Lock()
+	c.rbuf = c.capture(c.rbuf, b[:n], c.peer)
+	c.rmu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.wmu.Lock()
+	c.wbuf = c.capture(c.wbuf, b[:n], c.local)
+	c.wmu.Unlock()
+	return n, err
+}
+
+// capture appends b to buf and records every complete frame in it
+func (c *recordingConn) capture(buf, b []byte, from string) []byte {
+	buf = append(buf, b...)
+	for len(buf) >= codec.HeaderSize {
+		length := int(binary.BigEndian.Uint32(buf[2:6]))
+		if length < codec.HeaderSize {
+			// not LLRP, stop recording this direction
+			return nil
+		}
+		if len(buf) < length {
+			break
+		}
+		c.recorder.Record(c.Conn.RemoteAddr().String(), from, buf[:length])
+		buf = buf[length:]
+	}
+	return buf
+}
+
+// loadRecording reads all the records in a recording file
+func loadRecording(path string) ([]SessionRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []SessionRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec SessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Message decodes the recorded frame
+func (rec *SessionRecord) Message() (*codec.Message, error) {
+	frame, err := hex.DecodeString(rec.Frame)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(frame)
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// rfProfile is a set of regional rules limiting when the reader transmits
+type rfProfile struct {
+	// MaxOnTime limits a continuous transmission, followed by OffTime
+	MaxOnTime time.Duration
+	OffTime   time.Duration
+	// Listen is the listen-before-talk time before each transmission, plus
+	// up to ListenJitter; zero disables LBT
+	Listen       time.Duration
+	ListenJitter time.Duration
+	// DutyCycle limits the time on air to a fraction of every DutyPeriod
+	DutyCycle  float64
+	DutyPeriod time.Duration
+}
+
+// rfProfiles are the --region choices, keep the flag enum in sync
+var rfProfiles = map[string]rfProfile{
+	// FCC part 15 hops without pausing
+	"fcc": {},
+	// ETSI EN 302 208 v2 and later: 4 channels without LBT, each occupied
+	// for up to 4 s and left for 100 ms before the next transmission
+	"etsi": {MaxOnTime: 4 * time.Second, OffTime: 100 * time.Millisecond},
+	// ETSI EN 302 208 v1.1: listen for at least 5 ms before talking, with
+	// the same 4 s limit
+	"etsi-lbt": {
+		MaxOnTime:    4 * time.Second,
+		OffTime:      100 * time.Millisecond,
+		Listen:       5 * time.Millisecond,
+		ListenJitter: 5 * time.Millisecond,
+	},
+}
+
+// rfTransmitter follows the carrier of a continuous inventory through the
+// transmission bursts allowed by a profile
+type rfTransmitter struct {
+	profile rfProfile
+	busy    float64
+	rand    *rand.Rand
+	// the carrier is on from burstStart until burstEnd, or for good
+	burstStart time.Time
+	burstEnd   time.Time
+	endless    bool
+	// time on air since windowStart, for the duty cycle
+	windowStart time.Time
+	windowOn    time.Duration
+	// offUntil is the end of the last gap logged
+	offUntil time.Time
+}
+
+// newRFTransmitter starts an inventory at start; busy is the probability
+// that LBT finds the channel occupied and has to listen again
+func newRFTransmitter(p rfProfile, busy float64, start time.Time, r *rand.Rand) *rfTransmitter {
+	t := &rfTransmitter{profile: p, busy: busy, rand: r, windowStart: start}
+	t.schedule(start)
+	return t
+}
+
+// unlimited tells whether the carrier never has to pause
+func (t *rfTransmitter) unlimited() bool {
+	return t.profile.MaxOnTime == 0 && t.profile.Listen == 0 && t.profile.DutyCycle == 0
+}
+
+// On returns the earliest time at or after at when the carrier is on
+func (t *rfTransmitter) On(at time.Time) time.Time {
+	if t.unlimited() {
+		return at
+	}
+	for !t.endless && !at.Before(t.burstEnd) {
+		t.windowOn += t.burstEnd.Sub(t.burstStart)
+		t.schedule(t.burstEnd.Add(t.profile.OffTime))
+	}
+	if at.Before(t.burstStart) {
+		return t.burstStart
+	}
+	return at
+}
+
+// schedule plans the next burst after the carrier goes off at off
+func (t *rfTransmitter) schedule(off time.Time) {
+	p := t.profile
+	start := off.Add(t.listen())
+	length := p.MaxOnTime
+	if p.DutyCycle > 0 {
+		for !start.Before(t.windowStart.Add(p.DutyPeriod)) {
+			t.windowStart = t.windowStart.Add(p.DutyPeriod)
+			t.windowOn = 0
+		}
+		budget := time.Duration(p.DutyCycle*float64(p.DutyPeriod)) - t.windowOn
+		if budget <= 0 {
+			// wait for the next window
+			t.windowStart = t.windowStart.Add(p.DutyPeriod)
+			t.windowOn = 0
+			start = t.windowStart.Add(t.listen())
+			budget = time.Duration(p.DutyCycle * float64(p.DutyPeriod))
+		}
+		if length == 0 || budget < length {
+			length = budget
+		}
+	}
+	t.burstStart = start
+	t.burstEnd = start.Add(length)
+	// with only LBT, the carrier stays on once the channel is free
+	t.endless = length == 0
+}
+
+// listen returns the LBT time, listening again while the channel is busy
+func (t *rfTransmitter) listen() time.Duration {
+	p := t.profile
+	if p.Listen == 0 {
+		return 0
+	}
+	var d time.Duration
+	for i := 0; i < 100; i++ {
+		d += p.Listen
+		if p.ListenJitter > 0 {
+			d += time.Duration(t.rand.Int63n(int64(p.ListenJitter)))
+		}
+		if t.rand.Float64() >= t.busy {
+			break
+		}
+	}
+	return d
+}
+
+// Due returns when the event cycle of a report tick runs: at the tick, or
+// once the carrier is back on when it is off, so that the gap shows as
+// latency rather than lost reads. Each gap is logged once
+func (t *rfTransmitter) Due(tick time.Time) time.Time {
+	on := t.On(tick)
+	if on.After(tick) && !on.Equal(t.offUntil) {
+		log.Printf("the carrier is off for %v (%v), deferring the reports", on.Sub(tick), *region)
+		t.offUntil = on
+	}
+	return on
+}
+
+// Next receives the next report tick and returns when its event cycle is
+// due; while the carrier is off, it keeps receiving the ticks of c, which
+// join the deferred cycle: the tickers of the virtual clock wait for each
+// tick to be received
+func (t *rfTransmitter) Next(c <-chan time.Time) (time.Time, bool) {
+	tick, ok := <-c
+	if !ok {
+		return tick, ok
+	}
+	due := t.Due(tick)
+	if !due.After(tick) {
+		return tick, true
+	}
+	timer := clk.NewTimer(due)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return due, false
+			}
+		case at := <-timer.C:
+			return at, true
+		}
+	}
+}
+
+// newRegionTransmitter returns the transmitter of a new inventory for
+// the --region and --duty-cycle flags
+func newRegionTransmitter(start time.Time) *rfTransmitter {
+	p := rfProfiles[*region]
+	if *dutyCycle > 0 {
+		p.DutyCycle = *dutyCycle / 100
+		p.DutyPeriod = *dutyPeriod
+	}
+	return newRFTransmitter(p, *lbtBusy, start, rand.New(rand.NewSource(rng.Int63())))
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/iomz/go-llrp"
+	"github.com/iomz/go-llrp/binutil"
+)
+
+// Scenario is a simulation directory played as a timeline of steps, one
+// per event cycle
+type Scenario struct {
+	Name string
+	// Interval is the time between the steps in ms
+	Interval int
+	Steps    []ScenarioStep
+}
+
+// ScenarioStep is the tag population of an event cycle
+type ScenarioStep struct {
+	// Offset is the time the step is reported from the start in ms
+	Offset int
+	Tags   []llrp.TagRecord
+	// RSSI is the PeakRSSI in dBm of the tags by EPC, e.g. of the read
+	// model of a floor plan, reported along with them
+	RSSI map[string]int8 `json:",omitempty"`
+}
+
+// rssiFile returns the RSSI file of an event cycle file
+func rssiFile(cycle string) string {
+	return strings.TrimSuffix(cycle, ".gob") + ".rssi.json"
+}
+
+// loadCycleRSSI reads the RSSI of the tags of an event cycle file, nil
+// when it has none
+func loadCycleRSSI(cycle string) map[string]int8 {
+	data, err := ioutil.ReadFile(rssiFile(cycle))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var rssi map[string]int8
+	if err == nil {
+		err = json.Unmarshal(data, &rssi)
+	}
+	if err != nil {
+		log.Printf("%v: %v", rssiFile(cycle), err)
+		return nil
+	}
+	return rssi
+}
+
+// scenarioPath returns the directory of a scenario, refusing names that
+// would leave the --scenarios directory
+func scenarioPath(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid scenario name %q", name)
+	}
+	return filepath.Join(*scenarioDir, name), nil
+}
+
+// listScenarios returns the names of the simulation directories
+func listScenarios() ([]string, error) {
+	entries, err := ioutil.ReadDir(*scenarioDir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if files, err := listSimulationFiles(filepath.Join(*scenarioDir, e.Name())); err == nil && len(files) > 0 {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// loadScenario reads the event cycles of a scenario
+func loadScenario(name string) (*Scenario, error) {
+	dir, err := scenarioPath(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := listSimulationFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	sc := &Scenario{Name: name, Interval: *reportInterval, Steps: []ScenarioStep{}}
+	for i, f := range files {
+		var tags llrp.Tags
+		if err := binutil.Load(f, &tags); err != nil {
+			return nil, fmt.Errorf("%v: %v", f, err)
+		}
+		step := ScenarioStep{Offset: (i + 1) * *reportInterval, Tags: []llrp.TagRecord{}}
+		for _, t := range tags {
+			step.Tags = append(step.Tags, *llrp.NewTagRecord(*t))
+		}
+		step.RSSI = loadCycleRSSI(f)
+		sc.Steps = append(sc.Steps, step)
+	}
+	return sc, nil
+}
+
+// saveScenario replaces the event cycle files of a scenario with its
+// steps, numbered from 000000.gob in order
+func saveScenario(sc *Scenario) error {
+	dir, err := scenarioPath(sc.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// check every tag before touching the files
+	cycles := make([]llrp.Tags, len(sc.Steps))
+	rssi := make([]map[string]int8, len(sc.Steps))
+	for i, step := range sc.Steps {
+		cycles[i] = llrp.Tags{}
+		for _, tr := range step.Tags {
+			t, err := llrp.NewTag(&llrp.TagRecord{PCBits: tr.PCBits, EPC: tr.EPC})
+			if err != nil {
+				return fmt.Errorf("step %v: %v: %v", i+1, tr.EPC, err)
+			}
+			cycles[i] = append(cycles[i], t)
+			// keep the RSSI of the tags still in the step
+			for epc, v := range step.RSSI {
+				if strings.EqualFold(epc, tr.EPC) {
+					if rssi[i] == nil {
+						rssi[i] = map[string]int8{}
+					}
+					rssi[i][strings.ToLower(epc)] = v
+				}
+			}
+		}
+	}
+
+	old, err := listSimulationFiles(dir)
+	if err != nil {
+		return err
+	}
+	tmp := make([]string, len(cycles))
+	for i, tags := range cycles {
+		tmp[i] = filepath.Join(dir, fmt.Sprintf(".%06d.gob.tmp", i))
+		if err := binutil.Save(tmp[i], &tags); err != nil {
+			return err
+		}
+		if rssi[i] == nil {
+			continue
+		}
+		data, _ := json.Marshal(rssi[i])
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf(".%06d.rssi.json.tmp", i)), data, 0644); err != nil {
+			return err
+		}
+	}
+	for _, f := range old {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+		if err := os.Remove(rssiFile(f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for i, f := range tmp {
+		cycle := filepath.Join(dir, fmt.Sprintf("%06d.gob", i))
+		if err := os.Rename(f, cycle); err != nil {
+			return err
+		}
+		if rssi[i] != nil {
+			if err := os.Rename(filepath.Join(dir, fmt.Sprintf(".%06d.rssi.json.tmp", i)), rssiFile(cycle)); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("saved scenario %v with %v steps", sc.Name, len(sc.Steps))
+	return nil
+}
+
+// APIGetScenarios lists the scenarios
+func APIGetScenarios(c *gin.Context) {
+	names, err := listScenarios()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error()+"\n")
+		return
+	}
+	c.JSON(http.StatusOK, names)
+}
+
+// APIGetScenario returns the steps of a scenario
+func APIGetScenario(c *gin.Context) {
+	sc, err := loadScenario(c.Param("name"))
+	if os.IsNotExist(err) {
+		c.String(http.StatusNotFound, "The scenario doesn't exist!\n")
+		return
+	} else if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
+
+// APIPutScenario saves the steps of a scenario
+func APIPutScenario(c *gin.Context) {
+	var sc Scenario
+	if err := c.BindWith(&sc, binding.JSON); err != nil {
+		return
+	}
+	sc.Name = c.Param("name")
+	if err := saveScenario(&sc); err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	c.String(http.StatusAccepted, "Scenario saved!\n")
+}
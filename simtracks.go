@@ -0,0 +1,381 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/iomz/go-llrp"
+	"github.com/iomz/golemu/codec"
+)
+
+// simTrack is a simulation directory played on an antenna of a reader
+type simTrack struct {
+	Dir     string
+	Port    int
+	Antenna uint16
+	files   []string
+	cycle   int
+	// rssi is the PeakRSSI of the tags of the last loaded event cycle
+	rssi map[string]int8
+	// start is the event cycle of a cluster the track starts from
+	start int
+}
+
+// parseTrack parses a --track of the form [PORT:]ANTENNA=DIR, the port
+// defaulting to --port
+func parseTrack(spec string) (*simTrack, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid track %q, expected [PORT:]ANTENNA=DIR", spec)
+	}
+	t := &simTrack{Dir: spec[i+1:], Port: *port}
+	target := spec[:i]
+	if j := strings.Index(target, ":"); j >= 0 {
+		p, err := strconv.Atoi(target[:j])
+		if err != nil || p <= 0 || p > 0xffff {
+			return nil, fmt.Errorf("invalid port in track %q", spec)
+		}
+		t.Port, target = p, target[j+1:]
+	}
+	a, err := strconv.ParseUint(target, 10, 16)
+	if err != nil || a == 0 || int(a) > *antennas {
+		return nil, fmt.Errorf("invalid antenna in track %q, the reader has %v", spec, *antennas)
+	}
+	t.Antenna = uint16(a)
+	if t.Dir, err = filepath.Abs(t.Dir); err != nil {
+		return nil, err
+	}
+	if t.files, err = listSimulationFiles(t.Dir); err != nil {
+		return nil, err
+	}
+	if len(t.files) == 0 {
+		return nil, fmt.Errorf("no event cycle file found in %s", t.Dir)
+	}
+	return t, nil
+}
+
+// next loads the tags of the next event cycle of the track, starting over
+// after the last one
+func (t *simTrack) next() llrp.Tags {
+	tags, err := loadTagsForNextEventCycle(t.files, &t.cycle)
+	t.rssi = loadCycleRSSI(t.files[t.cycle])
+	t.cycle++
+	if err != nil {
+		log.Print(err)
+		return llrp.Tags{}
+	}
+	return tags
+}
+
+// at loads the tags of the track at an event cycle of a cluster, the
+// track starting over after its last cycle
+func (t *simTrack) at(cycle int) llrp.Tags {
+	if cycle < t.start {
+		return llrp.Tags{}
+	}
+	t.cycle = (cycle - t.start) % len(t.files)
+	return t.next()
+}
+
+// simReader is a reader of a multi-track simulation with its tracks
+type simReader struct {
+	port      int
+	tracks    []*simTrack
+	conn      net.Conn
+	inventory readerInventory
+}
+
+// antennaTags are the tags read on an antenna in an event cycle, with
+// their PeakRSSI by EPC when the scenario has it
+type antennaTags struct {
+	Antenna uint16
+	Tags    llrp.Tags
+	RSSI    map[string]int8
+}
+
+// nextCycle loads the next event cycle of every track of the reader
+func (r *simReader) nextCycle() []antennaTags {
+	cycle := []antennaTags{}
+	for _, t := range r.tracks {
+		tags := t.next()
+		log.Printf("<<< Simulated Event Cycle %v of %v, %v tags on antenna %v of port %v", t.cycle-1, t.Dir, len(tags), t.Antenna, r.port)
+		cycle = append(cycle, antennaTags{t.Antenna, tags, t.rssi})
+	}
+	return cycle
+}
+
+// antennaTagReportData encodes the TagReportData of a tag read on an
+// antenna, with its PeakRSSI when rssi has it
+func antennaTagReportData(t *llrp.Tag, antenna uint16, rssi map[string]int8) ([]byte, error) {
+	epc := codec.NewParameter(codec.EPCData).SetField("EPC", t.EPC)
+	if len(t.EPC) == 12 {
+		epc = codec.NewParameter(codec.EPC96).SetField("EPC", t.EPC)
+	}
+	trd := codec.NewParameter(codec.TagReportData).Add(
+		epc,
+		codec.NewParameter(codec.AntennaID).SetField("AntennaID", antenna),
+	)
+	if v, ok := rssi[hex.EncodeToString(t.EPC)]; ok {
+		trd.Add(codec.NewParameter(codec.PeakRSSI).SetField("PeakRSSI", v))
+	}
+	return trd.Add(codec.NewParameter(codec.C1G2PC).SetField("PC_Bits", t.PCBits)).Encode()
+}
+
+// buildAntennaReports splits the tags read on an antenna into reports like
+// buildReports, with the AntennaID in every TagReportData
+func buildAntennaReports(tags llrp.Tags, antenna uint16, rssi map[string]int8) llrp.TagReportDataStack {
+	max := reportLimit()
+	trds := llrp.TagReportDataStack{}
+	var trd *llrp.TagReportData
+	for _, t := range tags {
+		b, err := antennaTagReportData(t, antenna, rssi)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		// 10 bytes of message header
+		if trd == nil || (max > 0 && int(trd.TagCount) >= max) || 10+len(trd.Data)+len(b) > *pdu {
+			trd = &llrp.TagReportData{}
+			trds = append(trds, trd)
+		}
+		trd.Data = append(trd.Data, b...)
+		trd.TagCount++
+	}
+	return trds
+}
+
+// runTracks plays the --track directories on the antennas of one or more
+// readers; every reader waits for its client's SET_READER_CONFIG and then
+// all the tracks advance one event cycle per --reportInterval tick of the
+// shared clock
+func runTracks() int {
+	specs := *tracks
+	if *simulationDir != "" {
+		specs = append([]string{"1=" + *simulationDir}, specs...)
+	}
+	readers, err := groupTracks(specs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *checkpoint != "" {
+		log.Fatal("--checkpoint is only supported for a single simulation directory")
+	}
+	if *golden != "" && len(readers) > 1 {
+		log.Fatal("--golden is only supported for a single reader")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case signal := <-signals:
+				responder.Close()
+				closeOPCUA()
+				agent.Close()
+				closeSinks()
+				log.Fatal(signal)
+			}
+		}
+	}()
+	serveSNMP()
+
+	// every reader accepts a client and waits for its SET_READER_CONFIG
+	var configured sync.WaitGroup
+	var notify sync.Mutex
+	var stream *goldenConn
+	for _, r := range readers {
+		l, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(r.port))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+		log.Printf("listening on %v:%v", ip, r.port)
+		advertise(r.port)
+		if err := serveOPCUA(r.port, r.inventory.Cycle); err != nil {
+			log.Fatal(err)
+		}
+		if *golden != "" {
+			stream = &goldenConn{}
+		}
+		configured.Add(1)
+		go r.serve(l, stream, configured.Done, &notify)
+	}
+	configured.Wait()
+	health.SetConnected(true)
+
+	// play the event cycles of every track in lockstep
+	roarTicker := clk.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+	tx := newRegionTransmitter(clk.Now())
+	for n := 0; *cycles == 0 || n < *cycles; n++ {
+		tx.Next(roarTicker.C)
+		_, failed := playCycle(readers, (*simReader).nextCycle)
+		for _, err := range failed {
+			log.Fatal(err)
+		}
+	}
+	roarTicker.Stop()
+	log.Printf("simulated %v event cycles, closing LLRP connections", *cycles)
+	for _, r := range readers {
+		r.conn.Close()
+		publishEvent(localReader(r.port), "ConnectionClose", 0)
+	}
+	health.SetConnected(false)
+	closeSinks()
+	if stream != nil {
+		return stream.check(*golden, *updateGolden)
+	}
+	return 0
+}
+
+// groupTracks parses the --track specs into their readers, ordered by
+// port
+func groupTracks(specs []string) ([]*simReader, error) {
+	byPort := map[int]*simReader{}
+	readers := []*simReader{}
+	for _, spec := range specs {
+		t, err := parseTrack(spec)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := byPort[t.Port]
+		if !ok {
+			r = &simReader{port: t.Port}
+			byPort[t.Port] = r
+			readers = append(readers, r)
+		}
+		r.tracks = append(r.tracks, t)
+		log.Printf("playing %v on antenna %v of the reader on port %v", t.Dir, t.Antenna, t.Port)
+	}
+	sort.Slice(readers, func(i, j int) bool { return readers[i].port < readers[j].port })
+	return readers, nil
+}
+
+// playCycle sends the event cycle of every reader, given by cycle, to the
+// clients of the readers and returns the number of tags sent by each
+// reader, and the error of the readers whose client couldn't take them;
+// the readers without a client are skipped
+func playCycle(readers []*simReader, cycle func(*simReader) []antennaTags) (map[*simReader]uint, map[*simReader]error) {
+	trds := llrp.TagReportDataStack{}
+	owners := map[*llrp.TagReportData]*simReader{}
+	sent := map[*simReader]uint{}
+	failed := map[*simReader]error{}
+	for _, r := range readers {
+		if r.conn == nil {
+			continue
+		}
+		reports := llrp.TagReportDataStack{}
+		for _, at := range cycle(r) {
+			for _, trd := range buildAntennaReports(at.Tags, at.Antenna, at.RSSI) {
+				reports = append(reports, trd)
+				owners[trd] = r
+			}
+		}
+		r.inventory.Set(reports)
+		trds = append(trds, reports...)
+	}
+	paceReports(trds, func(trd *llrp.TagReportData) error {
+		roar := llrp.NewROAccessReport(trd.Data, messageID)
+		r := owners[trd]
+		if failed[r] != nil {
+			return nil
+		}
+		if err := roar.Send(r.conn); err != nil {
+			failed[r] = fmt.Errorf("reader on port %v: %v", r.port, err)
+			return nil
+		}
+		messageID++
+		sent[r] += trd.TagCount
+		publishTagReportData(localReader(r.port), trd.Data)
+		return nil
+	})
+	return sent, failed
+}
+
+// serve accepts the client of the reader, tells configured once it sent
+// SET_READER_CONFIG and then only logs the messages received; a client
+// leaving before that is replaced by the next one. notify orders the
+// READER_EVENT_NOTIFICATIONs of the readers
+func (r *simReader) serve(l net.Listener, stream *goldenConn, configured func(), notify *sync.Mutex) {
+	for {
+		log.Printf("waiting for LLRP connection on port %v...", r.port)
+		conn, err := l.Accept()
+		if err != nil {
+			// the listener is closed
+			return
+		}
+		if r.session(conn, stream, configured, notify) {
+			return
+		}
+	}
+}
+
+// session runs the connection of a client until it closes, and tells
+// whether it was configured
+func (r *simReader) session(conn net.Conn, stream *goldenConn, configured func(), notify *sync.Mutex) bool {
+	conn = recordConn(conn, "reader")
+	log.Printf("initiated LLRP connection with %v on port %v", conn.RemoteAddr(), r.port)
+	publishEvent(localReader(r.port), "ConnectionAttempt", 0)
+	if stream != nil {
+		stream.Conn = conn
+		conn = stream
+	}
+	notify.Lock()
+	conn.Write(llrp.ReaderEventNotification(messageID, uint64(clk.Now().UnixNano()/1000)))
+	log.Println("<<< READER_EVENT_NOTIFICATION")
+	messageID++
+	notify.Unlock()
+
+	header := make([]byte, 10)
+	started := false
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !started {
+				log.Printf("LLRP connection on port %v closed before SET_READER_CONFIG: %v", r.port, err)
+				conn.Close()
+			}
+			// or closed after the last event cycle
+			return started
+		}
+		length := binary.BigEndian.Uint32(header[2:6])
+		if length < uint32(len(header)) {
+			log.Printf("invalid message length %v on port %v", length, r.port)
+			conn.Close()
+			return started
+		}
+		if body := length - uint32(len(header)); body != 0 {
+			if _, err := io.CopyN(ioutil.Discard, conn, int64(body)); err != nil {
+				conn.Close()
+				return started
+			}
+		}
+		switch h := binary.BigEndian.Uint16(header[:2]); {
+		case h == llrp.SetReaderConfigHeader && !started:
+			conn.Write(llrp.SetReaderConfigResponse())
+			r.conn = conn
+			started = true
+			configured()
+		default:
+			log.Printf(">>> header: %v on port %v", h, r.port)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SNMP PDU tags and error statuses
+const (
+	snmpGetRequest     byte = 0xa0
+	snmpGetNextRequest byte = 0xa1
+	snmpResponse       byte = 0xa2
+	snmpSetRequest     byte = 0xa3
+	snmpGetBulkRequest byte = 0xa5
+	snmpTrapV2         byte = 0xa7
+
+	snmpVersion2c   = 1
+	snmpNotWritable = 17
+	// snmpMaxVarBinds caps the GetBulk responses to fit in a datagram
+	snmpMaxVarBinds = 48
+)
+
+var (
+	// MIB-II system group
+	sysDescr    = mustOID("1.3.6.1.2.1.1.1.0")
+	sysObjectID = mustOID("1.3.6.1.2.1.1.2.0")
+	sysUpTime   = mustOID("1.3.6.1.2.1.1.3.0")
+	sysName     = mustOID("1.3.6.1.2.1.1.5.0")
+	// SNMPv2-MIB notifications
+	snmpTrapOID = mustOID("1.3.6.1.6.3.1.1.4.1.0")
+	coldStart   = mustOID("1.3.6.1.6.3.1.1.5.1")
+
+	// golemuMIB is the root of the reader objects, in the experimental arc
+	golemuMIB = mustOID("1.3.6.1.3.5084")
+	// golemuReader.{llrpConnectionState,readerTemperature,antennaCount}.0
+	llrpConnectionState = golemuMIB.append(1, 1, 0)
+	readerTemperature   = golemuMIB.append(1, 2, 0)
+	antennaCount        = golemuMIB.append(1, 3, 0)
+	// antennaTable.antennaEntry.{antennaIndex,antennaStatus}.<antenna>
+	antennaIndex  = golemuMIB.append(2, 1, 1)
+	antennaStatus = golemuMIB.append(2, 1, 2)
+	// golemuNotifications
+	antennaDisconnected = golemuMIB.append(3, 0, 1)
+	antennaConnected    = golemuMIB.append(3, 0, 2)
+)
+
+// readerHealth is the reader state monitored over SNMP
+type readerHealth struct {
+	sync.Mutex
+	booted    time.Time
+	connected bool
+	antennas  []bool
+	listeners []func(antenna int, connected bool)
+}
+
+// newReaderHealth boots a reader with all its antennas connected
+func newReaderHealth(antennas int) *readerHealth {
+	h := &readerHealth{booted: clk.Now(), antennas: make([]bool, antennas)}
+	for i := range h.antennas {
+		h.antennas[i] = true
+	}
+	return h
+}
+
+// SetConnected records whether an LLRP client is connected
+func (h *readerHealth) SetConnected(connected bool) {
+	h.Lock()
+	h.connected = connected
+	h.Unlock()
+}
+
+// Connected tells whether an LLRP client is connected
+func (h *readerHealth) Connected() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.connected
+}
+
+// SetAntenna connects or disconnects the antenna, numbered from 1
+func (h *readerHealth) SetAntenna(antenna int, connected bool) error {
+	h.Lock()
+	if antenna < 1 || antenna > len(h.antennas) {
+		h.Unlock()
+		return fmt.Errorf("no antenna %v, the reader has %v", antenna, len(h.antennas))
+	}
+	changed := h.antennas[antenna-1] != connected
+	h.antennas[antenna-1] = connected
+	listeners := h.listeners
+	h.Unlock()
+	if changed {
+		log.Printf("antenna %v connected: %v", antenna, connected)
+		for _, f := range listeners {
+			f(antenna, connected)
+		}
+	}
+	return nil
+}
+
+// OnAntenna registers a function called when an antenna changes
+func (h *readerHealth) OnAntenna(f func(antenna int, connected bool)) {
+	h.Lock()
+	h.listeners = append(h.listeners, f)
+	h.Unlock()
+}
+
+// ConnectedAntennas returns the connected antennas, numbered from 1
+func (h *readerHealth) ConnectedAntennas() []int {
+	h.Lock()
+	defer h.Unlock()
+	connected := []int{}
+	for i, c := range h.antennas {
+		if c {
+			connected = append(connected, i+1)
+		}
+	}
+	return connected
+}
+
+// Uptime returns the time since the reader booted
+func (h *readerHealth) Uptime() time.Duration {
+	return clk.Now().Sub(h.booted)
+}
+
+// Temperature returns the board temperature in Celsius, warming up from
+// 35 to 45 in the first hour or so
+func (h *readerHealth) Temperature() int {
+	return 35 + int(math.Round(10*(1-math.Exp(-h.Uptime().Minutes()/15))))
+}
+
+// snmpAgent serves the reader health as an SNMP v2c and v3 agent
+type snmpAgent struct {
+	conn      *net.UDPConn
+	community string
+	engineID  []byte
+	users     map[string]*usmUser
+	traps     []*net.UDPAddr
+	health    *readerHealth
+	sync.Mutex
+	trapID   int32
+	usmStats map[string]int64
+}
+
+// mibObject is an instance in the MIB with its encoded value
+type mibObject struct {
+	oid   oid
+	value []byte
+}
+
+// newSNMPAgent listens on the UDP address and sends traps to the targets;
+// the v3 users are --snmp-user specs
+func newSNMPAgent(address, community string, engineID []byte, users, targets []string, health *readerHealth) (*snmpAgent, error) {
+	a := &snmpAgent{
+		community: community,
+		engineID:  engineID,
+		users:     map[string]*usmUser{},
+		health:    health,
+		usmStats:  map[string]int64{},
+	}
+	for _, spec := range users {
+		u, err := parseUSMUser(spec, engineID)
+		if err != nil {
+			return nil, err
+		}
+		a.users[u.name] = u
+	}
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	a.conn = conn
+	for _, t := range targets {
+		addr, err := net.ResolveUDPAddr("udp", t)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		a.traps = append(a.traps, addr)
+	}
+	health.OnAntenna(func(antenna int, connected bool) {
+		trap := antennaDisconnected
+		if connected {
+			trap = antennaConnected
+		}
+		a.trap(trap,
+			varBind(antennaIndex.append(uint32(antenna)), berInt(berInteger, int64(antenna))),
+			varBind(antennaStatus.append(uint32(antenna)), berInt(berInteger, snmpStatus(connected))))
+	})
+	go a.serve()
+	// the emulated reader has just booted
+	a.trap(coldStart)
+	return a, nil
+}
+
+// mib returns the current objects in OID order
+func (a *snmpAgent) mib() []mibObject {
+	h := a.health
+	hostname, _ := os.Hostname()
+	objects := []mibObject{
+		{sysDescr, berString("golemu " + version + " LLRP reader emulator")},
+		{sysObjectID, berObjectID(golemuMIB)},
+		{sysUpTime, berInt(berTimeTicks, int64(h.Uptime()/(10*time.Millisecond)))},
+		{sysName, berString(hostname)},
+		{readerTemperature, berInt(berInteger, int64(h.Temperature()))},
+	}
+	h.Lock()
+	objects = append(objects,
+		mibObject{llrpConnectionState, berInt(berInteger, snmpStatus(h.connected))},
+		mibObject{antennaCount, berInt(berInteger, int64(len(h.antennas)))})
+	for i, connected := range h.antennas {
+		objects = append(objects,
+			mibObject{antennaIndex.append(uint32(i + 1)), berInt(berInteger, int64(i+1))},
+			mibObject{antennaStatus.append(uint32(i + 1)), berInt(berInteger, snmpStatus(connected))})
+	}
+	h.Unlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].oid.compare(objects[j].oid) < 0 })
+	return objects
+}
+
+// serve answers the requests until the connection is closed
+func (a *snmpAgent) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		res, err := a.handle(buf[:n])
+		if err != nil {
+			if *debug {
+				log.Printf("SNMP request from %v dropped: %v", src, err)
+			}
+			continue
+		}
+		if _, err := a.conn.WriteToUDP(res, src); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// handle decodes a request message and encodes the response
+func (a *snmpAgent) handle(b []byte) ([]byte, error) {
+	tag, msg, _, err := berRead(b)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	ver, msg, err := berReadInt(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch ver {
+	case snmpVersion2c:
+	case snmpVersion3:
+		return a.handleV3(b, msg)
+	default:
+		return nil, fmt.Errorf("unsupported SNMP version %v", ver)
+	}
+	tag, community, msg, err := berRead(msg)
+	if err != nil || tag != berOctetString {
+		return nil, errBER
+	}
+	if string(community) != a.community {
+		return nil, fmt.Errorf("wrong community %q", community)
+	}
+	res, err := a.respond(msg)
+	if err != nil {
+		return nil, err
+	}
+	return berSeq(berSequence,
+		berInt(berInteger, snmpVersion2c),
+		berString(a.community),
+		res), nil
+}
+
+// respond answers a request PDU with a response PDU
+func (a *snmpAgent) respond(msg []byte) ([]byte, error) {
+	pduType, pdu, _, err := berRead(msg)
+	if err != nil {
+		return nil, err
+	}
+	requestID, pdu, err := berReadInt(pdu)
+	if err != nil {
+		return nil, err
+	}
+	// error-status and error-index, or non-repeaters and max-repetitions
+	x, pdu, err := berReadInt(pdu)
+	if err != nil {
+		return nil, err
+	}
+	y, pdu, err := berReadInt(pdu)
+	if err != nil {
+		return nil, err
+	}
+	tag, list, _, err := berRead(pdu)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	var names []oid
+	var values [][]byte
+	for len(list) > 0 {
+		var vb []byte
+		if tag, vb, list, err = berRead(list); err != nil || tag != berSequence {
+			return nil, errBER
+		}
+		name, rest, err := berReadOID(vb)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		values = append(values, rest)
+	}
+
+	mib := a.mib()
+	var vbs [][]byte
+	var errStatus, errIndex int64
+	switch pduType {
+	case snmpGetRequest:
+		for _, name := range names {
+			vbs = append(vbs, varBind(mibGet(mib, name)))
+		}
+	case snmpGetNextRequest:
+		for _, name := range names {
+			vbs = append(vbs, varBind(mibNext(mib, name)))
+		}
+	case snmpGetBulkRequest:
+		nonRepeaters, maxRepetitions := int(x), int(y)
+		if nonRepeaters < 0 {
+			nonRepeaters = 0
+		}
+		if nonRepeaters > len(names) {
+			nonRepeaters = len(names)
+		}
+		for _, name := range names[:nonRepeaters] {
+			vbs = append(vbs, varBind(mibNext(mib, name)))
+		}
+		repeaters := append([]oid{}, names[nonRepeaters:]...)
+		for r := 0; r < maxRepetitions && len(repeaters) > 0 && len(vbs)+len(repeaters) <= snmpMaxVarBinds; r++ {
+			for i, name := range repeaters {
+				var value []byte
+				repeaters[i], value = mibNext(mib, name)
+				vbs = append(vbs, varBind(repeaters[i], value))
+			}
+		}
+	case snmpSetRequest:
+		errStatus, errIndex = snmpNotWritable, 1
+		for i, name := range names {
+			vbs = append(vbs, varBind(name, values[i]))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU type %#x", pduType)
+	}
+	return berSeq(snmpResponse,
+		berInt(berInteger, requestID),
+		berInt(berInteger, errStatus),
+		berInt(berInteger, errIndex),
+		berSeq(berSequence, vbs...)), nil
+}
+
+// trap sends a notification with the extra variable bindings to the targets
+func (a *snmpAgent) trap(trap oid, extra ...[]byte) {
+	if len(a.traps) == 0 {
+		return
+	}
+	a.Lock()
+	a.trapID++
+	id := a.trapID
+	a.Unlock()
+	vbs := append([][]byte{
+		varBind(sysUpTime, berInt(berTimeTicks, int64(a.health.Uptime()/(10*time.Millisecond)))),
+		varBind(snmpTrapOID, berObjectID(trap)),
+	}, extra...)
+	msg := berSeq(berSequence,
+		berInt(berInteger, snmpVersion2c),
+		berString(a.community),
+		berSeq(snmpTrapV2,
+			berInt(berInteger, int64(id)),
+			berInt(berInteger, 0),
+			berInt(berInteger, 0),
+			berSeq(berSequence, vbs...)))
+	for _, addr := range a.traps {
+		if _, err := a.conn.WriteToUDP(msg, addr); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// Close stops the agent
+func (a *snmpAgent) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.conn.Close()
+}
+
+// mibGet returns the object named exactly, or noSuchObject
+func mibGet(mib []mibObject, name oid) (oid, []byte) {
+	i := sort.Search(len(mib), func(i int) bool { return mib[i].oid.compare(name) >= 0 })
+	if i < len(mib) && mib[i].oid.compare(name) == 0 {
+		return name, mib[i].value
+	}
+	return name, berTLV(berNoSuchObj, nil)
+}
+
+// mibNext returns the first object after name, or endOfMibView
+func mibNext(mib []mibObject, name oid) (oid, []byte) {
+	i := sort.Search(len(mib), func(i int) bool { return mib[i].oid.compare(name) > 0 })
+	if i < len(mib) {
+		return mib[i].oid, mib[i].value
+	}
+	return name, berTLV(berEndOfMib, nil)
+}
+
+func varBind(name oid, value []byte) []byte {
+	return berSeq(berSequence, berObjectID(name), value)
+}
+
+// snmpStatus encodes connected(1) and disconnected(2)
+func snmpStatus(connected bool) int64 {
+	if connected {
+		return 1
+	}
+	return 2
+}
+
+// serveSNMP starts the agent when --snmp is given
+func serveSNMP() {
+	if *snmpAddress == "" {
+		return
+	}
+	engineID, err := snmpEngineID(*snmpEngineIDHex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if agent, err = newSNMPAgent(*snmpAddress, *snmpCommunity, engineID, *snmpUsers, *snmpTraps, health); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving SNMP v2c and v3 (engine ID %x) on %v", engineID, agent.conn.LocalAddr())
+}
@@ -0,0 +1,499 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// OPC UA built-in type IDs of the variants
+const (
+	uaBoolean         = 1
+	uaByte            = 3
+	uaInt16           = 4
+	uaUInt16          = 5
+	uaInt32           = 6
+	uaUInt32          = 7
+	uaInt64           = 8
+	uaUInt64          = 9
+	uaDouble          = 11
+	uaString          = 12
+	uaDateTime        = 13
+	uaByteString      = 15
+	uaNodeIDType      = 17
+	uaStatusCode      = 19
+	uaQualifiedName   = 20
+	uaLocalizedText   = 21
+	uaExtensionObject = 22
+)
+
+// uaEpochOffset is the Unix epoch in the 100 ns since 1601 of the OPC UA
+// DateTime; a time.Duration can't span the four centuries in between
+const uaEpochOffset = 116444736000000000
+
+// uaNodeID is a numeric NodeId, or a string one when name is set
+type uaNodeID struct {
+	ns   uint16
+	id   uint32
+	name string
+}
+
+// uaNumeric returns the NodeId i=id in the namespace
+func uaNumeric(ns uint16, id uint32) uaNodeID {
+	return uaNodeID{ns: ns, id: id}
+}
+
+// uaNamed returns the NodeId s=name in the namespace
+func uaNamed(ns uint16, name string) uaNodeID {
+	return uaNodeID{ns: ns, name: name}
+}
+
+func (n uaNodeID) isNull() bool {
+	return n == uaNodeID{}
+}
+
+func (n uaNodeID) String() string {
+	if n.name != "" {
+		return fmt.Sprintf("ns=%v;s=%v", n.ns, n.name)
+	}
+	return fmt.Sprintf("ns=%v;i=%v", n.ns, n.id)
+}
+
+// uaQName is a QualifiedName
+type uaQName struct {
+	ns   uint16
+	name string
+}
+
+// uaExtension is an ExtensionObject with a binary body
+type uaExtension struct {
+	typeID uaNodeID
+	body   []byte
+}
+
+// uaVariant is a Variant of a built-in type; arrays hold their elements in
+// a []interface{}
+type uaVariant struct {
+	typ   byte
+	value interface{}
+}
+
+// uaArray returns an array Variant of the elements
+func uaArray(typ byte, elements ...interface{}) uaVariant {
+	if elements == nil {
+		elements = []interface{}{}
+	}
+	return uaVariant{typ: typ, value: elements}
+}
+
+// uaWriter encodes the little-endian OPC UA binary types
+type uaWriter struct {
+	bytes.Buffer
+}
+
+func (w *uaWriter) boolean(v bool) {
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+func (w *uaWriter) uint16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *uaWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *uaWriter) int32(v int32) { w.uint32(uint32(v)) }
+
+func (w *uaWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *uaWriter) double(v float64) { w.uint64(math.Float64bits(v)) }
+
+func (w *uaWriter) dateTime(t time.Time) {
+	if t.IsZero() {
+		w.uint64(0)
+		return
+	}
+	w.uint64(uint64(t.UnixNano()/100 + uaEpochOffset))
+}
+
+// string writes a String, empty strings as null
+func (w *uaWriter) string(s string) {
+	if s == "" {
+		w.int32(-1)
+		return
+	}
+	w.int32(int32(len(s)))
+	w.WriteString(s)
+}
+
+// byteString writes a ByteString, nil as null
+func (w *uaWriter) byteString(b []byte) {
+	if b == nil {
+		w.int32(-1)
+		return
+	}
+	w.int32(int32(len(b)))
+	w.Write(b)
+}
+
+func (w *uaWriter) nodeID(n uaNodeID) {
+	switch {
+	case n.name != "":
+		w.WriteByte(0x03)
+		w.uint16(n.ns)
+		w.string(n.name)
+	case n.ns == 0 && n.id < 0x100:
+		w.WriteByte(0x00)
+		w.WriteByte(byte(n.id))
+	case n.ns < 0x100 && n.id < 0x10000:
+		w.WriteByte(0x01)
+		w.WriteByte(byte(n.ns))
+		w.uint16(uint16(n.id))
+	default:
+		w.WriteByte(0x02)
+		w.uint16(n.ns)
+		w.uint32(n.id)
+	}
+}
+
+// expandedNodeID writes a local ExpandedNodeId
+func (w *uaWriter) expandedNodeID(n uaNodeID) { w.nodeID(n) }
+
+func (w *uaWriter) qualifiedName(q uaQName) {
+	w.uint16(q.ns)
+	w.string(q.name)
+}
+
+// localizedText writes a LocalizedText without locale
+func (w *uaWriter) localizedText(s string) {
+	if s == "" {
+		w.WriteByte(0)
+		return
+	}
+	w.WriteByte(0x02)
+	w.string(s)
+}
+
+func (w *uaWriter) extension(e uaExtension) {
+	w.nodeID(e.typeID)
+	if e.body == nil {
+		w.WriteByte(0)
+		return
+	}
+	w.WriteByte(0x01)
+	w.byteString(e.body)
+}
+
+// statusCodes writes an array of StatusCodes
+func (w *uaWriter) statusCodes(codes []uint32) {
+	w.int32(int32(len(codes)))
+	for _, c := range codes {
+		w.uint32(c)
+	}
+}
+
+// noDiagnostics writes an empty array of DiagnosticInfos
+func (w *uaWriter) noDiagnostics() { w.int32(0) }
+
+func (w *uaWriter) variant(v uaVariant) {
+	if v.typ == 0 {
+		w.WriteByte(0)
+		return
+	}
+	if elements, ok := v.value.([]interface{}); ok {
+		w.WriteByte(v.typ | 0x80)
+		w.int32(int32(len(elements)))
+		for _, e := range elements {
+			w.scalar(v.typ, e)
+		}
+		return
+	}
+	w.WriteByte(v.typ)
+	w.scalar(v.typ, v.value)
+}
+
+func (w *uaWriter) scalar(typ byte, v interface{}) {
+	switch typ {
+	case uaBoolean:
+		w.boolean(v.(bool))
+	case uaByte:
+		w.WriteByte(v.(byte))
+	case uaInt16:
+		w.uint16(uint16(v.(int16)))
+	case uaUInt16:
+		w.uint16(v.(uint16))
+	case uaInt32:
+		w.int32(v.(int32))
+	case uaUInt32, uaStatusCode:
+		w.uint32(v.(uint32))
+	case uaInt64:
+		w.uint64(uint64(v.(int64)))
+	case uaUInt64:
+		w.uint64(v.(uint64))
+	case uaDouble:
+		w.double(v.(float64))
+	case uaString:
+		w.string(v.(string))
+	case uaDateTime:
+		w.dateTime(v.(time.Time))
+	case uaByteString:
+		w.byteString(v.([]byte))
+	case uaNodeIDType:
+		w.nodeID(v.(uaNodeID))
+	case uaQualifiedName:
+		w.qualifiedName(v.(uaQName))
+	case uaLocalizedText:
+		w.localizedText(v.(string))
+	case uaExtensionObject:
+		w.extension(v.(uaExtension))
+	default:
+		panic(fmt.Sprintf("unsupported variant type %v", typ))
+	}
+}
+
+// dataValue writes a DataValue with a value or a bad status
+func (w *uaWriter) dataValue(v uaVariant, status uint32, ts time.Time) {
+	if status != 0 {
+		w.WriteByte(0x02)
+		w.uint32(status)
+		return
+	}
+	w.WriteByte(0x01 | 0x08)
+	w.variant(v)
+	w.dateTime(ts)
+}
+
+// uaReader decodes the OPC UA binary types, keeping the first error
+type uaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *uaReader) next(n int) []byte {
+	if r.err == nil && (n < 0 || len(r.b) < n) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return make([]byte, 8)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *uaReader) byte() byte       { return r.next(1)[0] }
+func (r *uaReader) boolean() bool    { return r.byte() != 0 }
+func (r *uaReader) uint16() uint16   { return binary.LittleEndian.Uint16(r.next(2)) }
+func (r *uaReader) uint32() uint32   { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *uaReader) int32() int32     { return int32(r.uint32()) }
+func (r *uaReader) uint64() uint64   { return binary.LittleEndian.Uint64(r.next(8)) }
+func (r *uaReader) double() float64  { return math.Float64frombits(r.uint64()) }
+func (r *uaReader) dateTime() uint64 { return r.uint64() }
+
+// count reads the length of an array, bounded by the bytes left
+func (r *uaReader) count() int {
+	n := r.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(r.b) && r.err == nil {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (r *uaReader) byteString() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return append([]byte{}, r.next(int(n))...)
+}
+
+func (r *uaReader) string() string { return string(r.byteString()) }
+
+func (r *uaReader) nodeID() uaNodeID {
+	mask := r.byte()
+	var n uaNodeID
+	switch mask & 0x3f {
+	case 0x00:
+		n.id = uint32(r.byte())
+	case 0x01:
+		n.ns = uint16(r.byte())
+		n.id = uint32(r.uint16())
+	case 0x02:
+		n.ns = r.uint16()
+		n.id = r.uint32()
+	case 0x03:
+		n.ns = r.uint16()
+		n.name = r.string()
+	case 0x04:
+		n.ns = r.uint16()
+		n.name = fmt.Sprintf("g=%x", r.next(16))
+	case 0x05:
+		n.ns = r.uint16()
+		n.name = fmt.Sprintf("b=%x", r.byteString())
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("invalid NodeId encoding %#x", mask)
+		}
+	}
+	// the ExpandedNodeId fields
+	if mask&0x80 != 0 {
+		r.string()
+	}
+	if mask&0x40 != 0 {
+		r.uint32()
+	}
+	return n
+}
+
+func (r *uaReader) qualifiedName() uaQName {
+	return uaQName{ns: r.uint16(), name: r.string()}
+}
+
+func (r *uaReader) localizedText() string {
+	mask := r.byte()
+	if mask&0x01 != 0 {
+		r.string()
+	}
+	if mask&0x02 != 0 {
+		return r.string()
+	}
+	return ""
+}
+
+func (r *uaReader) extension() uaExtension {
+	e := uaExtension{typeID: r.nodeID()}
+	if r.byte() != 0 {
+		e.body = r.byteString()
+		if e.body == nil {
+			e.body = []byte{}
+		}
+	}
+	return e
+}
+
+// diagnosticInfo skips a DiagnosticInfo
+func (r *uaReader) diagnosticInfo() {
+	mask := r.byte()
+	for _, bit := range []byte{0x01, 0x02, 0x04, 0x08} {
+		if mask&bit != 0 {
+			r.int32()
+		}
+	}
+	if mask&0x10 != 0 {
+		r.string()
+	}
+	if mask&0x20 != 0 {
+		r.uint32()
+	}
+	if mask&0x40 != 0 {
+		r.diagnosticInfo()
+	}
+}
+
+func (r *uaReader) variant() uaVariant {
+	mask := r.byte()
+	typ := mask & 0x3f
+	if typ == 0 {
+		return uaVariant{}
+	}
+	if mask&0x80 == 0 {
+		return uaVariant{typ: typ, value: r.scalar(typ)}
+	}
+	n := r.count()
+	elements := make([]interface{}, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		elements = append(elements, r.scalar(typ))
+	}
+	if mask&0x40 != 0 {
+		// array dimensions
+		for i := r.count(); i > 0; i-- {
+			r.int32()
+		}
+	}
+	return uaVariant{typ: typ, value: elements}
+}
+
+func (r *uaReader) scalar(typ byte) interface{} {
+	switch typ {
+	case uaBoolean:
+		return r.boolean()
+	case 2, uaByte:
+		return r.byte()
+	case uaInt16:
+		return int16(r.uint16())
+	case uaUInt16:
+		return r.uint16()
+	case uaInt32:
+		return r.int32()
+	case uaUInt32, uaStatusCode:
+		return r.uint32()
+	case uaInt64:
+		return int64(r.uint64())
+	case uaUInt64:
+		return r.uint64()
+	case 10:
+		return float64(math.Float32frombits(r.uint32()))
+	case uaDouble:
+		return r.double()
+	case uaString:
+		return r.string()
+	case uaDateTime:
+		return time.Unix(0, (int64(r.dateTime())-uaEpochOffset)*100).UTC()
+	case 14:
+		return r.next(16)
+	case uaByteString, 16:
+		return r.byteString()
+	case uaNodeIDType, 18:
+		return r.nodeID()
+	case uaQualifiedName:
+		return r.qualifiedName()
+	case uaLocalizedText:
+		return r.localizedText()
+	case uaExtensionObject:
+		return r.extension()
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("unsupported variant type %v", typ)
+	}
+	return nil
+}
+
+// requestHeader reads a RequestHeader and returns the authentication
+// token and the request handle
+func (r *uaReader) requestHeader() (uaNodeID, uint32) {
+	token := r.nodeID()
+	r.dateTime()
+	handle := r.uint32()
+	r.uint32() // return diagnostics
+	r.string() // audit entry
+	r.uint32() // timeout hint
+	r.extension()
+	return token, handle
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUANodeID(t *testing.T) {
+	// the NodeId encodings of OPC UA Part 6 5.2.2.9, the first three are
+	// its examples
+	for _, c := range []struct {
+		id   uaNodeID
+		want string
+	}{
+		{uaNumeric(0, 72), "0048"},
+		{uaNumeric(5, 1025), "01050104"},
+		{uaNamed(1, "Hot水"), "03010006000000486f74e6b0b4"},
+		{uaNumeric(0, 256), "01000001"},
+		{uaNumeric(300, 70000), "022c0170110100"},
+	} {
+		var w uaWriter
+		w.nodeID(c.id)
+		if got := hex.EncodeToString(w.Bytes()); got != c.want {
+			t.Errorf("%v = %v, want %v", c.id, got, c.want)
+		}
+		r := &uaReader{b: w.Bytes()}
+		if got := r.nodeID(); got != c.id || r.err != nil || len(r.b) != 0 {
+			t.Errorf("%v decoded as %v, %v", c.want, got, r.err)
+		}
+	}
+}
+
+func TestUAVariant(t *testing.T) {
+	// OPC UA Part 6 5.2.2: little-endian scalars, Int32-prefixed strings
+	// with -1 for null, DateTimes in 100 ns since 1601 and the Variant
+	// encoding mask with 0x80 for arrays
+	epoch := time.Unix(0, 0).UTC()
+	for _, c := range []struct {
+		v    uaVariant
+		want string
+	}{
+		{uaVariant{uaBoolean, true}, "0101"},
+		{uaVariant{uaInt32, int32(-2)}, "06feffffff"},
+		{uaVariant{uaUInt16, uint16(0x1234)}, "053412"},
+		{uaVariant{uaDouble, 1.0}, "0b000000000000f03f"},
+		{uaVariant{uaString, "水Boy"}, "0c06000000e6b0b4426f79"},
+		{uaVariant{uaString, ""}, "0cffffffff"},
+		{uaVariant{uaByteString, []byte{0xde, 0xad}}, "0f02000000dead"},
+		{uaVariant{uaDateTime, epoch}, "0d00803ed5deb19d01"},
+		{uaVariant{uaDateTime, time.Date(2018, 1, 1, 0, 0, 0, 100, time.UTC)}, "0d018077779382d301"},
+		{uaVariant{uaLocalizedText, "abc"}, "150203000000616263"},
+		{uaVariant{uaQualifiedName, uaQName{2, "Scan"}}, "140200040000005363616e"},
+		{uaArray(uaUInt32, uint32(1), uint32(2)), "87020000000100000002000000"},
+		{uaArray(uaString), "8c00000000"},
+		{uaVariant{}, "00"},
+	} {
+		var w uaWriter
+		w.variant(c.v)
+		if got := hex.EncodeToString(w.Bytes()); got != c.want {
+			t.Errorf("%v = %v, want %v", c.v, got, c.want)
+		}
+		r := &uaReader{b: w.Bytes()}
+		if got := r.variant(); !reflect.DeepEqual(got, c.v) || r.err != nil || len(r.b) != 0 {
+			t.Errorf("%v decoded as %v, %v", c.want, got, r.err)
+		}
+	}
+}
+
+func TestUAReaderTruncated(t *testing.T) {
+	for _, b := range []string{"0c05000000616263", "87020000000100", "01", "0d0100"} {
+		raw, _ := hex.DecodeString(b)
+		r := &uaReader{b: raw}
+		r.variant()
+		if r.err == nil {
+			t.Errorf("%v decoded without error", b)
+		}
+	}
+}
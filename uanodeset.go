@@ -0,0 +1,169 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// uaNodeSet is the part of a NodeSet2 XML file naming its nodes
+type uaNodeSet struct {
+	NamespaceURIs []string `xml:"NamespaceUris>Uri"`
+	Aliases       []struct {
+		Alias  string `xml:"Alias,attr"`
+		NodeID string `xml:",chardata"`
+	} `xml:"Aliases>Alias"`
+	Nodes []uaNodeSetNode `xml:",any"`
+}
+
+type uaNodeSetNode struct {
+	NodeID     string `xml:"NodeId,attr"`
+	BrowseName string `xml:"BrowseName,attr"`
+	Parent     string `xml:"ParentNodeId,attr"`
+	References []struct {
+		Type      string `xml:"ReferenceType,attr"`
+		IsForward string `xml:"IsForward,attr"`
+		Target    string `xml:",chardata"`
+	} `xml:"References>Reference"`
+}
+
+// uaNodeSetIDs resolves the NodeIds of a NodeSet in the namespaces of the
+// server
+type uaNodeSetIDs struct {
+	set        uaNodeSet
+	namespaces []string
+	aliases    map[string]string
+}
+
+// loadNodeSet reads a NodeSet2 XML file
+func loadNodeSet(path string, namespaces []string) (*uaNodeSetIDs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ids := &uaNodeSetIDs{namespaces: namespaces, aliases: map[string]string{}}
+	if err := xml.NewDecoder(f).Decode(&ids.set); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	for _, a := range ids.set.Aliases {
+		ids.aliases[a.Alias] = strings.TrimSpace(a.NodeID)
+	}
+	return ids, nil
+}
+
+// nodeID converts a NodeId of the file, ns=N;i=ID, to the namespace of the
+// server with the same URI
+func (ids *uaNodeSetIDs) nodeID(s string) (uaNodeID, error) {
+	s = strings.TrimSpace(s)
+	if alias, ok := ids.aliases[s]; ok {
+		s = alias
+	}
+	ns := 0
+	if strings.HasPrefix(s, "ns=") {
+		i := strings.Index(s, ";")
+		if i < 0 {
+			return uaNodeID{}, fmt.Errorf("invalid NodeId %q", s)
+		}
+		n, err := strconv.Atoi(s[3:i])
+		if err != nil || n < 1 || n > len(ids.set.NamespaceURIs) {
+			return uaNodeID{}, fmt.Errorf("invalid NodeId %q", s)
+		}
+		for j, uri := range ids.namespaces {
+			if uri == ids.set.NamespaceURIs[n-1] {
+				ns = j
+			}
+		}
+		if ns == 0 {
+			return uaNodeID{}, fmt.Errorf("the namespace %v of %q isn't served", ids.set.NamespaceURIs[n-1], s)
+		}
+		s = s[i+1:]
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(s, "i="), 10, 32)
+	if !strings.HasPrefix(s, "i=") || err != nil {
+		return uaNodeID{}, fmt.Errorf("NodeId %q isn't numeric", s)
+	}
+	return uaNumeric(uint16(ns), uint32(id)), nil
+}
+
+// name returns the browse name of a node without its namespace index
+func (n *uaNodeSetNode) name() string {
+	if i := strings.Index(n.BrowseName, ":"); i >= 0 {
+		return n.BrowseName[i+1:]
+	}
+	return n.BrowseName
+}
+
+// find returns the NodeId of the node of the browse name in the namespace,
+// below the parent unless it's null
+func (ids *uaNodeSetIDs) find(ns uint16, parent uaNodeID, name string) (uaNodeID, error) {
+	for i := range ids.set.Nodes {
+		n := &ids.set.Nodes[i]
+		if n.name() != name || n.NodeID == "" {
+			continue
+		}
+		id, err := ids.nodeID(n.NodeID)
+		if err != nil || id.ns != ns {
+			continue
+		}
+		if parent.isNull() {
+			return id, nil
+		}
+		if p, err := ids.nodeID(n.Parent); err == nil && p == parent {
+			return id, nil
+		}
+		for _, ref := range n.References {
+			if p, err := ids.nodeID(ref.Target); err == nil && p == parent && ref.IsForward == "false" {
+				return id, nil
+			}
+		}
+	}
+	return uaNodeID{}, fmt.Errorf("no %v in the NodeSet", name)
+}
+
+// encoding returns the NodeId of the encoding of the data type by name,
+// e.g. Default Binary
+func (ids *uaNodeSetIDs) encoding(dataType uaNodeID, name string) (uaNodeID, error) {
+	for i := range ids.set.Nodes {
+		n := &ids.set.Nodes[i]
+		id, err := ids.nodeID(n.NodeID)
+		if err != nil {
+			continue
+		}
+		for _, ref := range n.References {
+			if t, err := ids.nodeID(ref.Type); err != nil || t != uaHasEncoding {
+				continue
+			}
+			target, err := ids.nodeID(ref.Target)
+			if err != nil {
+				continue
+			}
+			// the data type refers to its encoding, and back
+			if id == dataType && ref.IsForward != "false" && ids.named(target, name) {
+				return target, nil
+			}
+			if target == dataType && ref.IsForward == "false" && n.name() == name {
+				return id, nil
+			}
+		}
+	}
+	return uaNodeID{}, fmt.Errorf("no %v encoding of %v in the NodeSet", name, dataType)
+}
+
+// named tells whether the node of the id has the browse name
+func (ids *uaNodeSetIDs) named(id uaNodeID, name string) bool {
+	for i := range ids.set.Nodes {
+		n := &ids.set.Nodes[i]
+		if other, err := ids.nodeID(n.NodeID); err == nil && other == id {
+			return n.name() == name
+		}
+	}
+	return false
+}
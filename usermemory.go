@@ -0,0 +1,594 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/iomz/golemu/codec"
+)
+
+const (
+	// ataDSFID is the DSFID of the ATA Spec 2000 records, data format 13
+	// of the no-directory access method
+	ataDSFID = 0x0d
+	// ataRecordSize is the most 16-bit words of an ATA record
+	ataRecordSize = 255
+	// isoTerminator ends the data sets of the no-directory access method
+	isoTerminator = 0x00
+	// pcUMI is the user memory indicator of the PC word, set on the tags
+	// with user memory
+	pcUMI = 0x0400
+)
+
+// compactions are the ISO/IEC 15962 compaction schemes by their code in
+// the precursor
+var compactions = []string{"application", "integer", "numeric", "5-bit", "6-bit", "7-bit", "octet"}
+
+// userMemory holds the structured user memory of the tags of the server
+// mode
+var userMemory = &userMemoryStore{tags: map[string]*UserMemory{}}
+
+// UserMemory is the user memory bank of a tag as ISO/IEC 15962 data sets
+// or an ATA Spec 2000 record
+type UserMemory struct {
+	// Format is iso15962 or ata
+	Format string
+	// DataFormat is the data format of the DSFID, the data sets taking
+	// their OIDs relative to 1.0.15961.DataFormat
+	DataFormat uint8     `json:",omitempty"`
+	DataSets   []DataSet `json:",omitempty"`
+	// Record is the text elements of the ATA record, in order
+	Record []TextElement `json:",omitempty"`
+	// Hex is the memory bank, set in the responses
+	Hex string `json:",omitempty"`
+}
+
+// DataSet is an ISO/IEC 15962 data set
+type DataSet struct {
+	// OID is the relative OID of the data set
+	OID  uint32
+	Data string
+	// Compaction is application, integer, numeric, 5-bit, 6-bit, 7-bit or
+	// octet, the most compact one for the data without
+	Compaction string `json:",omitempty"`
+}
+
+// TextElement is a text element of an ATA Spec 2000 record
+type TextElement struct {
+	// TEI is the text element identifier, e.g. MFR, PNO or SER
+	TEI  string
+	Data string
+}
+
+// Encode returns the memory bank of the user memory, in whole words
+func (m *UserMemory) Encode() ([]byte, error) {
+	var b []byte
+	var err error
+	switch m.Format {
+	case "iso15962":
+		b, err = encodeDataSets(m.DataFormat, m.DataSets)
+	case "ata":
+		b, err = encodeATARecord(m.Record)
+	default:
+		return nil, fmt.Errorf("unknown user memory format %q, expected iso15962 or ata", m.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+// decodeUserMemory decodes a memory bank by its DSFID
+func decodeUserMemory(b []byte) (*UserMemory, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty user memory")
+	}
+	var m *UserMemory
+	var err error
+	if b[0] == ataDSFID {
+		m, err = decodeATARecord(b)
+	} else {
+		m, err = decodeDataSets(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.Hex = hex.EncodeToString(b)
+	return m, nil
+}
+
+// encodeDataSets encodes the data sets in the no-directory access method:
+// the DSFID, then a precursor, the relative OID, the length and the
+// compacted data of each, and a terminator
+func encodeDataSets(format uint8, sets []DataSet) ([]byte, error) {
+	if format == ataDSFID {
+		return nil, fmt.Errorf("data format %v is the ATA Spec 2000 records, use the ata format", format)
+	}
+	if format < 3 || format > 28 {
+		return nil, fmt.Errorf("data format %v doesn't take relative OIDs, expected 3 to 28", format)
+	}
+	b := []byte{format}
+	for _, s := range sets {
+		if s.OID == 0 {
+			return nil, fmt.Errorf("the relative OID 0 is reserved")
+		}
+		c := s.Compaction
+		if c == "" {
+			c = compactionOf(s.Data)
+		}
+		code := -1
+		for i, name := range compactions {
+			if name == c {
+				code = i
+			}
+		}
+		if code < 0 {
+			return nil, fmt.Errorf("data set %v: unknown compaction %q", s.OID, c)
+		}
+		data, err := compact(c, s.Data)
+		if err != nil {
+			return nil, fmt.Errorf("data set %v: %v", s.OID, err)
+		}
+		if s.OID < 15 {
+			b = append(b, byte(code)<<4|byte(s.OID))
+		} else {
+			b = appendEBV(append(b, byte(code)<<4|0x0f), s.OID-15)
+		}
+		b = append(appendEBV(b, uint32(len(data))), data...)
+	}
+	return append(b, isoTerminator), nil
+}
+
+// decodeDataSets decodes the data sets of the no-directory access method
+func decodeDataSets(b []byte) (*UserMemory, error) {
+	if b[0]>>6 != 0 || b[0]&0x20 != 0 {
+		return nil, fmt.Errorf("DSFID %#02x: only the no-directory access method is supported", b[0])
+	}
+	m := &UserMemory{Format: "iso15962", DataFormat: b[0] & 0x1f}
+	if m.DataFormat < 3 || m.DataFormat > 28 {
+		return nil, fmt.Errorf("DSFID %#02x: data format %v doesn't take relative OIDs", b[0], m.DataFormat)
+	}
+	for i := 1; i < len(b) && b[i] != isoTerminator; {
+		p := b[i]
+		i++
+		if p&0x80 != 0 {
+			return nil, fmt.Errorf("byte %v: offset data sets aren't supported", i-1)
+		}
+		code := int(p >> 4 & 0x07)
+		if code >= len(compactions) {
+			return nil, fmt.Errorf("byte %v: unknown compaction %v", i-1, code)
+		}
+		s := DataSet{OID: uint32(p & 0x0f), Compaction: compactions[code]}
+		var n uint32
+		var err error
+		if s.OID == 0x0f {
+			if n, i, err = readEBV(b, i); err != nil {
+				return nil, err
+			}
+			s.OID += n
+		}
+		if n, i, err = readEBV(b, i); err != nil {
+			return nil, err
+		}
+		if i+int(n) > len(b) {
+			return nil, fmt.Errorf("data set %v: truncated data", s.OID)
+		}
+		s.Data = expand(s.Compaction, b[i:i+int(n)])
+		i += int(n)
+		m.DataSets = append(m.DataSets, s)
+	}
+	return m, nil
+}
+
+// compactionOf returns the most compact scheme for the data
+func compactionOf(data string) string {
+	if data == "" {
+		return "octet"
+	}
+	switch {
+	case strings.Trim(data, "0123456789") == "":
+		if data == "0" || data[0] != '0' {
+			return "integer"
+		}
+		return "numeric"
+	case inRange(data, 0x41, 0x5e):
+		return "5-bit"
+	case inRange(data, 0x20, 0x5f) && !strings.Contains(data, "?"):
+		return "6-bit"
+	case inRange(data, 0x00, 0x7e):
+		return "7-bit"
+	}
+	return "octet"
+}
+
+// compact encodes the data with the compaction scheme
+func compact(c, data string) ([]byte, error) {
+	switch c {
+	case "integer", "numeric":
+		if data == "" || strings.Trim(data, "0123456789") != "" {
+			return nil, fmt.Errorf("%q isn't a string of digits", data)
+		}
+		if c == "integer" && data != "0" && data[0] == '0' {
+			return nil, fmt.Errorf("%q has leading zeros, use the numeric compaction", data)
+		}
+		if c == "numeric" {
+			// the leading 1 keeps the leading zeros
+			data = "1" + data
+		}
+		n, _ := new(big.Int).SetString(data, 10)
+		return n.Bytes(), nil
+	case "5-bit":
+		return packBits(data, 5, 0x41, 0x5e)
+	case "6-bit":
+		if strings.Contains(data, "?") {
+			return nil, fmt.Errorf("%q has a ?, the padding of the 6-bit code", data)
+		}
+		return packBits(data, 6, 0x20, 0x5f)
+	case "7-bit":
+		return packBits(data, 7, 0x00, 0x7e)
+	}
+	return []byte(data), nil
+}
+
+// expand decodes data compacted with the scheme
+func expand(c string, b []byte) string {
+	switch c {
+	case "integer":
+		return new(big.Int).SetBytes(b).String()
+	case "numeric":
+		s := new(big.Int).SetBytes(b).String()
+		return strings.TrimPrefix(s, "1")
+	case "5-bit":
+		return unpackBits(b, 5, true)
+	case "6-bit":
+		return unpackBits(b, 6, true)
+	case "7-bit":
+		return unpackBits(b, 7, true)
+	}
+	return string(b)
+}
+
+// inRange tells whether every character of s is between lo and hi
+func inRange(s string, lo, hi byte) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < lo || s[i] > hi {
+			return false
+		}
+	}
+	return true
+}
+
+// packBits packs the characters between lo and hi in codes of the width,
+// the last byte padded with ones; the all-ones code is left out of the
+// compactions for the padding to be told apart
+func packBits(s string, width uint, lo, hi byte) ([]byte, error) {
+	if !inRange(s, lo, hi) {
+		return nil, fmt.Errorf("%q has characters outside the %v-bit code", s, width)
+	}
+	mask := byte(1)<<width - 1
+	b := make([]byte, (len(s)*int(width)+7)/8)
+	for i := range b {
+		b[i] = 0xff
+	}
+	bit := 0
+	for i := 0; i < len(s); i++ {
+		v := s[i] & mask
+		for j := int(width) - 1; j >= 0; j-- {
+			if v>>uint(j)&1 == 0 {
+				b[bit/8] &^= 0x80 >> uint(bit%8)
+			}
+			bit++
+		}
+	}
+	return b, nil
+}
+
+// unpackBits unpacks the codes of the width, up to an all-ones code when
+// padded
+func unpackBits(b []byte, width uint, padded bool) string {
+	mask := byte(1)<<width - 1
+	var s []byte
+	for bit := 0; bit+int(width) <= len(b)*8; {
+		var v byte
+		for j := 0; j < int(width); j++ {
+			v = v<<1 | b[bit/8]>>uint(7-bit%8)&1
+			bit++
+		}
+		if v == mask && padded {
+			break
+		}
+		switch {
+		case width == 5, width == 6 && v < 0x20:
+			v |= 0x40
+		}
+		s = append(s, v)
+	}
+	return string(s)
+}
+
+// appendEBV appends n as an extensible bit vector of 7-bit groups
+func appendEBV(b []byte, n uint32) []byte {
+	groups := []byte{byte(n & 0x7f)}
+	for n >>= 7; n != 0; n >>= 7 {
+		groups = append([]byte{byte(n&0x7f) | 0x80}, groups...)
+	}
+	return append(b, groups...)
+}
+
+// readEBV reads an extensible bit vector at i and returns the index after
+func readEBV(b []byte, i int) (uint32, int, error) {
+	var n uint32
+	for start := i; i < len(b); i++ {
+		if i-start == 5 {
+			break
+		}
+		n = n<<7 | uint32(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return n, i + 1, nil
+		}
+	}
+	return 0, i, fmt.Errorf("byte %v: truncated length", i)
+}
+
+// encodeATARecord encodes the text elements as *TEI DATA in the 6-bit
+// code, padded with spaces to whole words, after the DSFID and the length
+// of the record in words
+func encodeATARecord(record []TextElement) ([]byte, error) {
+	seen := map[string]bool{}
+	var text string
+	for _, e := range record {
+		if len(e.TEI) != 3 || strings.Trim(e.TEI, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return nil, fmt.Errorf("invalid text element identifier %q", e.TEI)
+		}
+		if strings.Contains(e.Data, "*") {
+			return nil, fmt.Errorf("%v: * separates the text elements", e.TEI)
+		}
+		seen[e.TEI] = true
+		text += "*" + e.TEI + " " + e.Data
+	}
+	if !(seen["MFR"] || seen["CAG"]) || !seen["PNO"] || !seen["SER"] {
+		return nil, fmt.Errorf("a birth record needs MFR or CAG, PNO and SER")
+	}
+	// 8 characters of 6 bits are 3 words
+	if r := len(text) % 8; r != 0 {
+		text += strings.Repeat(" ", 8-r)
+	}
+	packed, err := packBits(text, 6, 0x20, 0x5f)
+	if err != nil {
+		return nil, err
+	}
+	if len(packed)/2 > ataRecordSize {
+		return nil, fmt.Errorf("the record takes %v words, more than %v", len(packed)/2, ataRecordSize)
+	}
+	return append([]byte{ataDSFID, byte(len(packed) / 2)}, packed...), nil
+}
+
+// decodeATARecord decodes the text elements of an ATA record
+func decodeATARecord(b []byte) (*UserMemory, error) {
+	if len(b) < 2 || len(b) < 2+int(b[1])*2 {
+		return nil, fmt.Errorf("truncated ATA record")
+	}
+	text := strings.TrimRight(unpackBits(b[2:2+int(b[1])*2], 6, false), " ")
+	if !strings.HasPrefix(text, "*") {
+		return nil, fmt.Errorf("the ATA record doesn't start with a text element")
+	}
+	m := &UserMemory{Format: "ata"}
+	for _, e := range strings.Split(text[1:], "*") {
+		if len(e) < 3 {
+			return nil, fmt.Errorf("invalid text element %q", e)
+		}
+		m.Record = append(m.Record, TextElement{TEI: e[:3], Data: strings.TrimPrefix(e[3:], " ")})
+	}
+	return m, nil
+}
+
+// userMemoryStore is the user memory of the tags by EPC
+type userMemoryStore struct {
+	sync.Mutex
+	tags map[string]*UserMemory
+}
+
+// Set encodes the user memory of a tag and keeps it
+func (s *userMemoryStore) Set(epc string, m UserMemory) (*UserMemory, error) {
+	b, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, model := chips.Get(epc); model != nil && len(b)*8 > model.UserBits {
+		return nil, fmt.Errorf("the %v bits of user memory don't fit the %v bits of the %v", len(b)*8, model.UserBits, model.Name)
+	}
+	m.Hex = hex.EncodeToString(b)
+	s.Lock()
+	defer s.Unlock()
+	s.tags[strings.ToLower(epc)] = &m
+	return &m, nil
+}
+
+// Get returns the user memory of a tag, nil without one
+func (s *userMemoryStore) Get(epc string) *UserMemory {
+	s.Lock()
+	defer s.Unlock()
+	return s.tags[strings.ToLower(epc)]
+}
+
+// Bank returns the memory bank of a tag, nil without one
+func (s *userMemoryStore) Bank(epc string) []byte {
+	m := s.Get(epc)
+	if m == nil {
+		return nil
+	}
+	b, _ := hex.DecodeString(m.Hex)
+	return b
+}
+
+// PC returns the PC word of a tag, with the UMI set when it has user memory
+func (s *userMemoryStore) PC(pc uint16, epc string) uint16 {
+	if len(s.Bank(epc)) != 0 {
+		pc |= pcUMI
+	}
+	return pc
+}
+
+// Apply sets the UMI in the C1G2PC of the tags with user memory in the
+// TagReportData
+func (s *userMemoryStore) Apply(data []byte) []byte {
+	s.Lock()
+	n := len(s.tags)
+	s.Unlock()
+	if n == 0 {
+		return data
+	}
+	m, err := decodeTagReportData(data)
+	if err != nil {
+		log.Printf("couldn't set the UMI of the report: %v", err)
+		return data
+	}
+	for _, trd := range m.Find(codec.TagReportData) {
+		if p := trd.First(codec.C1G2PC); p != nil {
+			p.SetField("PC_Bits", s.PC(uint16(p.Uint("PC_Bits")), hex.EncodeToString(codec.EPC(trd))))
+		}
+	}
+	b, err := encodeTagReportData(m)
+	if err != nil {
+		log.Printf("couldn't set the UMI of the report: %v", err)
+		return data
+	}
+	return b
+}
+
+// Delete forgets the user memory of a tag
+func (s *userMemoryStore) Delete(epc string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.tags[strings.ToLower(epc)]
+	delete(s.tags, strings.ToLower(epc))
+	return ok
+}
+
+// All returns the user memory of every tag by EPC
+func (s *userMemoryStore) All() map[string]*UserMemory {
+	s.Lock()
+	defer s.Unlock()
+	all := make(map[string]*UserMemory, len(s.tags))
+	for epc, m := range s.tags {
+		all[epc] = m
+	}
+	return all
+}
+
+// save writes the user memory to the --usermemory file
+func (s *userMemoryStore) save() error {
+	if *memoryFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.All(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*memoryFile, data, 0644)
+}
+
+// loadUserMemory sets the user memory of the --usermemory file, if it
+// exists
+func loadUserMemory() {
+	if *memoryFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*memoryFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	var tags map[string]UserMemory
+	if err := json.Unmarshal(data, &tags); err != nil {
+		log.Fatalf("%v: %v", *memoryFile, err)
+	}
+	for epc, m := range tags {
+		if _, err := userMemory.Set(epc, m); err != nil {
+			log.Fatalf("%v: %v: %v", *memoryFile, epc, err)
+		}
+	}
+	log.Printf("loaded the user memory of %v tags from %v", len(tags), *memoryFile)
+}
+
+// APIGetUserMemories returns the user memory of every tag by EPC
+func APIGetUserMemories(c *gin.Context) {
+	c.JSON(http.StatusOK, userMemory.All())
+}
+
+// APIGetUserMemory returns the user memory of a tag
+func APIGetUserMemory(c *gin.Context) {
+	m := userMemory.Get(c.Param("epc"))
+	if m == nil {
+		c.String(http.StatusNotFound, "No user memory!\n")
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// APIPutUserMemory encodes and sets the user memory of a tag
+func APIPutUserMemory(c *gin.Context) {
+	var m UserMemory
+	if err := c.BindWith(&m, binding.JSON); err != nil {
+		return
+	}
+	set, err := userMemory.Set(c.Param("epc"), m)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+	if err := userMemory.save(); err != nil {
+		c.String(http.StatusInternalServerError, err.Error()+"\n")
+		return
+	}
+	c.JSON(http.StatusOK, set)
+}
+
+// APIDeleteUserMemory clears the user memory of a tag
+func APIDeleteUserMemory(c *gin.Context) {
+	if !userMemory.Delete(c.Param("epc")) {
+		c.String(http.StatusNotFound, "No user memory!\n")
+		return
+	}
+	if err := userMemory.save(); err != nil {
+		c.String(http.StatusInternalServerError, err.Error()+"\n")
+		return
+	}
+	c.String(http.StatusAccepted, "User memory cleared!\n")
+}
+
+// APIPostDecodeUserMemory decodes the Hex of a memory bank
+func APIPostDecodeUserMemory(c *gin.Context) {
+	var req struct{ Hex string }
+	if err := c.BindWith(&req, binding.JSON); err != nil {
+		return
+	}
+	b, err := hex.DecodeString(req.Hex)
+	if err == nil {
+		var m *UserMemory
+		if m, err = decodeUserMemory(b); err == nil {
+			c.JSON(http.StatusOK, m)
+			return
+		}
+	}
+	c.String(http.StatusBadRequest, err.Error()+"\n")
+}
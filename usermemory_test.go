@@ -0,0 +1,130 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	// the ISO/IEC 15962 compactions, the bit-packed ones padded with ones
+	for _, c := range []struct {
+		compaction string
+		data       string
+		want       string
+	}{
+		{"integer", "12345", "3039"},
+		{"integer", "0", ""},
+		{"numeric", "0012", "271c"},
+		{"5-bit", "AB", "08bf"},
+		{"6-bit", "ABC", "0420ff"},
+		{"6-bit", "A1 Z", "07181a"},
+		{"7-bit", "a", "c3"},
+		{"7-bit", "Hi!", "91a50f"},
+		{"octet", "é", "c3a9"},
+	} {
+		b, err := compact(c.compaction, c.data)
+		if err != nil {
+			t.Errorf("%v %q: %v", c.compaction, c.data, err)
+			continue
+		}
+		if got := hex.EncodeToString(b); got != c.want {
+			t.Errorf("%v %q = %v, want %v", c.compaction, c.data, got, c.want)
+		}
+		if got := expand(c.compaction, b); got != c.data {
+			t.Errorf("%v %v expanded to %q, want %q", c.compaction, c.want, got, c.data)
+		}
+	}
+	for _, c := range []struct{ compaction, data string }{
+		{"integer", "012"},
+		{"numeric", "1a"},
+		{"5-bit", "a"},
+		{"6-bit", "A?"},
+		{"7-bit", "\x7f"},
+	} {
+		if _, err := compact(c.compaction, c.data); err == nil {
+			t.Errorf("%v %q accepted", c.compaction, c.data)
+		}
+	}
+}
+
+func TestEBV(t *testing.T) {
+	for _, c := range []struct {
+		n    uint32
+		want string
+	}{
+		{0, "00"},
+		{127, "7f"},
+		{128, "8100"},
+		{16383, "ff7f"},
+		{16384, "818000"},
+	} {
+		b := appendEBV(nil, c.n)
+		if got := hex.EncodeToString(b); got != c.want {
+			t.Errorf("EBV %v = %v, want %v", c.n, got, c.want)
+		}
+		if n, i, err := readEBV(b, 0); n != c.n || i != len(b) || err != nil {
+			t.Errorf("EBV %v read as %v, %v, %v", c.want, n, i, err)
+		}
+	}
+	if _, _, err := readEBV([]byte{0x81, 0x80}, 0); err == nil {
+		t.Error("truncated EBV accepted")
+	}
+}
+
+func TestUserMemory(t *testing.T) {
+	for _, c := range []struct {
+		m    UserMemory
+		want string
+	}{
+		// the DSFID, a precursor of the compaction and the OID, the
+		// length, the data and the terminator, padded to whole words
+		{UserMemory{Format: "iso15962", DataFormat: 9, DataSets: []DataSet{
+			{OID: 3, Data: "12345", Compaction: "integer"},
+		}}, "091302303900"},
+		{UserMemory{Format: "iso15962", DataFormat: 9, DataSets: []DataSet{
+			{OID: 1, Data: "0614141", Compaction: "numeric"},
+			{OID: 20, Data: "LOT A", Compaction: "6-bit"},
+		}}, "092103a1f57d4f050430f5200700"},
+		// the DSFID, the length in words and *MFR ABC*PNO 12*SER 1 padded
+		// to 24 characters in the 6-bit code
+		{UserMemory{Format: "ata", Record: []TextElement{
+			{TEI: "MFR", Data: "ABC"}, {TEI: "PNO", Data: "12"}, {TEI: "SER", Data: "1"},
+		}}, "0d09a8d192801083a9038f831caa4c54a0c60820"},
+	} {
+		b, err := c.m.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(b); got != c.want {
+			t.Errorf("%+v = %v, want %v", c.m, got, c.want)
+		}
+		m, err := decodeUserMemory(b)
+		if err != nil {
+			t.Fatalf("%x: %v", b, err)
+		}
+		m.Hex = ""
+		if !reflect.DeepEqual(*m, c.m) {
+			t.Errorf("%x decoded as %+v, want %+v", b, *m, c.m)
+		}
+	}
+}
+
+func TestUMI(t *testing.T) {
+	s := &userMemoryStore{tags: map[string]*UserMemory{"0102030405060708090a0b0c": {Hex: "0d00"}}}
+	for _, c := range []struct{ epc, want string }{
+		{"0102030405060708090a0b0c", "8c3400"},
+		{"0102030405060708090a0b0d", "8c3000"},
+	} {
+		// an EPC96 and a C1G2PC of 0x3000
+		data := unhex(t, "00f00014 8d"+c.epc+"8c3000")
+		if got := hex.EncodeToString(s.Apply(data)[17:]); got != c.want {
+			t.Errorf("%v reported with the PC %v, want %v", c.epc, got, c.want)
+		}
+	}
+}
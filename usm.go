@@ -0,0 +1,313 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+)
+
+// SNMP v3 message flags and the user-based security model, RFC 3412/3414
+const (
+	snmpVersion3      = 3
+	snmpReport   byte = 0xa8
+
+	usmFlagAuth       = 0x01
+	usmFlagPriv       = 0x02
+	usmFlagReportable = 0x04
+	usmSecurityModel  = 3
+	// usmEngineBoots is constant, the agent doesn't keep state across runs
+	usmEngineBoots = 1
+	// usmTimeWindow is the accepted difference of engine time in seconds
+	usmTimeWindow = 150
+	// usmMaxSize is the largest message the agent accepts
+	usmMaxSize = 65507
+	// usmDigestSize is the length of the HMAC-MD5-96 and HMAC-SHA-96
+	usmDigestSize = 12
+)
+
+// usmStats counters, reported to the managers
+var (
+	usmStatsUnsupportedSecLevels = mustOID("1.3.6.1.6.3.15.1.1.1.0")
+	usmStatsNotInTimeWindows     = mustOID("1.3.6.1.6.3.15.1.1.2.0")
+	usmStatsUnknownUserNames     = mustOID("1.3.6.1.6.3.15.1.1.3.0")
+	usmStatsUnknownEngineIDs     = mustOID("1.3.6.1.6.3.15.1.1.4.0")
+	usmStatsWrongDigests         = mustOID("1.3.6.1.6.3.15.1.1.5.0")
+)
+
+// usmUser is an SNMP v3 user, authenticated with its key localized to the
+// engine unless auth is empty; privacy isn't supported
+type usmUser struct {
+	name string
+	auth string
+	key  []byte
+}
+
+// parseUSMUser parses a --snmp-user NAME, NAME:md5:PASSWORD or
+// NAME:sha:PASSWORD
+func parseUSMUser(spec string, engineID []byte) (*usmUser, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	u := &usmUser{name: parts[0]}
+	if u.name == "" || len(parts) == 2 {
+		return nil, fmt.Errorf("invalid SNMP user %q, expected NAME or NAME:md5|sha:PASSWORD", spec)
+	}
+	if len(parts) == 1 {
+		return u, nil
+	}
+	u.auth = strings.ToLower(parts[1])
+	if u.auth != "md5" && u.auth != "sha" {
+		return nil, fmt.Errorf("unsupported authentication protocol %q of SNMP user %v, expected md5 or sha", parts[1], u.name)
+	}
+	if len(parts[2]) < 8 {
+		return nil, fmt.Errorf("the password of SNMP user %v must have at least 8 characters", u.name)
+	}
+	u.key = usmLocalizeKey(u.hash(), parts[2], engineID)
+	return u, nil
+}
+
+func (u *usmUser) hash() func() hash.Hash {
+	if u.auth == "md5" {
+		return md5.New
+	}
+	return sha1.New
+}
+
+// digest returns the HMAC-MD5-96 or HMAC-SHA-96 of the message
+func (u *usmUser) digest(msg []byte) []byte {
+	mac := hmac.New(u.hash(), u.key)
+	mac.Write(msg)
+	return mac.Sum(nil)[:usmDigestSize]
+}
+
+// usmLocalizeKey derives the key of a password and localizes it to the
+// engine, RFC 3414 A.2
+func usmLocalizeKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	h := newHash()
+	buf := make([]byte, 64)
+	for i := 0; i < 1048576; i += len(buf) {
+		for j := range buf {
+			buf[j] = password[(i+j)%len(password)]
+		}
+		h.Write(buf)
+	}
+	ku := h.Sum(nil)
+	h.Reset()
+	h.Write(ku)
+	h.Write(engineID)
+	h.Write(ku)
+	return h.Sum(nil)
+}
+
+// snmpEngineID returns the --snmp-engine-id, or a text engine ID of the
+// hostname in the RFC 3411 format
+func snmpEngineID(s string) ([]byte, error) {
+	if s != "" {
+		id, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+		if err != nil || len(id) < 5 || len(id) > 32 {
+			return nil, fmt.Errorf("invalid SNMP engine ID %q, expected 5 to 32 bytes in hex", s)
+		}
+		return id, nil
+	}
+	host, _ := os.Hostname()
+	// the enterprise 8072 (net-snmp) and the text format
+	id := append([]byte{0x80, 0x00, 0x1f, 0x88, 0x04}, "golemu:"+host...)
+	if len(id) > 32 {
+		id = id[:32]
+	}
+	return id, nil
+}
+
+// engineTime is the number of seconds since the engine booted
+func (a *snmpAgent) engineTime() int64 {
+	return int64(a.health.Uptime() / time.Second)
+}
+
+// handleV3 checks the security parameters of a v3 message and answers its
+// scoped PDU, or reports why it can't; whole is the message as received
+func (a *snmpAgent) handleV3(whole, msg []byte) ([]byte, error) {
+	tag, global, msg, err := berRead(msg)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	msgID, global, err := berReadInt(global)
+	if err != nil {
+		return nil, err
+	}
+	if _, global, err = berReadInt(global); err != nil {
+		return nil, err
+	}
+	tag, flags, global, err := berRead(global)
+	if err != nil || tag != berOctetString || len(flags) != 1 {
+		return nil, errBER
+	}
+	model, _, err := berReadInt(global)
+	if err != nil {
+		return nil, err
+	}
+	if model != usmSecurityModel {
+		return nil, fmt.Errorf("unsupported SNMP security model %v", model)
+	}
+	tag, params, scoped, err := berRead(msg)
+	if err != nil || tag != berOctetString {
+		return nil, errBER
+	}
+	tag, params, _, err = berRead(params)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	var fields [6][]byte
+	for i := range fields {
+		var content []byte
+		if tag, content, params, err = berRead(params); err != nil {
+			return nil, err
+		}
+		expected := berOctetString
+		if i == 1 || i == 2 {
+			// the engine boots and time, kept encoded for berReadInt
+			expected, content = berInteger, berTLV(berInteger, content)
+		}
+		if tag != expected {
+			return nil, errBER
+		}
+		fields[i] = content
+	}
+	engineID, userName, authParams := fields[0], fields[3], fields[4]
+	boots, _, _ := berReadInt(fields[1])
+	engineTime, _, _ := berReadInt(fields[2])
+
+	level := flags[0] & (usmFlagAuth | usmFlagPriv)
+	reportable := flags[0]&usmFlagReportable != 0
+	report := func(counter oid, user *usmUser) ([]byte, error) {
+		a.Lock()
+		a.usmStats[counter.String()]++
+		n := a.usmStats[counter.String()]
+		a.Unlock()
+		if !reportable {
+			return nil, fmt.Errorf("SNMP v3 request of %q dropped, %v", userName, counter)
+		}
+		requestID, contextName := scopedRequest(scoped)
+		pdu := berSeq(snmpReport,
+			berInt(berInteger, requestID),
+			berInt(berInteger, 0),
+			berInt(berInteger, 0),
+			berSeq(berSequence, varBind(counter, berInt(berCounter32, n))))
+		var reportLevel byte
+		if user != nil {
+			reportLevel = usmFlagAuth
+		}
+		return a.encodeV3(msgID, reportLevel, user, userName, contextName, pdu), nil
+	}
+	if level == usmFlagPriv {
+		return nil, fmt.Errorf("SNMP v3 privacy without authentication")
+	}
+	if !bytes.Equal(engineID, a.engineID) {
+		// a discovery
+		return report(usmStatsUnknownEngineIDs, nil)
+	}
+	user := a.users[string(userName)]
+	if user == nil {
+		return report(usmStatsUnknownUserNames, nil)
+	}
+	if level != map[bool]byte{false: 0, true: usmFlagAuth}[user.auth != ""] {
+		return report(usmStatsUnsupportedSecLevels, nil)
+	}
+	if level&usmFlagAuth != 0 {
+		if len(authParams) != usmDigestSize {
+			return report(usmStatsWrongDigests, nil)
+		}
+		// authParams is a slice of whole, find it to zero it for the digest
+		offset := cap(whole) - cap(authParams)
+		check := append([]byte{}, whole...)
+		copy(check[offset:offset+usmDigestSize], make([]byte, usmDigestSize))
+		if !hmac.Equal(user.digest(check), authParams) {
+			return report(usmStatsWrongDigests, nil)
+		}
+		if diff := engineTime - a.engineTime(); boots != usmEngineBoots || diff > usmTimeWindow || diff < -usmTimeWindow {
+			return report(usmStatsNotInTimeWindows, user)
+		}
+	}
+
+	tag, scoped, _, err = berRead(scoped)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	if tag, _, scoped, err = berRead(scoped); err != nil || tag != berOctetString {
+		return nil, errBER
+	}
+	tag, contextName, pdu, err := berRead(scoped)
+	if err != nil || tag != berOctetString {
+		return nil, errBER
+	}
+	res, err := a.respond(pdu)
+	if err != nil {
+		return nil, err
+	}
+	return a.encodeV3(msgID, level, user, userName, contextName, res), nil
+}
+
+// scopedRequest returns the request ID and the context name of a plain
+// scoped PDU, zero when it can't be read
+func scopedRequest(scoped []byte) (int64, []byte) {
+	tag, scoped, _, err := berRead(scoped)
+	if err != nil || tag != berSequence {
+		return 0, nil
+	}
+	if _, _, scoped, err = berRead(scoped); err != nil {
+		return 0, nil
+	}
+	_, contextName, pdu, err := berRead(scoped)
+	if err != nil {
+		return 0, nil
+	}
+	if _, pdu, _, err = berRead(pdu); err != nil {
+		return 0, contextName
+	}
+	requestID, _, _ := berReadInt(pdu)
+	return requestID, contextName
+}
+
+// encodeV3 encodes a response or report PDU in a v3 message of the agent,
+// authenticated by the user at the auth level
+func (a *snmpAgent) encodeV3(msgID int64, level byte, user *usmUser, userName, contextName, pdu []byte) []byte {
+	var authParams []byte
+	if level&usmFlagAuth != 0 {
+		authParams = make([]byte, usmDigestSize)
+	}
+	params := berSeq(berSequence,
+		berTLV(berOctetString, a.engineID),
+		berInt(berInteger, usmEngineBoots),
+		berInt(berInteger, a.engineTime()),
+		berTLV(berOctetString, userName),
+		berTLV(berOctetString, authParams),
+		berTLV(berOctetString, nil))
+	msg := berSeq(berSequence,
+		berInt(berInteger, snmpVersion3),
+		berSeq(berSequence,
+			berInt(berInteger, msgID),
+			berInt(berInteger, usmMaxSize),
+			berTLV(berOctetString, []byte{level}),
+			berInt(berInteger, usmSecurityModel)),
+		berTLV(berOctetString, params),
+		berSeq(berSequence,
+			berTLV(berOctetString, a.engineID),
+			berTLV(berOctetString, contextName),
+			pdu))
+	if authParams != nil {
+		// the digest goes before the empty privacy parameters at the end
+		// of the security parameters, which come first after the header
+		offset := bytes.Index(msg, params) + len(params) - 2 - usmDigestSize
+		copy(msg[offset:], user.digest(msg))
+	}
+	return msg
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+func TestUSMLocalizeKey(t *testing.T) {
+	// RFC 3414 A.3.1 and A.3.2
+	engineID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	for _, c := range []struct {
+		name    string
+		newHash func() hash.Hash
+		want    string
+	}{
+		{"md5", md5.New, "526f5eed9fcce26f8964c2930787d82b"},
+		{"sha", sha1.New, "6695febc9288e36282235fc7151f128497b38f3f"},
+	} {
+		if got := hex.EncodeToString(usmLocalizeKey(c.newHash, "maplesyrup", engineID)); got != c.want {
+			t.Errorf("%v key %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUSMDigest(t *testing.T) {
+	// RFC 2202 test cases 1 and 2, truncated to 96 bits
+	for _, c := range []struct {
+		auth string
+		key  []byte
+		msg  string
+		want string
+	}{
+		{"md5", bytes.Repeat([]byte{0x0b}, 16), "Hi There", "9294727a3638bb1c13f48ef8"},
+		{"md5", []byte("Jefe"), "what do ya want for nothing?", "750c783e6ab0b503eaa86e31"},
+		{"sha", bytes.Repeat([]byte{0x0b}, 20), "Hi There", "b617318655057264e28bc0b6"},
+		{"sha", []byte("Jefe"), "what do ya want for nothing?", "effcdf6ae5eb2fa2d27416d5"},
+	} {
+		u := &usmUser{name: "test", auth: c.auth, key: c.key}
+		if got := hex.EncodeToString(u.digest([]byte(c.msg))); got != c.want {
+			t.Errorf("%v digest of %q = %v, want %v", c.auth, c.msg, got, c.want)
+		}
+	}
+}
+
+func TestParseUSMUser(t *testing.T) {
+	engineID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	u, err := parseUSMUser("admin:SHA:maplesyrup", engineID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(u.key), "6695febc9288e36282235fc7151f128497b38f3f"; u.auth != "sha" || got != want {
+		t.Errorf("%v key %v, want sha key %v", u.auth, got, want)
+	}
+	for _, spec := range []string{"", "admin:md5", "admin:des:maplesyrup", "admin:md5:short"} {
+		if _, err := parseUSMUser(spec, engineID); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+var refreshInterval = 1000;
+
+var workerLabel = function(w) {
+    var label = w.Address + (w.Local ? " (local)" : "");
+    if (w.Error) {
+        label += " - " + w.Error;
+    }
+    return label;
+};
+
+var antennaLabel = function(a) {
+    var label = a.ID + ": " + (a.Track ? a.Track.split("/").pop() : "-");
+    if (a.Tags) {
+        label += " +" + a.Tags.length + " tags";
+    }
+    return label;
+};
+
+var toggleAntenna = function(port, a) {
+    $.ajax({
+        url: "/api/v1/readers/" + port + "/antennas/" + a.ID,
+        type: "PUT",
+        contentType: "application/json",
+        data: JSON.stringify({ connected: !a.Connected })
+    });
+};
+
+var antennaCell = function(r) {
+    var cell = $("<td/>");
+    var antennas = r.Antennas || [];
+    for (var i = 0; i < antennas.length; i++) {
+        (function(a) {
+            $("<button/>", {
+                "class": "button mini-button " + (a.Connected ? "success" : "danger"),
+                text: antennaLabel(a),
+                title: a.Connected ? "Disconnect" : "Connect"
+            }).click(function() {
+                toggleAntenna(r.Port, a);
+            }).appendTo(cell);
+        })(antennas[i]);
+    }
+    return cell;
+};
+
+var showCluster = function(c) {
+    $("#cycle").text(c.Cycle);
+    $("#time").text(c.Time);
+    var rows = $("#readers").empty();
+    for (var i = 0; i < c.Workers.length; i++) {
+        var w = c.Workers[i];
+        for (var j = 0; j < w.Readers.length; j++) {
+            var r = w.Readers[j];
+            var row = $("<tr/>").appendTo(rows);
+            if (w.Error) {
+                row.addClass("bg-lightRed");
+            }
+            $("<td/>", { text: j === 0 ? workerLabel(w) : "" }).appendTo(row);
+            $("<td/>", { text: r.Port }).appendTo(row);
+            antennaCell(r).appendTo(row);
+            $("<td/>", { text: r.Connected ? r.Client : "waiting" }).appendTo(row);
+            $("<td/>", { text: r.Reads }).appendTo(row);
+        }
+    }
+};
+
+var refresh = function() {
+    $.getJSON("/api/v1/cluster", showCluster).always(function() {
+        setTimeout(refresh, refreshInterval);
+    });
+};
+
+$(function() {
+    refresh();
+});
@@ -0,0 +1,456 @@
+var plan = null, selected = null, dragging = null, reads = [];
+
+// pixels per meter
+var scale = 50;
+
+var svgNS = "http://www.w3.org/2000/svg";
+
+var notify = function(caption, content, type) {
+    $.Notify({
+        caption: caption,
+        content: content,
+        type: type
+    });
+};
+
+var svg = function(tag, attrs) {
+    var e = $(document.createElementNS(svgNS, tag));
+    $.each(attrs, function(k, v) {
+        e[0].setAttribute(k, v);
+    });
+    return e;
+};
+
+var newFloorPlan = function() {
+    return { Name: "", Width: 20, Height: 12, Readers: [], Tags: [] };
+};
+
+var randomEPC = function() {
+    var epc = "";
+    for (var i = 0; i < 24; i++) {
+        epc += "0123456789ABCDEF"[Math.floor(Math.random() * 16)];
+    }
+    return epc;
+};
+
+var listFloorPlans = function() {
+    $.getJSON("/api/v1/floorplans", function(names) {
+        var list = $("#floorplan-list").empty();
+        for (var i = 0; i < names.length; i++) {
+            $("<option/>", { value: names[i], text: names[i] }).appendTo(list);
+        }
+    });
+    $.getJSON("/api/v1/scenarios", function(names) {
+        var list = $("#scenario-list").empty();
+        for (var i = 0; i < names.length; i++) {
+            $("<option/>", { value: names[i], text: names[i] }).appendTo(list);
+        }
+    });
+};
+
+var loadFloorPlan = function(name) {
+    if (!name) {
+        return;
+    }
+    $.getJSON("/api/v1/floorplans/" + encodeURIComponent(name), function(fp) {
+        plan = fp;
+        plan.Readers = plan.Readers || [];
+        plan.Tags = plan.Tags || [];
+        selected = null;
+        $("#floorplan-name").val(plan.Name);
+        render();
+        updateVisibility();
+        notify("Loaded", plan.Name + ": " + plan.Readers.length + " readers, " + plan.Tags.length + " tags", "success");
+    }).fail(function(xhr) {
+        notify("Error", xhr.responseText, "alert");
+    });
+};
+
+var saveFloorPlan = function() {
+    plan.Name = $("#floorplan-name").val().trim();
+    if (plan.Name === "") {
+        notify("Error", "The floor plan needs a name", "alert");
+        return;
+    }
+    $.ajax({
+        url: "/api/v1/floorplans/" + encodeURIComponent(plan.Name),
+        type: "PUT",
+        contentType: "application/json",
+        data: JSON.stringify(plan)
+    }).done(function() {
+        notify("Saved", plan.Name, "success");
+        listFloorPlans();
+    }).fail(function(xhr) {
+        notify("Error", xhr.responseText, "alert");
+    });
+};
+
+// the read model runs on the server, the reads are shown in the table and
+// the tags read are highlighted
+var updateVisibility = function() {
+    $.ajax({
+        url: "/api/v1/floorplans/visibility",
+        type: "POST",
+        contentType: "application/json",
+        data: JSON.stringify(plan)
+    }).done(function(r) {
+        reads = r;
+        renderVisibility();
+        render();
+    }).fail(function(xhr) {
+        notify("Error", xhr.responseText, "alert");
+    });
+};
+
+// the reads of the selected reader or antenna, all of them otherwise
+var selectedReads = function() {
+    return $.grep(reads, function(read) {
+        if (selected === null || selected.tag !== undefined) {
+            return true;
+        }
+        var r = plan.Readers[selected.reader];
+        if (read.Port !== r.Port) {
+            return false;
+        }
+        return selected.antenna === undefined || read.Antenna === r.Antennas[selected.antenna].ID;
+    });
+};
+
+var renderVisibility = function() {
+    var rows = {}, table = $("#visibility").empty();
+    $.each(selectedReads(), function(_, read) {
+        var key = read.Port + "/" + read.Antenna + "/" + read.Label;
+        if (!(key in rows)) {
+            rows[key] = { read: read, count: 0 };
+        }
+        rows[key].count++;
+    });
+    $.each(rows, function(_, row) {
+        var tr = $("<tr/>");
+        $("<td/>", { text: row.read.Port }).appendTo(tr);
+        $("<td/>", { text: row.read.Antenna }).appendTo(tr);
+        $("<td/>", { text: row.read.Label }).appendTo(tr);
+        $("<td/>", { text: row.count }).appendTo(tr);
+        $("<td/>", { text: row.read.RSSI + " dBm" }).appendTo(tr);
+        tr.appendTo(table);
+    });
+};
+
+// the beam of an antenna, clockwise from the x axis like the y axis
+// pointing down
+var beamPath = function(a) {
+    var r = a.Range * scale, x = a.X * scale, y = a.Y * scale;
+    var from = (a.Orientation - a.BeamWidth / 2) * Math.PI / 180;
+    var to = (a.Orientation + a.BeamWidth / 2) * Math.PI / 180;
+    if (a.BeamWidth >= 360) {
+        return "M " + (x - r) + " " + y + " a " + r + " " + r + " 0 1 0 " + (2 * r) + " 0" +
+            " a " + r + " " + r + " 0 1 0 " + (-2 * r) + " 0";
+    }
+    return "M " + x + " " + y +
+        " L " + (x + r * Math.cos(from)) + " " + (y + r * Math.sin(from)) +
+        " A " + r + " " + r + " 0 " + (a.BeamWidth > 180 ? 1 : 0) + " 1 " +
+        (x + r * Math.cos(to)) + " " + (y + r * Math.sin(to)) + " Z";
+};
+
+var isSelected = function(s) {
+    return selected !== null && selected.reader === s.reader &&
+        selected.antenna === s.antenna && selected.tag === s.tag;
+};
+
+var render = function() {
+    if (plan === null) {
+        return;
+    }
+    var floor = $("#floor").empty().attr({
+        width: plan.Width * scale,
+        height: plan.Height * scale
+    });
+    svg("rect", {
+        "class": "floor-area", x: 0, y: 0,
+        width: plan.Width * scale, height: plan.Height * scale
+    }).on("mousedown", function() {
+        select(null);
+    }).appendTo(floor);
+    for (var m = 1; m < plan.Width; m++) {
+        svg("line", { "class": "floor-grid", x1: m * scale, y1: 0, x2: m * scale, y2: plan.Height * scale }).appendTo(floor);
+    }
+    for (m = 1; m < plan.Height; m++) {
+        svg("line", { "class": "floor-grid", x1: 0, y1: m * scale, x2: plan.Width * scale, y2: m * scale }).appendTo(floor);
+    }
+
+    var seen = {};
+    $.each(selectedReads(), function(_, read) {
+        seen[read.Label] = Math.max(seen[read.Label] || -128, read.RSSI);
+    });
+
+    $.each(plan.Readers, function(i, r) {
+        $.each(r.Antennas, function(j, a) {
+            var s = { reader: i, antenna: j };
+            var cls = isSelected(s) || isSelected({ reader: i }) ? " selected" : "";
+            svg("path", { "class": "floor-beam" + cls, d: beamPath(a) }).appendTo(floor);
+            var g = svg("g", { "class": "floor-antenna" + cls }).on("mousedown", function(e) {
+                startDrag(e, s, a);
+            }).appendTo(floor);
+            svg("circle", { cx: a.X * scale, cy: a.Y * scale, r: 8 }).appendTo(g);
+            svg("text", { x: a.X * scale + 10, y: a.Y * scale - 10 }).text(r.Name + " #" + a.ID).appendTo(g);
+        });
+    });
+
+    $.each(plan.Tags, function(k, t) {
+        var s = { tag: k };
+        var size = t.Tags.length > 1 ? 20 : 10;
+        var cls = (isSelected(s) ? " selected" : "") + (t.Label in seen ? " seen" : "");
+        var g = svg("g", { "class": "floor-tag" + cls }).on("mousedown", function(e) {
+            startDrag(e, s, t);
+        }).appendTo(floor);
+        svg("rect", {
+            x: t.X * scale - size / 2, y: t.Y * scale - size / 2,
+            width: size, height: size
+        }).appendTo(g);
+        svg("title", {}).text(t.Label + ": " + t.Tags.length + " tags" +
+            (t.Label in seen ? ", " + seen[t.Label] + " dBm" : ", not read")).appendTo(g);
+        svg("text", { x: t.X * scale + size / 2 + 2, y: t.Y * scale + 4 }).text(t.Label).appendTo(g);
+    });
+};
+
+var startDrag = function(e, s, item) {
+    e.stopPropagation();
+    select(s);
+    dragging = item;
+};
+
+$("#floor").on("mousemove", function(e) {
+    if (dragging === null) {
+        return;
+    }
+    var offset = $(this).offset();
+    dragging.X = Math.max(0, Math.min(plan.Width, Math.round((e.pageX - offset.left) / scale * 10) / 10));
+    dragging.Y = Math.max(0, Math.min(plan.Height, Math.round((e.pageY - offset.top) / scale * 10) / 10));
+    render();
+});
+
+$(document).on("mouseup", function() {
+    if (dragging !== null) {
+        dragging = null;
+        renderForm();
+        updateVisibility();
+    }
+});
+
+var select = function(s) {
+    selected = s;
+    renderForm();
+    renderVisibility();
+    render();
+};
+
+// a field of the selection form, parse converts the value before it is set
+var field = function(form, label, obj, key, parse) {
+    $("<label/>", { text: label }).appendTo(form);
+    var div = $("<div/>", { "class": "input-control text full-size" }).appendTo(form);
+    $("<input/>", { type: "text", value: obj[key] }).on("change", function() {
+        obj[key] = parse ? parse($(this).val()) : $(this).val();
+        render();
+        updateVisibility();
+    }).appendTo(div);
+};
+
+var renderForm = function() {
+    var form = $("#selection-form").empty();
+    if (selected === null) {
+        $("#selection-title").text("Floor");
+        field(form, "Width (m)", plan, "Width", parseFloat);
+        field(form, "Height (m)", plan, "Height", parseFloat);
+        return;
+    }
+    if (selected.tag !== undefined) {
+        var t = plan.Tags[selected.tag];
+        $("#selection-title").text(t.Tags.length > 1 ? "Pallet" : "Tag");
+        field(form, "Label", t, "Label");
+        field(form, "X (m)", t, "X", parseFloat);
+        field(form, "Y (m)", t, "Y", parseFloat);
+        $("<label/>", { text: "EPCs, one per line" }).appendTo(form);
+        var div = $("<div/>", { "class": "input-control textarea full-size" }).appendTo(form);
+        $("<textarea/>", {
+            text: $.map(t.Tags, function(tr) { return tr.EPC; }).join("\n")
+        }).on("change", function() {
+            t.Tags = $.map($(this).val().split("\n"), function(epc) {
+                epc = epc.trim();
+                return epc === "" ? null : { PCBits: "3000", EPC: epc };
+            });
+            render();
+            updateVisibility();
+        }).appendTo(div);
+        return;
+    }
+    var r = plan.Readers[selected.reader];
+    if (selected.antenna === undefined) {
+        $("#selection-title").text("Reader");
+        field(form, "Name", r, "Name");
+        field(form, "LLRP port", r, "Port", function(v) { return parseInt(v, 10); });
+        return;
+    }
+    var a = r.Antennas[selected.antenna];
+    $("#selection-title").text(r.Name + ", antenna " + a.ID);
+    field(form, "X (m)", a, "X", parseFloat);
+    field(form, "Y (m)", a, "Y", parseFloat);
+    field(form, "Orientation (deg)", a, "Orientation", parseFloat);
+    field(form, "Beam width (deg)", a, "BeamWidth", parseFloat);
+    field(form, "Range (m)", a, "Range", parseFloat);
+    $("<button/>", { "class": "button", text: "Select the reader" }).on("click", function() {
+        select({ reader: selected.reader });
+    }).appendTo(form);
+};
+
+var addReader = function() {
+    var port = 5084;
+    $.each(plan.Readers, function(_, r) {
+        port = Math.max(port, r.Port + 1);
+    });
+    plan.Readers.push({ Name: "reader-" + (plan.Readers.length + 1), Port: port, Antennas: [] });
+    addAntenna(plan.Readers.length - 1);
+};
+
+// add an antenna to the selected reader, or the given one
+var addAntenna = function(i) {
+    if (i === undefined) {
+        if (selected === null || selected.reader === undefined) {
+            notify("Error", "Select a reader or one of its antennas first", "alert");
+            return;
+        }
+        i = selected.reader;
+    }
+    var r = plan.Readers[i], id = 1;
+    $.each(r.Antennas, function(_, a) {
+        id = Math.max(id, a.ID + 1);
+    });
+    r.Antennas.push({ ID: id, X: plan.Width / 2, Y: plan.Height / 2, Orientation: 0, BeamWidth: 70, Range: 4 });
+    select({ reader: i, antenna: r.Antennas.length - 1 });
+    updateVisibility();
+};
+
+// add a tag, or a pallet of n tags
+var addTag = function(n) {
+    var tags = [];
+    for (var i = 0; i < n; i++) {
+        tags.push({ PCBits: "3000", EPC: randomEPC() });
+    }
+    plan.Tags.push({
+        Label: (n > 1 ? "pallet-" : "tag-") + (plan.Tags.length + 1),
+        X: plan.Width / 2, Y: plan.Height / 2, Tags: tags
+    });
+    select({ tag: plan.Tags.length - 1 });
+    updateVisibility();
+};
+
+var deleteSelected = function() {
+    if (selected === null) {
+        return;
+    }
+    if (selected.tag !== undefined) {
+        plan.Tags.splice(selected.tag, 1);
+    } else if (selected.antenna !== undefined) {
+        plan.Readers[selected.reader].Antennas.splice(selected.antenna, 1);
+    } else {
+        plan.Readers.splice(selected.reader, 1);
+    }
+    select(null);
+    updateVisibility();
+};
+
+// the antennas of the selected reader or the selected antenna, all of
+// them otherwise
+var selectedAntennas = function() {
+    var antennas = [];
+    $.each(plan.Readers, function(i, r) {
+        $.each(r.Antennas, function(j, a) {
+            if (selected === null || selected.tag !== undefined ||
+                (selected.reader === i && (selected.antenna === undefined || selected.antenna === j))) {
+                antennas.push({ Port: r.Port, Antenna: a.ID });
+            }
+        });
+    });
+    return antennas;
+};
+
+// append the tags read by every selected antenna, with their RSSI, as the
+// last step of the scenario NAME-PORT-ANTENNA, a track of the antenna;
+// the tracks are padded with empty steps to stay aligned
+var appendStep = function() {
+    var name = $("#scenario-list").val();
+    if (!name) {
+        return;
+    }
+    var tracks = $.map(selectedAntennas(), function(a) {
+        var t = { Port: a.Port, Antenna: a.Antenna, Name: name + "-" + a.Port + "-" + a.Antenna, Tags: [], RSSI: {} };
+        $.each(reads, function(_, read) {
+            if (read.Port !== a.Port || read.Antenna !== a.Antenna) {
+                return;
+            }
+            var epc = read.EPC.toLowerCase();
+            if (epc in t.RSSI) {
+                t.RSSI[epc] = Math.max(t.RSSI[epc], read.RSSI);
+                return;
+            }
+            t.Tags.push({ PCBits: read.PCBits, EPC: read.EPC });
+            t.RSSI[epc] = read.RSSI;
+        });
+        return t;
+    });
+    if (tracks.length === 0) {
+        notify("Error", "The floor plan has no antenna", "alert");
+        return;
+    }
+    $.getJSON("/api/v1/scenarios/" + encodeURIComponent(name), function(base) {
+        // load the tracks, a new one starts empty
+        var loads = $.map(tracks, function(t) {
+            var d = $.Deferred();
+            $.getJSON("/api/v1/scenarios/" + encodeURIComponent(t.Name), function(s) {
+                t.Scenario = s;
+                d.resolve();
+            }).fail(function(xhr) {
+                if (xhr.status !== 404) {
+                    d.reject(xhr);
+                    return;
+                }
+                t.Scenario = { Name: t.Name, Interval: base.Interval, Steps: [] };
+                d.resolve();
+            });
+            return d.promise();
+        });
+        $.when.apply($, loads).done(function() {
+            var steps = 0;
+            $.each(tracks, function(_, t) {
+                steps = Math.max(steps, t.Scenario.Steps.length);
+            });
+            var saves = $.map(tracks, function(t) {
+                var s = t.Scenario;
+                while (s.Steps.length < steps) {
+                    s.Steps.push({ Offset: (s.Steps.length + 1) * s.Interval, Tags: [] });
+                }
+                s.Steps.push({ Offset: (s.Steps.length + 1) * s.Interval, Tags: t.Tags, RSSI: t.RSSI });
+                return $.ajax({
+                    url: "/api/v1/scenarios/" + encodeURIComponent(t.Name),
+                    type: "PUT",
+                    contentType: "application/json",
+                    data: JSON.stringify(s)
+                });
+            });
+            $.when.apply($, saves).done(function() {
+                notify("Saved", "step " + (steps + 1) + " of " + $.map(tracks, function(t) {
+                    return "--track " + t.Port + ":" + t.Antenna + "=" + t.Name + " (" + t.Tags.length + " tags)";
+                }).join(", "), "success");
+            }).fail(function(xhr) {
+                notify("Error", xhr.responseText, "alert");
+            });
+        }).fail(function(xhr) {
+            notify("Error", xhr.responseText, "alert");
+        });
+    }).fail(function(xhr) {
+        notify("Error", xhr.responseText, "alert");
+    });
+};
+
+plan = newFloorPlan();
+listFloorPlans();
+select(null);
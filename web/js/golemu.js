@@ -1,5 +1,10 @@
 var tagTile, isWaiting = false;
 
+// the sequence number of the last tag store change applied, and the epoch
+// of the server process numbering them
+var lastSeq = 0;
+var lastEpoch = "";
+
 String.prototype.hashCode = function() {
     var hash = 0;
     if (this.length == 0) return hash;
@@ -74,6 +79,16 @@ var waitForConnection = function(callback, interval) {
     }
 };
 
+// asks for the changes after lastSeq, or a snapshot when lastSeq is 0 or
+// the server has another epoch
+var resumeTagList = function() {
+    waitAndSend(JSON.stringify({
+        UpdateType: "resume",
+        Seq: lastSeq,
+        Epoch: lastEpoch
+    }));
+};
+
 var retrieveTagList = function() {
     var retrieve_tag = {
         updateType: "retrieve",
@@ -160,6 +175,9 @@ var addTagFromDialog = function() {
         Tags: null
     };
     ws.send(JSON.stringify(tagToAdd));
+    saveChip($("#EPC").val()).always(function() {
+        saveUserMemory($("#EPC").val());
+    });
     hideMetroDialog("#dialog");
     isWaiting = true;
 };
@@ -182,6 +200,7 @@ var deleteTagFromDialog = function() {
         Tags: null
     };
     ws.send(JSON.stringify(tagToDelete));
+    $.ajax({ url: "/api/v1/usermemory/" + encodeURIComponent($("#EPC").val()), type: "DELETE" });
     hideMetroDialog("#dialog");
     isWaiting = true;
 };
@@ -218,15 +237,117 @@ var updateTagFromDialog = function() {
         Tags: null
     };
     ws.send(JSON.stringify(tagToAdd));
+    saveChip($("#EPC").val()).always(function() {
+        saveUserMemory($("#EPC").val());
+    });
     hideMetroDialog("#dialog");
 };
 
+// the text elements or data sets of a user memory, one per line
+var describeUserMemory = function(m) {
+    var lines = [];
+    if (m.Format == "ata") {
+        $.each(m.Record || [], function(i, e) {
+            lines.push(e.TEI + "  " + e.Data);
+        });
+    } else {
+        $.each(m.DataSets || [], function(i, d) {
+            lines.push("1.0.15961." + m.DataFormat + "." + d.OID + " (" + d.Compaction + ")  " + d.Data);
+        });
+    }
+    lines.push("", m.Hex);
+    return lines.join("\n");
+};
+
+// shows the user memory of a tag, decoded by the server
+var showUserMemory = function(epc) {
+    $("#UserMemory").val("");
+    $("#UserMemoryDecoded").text("");
+    $.getJSON("/api/v1/usermemory/" + encodeURIComponent(epc), function(m) {
+        var hex = m.Hex;
+        delete m.Hex;
+        $("#UserMemory").val(JSON.stringify(m, null, 2));
+        m.Hex = hex;
+        $("#UserMemoryDecoded").text(describeUserMemory(m));
+    });
+};
+
+// the chip of the tag in the dialog, as loaded
+var currentChip = null;
+
+// lists the chip models of the catalog in the dialog
+var listChipModels = function() {
+    $.getJSON("/api/v1/chips", function(models) {
+        $.each(models, function(i, m) {
+            $("<option/>", { value: m.Name, text: m.Vendor + " " + m.Name }).appendTo("#Chip");
+        });
+    });
+};
+
+// shows the chip of a tag and its TID
+var showChip = function(epc) {
+    currentChip = null;
+    $("#Chip").val("");
+    $("#ChipTID").text("");
+    $.getJSON("/api/v1/tags/" + encodeURIComponent(epc) + "/chip", function(c) {
+        currentChip = c;
+        $("#Chip").val(c.Model);
+        $("#ChipTID").text("TID " + c.TID);
+    });
+};
+
+// sets the chip of the dialog to the tag when changed
+var saveChip = function(epc) {
+    var model = $("#Chip").val();
+    if (currentChip != null && currentChip.Model == model || currentChip == null && model === "") {
+        return $.when();
+    }
+    var req = model === "" ? {
+        url: "/api/v1/tags/" + encodeURIComponent(epc) + "/chip",
+        type: "DELETE"
+    } : {
+        url: "/api/v1/tags/" + encodeURIComponent(epc) + "/chip",
+        type: "PUT",
+        contentType: "application/json",
+        data: JSON.stringify({ Model: model })
+    };
+    return $.ajax(req).fail(function(xhr) {
+        $.Notify({
+            caption: "Error",
+            content: "Chip model: " + xhr.responseText,
+            type: "alert"
+        });
+    });
+};
+
+// encodes the user memory of the dialog into the tag, if any
+var saveUserMemory = function(epc) {
+    var text = $("#UserMemory").val().trim();
+    if (text === "") {
+        return;
+    }
+    $.ajax({
+        url: "/api/v1/usermemory/" + encodeURIComponent(epc),
+        type: "PUT",
+        contentType: "application/json",
+        data: text
+    }).fail(function(xhr) {
+        $.Notify({
+            caption: "Error",
+            content: "User memory: " + xhr.responseText,
+            type: "alert"
+        });
+    });
+};
+
 var editTag = function(t) {
     $("#EPC").val(t.EPC);
     $("#PCBits").val(t.PCBits);
     $("#Length").val(t.Length);
     $("#EPCLengthBits").val(t.EPCLengthBits);
     $("#ReadData").val(t.ReadData);
+    showUserMemory(t.EPC);
+    showChip(t.EPC);
     $("#rand-epc-btn").show();
     $("#rand-iso-btn").show();
     $("#rand-prop-btn").show();
@@ -349,6 +470,11 @@ $("#add-tile").click(function(event) {
     $("#Length").val("");
     $("#EPCLengthBits").val("");
     $("#ReadData").val("");
+    $("#UserMemory").val("");
+    $("#UserMemoryDecoded").text("");
+    $("#Chip").val("");
+    $("#ChipTID").text("");
+    currentChip = null;
     $("#rand-epc-btn").show();
     $("#rand-iso-btn").show();
     $("#rand-prop-btn").show();
@@ -365,6 +491,11 @@ $("#delete-tile").click(function(event) {
     $("#Length").val("");
     $("#EPCLengthBits").val("");
     $("#ReadData").val("");
+    $("#UserMemory").val("");
+    $("#UserMemoryDecoded").text("");
+    $("#Chip").val("");
+    $("#ChipTID").text("");
+    currentChip = null;
     $("#rand-epc-btn").hide();
     $("#rand-iso-btn").hide();
     $("#rand-prop-btn").hide();
@@ -396,51 +527,90 @@ $(document).click(function(e) {
     }
 });
 
-try {
-    var ws = new WebSocket("ws://" + window.location.host + "/ws");
-    console.log("Websocket - status: " + ws.readyState);
-    ws.onopen = function(m) {
-        console.log("CONNECTION opened..." + this.readyState);
-        retrieveTagList();
-    };
-    ws.onmessage = function(m) {
-        var m = JSON.parse(m.data);
-        console.log(m);
-        switch (m.UpdateType) {
-          case "add":
-            addTag(m.Tag);
-            if (isWaiting) {
-                notifyOnSuccess(m);
-                isWaiting = false;
-            }
-            break;
-
-          case "delete":
-            deleteTag(m.Tag);
-            if (isWaiting) {
-                notifyOnSuccess(m);
-                isWaiting = false;
-            }
-            break;
-
-          case "retrieval":
-            for (var i = 0; i < m.Tags.length; i++) {
-                addTag(m.Tags[i]);
-            }
-            break;
+// applies a numbered change, asking to resume when one was missed
+var applyChange = function(m, apply) {
+    if (m.Epoch != lastEpoch) {
+        console.log("server epoch " + m.Epoch + ", resuming");
+        resumeTagList();
+        return;
+    }
+    if (m.Seq <= lastSeq) {
+        return;
+    }
+    if (m.Seq != lastSeq + 1) {
+        console.log("missed changes " + (lastSeq + 1) + " to " + (m.Seq - 1) + ", resuming");
+        resumeTagList();
+        return;
+    }
+    lastSeq = m.Seq;
+    apply();
+    if (isWaiting) {
+        notifyOnSuccess(m);
+        isWaiting = false;
+    }
+};
 
-          case "error":
-            notifyOnError();
-            break;
+var ws;
+
+var connect = function() {
+    try {
+        ws = new WebSocket("ws://" + window.location.host + "/ws");
+        console.log("Websocket - status: " + ws.readyState);
+        ws.onopen = function(m) {
+            console.log("CONNECTION opened..." + this.readyState);
+            resumeTagList();
+        };
+        ws.onmessage = function(m) {
+            var m = JSON.parse(m.data);
+            console.log(m);
+            switch (m.UpdateType) {
+              case "add":
+                applyChange(m, function() {
+                    addTag(m.Tag);
+                });
+                break;
+
+              case "delete":
+                applyChange(m, function() {
+                    deleteTag(m.Tag);
+                });
+                break;
+
+              case "retrieval":
+                // a snapshot replaces the whole population
+                $(".tag-tile").remove();
+                for (var i = 0; i < m.Tags.length; i++) {
+                    addTag(m.Tags[i]);
+                }
+                lastSeq = m.Seq;
+                lastEpoch = m.Epoch;
+                break;
+
+              case "error":
+                notifyOnError();
+                break;
+
+              case "gpo":
+                $.Notify({
+                    caption: "GPO " + m.GPO.Port,
+                    content: m.GPO.State ? "on" : "off",
+                    type: m.GPO.State ? "warning" : "info"
+                });
+                break;
+
+              default:        }
+        };
+        ws.onerror = function(m) {
+            console.log("Error occured sending..." + m.data);
+        };
+        ws.onclose = function(m) {
+            console.log("Disconnected - status " + this.readyState + ", reconnecting");
+            setTimeout(connect, 1000);
+        };
+    } catch (exception) {
+        console.log(exception);
+    }
+};
 
-          default:        }
-    };
-    ws.onerror = function(m) {
-        console.log("Error occured sending..." + m.data);
-    };
-    ws.onclose = function(m) {
-        console.log("Disconnected - status " + this.readyState);
-    };
-} catch (exception) {
-    console.log(exception);
-}
+listChipModels();
+connect();
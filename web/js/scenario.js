@@ -0,0 +1,245 @@
+var scenario = null, cursor = 0, playTimer = null;
+
+var tickInterval = 50;
+
+// the duration of the scenario in ms, until one interval after the last step
+var scenarioDuration = function() {
+    if (scenario === null || scenario.Steps.length === 0) {
+        return 0;
+    }
+    return scenario.Steps[scenario.Steps.length - 1].Offset + scenario.Interval;
+};
+
+// the index of the step reported last at time t, -1 before the first one
+var stepAt = function(t) {
+    var current = -1;
+    for (var i = 0; i < scenario.Steps.length; i++) {
+        if (scenario.Steps[i].Offset <= t) {
+            current = i;
+        }
+    }
+    return current;
+};
+
+// offsets follow the order of the steps like the event cycle files
+var renumberSteps = function() {
+    for (var i = 0; i < scenario.Steps.length; i++) {
+        scenario.Steps[i].Offset = (i + 1) * scenario.Interval;
+    }
+};
+
+var notify = function(caption, content, type) {
+    $.Notify({
+        caption: caption,
+        content: content,
+        type: type
+    });
+};
+
+var listScenarios = function() {
+    $.getJSON("/api/v1/scenarios", function(names) {
+        var list = $("#scenario-list").empty();
+        for (var i = 0; i < names.length; i++) {
+            $("<option/>", { value: names[i], text: names[i] }).appendTo(list);
+        }
+    });
+};
+
+var loadScenario = function(name) {
+    if (!name) {
+        return;
+    }
+    $.getJSON("/api/v1/scenarios/" + encodeURIComponent(name), function(s) {
+        scenario = s;
+        pause();
+        seek(0);
+        notify("Loaded", s.Name + ": " + s.Steps.length + " steps", "success");
+    }).fail(function(xhr) {
+        notify("Error", xhr.responseText, "alert");
+    });
+};
+
+var saveScenario = function() {
+    if (scenario === null) {
+        return;
+    }
+    $.ajax({
+        url: "/api/v1/scenarios/" + encodeURIComponent(scenario.Name),
+        type: "PUT",
+        contentType: "application/json",
+        data: JSON.stringify(scenario)
+    }).done(function() {
+        notify("Saved", scenario.Name + ": " + scenario.Steps.length + " steps", "success");
+    }).fail(function(xhr) {
+        notify("Error", xhr.responseText, "alert");
+    });
+};
+
+var renderTimeline = function() {
+    var steps = $("#timeline-steps").empty();
+    var duration = scenarioDuration();
+    var largest = 1;
+    for (var i = 0; i < scenario.Steps.length; i++) {
+        largest = Math.max(largest, scenario.Steps[i].Tags.length);
+    }
+    $.each(scenario.Steps, function(i, step) {
+        $("<div/>", {
+            "class": "timeline-step",
+            title: "Step " + (i + 1) + ": " + step.Tags.length + " tags",
+            css: {
+                left: (100 * step.Offset / duration) + "%",
+                height: (10 + 90 * step.Tags.length / largest) + "%"
+            },
+            click: function() {
+                seek(step.Offset);
+            }
+        }).appendTo(steps);
+    });
+    $("#scrubber").attr("max", duration);
+};
+
+var renderStep = function() {
+    var duration = scenarioDuration();
+    var i = stepAt(cursor);
+    $("#clock").text((cursor / 1000).toFixed(3) + " s");
+    $("#scrubber").val(cursor);
+    $("#timeline-cursor").css("left", (duration === 0 ? 0 : 100 * cursor / duration) + "%");
+    $(".timeline-step").removeClass("active").eq(i).addClass("active");
+
+    var population = $("#population").empty();
+    var departed = $("#departed").empty();
+    if (i < 0) {
+        $("#step-title").text("Before the first report");
+        $("#step-summary").text("");
+        return;
+    }
+    var step = scenario.Steps[i];
+    var previous = {};
+    if (i > 0) {
+        $.each(scenario.Steps[i - 1].Tags, function(_, t) {
+            previous[t.EPC] = t;
+        });
+    }
+    var arrived = 0;
+    $.each(step.Tags, function(j, t) {
+        var isNew = !(t.EPC in previous);
+        arrived += isNew ? 1 : 0;
+        delete previous[t.EPC];
+        var row = $("<tr/>", { "class": isNew ? "tag-arrived" : "" });
+        $("<td/>", { text: t.EPC }).appendTo(row);
+        $("<td/>", { text: t.PCBits }).appendTo(row);
+        $("<td/>", { text: isNew ? "arrived" : "read" }).appendTo(row);
+        $("<td/>").append($("<button/>", {
+            "class": "button mini-button danger",
+            html: "<span class='mif-cross'></span>",
+            click: function() {
+                removeTag(j);
+            }
+        })).appendTo(row);
+        row.appendTo(population);
+    });
+    $.each(previous, function(epc) {
+        $("<li/>", { text: epc }).appendTo(departed);
+    });
+    $("#step-title").text("Step " + (i + 1) + " of " + scenario.Steps.length);
+    $("#step-summary").text("Reported at " + (step.Offset / 1000).toFixed(3) + " s: " +
+        step.Tags.length + " tags read, " + arrived + " arrived, " + departed.children().length + " left");
+};
+
+var render = function() {
+    if (scenario === null) {
+        return;
+    }
+    renderTimeline();
+    renderStep();
+};
+
+var seek = function(t) {
+    cursor = Math.max(0, Math.min(t, scenarioDuration()));
+    render();
+};
+
+var play = function() {
+    if (scenario === null) {
+        return;
+    }
+    if (cursor >= scenarioDuration()) {
+        cursor = 0;
+    }
+    $("#play-btn span").attr("class", "mif-pause");
+    playTimer = setInterval(function() {
+        cursor += tickInterval * parseInt($("#speed").val(), 10);
+        if (cursor >= scenarioDuration()) {
+            cursor = scenarioDuration();
+            pause();
+        }
+        renderStep();
+    }, tickInterval);
+};
+
+var pause = function() {
+    clearInterval(playTimer);
+    playTimer = null;
+    $("#play-btn span").attr("class", "mif-play");
+};
+
+var togglePlay = function() {
+    if (playTimer === null) {
+        play();
+    } else {
+        pause();
+    }
+};
+
+// insert a copy of the current step after it
+var insertStep = function() {
+    if (scenario === null) {
+        return;
+    }
+    var i = stepAt(cursor);
+    var tags = i < 0 ? [] : $.map(scenario.Steps[i].Tags, function(t) {
+        return { PCBits: t.PCBits, EPC: t.EPC };
+    });
+    scenario.Steps.splice(i + 1, 0, { Offset: 0, Tags: tags });
+    renumberSteps();
+    seek(scenario.Steps[i + 1].Offset);
+};
+
+var deleteStep = function() {
+    if (scenario === null) {
+        return;
+    }
+    var i = stepAt(cursor);
+    if (i < 0) {
+        return;
+    }
+    scenario.Steps.splice(i, 1);
+    renumberSteps();
+    seek(i > 0 ? scenario.Steps[i - 1].Offset : 0);
+};
+
+var addTagToStep = function() {
+    if (scenario === null) {
+        return;
+    }
+    var i = stepAt(cursor);
+    var epc = $("#new-epc").val().trim();
+    if (i < 0 || epc === "") {
+        return;
+    }
+    scenario.Steps[i].Tags.push({ PCBits: $("#new-pcbits").val().trim(), EPC: epc });
+    $("#new-epc").val("");
+    render();
+};
+
+var removeTag = function(j) {
+    var i = stepAt(cursor);
+    scenario.Steps[i].Tags.splice(j, 1);
+    render();
+};
+
+$("#scrubber").on("input change", function() {
+    seek(parseInt($(this).val(), 10));
+});
+
+listScenarios();